@@ -0,0 +1,20 @@
+// Package api embeds the OpenAPI specification of the service.
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Spec is the OpenAPI 3.1 specification, in JSON.
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Handler serves the specification.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(Spec)
+	})
+}
@@ -3,97 +3,493 @@ package main
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"WalletApi/api"
+	"WalletApi/internal/cache"
+	"WalletApi/internal/config"
+	"WalletApi/internal/export"
 	"WalletApi/internal/handler"
+	"WalletApi/internal/logging"
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/mtls"
+	"WalletApi/internal/ratelimit"
 	"WalletApi/internal/repository"
 	"WalletApi/internal/service"
+	"WalletApi/internal/tracing"
 
 	_ "github.com/lib/pq"
 )
 
-const (
-	workers = 16 // The number of goroutines for processing transactions
-)
+// Share of a shard queue that makes the instance not ready
+const queueSaturation = 0.9
 
 func main() {
-	// Checking required environment variables
-	requiredEnvVars := []string{"DB_URL", "DB_NAME", "DB_USER", "DB_PASSWORD"}
-	for _, envVar := range requiredEnvVars {
-		if os.Getenv(envVar) == "" {
-			log.Fatalf("Environment variable %s is not set", envVar)
-		}
+	cfg, opts, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		fmt.Print(cfg)
+		return
 	}
 
-	dbURL := os.Getenv("DB_URL")
-	if dbURL == "" {
-		log.Fatal("DB_URL environment variable is not set")
+	if err := run(cfg); err != nil {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
 	}
+}
 
-	// Connecting to the database
-	db, err := sql.Open("postgres", dbURL)
+// run starts the server and blocks until it is stopped. Cleanup is deferred, so
+// it also runs when startup fails halfway: the shard queues are drained before
+// the database pool is closed and the traces are flushed last.
+func run(cfg config.Config) error {
+	logging.Setup(cfg.LogLevel())
+	slog.Info("Effective configuration", "config", cfg.String())
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter: cfg.Tracing.Exporter,
+		Endpoint: cfg.Tracing.Endpoint,
+		File:     cfg.Tracing.File,
+	})
 	if err != nil {
-		log.Fatalf("Database connection failed: %v", err)
+		return fmt.Errorf("failed to set up tracing: %w", err)
 	}
-	defer db.Close()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
 
-	// Configuring the Connection pool
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	var walletRepo repository.WalletRepository
+	switch cfg.Storage {
+	case "memory":
+		slog.Warn("Using in-memory storage, data will not survive a restart")
+		walletRepo = repository.NewMemoryRepository()
+	case "postgres":
+		db, err := openPostgres(cfg.Database, cfg.Database.DSN())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		metrics.RegisterDB(db, "primary")
 
-	// Checking the connection
-	if err := db.Ping(); err != nil {
-		log.Fatalf("Database ping failed: %v", err)
-	}
+		opts := []repository.PostgresOption{
+			repository.WithQueryHook(tracing.QueryHook),
+			repository.WithQueryHook(metrics.QueryHook),
+		}
+		if len(cfg.Database.ReplicaURLs) > 0 {
+			replicaSet, err := openReplicas(db, cfg.Database)
+			if err != nil {
+				return err
+			}
+			defer replicaSet.Close()
+
+			replicaCtx, stopReplicaChecks := context.WithCancel(context.Background())
+			defer stopReplicaChecks()
+			replicaSet.Start(replicaCtx)
+
+			opts = append(opts, repository.WithReplicas(replicaSet))
+		}
+
+		// Initializing the repository
+		postgresRepo := repository.NewPostgresRepository(db, opts...)
+
+		if err := postgresRepo.RunMigrations(context.Background()); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
+		walletRepo = postgresRepo
+	case "sqlite":
+		db, err := repository.OpenSQLite(cfg.SQLite.Path)
+		if err != nil {
+			return fmt.Errorf("database connection failed: %w", err)
+		}
+		defer db.Close()
+		metrics.RegisterDB(db, "sqlite")
 
-	// Initializing the repository
-	walletRepo := repository.NewPostgresRepository(db)
+		sqliteRepo := repository.NewSQLiteRepository(db)
 
-	if err := walletRepo.RunMigrations(context.Background()); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+		if err := sqliteRepo.RunMigrations(context.Background()); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
+		walletRepo = sqliteRepo
+	}
+
+	serviceOpts := []service.Option{service.WithQueueSize(cfg.Service.QueueSize)}
+	// Also given to the background jobs that change balances outside of the service
+	var balanceCache cache.BalanceCache
+	if cfg.Cache.Size > 0 {
+		slog.Info("Balance cache enabled", "size", cfg.Cache.Size, "ttl", cfg.Cache.TTL.String())
+		lru := cache.NewLRU(cfg.Cache.Size, cfg.Cache.TTL)
+		metrics.RegisterCacheStats(lru.Stats)
+		balanceCache = lru
+		serviceOpts = append(serviceOpts, service.WithCache(balanceCache))
 	}
 
 	// Initializing the service
-	walletService := service.NewWalletService(walletRepo, workers)
-	defer walletService.Shutdown() // Graceful shutdown сервиса
+	walletService := service.NewWalletService(walletRepo, cfg.Service.Workers, serviceOpts...)
+	// Deferred after the database, so it runs first: the pool stays open until the queues are drained
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Service.QueueDrainTimeout)
+		defer cancel()
+		if err := walletService.Shutdown(ctx); err != nil {
+			slog.Error("Shard queues not drained in time", "error", err)
+			return
+		}
+		slog.Info("Shard queues drained")
+	}()
+	metrics.RegisterQueueDepth(walletService.QueueDepths)
 
-	// Initializing the handler
-	walletHandler := handler.NewWalletHandler(walletService)
+	// Deferred after the service, so it runs first: the background jobs are
+	// stopped and waited for before the queues drain and the pool is closed
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs []func()
+	defer func() {
+		stopJobs()
+		for _, wait := range jobs {
+			wait()
+		}
+	}()
+
+	if cfg.Reconcile.Interval > 0 {
+		reconciler := service.NewReconciler(walletRepo.(repository.Administrator),
+			service.WithChunkSize(cfg.Reconcile.ChunkSize),
+			service.WithFreeze(cfg.Reconcile.Freeze),
+			service.WithReconcileCache(balanceCache),
+		)
+		jobs = append(jobs, reconciler.Start(jobsCtx, cfg.Reconcile.Interval))
+		slog.Info("Balance reconciliation scheduled", "interval", cfg.Reconcile.Interval.String(), "freeze", cfg.Reconcile.Freeze)
+	}
+
+	if cfg.Snapshot.Interval > 0 {
+		snapshotter := service.NewSnapshotter(walletRepo.(repository.BalanceHistory), cfg.Snapshot.ChunkSize)
+		jobs = append(jobs, snapshotter.Start(jobsCtx, cfg.Snapshot.Interval))
+		slog.Info("Balance snapshots scheduled", "interval", cfg.Snapshot.Interval.String())
+	}
+
+	scheduler := service.NewScheduler(walletRepo.(repository.Schedules), walletService,
+		service.WithBatchSize(cfg.Scheduler.BatchSize),
+		service.WithLease(cfg.Scheduler.Lease),
+		service.WithRetries(cfg.Scheduler.Retries, cfg.Scheduler.RetryBackoff),
+	)
+	if cfg.Scheduler.Interval > 0 {
+		// Waited for before the service shuts down: no occurrence is started once the queues drain
+		jobs = append(jobs, scheduler.Start(jobsCtx, cfg.Scheduler.Interval))
+		slog.Info("Scheduled transactions enabled", "interval", cfg.Scheduler.Interval.String())
+	}
+
+	if cfg.Interest.Interval > 0 {
+		accruer := service.NewInterestAccruer(walletRepo.(repository.Interest), walletRepo.(repository.BalanceHistory),
+			service.WithInterestChunkSize(cfg.Interest.ChunkSize),
+			service.WithAccrualLag(cfg.Interest.Lag),
+			service.WithInterestCache(balanceCache),
+		)
+		jobs = append(jobs, accruer.Start(jobsCtx, cfg.Interest.Interval))
+		slog.Info("Interest accrual scheduled", "interval", cfg.Interest.Interval.String(), "lag", cfg.Interest.Lag.String())
+	}
+
+	if cfg.Overdraft.FeeInterval > 0 {
+		charger := service.NewOverdraftFeeCharger(walletRepo.(repository.Overdraft), walletRepo.(repository.BalanceHistory),
+			service.WithOverdraftChunkSize(cfg.Overdraft.ChunkSize),
+			service.WithOverdraftFeeLag(cfg.Overdraft.FeeLag),
+			service.WithOverdraftCache(balanceCache),
+		)
+		jobs = append(jobs, charger.Start(jobsCtx, cfg.Overdraft.FeeInterval))
+		slog.Info("Overdraft fees scheduled", "interval", cfg.Overdraft.FeeInterval.String(), "lag", cfg.Overdraft.FeeLag.String())
+	}
+
+	// Initializing the handlers
+	walletHandler := handler.NewWalletHandler(walletService, handler.WithMaxBodyBytes(int64(cfg.Server.MaxBodyBytes)))
+
+	scheduleHandler := handler.NewScheduleHandler(scheduler, int64(cfg.Server.MaxBodyBytes))
+
+	exportHandler, err := newExportHandler(cfg.Export, walletRepo)
+	if err != nil {
+		return err
+	}
+	// Deferred after the database, so it runs first: a running export is cancelled before the pool is closed
+	defer exportHandler.Shutdown()
+
+	healthHandler := handler.NewHealthHandler(cfg.Health.ReadinessTimeout)
+	maintainer := walletRepo.(repository.Maintainer)
+	healthHandler.AddCheck("database", handler.DatabaseCheck(maintainer))
+	healthHandler.AddCheck("migrations", handler.MigrationsCheck(maintainer))
+	healthHandler.AddCheck("queues", handler.QueueCheck(walletService, queueSaturation))
+
+	limiter := handler.NewRateLimiter(ratelimit.NewMemoryStore(), rateLimitPolicy(cfg.RateLimit))
+
+	var certs *mtls.Reloader
+	var tenants mtls.Tenants
+	if cfg.TLS.CertFile != "" {
+		certs, err = mtls.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		if certs.MutualTLS() {
+			tenants = cfg.TLS.ClientTenants
+		}
+	}
 
 	// Setting up routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/v1/wallets", walletHandler.CreateWallet)
-	mux.HandleFunc("POST /api/v1/wallets/{id}/transactions", walletHandler.HandleTransaction)
-	mux.HandleFunc("GET /api/v1/wallets/{id}", walletHandler.HandleGetBalance)
+	mux := newMux(routes(walletHandler, scheduleHandler, healthHandler, limiter), tenants)
+	server := newServer(cfg.Server, ":"+strconv.Itoa(cfg.Server.Port), mux)
 
-	// Starting the server
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	// The operator routes are left off the public listener, see adminRoutes
+	var adminServer *http.Server
+	if cfg.Server.AdminAddr != "" {
+		adminServer = newServer(cfg.Server, cfg.Server.AdminAddr, newMux(adminRoutes(exportHandler), nil))
 	}
 
+	// Starting the servers
+	serverErr := make(chan error, 1)
 	go func() {
-		log.Println("Server started on :8080")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+		var err error
+		if certs != nil {
+			server.TLSConfig = certs.TLSConfig()
+			slog.Info("Server started", "addr", server.Addr, "tls", true, "mutual_tls", certs.MutualTLS())
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Server started", "addr", server.Addr, "tls", false)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			serverErr <- err
 		}
 	}()
+	if adminServer != nil {
+		go func() {
+			slog.Info("Admin server started", "addr", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serverErr <- fmt.Errorf("admin server: %w", err)
+			}
+		}()
+	}
+
+	if certs != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		go func() {
+			for range reload {
+				if err := certs.Reload(); err != nil {
+					slog.Error("Failed to reload certificates, keeping the current ones", "error", err)
+					continue
+				}
+				slog.Info("Certificates reloaded")
+			}
+		}()
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("server error: %w", err)
+	case <-quit:
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Failing readiness first lets load balancers drain traffic before connections are refused
+	healthHandler.SetShuttingDown()
+	slog.Info("Shutting down, readiness is failing", "drain_delay", cfg.Health.DrainDelay.String())
+	time.Sleep(cfg.Health.DrainDelay)
+
+	// Waits for the in-flight requests, the handlers still running after the
+	// timeout get a 503 once the deferred service shutdown stops accepting transactions
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		slog.Error("Server forced to shutdown", "error", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			slog.Error("Admin server forced to shutdown", "error", err)
+		}
+	}
+	slog.Info("Server exiting")
+	return nil
+}
+
+// route is a route of the server, api/openapi.json documents every one of them
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+// operationalRoutes serve the platform rather than the clients: kubelet and
+// Prometheus have no client certificate, so they are left out of the tenant check
+var operationalRoutes = map[string]bool{
+	"GET /metrics": true,
+	"GET /healthz": true,
+	"GET /readyz":  true,
+}
+
+// newMux registers the routes. With tenants, every route but the operational
+// ones requires a client certificate mapped to a tenant.
+func newMux(rts []route, tenants mtls.Tenants) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range rts {
+		h := rt.handler
+		if tenants != nil && !operationalRoutes[rt.pattern] {
+			h = handler.TenantMiddleware(tenants)(h)
+		}
+		mux.Handle(rt.pattern, h)
+	}
+	return mux
+}
+
+// newServer returns a server of mux listening on addr, with the timeouts of cfg.
+func newServer(cfg config.ServerConfig, addr string, mux *http.ServeMux) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           logging.Middleware(tracing.Middleware(metrics.Middleware(mux))),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+func routes(walletHandler *handler.WalletHandler, scheduleHandler *handler.ScheduleHandler, healthHandler *handler.HealthHandler, limiter *handler.RateLimiter) []route {
+	var rts []route
+	// v2 serves the same API with RFC 7807 problem details as errors
+	for _, version := range []string{"v1", "v2"} {
+		prefix := "/api/" + version
+		rts = append(rts,
+			route{"POST " + prefix + "/wallets", limiter.Limit(http.HandlerFunc(walletHandler.CreateWallet))},
+			route{"POST " + prefix + "/wallets/{id}/transactions", limiter.Limit(limiter.LimitWallet(http.HandlerFunc(walletHandler.HandleTransaction)))},
+			route{"GET " + prefix + "/wallets/{id}", limiter.Limit(http.HandlerFunc(walletHandler.HandleGetBalance))},
+			route{"GET " + prefix + "/wallets/{id}/balance", limiter.Limit(http.HandlerFunc(walletHandler.HandleGetBalanceAt))},
+			route{"GET " + prefix + "/wallets/{id}/statement", limiter.Limit(http.HandlerFunc(walletHandler.HandleStatement))},
+			route{"POST " + prefix + "/wallets/{id}/schedules", limiter.Limit(http.HandlerFunc(scheduleHandler.HandleCreateSchedule))},
+			route{"GET " + prefix + "/wallets/{id}/schedules", limiter.Limit(http.HandlerFunc(scheduleHandler.HandleListSchedules))},
+			route{"GET " + prefix + "/wallets/{id}/schedules/{scheduleId}", limiter.Limit(http.HandlerFunc(scheduleHandler.HandleGetSchedule))},
+			route{"PATCH " + prefix + "/wallets/{id}/schedules/{scheduleId}", limiter.Limit(http.HandlerFunc(scheduleHandler.HandleUpdateSchedule))},
+			route{"DELETE " + prefix + "/wallets/{id}/schedules/{scheduleId}", limiter.Limit(http.HandlerFunc(scheduleHandler.HandleCancelSchedule))},
+			route{"GET " + prefix + "/wallets/{id}/schedules/{scheduleId}/runs", limiter.Limit(http.HandlerFunc(scheduleHandler.HandleScheduleRuns))},
+		)
+	}
+	return append(rts,
+		route{"GET /metrics", metrics.Handler()},
+		route{"GET /healthz", http.HandlerFunc(healthHandler.HandleLiveness)},
+		route{"GET /readyz", http.HandlerFunc(healthHandler.HandleReadiness)},
+		route{"GET /openapi.json", api.Handler()},
+	)
+}
+
+// adminRoutes are the routes of the operators, like the walletctl commands they
+// are kept from the clients: they are served only on the admin listener, which
+// is meant for a private interface and has no tenant check nor rate limit.
+func adminRoutes(exportHandler *handler.ExportHandler) []route {
+	var rts []route
+	for _, version := range []string{"v1", "v2"} {
+		prefix := "/api/" + version
+		rts = append(rts,
+			route{"POST " + prefix + "/exports", http.HandlerFunc(exportHandler.HandleStartExport)},
+			route{"GET " + prefix + "/exports", http.HandlerFunc(exportHandler.HandleExportStatus)},
+		)
+	}
+	return rts
+}
+
+// newExportHandler returns the handler of the ledger export, disabled unless
+// a directory or bucket is configured.
+func newExportHandler(cfg config.ExportConfig, repo repository.WalletRepository) (*handler.ExportHandler, error) {
+	if !cfg.Enabled() {
+		return handler.NewExportHandler(nil, nil), nil
+	}
+	sink, err := export.OpenSink(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the export target: %w", err)
 	}
-	log.Println("Server exiting")
+	exporter := export.NewExporter(repo.(repository.LedgerExporter), sink,
+		export.WithRowsPerFile(cfg.RowsPerFile),
+		export.WithLag(cfg.Lag),
+	)
+	slog.Info("Ledger export enabled", "dir", cfg.Dir, "bucket", cfg.S3.Bucket, "lag", cfg.Lag.String())
+	return handler.NewExportHandler(exporter, sink), nil
+}
+
+func rateLimitPolicy(cfg config.RateLimitConfig) ratelimit.Policy {
+	policy := ratelimit.Policy{
+		DefaultTier: cfg.DefaultTier,
+		TenantTiers: cfg.TenantTiers,
+		Tiers:       make(map[string]ratelimit.Tier, len(cfg.Tiers)),
+		APIKeys:     cfg.APIKeys,
+	}
+	for name, tier := range cfg.Tiers {
+		routes := make(map[string]ratelimit.Limit, len(tier.Routes))
+		for route, limit := range tier.Routes {
+			routes[route] = ratelimit.Limit(limit)
+		}
+		policy.Tiers[name] = ratelimit.Tier{
+			Client: ratelimit.Limit(tier.Client),
+			Routes: routes,
+			Wallet: ratelimit.Limit(tier.Wallet),
+		}
+	}
+	return policy
+}
+
+// openDB opens a PostgreSQL pool configured with the pool settings of cfg.
+func openDB(cfg config.DatabaseConfig, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configuring the Connection pool
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return db, nil
+}
+
+func openPostgres(cfg config.DatabaseConfig, dsn string) (*sql.DB, error) {
+	// Connecting to the database
+	db, err := openDB(cfg, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	// Checking the connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database ping failed: %w", err)
+	}
+
+	return db, nil
+}
+
+func openReplicas(primary *sql.DB, cfg config.DatabaseConfig) (*repository.ReplicaSet, error) {
+	replicas := make([]*sql.DB, 0, len(cfg.ReplicaURLs))
+	for _, replicaURL := range cfg.ReplicaURLs {
+		replica, err := openDB(cfg, replicaURL)
+		if err != nil {
+			for _, opened := range replicas {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("replica connection failed: %w", err)
+		}
+		replicas = append(replicas, replica)
+		metrics.RegisterDB(replica, "replica_"+strconv.Itoa(len(replicas)-1))
+	}
+
+	slog.Info("Routing reads to replicas", "replicas", len(replicas), "max_lag", cfg.ReplicaMaxLag.String())
+	return repository.NewReplicaSet(primary, replicas, cfg.ReplicaMaxLag, cfg.ReplicaCheckInterval), nil
 }
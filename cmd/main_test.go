@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/api"
+	"WalletApi/internal/export"
+	"WalletApi/internal/handler"
+	"WalletApi/internal/mtls"
+	"WalletApi/internal/ratelimit"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/service"
+)
+
+// spec is the part of an OpenAPI document the tests look at
+type spec struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas   map[string]schema   `json:"schemas"`
+		Responses map[string]response `json:"responses"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Responses map[string]response `json:"responses"`
+}
+
+type response struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema schema `json:"schema"`
+	} `json:"content"`
+}
+
+// schema is the subset of JSON Schema used by api/openapi.json
+type schema struct {
+	Ref                  string            `json:"$ref"`
+	Type                 string            `json:"type"`
+	Format               string            `json:"format"`
+	Properties           map[string]schema `json:"properties"`
+	Required             []string          `json:"required"`
+	AdditionalProperties json.RawMessage   `json:"additionalProperties"`
+	Items                *schema           `json:"items"`
+	Enum                 []any             `json:"enum"`
+	Const                any               `json:"const"`
+	Minimum              *float64          `json:"minimum"`
+	Pattern              string            `json:"pattern"`
+}
+
+func loadSpec(t *testing.T) spec {
+	t.Helper()
+	var s spec
+	require.NoError(t, json.Unmarshal(api.Spec, &s))
+	return s
+}
+
+// newTestRoutes returns the public routes followed by the admin ones.
+func newTestRoutes(t *testing.T, policy ratelimit.Policy) []route {
+	t.Helper()
+	public, admin := newTestServerRoutes(t, policy)
+	return append(public, admin...)
+}
+
+func newTestServerRoutes(t *testing.T, policy ratelimit.Policy) (public, admin []route) {
+	t.Helper()
+	repo := repository.NewMemoryRepository()
+	walletService := service.NewWalletService(repo, 2)
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+
+	healthHandler := handler.NewHealthHandler(time.Second)
+	healthHandler.AddCheck("database", handler.DatabaseCheck(repo))
+	healthHandler.AddCheck("queues", handler.QueueCheck(walletService, queueSaturation))
+
+	sink := export.NewDirSink(t.TempDir())
+	exportHandler := handler.NewExportHandler(export.NewExporter(repo, sink), sink)
+	t.Cleanup(exportHandler.Shutdown)
+
+	scheduleHandler := handler.NewScheduleHandler(service.NewScheduler(repo, walletService), handler.DefaultMaxBodyBytes)
+
+	limiter := handler.NewRateLimiter(ratelimit.NewMemoryStore(), policy)
+	return routes(handler.NewWalletHandler(walletService), scheduleHandler, healthHandler, limiter), adminRoutes(exportHandler)
+}
+
+func TestOpenAPI_CoversRoutes(t *testing.T) {
+	s := loadSpec(t)
+
+	var registered, documented []string
+	for _, rt := range newTestRoutes(t, ratelimit.Policy{}) {
+		registered = append(registered, rt.pattern)
+	}
+	for path, operations := range s.Paths {
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(registered)
+	sort.Strings(documented)
+
+	assert.Equal(t, registered, documented)
+}
+
+func TestOpenAPI_RefsResolve(t *testing.T) {
+	s := loadSpec(t)
+	for path, operations := range s.Paths {
+		for method, op := range operations {
+			for status, resp := range op.Responses {
+				resp, err := s.resolveResponse(resp)
+				require.NoError(t, err, "%s %s %s", method, path, status)
+				for mediaType, content := range resp.Content {
+					assert.NoError(t, s.checkRefs(content.Schema), "%s %s %s %s", method, path, status, mediaType)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenAPI_ResponsesMatchSpec(t *testing.T) {
+	s := loadSpec(t)
+
+	// Two transactions per wallet, the third one is rate limited
+	policy := ratelimit.Policy{
+		DefaultTier: "default",
+		Tiers:       map[string]ratelimit.Tier{"default": {Wallet: ratelimit.Limit{Rate: 0.001, Burst: 2}}},
+	}
+	mux := http.NewServeMux()
+	for _, rt := range newTestRoutes(t, policy) {
+		mux.Handle(rt.pattern, rt.handler)
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		prefix := "/api/" + version
+
+		w := serve(mux, http.MethodPost, prefix+"/wallets", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var created struct {
+			Data struct {
+				WalletID string `json:"walletId"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		walletID := created.Data.WalletID
+
+		w = serve(mux, http.MethodPost, prefix+"/wallets/"+walletID+"/schedules", `{"operationType":"DEPOSIT","amount":10,"recurrence":"weekly"}`, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var schedule struct {
+			Data struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &schedule))
+		schedulePath := prefix + "/wallets/" + walletID + "/schedules/" + schedule.Data.ID
+
+		problem := map[string]string{"Accept": "application/problem+json"}
+		tests := []struct {
+			name       string
+			method     string
+			path       string
+			body       string
+			headers    map[string]string
+			wantStatus int
+		}{
+			{"create", http.MethodPost, prefix + "/wallets", "", nil, http.StatusOK},
+			{"deposit", http.MethodPost, prefix + "/wallets/" + walletID + "/transactions", `{"operationType":"DEPOSIT","amount":100}`, nil, http.StatusOK},
+			{"insufficient funds", http.MethodPost, prefix + "/wallets/" + walletID + "/transactions", `{"operationType":"WITHDRAW","amount":500}`, nil, http.StatusConflict},
+			{"rate limited", http.MethodPost, prefix + "/wallets/" + walletID + "/transactions", `{"operationType":"DEPOSIT","amount":1}`, nil, http.StatusTooManyRequests},
+			{"not found", http.MethodPost, prefix + "/wallets/" + uuid.NewString() + "/transactions", `{"operationType":"DEPOSIT","amount":1}`, nil, http.StatusNotFound},
+			{"invalid amount", http.MethodPost, prefix + "/wallets/" + uuid.NewString() + "/transactions", `{"operationType":"DEPOSIT","amount":0}`, problem, http.StatusBadRequest},
+			{"unknown field", http.MethodPost, prefix + "/wallets/" + uuid.NewString() + "/transactions", `{"operationType":"DEPOSIT","amount":1,"currency":"EUR"}`, nil, http.StatusBadRequest},
+			{"not json", http.MethodPost, prefix + "/wallets/" + uuid.NewString() + "/transactions", `{}`, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+			{"balance", http.MethodGet, prefix + "/wallets/" + walletID, "", nil, http.StatusOK},
+			{"strong balance", http.MethodGet, prefix + "/wallets/" + walletID + "?consistency=strong", "", nil, http.StatusOK},
+			{"invalid wallet ID", http.MethodGet, prefix + "/wallets/not-a-uuid", "", nil, http.StatusBadRequest},
+			{"balance not found", http.MethodGet, prefix + "/wallets/" + uuid.NewString(), "", problem, http.StatusNotFound},
+			{"balance at", http.MethodGet, prefix + "/wallets/" + walletID + "/balance?at=" + time.Now().UTC().Format(time.RFC3339), "", nil, http.StatusOK},
+			{"invalid at", http.MethodGet, prefix + "/wallets/" + walletID + "/balance?at=yesterday", "", nil, http.StatusBadRequest},
+			{"statement", http.MethodGet, prefix + "/wallets/" + walletID + "/statement?from=2025-01-01T00:00:00Z", "", nil, http.StatusOK},
+			{"jsonl statement", http.MethodGet, prefix + "/wallets/" + walletID + "/statement?from=2025-01-01T00:00:00Z&format=jsonl", "", nil, http.StatusOK},
+			{"txt statement", http.MethodGet, prefix + "/wallets/" + walletID + "/statement?from=2025-01-01T00:00:00Z&format=txt", "", nil, http.StatusOK},
+			{"invalid statement format", http.MethodGet, prefix + "/wallets/" + walletID + "/statement?from=2025-01-01T00:00:00Z&format=pdf", "", problem, http.StatusBadRequest},
+			{"statement not found", http.MethodGet, prefix + "/wallets/" + uuid.NewString() + "/statement?from=2025-01-01T00:00:00Z", "", nil, http.StatusNotFound},
+			{"balance at not found", http.MethodGet, prefix + "/wallets/" + uuid.NewString() + "/balance?at=2025-01-31T00:00:00Z", "", problem, http.StatusNotFound},
+			{"create schedule", http.MethodPost, prefix + "/wallets/" + walletID + "/schedules", `{"operationType":"WITHDRAW","amount":5,"recurrence":"0 9 * * 1-5","endAt":"2099-01-01T00:00:00Z"}`, nil, http.StatusOK},
+			{"invalid schedule", http.MethodPost, prefix + "/wallets/" + walletID + "/schedules", `{"operationType":"DEPOSIT","amount":5,"recurrence":"yearly"}`, problem, http.StatusBadRequest},
+			{"schedule wallet not found", http.MethodPost, prefix + "/wallets/" + uuid.NewString() + "/schedules", `{"operationType":"DEPOSIT","amount":5}`, nil, http.StatusNotFound},
+			{"schedules", http.MethodGet, prefix + "/wallets/" + walletID + "/schedules", "", nil, http.StatusOK},
+			{"schedule", http.MethodGet, schedulePath, "", nil, http.StatusOK},
+			{"schedule not found", http.MethodGet, prefix + "/wallets/" + walletID + "/schedules/" + uuid.NewString(), "", problem, http.StatusNotFound},
+			{"pause schedule", http.MethodPatch, schedulePath, `{"status":"PAUSED","amount":20}`, nil, http.StatusOK},
+			{"schedule runs", http.MethodGet, schedulePath + "/runs", "", nil, http.StatusOK},
+			{"cancel schedule", http.MethodDelete, schedulePath, "", nil, http.StatusOK},
+			{"schedule closed", http.MethodPatch, schedulePath, `{"status":"ACTIVE"}`, problem, http.StatusConflict},
+			{"export", http.MethodPost, prefix + "/exports", "", nil, http.StatusAccepted},
+			{"export status", http.MethodGet, prefix + "/exports", "", nil, http.StatusOK},
+		}
+
+		for _, tt := range tests {
+			t.Run(version+"/"+tt.name, func(t *testing.T) {
+				w := serve(mux, tt.method, tt.path, tt.body, tt.headers)
+				assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+				assert.NoError(t, s.validateResponse(tt.method, templatePath(tt.path), w))
+			})
+		}
+
+		// The export of the next version would conflict with this one
+		require.Eventually(t, func() bool {
+			return !strings.Contains(serve(mux, http.MethodGet, prefix+"/exports", "", nil).Body.String(), `"running":true`)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	for _, path := range []string{"/healthz", "/readyz", "/metrics", "/openapi.json"} {
+		t.Run(path, func(t *testing.T) {
+			w := serve(mux, http.MethodGet, path, "", nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.NoError(t, s.validateResponse(http.MethodGet, path, w))
+		})
+	}
+}
+
+func TestNewMux_Tenants(t *testing.T) {
+	mux := newMux(newTestRoutes(t, ratelimit.Policy{}), mtls.Tenants{"CN=payments": "payments-team"})
+
+	// Kubelet and Prometheus present no client certificate
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		w := serve(mux, http.MethodGet, path, "", nil)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+
+	w := serve(mux, http.MethodPost, "/api/v1/wallets", "", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "client_certificate_required")
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/wallets", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "payments"}}}}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	public, admin := newTestServerRoutes(t, ratelimit.Policy{})
+
+	// Exports are operator actions, they stay off the public listener even without mutual TLS
+	publicMux := newMux(public, nil)
+	for _, version := range []string{"v1", "v2"} {
+		for _, method := range []string{http.MethodPost, http.MethodGet} {
+			w := serve(publicMux, method, "/api/"+version+"/exports", "", nil)
+			assert.Equal(t, http.StatusNotFound, w.Code, "%s %s", method, version)
+		}
+	}
+
+	adminMux := newMux(admin, nil)
+	w := serve(adminMux, http.MethodGet, "/api/v1/exports", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func serve(h http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+var (
+	walletIDSegment   = regexp.MustCompile(`/wallets/[^/?]+`)
+	scheduleIDSegment = regexp.MustCompile(`/schedules/[^/?]+`)
+)
+
+// templatePath turns a request path into its path in the spec
+func templatePath(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	path = walletIDSegment.ReplaceAllString(path, "/wallets/{id}")
+	return scheduleIDSegment.ReplaceAllString(path, "/schedules/{scheduleId}")
+}
+
+// validateResponse checks the status, content type and body of w against the operation of method and path.
+func (s spec) validateResponse(method, path string, w *httptest.ResponseRecorder) error {
+	op, ok := s.Paths[path][strings.ToLower(method)]
+	if !ok {
+		return fmt.Errorf("%s %s is not documented", method, path)
+	}
+	resp, ok := op.Responses[fmt.Sprint(w.Code)]
+	if !ok {
+		return fmt.Errorf("status %d of %s %s is not documented", w.Code, method, path)
+	}
+	resp, err := s.resolveResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid content type: %w", err)
+	}
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("content type %s of status %d is not documented", mediaType, w.Code)
+	}
+	if !strings.HasSuffix(mediaType, "json") {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+	dec.UseNumber()
+	var body any
+	if err := dec.Decode(&body); err != nil {
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return s.validate(content.Schema, body, "body")
+}
+
+func (s spec) resolveResponse(resp response) (response, error) {
+	if resp.Ref == "" {
+		return resp, nil
+	}
+	name := strings.TrimPrefix(resp.Ref, "#/components/responses/")
+	resolved, ok := s.Components.Responses[name]
+	if !ok {
+		return response{}, fmt.Errorf("unknown response %s", resp.Ref)
+	}
+	return resolved, nil
+}
+
+func (s spec) resolveSchema(sc schema) (schema, error) {
+	for sc.Ref != "" {
+		name := strings.TrimPrefix(sc.Ref, "#/components/schemas/")
+		resolved, ok := s.Components.Schemas[name]
+		if !ok {
+			return schema{}, fmt.Errorf("unknown schema %s", sc.Ref)
+		}
+		sc = resolved
+	}
+	return sc, nil
+}
+
+func (s spec) checkRefs(sc schema) error {
+	sc, err := s.resolveSchema(sc)
+	if err != nil {
+		return err
+	}
+	for _, prop := range sc.Properties {
+		if err := s.checkRefs(prop); err != nil {
+			return err
+		}
+	}
+	if sc.Items != nil {
+		return s.checkRefs(*sc.Items)
+	}
+	return nil
+}
+
+// validate checks v, decoded with UseNumber, against sc.
+func (s spec) validate(sc schema, v any, at string) error {
+	sc, err := s.resolveSchema(sc)
+	if err != nil {
+		return err
+	}
+
+	if sc.Const != nil && fmt.Sprint(sc.Const) != fmt.Sprint(v) {
+		return fmt.Errorf("%s: %v is not %v", at, v, sc.Const)
+	}
+	if len(sc.Enum) > 0 {
+		found := false
+		for _, e := range sc.Enum {
+			found = found || fmt.Sprint(e) == fmt.Sprint(v)
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, v, sc.Enum)
+		}
+	}
+
+	switch sc.Type {
+	case "":
+		return nil
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %T is not an object", at, v)
+		}
+		for _, name := range sc.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", at, name)
+			}
+		}
+		for name, value := range obj {
+			if prop, ok := sc.Properties[name]; ok {
+				if err := s.validate(prop, value, at+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.validateAdditional(sc.AdditionalProperties, value, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: %T is not an array", at, v)
+		}
+		if sc.Items != nil {
+			for i, item := range items {
+				if err := s.validate(*sc.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %T is not a string", at, v)
+		}
+		if sc.Format == "uuid" {
+			if _, err := uuid.Parse(str); err != nil {
+				return fmt.Errorf("%s: %q is not a uuid", at, str)
+			}
+		}
+		if sc.Pattern != "" && !regexp.MustCompile(sc.Pattern).MatchString(str) {
+			return fmt.Errorf("%s: %q does not match %s", at, str, sc.Pattern)
+		}
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: %T is not a number", at, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %w", at, err)
+		}
+		if sc.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return fmt.Errorf("%s: %s is not an integer", at, n)
+			}
+		}
+		if sc.Minimum != nil && f < *sc.Minimum {
+			return fmt.Errorf("%s: %s is below %v", at, n, *sc.Minimum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %T is not a boolean", at, v)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported type %s", at, sc.Type)
+	}
+	return nil
+}
+
+// validateAdditional checks a property missing from properties against additionalProperties.
+func (s spec) validateAdditional(raw json.RawMessage, v any, at string) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	var allowed bool
+	if err := json.Unmarshal(raw, &allowed); err == nil {
+		if !allowed {
+			return fmt.Errorf("%s: property is not allowed", at)
+		}
+		return nil
+	}
+	var sc schema
+	if err := json.Unmarshal(raw, &sc); err != nil {
+		return fmt.Errorf("%s: invalid additionalProperties: %w", at, err)
+	}
+	return s.validate(sc, v, at)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"WalletApi/internal/handler"
+)
+
+// apiClient calls the v2 API of a running instance, whose errors are problem details.
+type apiClient struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// newAPIClient returns a client of the instance at baseURL. With certFile and
+// keyFile, it presents that client certificate, which an instance with mutual
+// TLS requires; caFile replaces the system roots to verify the instance.
+func newAPIClient(baseURL, apiKey, certFile, keyFile, caFile string) (*apiClient, error) {
+	tlsConfig, err := apiTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func apiTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-cert and -key must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s holds no PEM certificate", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// apiError is an error response of the API.
+type apiError struct {
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s (HTTP %d)", e.Code, e.Detail, e.Status)
+}
+
+func (c *apiClient) CreateWallet(ctx context.Context) (string, error) {
+	var resp struct {
+		Data struct {
+			WalletID string `json:"walletId"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/v2/wallets", &resp); err != nil {
+		return "", err
+	}
+	return resp.Data.WalletID, nil
+}
+
+// GetBalance reads the balance from the primary, replicas and caches may lag behind.
+func (c *apiClient) GetBalance(ctx context.Context, walletID string) (int64, error) {
+	var resp struct {
+		Data struct {
+			Balance int64 `json:"balance"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v2/wallets/"+walletID+"?consistency=strong", &resp); err != nil {
+		return 0, err
+	}
+	return resp.Data.Balance, nil
+}
+
+func (c *apiClient) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json, application/problem+json")
+	if c.apiKey != "" {
+		req.Header.Set(handler.APIKeyHeader, c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &apiError{Status: resp.StatusCode}
+		if json.Unmarshal(body, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Code, apiErr.Detail = "HTTP_ERROR", strings.TrimSpace(string(body))
+		}
+		return apiErr
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
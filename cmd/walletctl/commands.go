@@ -0,0 +1,784 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"WalletApi/internal/export"
+	"WalletApi/internal/interest"
+	"WalletApi/internal/model"
+	"WalletApi/internal/service"
+
+	"github.com/google/uuid"
+)
+
+// usageError is a wrong invocation of a command, it is reported with the command usage.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...any) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// parseFlags parses the flags of a command, which come before its arguments,
+// and checks the number of arguments left.
+func parseFlags(name string, fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, usagef("%s: %v", name, err)
+	}
+	if fs.NArg() != nargs {
+		return nil, usagef("%s takes %d arguments, got %d", name, nargs, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// walletArg parses the only argument of a command, a wallet ID.
+func walletArg(name string, args []string) (string, error) {
+	args, err := parseFlags(name, flag.NewFlagSet(name, flag.ContinueOnError), args, 1)
+	if err != nil {
+		return "", err
+	}
+	return parseWalletID(args[0])
+}
+
+func parseWalletID(s string) (string, error) {
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return "", usagef("invalid wallet ID %q", s)
+	}
+	return id.String(), nil
+}
+
+// walletView is a wallet as printed, Frozen is unknown through the API.
+type walletView struct {
+	ID      string `json:"walletId"`
+	Balance int64  `json:"balance"`
+	Frozen  *bool  `json:"frozen,omitempty"`
+}
+
+func viewWallet(w model.Wallet) walletView {
+	return walletView{ID: w.ID, Balance: w.Balance, Frozen: &w.Frozen}
+}
+
+func (c *cli) printWallet(w walletView) error {
+	return c.out.print(w, func(tw *tabwriter.Writer) {
+		if w.Frozen == nil {
+			fmt.Fprintln(tw, "WALLET\tBALANCE")
+			fmt.Fprintf(tw, "%s\t%d\n", w.ID, w.Balance)
+			return
+		}
+		fmt.Fprintln(tw, "WALLET\tBALANCE\tFROZEN")
+		fmt.Fprintf(tw, "%s\t%d\t%t\n", w.ID, w.Balance, *w.Frozen)
+	})
+}
+
+func runCreate(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseFlags("create", flag.NewFlagSet("create", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	var walletID string
+	var err error
+	if c.api != nil {
+		walletID, err = c.api.CreateWallet(ctx)
+	} else {
+		walletID, err = c.db.CreateWallet(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create wallet: %w", err)
+	}
+	return c.printWallet(walletView{ID: walletID})
+}
+
+func runBalance(ctx context.Context, c *cli, args []string) error {
+	walletID, err := walletArg("balance", args)
+	if err != nil {
+		return err
+	}
+
+	if c.api != nil {
+		balance, err := c.api.GetBalance(ctx, walletID)
+		if err != nil {
+			return err
+		}
+		return c.printWallet(walletView{ID: walletID, Balance: balance})
+	}
+
+	wallet, err := c.db.GetWallet(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	return c.printWallet(viewWallet(wallet))
+}
+
+func runHistory(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	limit := fs.Int("limit", 50, "number of entries to show, 0 for all")
+	args, err := parseFlags("history", fs, args, 1)
+	if err != nil {
+		return err
+	}
+	walletID, err := parseWalletID(args[0])
+	if err != nil {
+		return err
+	}
+
+	history, err := c.db.GetHistory(ctx, walletID, *limit)
+	if err != nil {
+		return err
+	}
+	return c.out.print(history, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "ID\tCREATED AT\tOPERATION\tAMOUNT\tREASON")
+		for _, e := range history {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", e.ID, e.CreatedAt.Format(time.RFC3339), e.OperationType, e.Amount, e.Reason)
+		}
+	})
+}
+
+func runFreeze(ctx context.Context, c *cli, args []string) error {
+	return setFrozen(ctx, c, "freeze", args, true)
+}
+
+func runUnfreeze(ctx context.Context, c *cli, args []string) error {
+	return setFrozen(ctx, c, "unfreeze", args, false)
+}
+
+func setFrozen(ctx context.Context, c *cli, name string, args []string, frozen bool) error {
+	walletID, err := walletArg(name, args)
+	if err != nil {
+		return err
+	}
+	if err := c.db.SetFrozen(ctx, walletID, frozen); err != nil {
+		return err
+	}
+
+	wallet, err := c.db.GetWallet(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	return c.printWallet(viewWallet(wallet))
+}
+
+func runAdjust(ctx context.Context, c *cli, args []string) error {
+	if len(args) == 0 {
+		return usagef("adjust: expected the request, list, approve or reject subcommand")
+	}
+	switch args[0] {
+	case "request":
+		return runAdjustRequest(ctx, c, args[1:])
+	case "list":
+		return runAdjustList(ctx, c, args[1:])
+	case "approve":
+		return decideAdjustment(ctx, c, "adjust approve", args[1:], c.db.ApproveAdjustment)
+	case "reject":
+		return decideAdjustment(ctx, c, "adjust reject", args[1:], c.db.RejectAdjustment)
+	default:
+		return usagef("unknown adjust subcommand %q", args[0])
+	}
+}
+
+func runAdjustRequest(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("adjust request", flag.ContinueOnError)
+	reasonCode := fs.String("reason-code", "", "why the balance is adjusted, one of "+reasonCodes()+" (required)")
+	justification := fs.String("justification", "", "free text explaining the adjustment to the approver (required)")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the request can be approved")
+	args, err := parseFlags("adjust request", fs, args, 2)
+	if err != nil {
+		return err
+	}
+	if !model.ReasonCode(*reasonCode).Valid() {
+		return usagef("adjust request: -reason-code must be one of %s", reasonCodes())
+	}
+	if strings.TrimSpace(*justification) == "" {
+		return usagef("adjust request: -justification is required")
+	}
+	if *ttl <= 0 {
+		return usagef("adjust request: -ttl must be positive")
+	}
+	walletID, err := parseWalletID(args[0])
+	if err != nil {
+		return err
+	}
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount == 0 {
+		return usagef("invalid amount %q, expected a non-zero integer in minor units", args[1])
+	}
+	if err := c.requireOperator(); err != nil {
+		return err
+	}
+
+	a, err := c.db.RequestAdjustment(ctx, model.AdjustmentRequest{
+		WalletID:      walletID,
+		Amount:        amount,
+		ReasonCode:    model.ReasonCode(*reasonCode),
+		Justification: *justification,
+		RequestedBy:   c.operator,
+		ExpiresAt:     time.Now().Add(*ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to request adjustment: %w", err)
+	}
+	return c.printAdjustments(a, a)
+}
+
+func runAdjustList(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseFlags("adjust list", flag.NewFlagSet("adjust list", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	pending, err := c.db.PendingAdjustments(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printAdjustments(pending, pending...)
+}
+
+func decideAdjustment(ctx context.Context, c *cli, name string, args []string, decide func(ctx context.Context, id, operator string) (model.AdjustmentRequest, error)) error {
+	args, err := parseFlags(name, flag.NewFlagSet(name, flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(args[0])
+	if err != nil {
+		return usagef("invalid adjustment ID %q", args[0])
+	}
+	if err := c.requireOperator(); err != nil {
+		return err
+	}
+
+	a, err := decide(ctx, id.String(), c.operator)
+	if err != nil {
+		return fmt.Errorf("failed to decide adjustment: %w", err)
+	}
+	return c.printAdjustments(a, a)
+}
+
+// requireOperator checks the operator recorded with a request or a decision is known.
+func (c *cli) requireOperator() error {
+	if strings.TrimSpace(c.operator) == "" {
+		return usagef("the operator is unknown, set -operator or WALLETCTL_OPERATOR")
+	}
+	return nil
+}
+
+// printAdjustments prints v as JSON or the adjustments as a table.
+func (c *cli) printAdjustments(v any, adjustments ...model.AdjustmentRequest) error {
+	return c.out.print(v, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "ID\tWALLET\tAMOUNT\tREASON CODE\tSTATUS\tREQUESTED BY\tEXPIRES AT\tJUSTIFICATION")
+		for _, a := range adjustments {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+				a.ID, a.WalletID, a.Amount, a.ReasonCode, a.Status, a.RequestedBy, a.ExpiresAt.Format(time.RFC3339), a.Justification)
+		}
+	})
+}
+
+func reasonCodes() string {
+	codes := make([]string, len(model.ReasonCodes))
+	for i, code := range model.ReasonCodes {
+		codes[i] = string(code)
+	}
+	return strings.Join(codes, ", ")
+}
+
+func runMigrate(ctx context.Context, c *cli, args []string) error {
+	args, err := parseFlags("migrate", flag.NewFlagSet("migrate", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		if err := c.db.RunMigrations(ctx); err != nil {
+			return err
+		}
+	case "status":
+	default:
+		return usagef("unknown migrate subcommand %q", args[0])
+	}
+
+	pending, err := c.db.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		pending = []string{}
+	}
+	return c.out.print(map[string][]string{"pending": pending}, func(tw *tabwriter.Writer) {
+		if len(pending) == 0 {
+			fmt.Fprintln(tw, "Schema is up to date")
+			return
+		}
+		fmt.Fprintln(tw, "PENDING MIGRATION")
+		for _, version := range pending {
+			fmt.Fprintln(tw, version)
+		}
+	})
+}
+
+func runReconcile(ctx context.Context, c *cli, args []string) error {
+	if len(args) == 0 {
+		return usagef("reconcile: expected the check or drifts subcommand")
+	}
+	switch args[0] {
+	case "check":
+		return runReconcileCheck(ctx, c, args[1:])
+	case "drifts":
+		return runReconcileDrifts(ctx, c, args[1:])
+	default:
+		return usagef("unknown reconcile subcommand %q", args[0])
+	}
+}
+
+func runReconcileCheck(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("reconcile check", flag.ContinueOnError)
+	chunk := fs.Int("chunk", service.DefaultReconcileChunkSize, "number of wallets compared per query")
+	freeze := fs.Bool("freeze", false, "freeze the wallets that drifted")
+	if _, err := parseFlags("reconcile check", fs, args, 0); err != nil {
+		return err
+	}
+	if *chunk <= 0 {
+		return usagef("reconcile check: -chunk must be positive")
+	}
+
+	reconciler := service.NewReconciler(c.db, service.WithChunkSize(*chunk), service.WithFreeze(*freeze))
+	report, err := reconciler.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.out.print(report, func(tw *tabwriter.Writer) {
+		if len(report.Drifts) > 0 {
+			fmt.Fprintln(tw, "WALLET\tBALANCE\tLEDGER\tDRIFT")
+			for _, d := range report.Drifts {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%+d\n", d.WalletID, d.Balance, d.LedgerBalance, d.Drift())
+			}
+		}
+		fmt.Fprintf(tw, "%d wallets checked, %d drifted", report.Checked, len(report.Drifts))
+		if report.Frozen && len(report.Drifts) > 0 {
+			fmt.Fprint(tw, " and frozen")
+		}
+		fmt.Fprintln(tw)
+	})
+	if err != nil {
+		return err
+	}
+	if len(report.Drifts) > 0 {
+		return errDrift
+	}
+	return nil
+}
+
+func runReconcileDrifts(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("reconcile drifts", flag.ContinueOnError)
+	limit := fs.Int("limit", 50, "number of reports to show, 0 for all")
+	if _, err := parseFlags("reconcile drifts", fs, args, 0); err != nil {
+		return err
+	}
+
+	reports, err := c.db.DriftReports(ctx, *limit)
+	if err != nil {
+		return err
+	}
+	return c.out.print(reports, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "WALLET\tBALANCE\tLEDGER\tDRIFT\tDETECTED AT\tLAST SEEN AT\tFROZEN")
+		for _, d := range reports {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%+d\t%s\t%s\t%t\n", d.WalletID, d.Balance, d.LedgerBalance, d.Drift(),
+				d.DetectedAt.Format(time.RFC3339), d.LastSeenAt.Format(time.RFC3339), d.Frozen)
+		}
+	})
+}
+
+func runExport(ctx context.Context, c *cli, args []string) error {
+	if len(args) == 0 {
+		return usagef("export: expected the run or verify subcommand")
+	}
+	switch args[0] {
+	case "run":
+		return runExportRun(ctx, c, args[1:])
+	case "verify":
+		return runExportVerify(ctx, c, args[1:])
+	default:
+		return usagef("unknown export subcommand %q", args[0])
+	}
+}
+
+func runExportRun(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("export run", flag.ContinueOnError)
+	from := fs.Int64("from", -1, "export the entries after this ID instead of the watermark of the latest manifest")
+	if _, err := parseFlags("export run", fs, args, 0); err != nil {
+		return err
+	}
+	sink, err := export.OpenSink(c.export)
+	if err != nil {
+		return err
+	}
+
+	exporter := export.NewExporter(c.db, sink, export.WithRowsPerFile(c.export.RowsPerFile), export.WithLag(c.export.Lag))
+	var m export.Manifest
+	if *from >= 0 {
+		m, err = exporter.RunFrom(ctx, *from)
+	} else {
+		m, err = exporter.Run(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("export failed after entry %d: %w", m.FromID, err)
+	}
+	return c.printManifest(m, fmt.Sprintf("%d entries exported after entry %d up to entry %d to %s", m.Rows, m.FromID, m.ToID, m.Name()))
+}
+
+func runExportVerify(ctx context.Context, c *cli, args []string) error {
+	if len(args) > 1 {
+		return usagef("export verify takes at most 1 argument, got %d", len(args))
+	}
+	name := export.LatestManifest
+	if len(args) == 1 {
+		name = args[0]
+	}
+	sink, err := export.OpenSink(c.export)
+	if err != nil {
+		return err
+	}
+
+	m, err := export.ReadManifest(ctx, sink, name)
+	if err != nil {
+		return err
+	}
+	if err := export.Verify(ctx, sink, m); err != nil {
+		return err
+	}
+	return c.printManifest(m, fmt.Sprintf("%d files of %s verified, %d entries", len(m.Files), m.Name(), m.Rows))
+}
+
+// printManifest prints the manifest as JSON or its files as a table followed by the summary.
+func (c *cli) printManifest(m export.Manifest, summary string) error {
+	return c.out.print(m, func(tw *tabwriter.Writer) {
+		if len(m.Files) > 0 {
+			fmt.Fprintln(tw, "FILE\tROWS\tBYTES\tSHA256")
+			for _, f := range m.Files {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", f.Name, f.Rows, f.Bytes, f.SHA256)
+			}
+		}
+		fmt.Fprintln(tw, summary)
+	})
+}
+
+func runInterest(ctx context.Context, c *cli, args []string) error {
+	if len(args) == 0 {
+		return usagef("interest: expected the create-product, products, assign, show, run or audit subcommand")
+	}
+	switch args[0] {
+	case "create-product":
+		return runInterestCreateProduct(ctx, c, args[1:])
+	case "products":
+		return runInterestProducts(ctx, c, args[1:])
+	case "assign":
+		return runInterestAssign(ctx, c, args[1:])
+	case "show":
+		return runInterestShow(ctx, c, args[1:])
+	case "run":
+		return runInterestRun(ctx, c, args[1:])
+	case "audit":
+		return runInterestAudit(ctx, c, args[1:])
+	default:
+		return usagef("unknown interest subcommand %q", args[0])
+	}
+}
+
+func (c *cli) interestAccruer() *service.InterestAccruer {
+	return service.NewInterestAccruer(c.db, c.db,
+		service.WithInterestChunkSize(c.interest.ChunkSize),
+		service.WithAccrualLag(c.interest.Lag),
+	)
+}
+
+func runInterestCreateProduct(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("interest create-product", flag.ContinueOnError)
+	name := fs.String("name", "", "unique name of the product")
+	rate := fs.Int64("rate", 0, "annual rate in basis points, 250 for 2.5%")
+	dayCount := fs.String("day-count", string(interest.Actual365), "day count convention: ACT/365, ACT/360, ACT/ACT or 30/360")
+	rounding := fs.String("rounding", string(interest.RoundHalfEven), "rounding of the monthly posting: DOWN, UP, HALF_UP or HALF_EVEN")
+	if _, err := parseFlags("interest create-product", fs, args, 0); err != nil {
+		return err
+	}
+
+	product, err := c.interestAccruer().CreateProduct(ctx, model.InterestProduct{
+		Name:          *name,
+		AnnualRateBps: *rate,
+		DayCount:      *dayCount,
+		Rounding:      *rounding,
+	})
+	if errors.Is(err, model.ErrInvalidInterestProduct) {
+		return usagef("interest create-product: %v", err)
+	}
+	if err != nil {
+		return err
+	}
+	return c.printInterestProducts(product, product)
+}
+
+func runInterestProducts(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseFlags("interest products", flag.NewFlagSet("interest products", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	products, err := c.db.InterestProducts(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printInterestProducts(products, products...)
+}
+
+// printInterestProducts prints v as JSON or the products as a table.
+func (c *cli) printInterestProducts(v any, products ...model.InterestProduct) error {
+	return c.out.print(v, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "ID\tNAME\tRATE BPS\tDAY COUNT\tROUNDING\tCREATED AT")
+		for _, p := range products {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", p.ID, p.Name, p.AnnualRateBps, p.DayCount, p.Rounding, p.CreatedAt.Format(time.RFC3339))
+		}
+	})
+}
+
+func runInterestAssign(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("interest assign", flag.ContinueOnError)
+	from := fs.String("from", "", "first day to accrue, as YYYY-MM-DD in UTC, today if not set; ignored when the wallet has a product")
+	args, err := parseFlags("interest assign", fs, args, 2)
+	if err != nil {
+		return err
+	}
+	walletID, err := parseWalletID(args[0])
+	if err != nil {
+		return err
+	}
+	productID, err := uuid.Parse(args[1])
+	if err != nil {
+		return usagef("invalid product ID %q", args[1])
+	}
+	var day time.Time
+	if *from != "" {
+		if day, err = time.Parse(time.DateOnly, *from); err != nil {
+			return usagef("interest assign: invalid -from %q, expected YYYY-MM-DD", *from)
+		}
+	}
+
+	account, err := c.interestAccruer().Assign(ctx, walletID, productID.String(), day)
+	if err != nil {
+		return err
+	}
+	return c.printInterestAccount(interestView{Account: account, Postings: []model.InterestPosting{}})
+}
+
+// interestView is the interest of a wallet as printed.
+type interestView struct {
+	Account  model.InterestAccount   `json:"account"`
+	Postings []model.InterestPosting `json:"postings"`
+}
+
+func runInterestShow(ctx context.Context, c *cli, args []string) error {
+	walletID, err := walletArg("interest show", args)
+	if err != nil {
+		return err
+	}
+	accruer := c.interestAccruer()
+	account, err := accruer.Account(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	postings, err := accruer.Postings(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	return c.printInterestAccount(interestView{Account: account, Postings: postings})
+}
+
+// printInterestAccount prints the account and its postings as JSON, or as tables.
+func (c *cli) printInterestAccount(v interestView) error {
+	a := v.Account
+	return c.out.print(v, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "WALLET\tPRODUCT\tRATE BPS\tDAY COUNT\tACCRUED THROUGH\tNOT POSTED")
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", a.WalletID, a.Product.Name, a.Product.AnnualRateBps, a.Product.DayCount,
+			a.AccruedThrough.Format(time.DateOnly), interest.Amount{Units: a.AccruedUnits, Fraction: a.AccruedFraction})
+		if len(v.Postings) > 0 {
+			fmt.Fprintln(tw)
+			fmt.Fprintln(tw, "PERIOD\tACCRUED\tROUNDING\tPOSTED\tENTRY\tPOSTED AT")
+			for _, p := range v.Postings {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", p.Period, interest.Amount{Units: p.AccruedUnits, Fraction: p.AccruedFraction},
+					p.Rounding, p.Amount, p.LedgerEntryID, p.PostedAt.Format(time.RFC3339))
+			}
+		}
+	})
+}
+
+func runInterestRun(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseFlags("interest run", flag.NewFlagSet("interest run", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	report, err := c.interestAccruer().Run(ctx)
+	if err != nil {
+		return fmt.Errorf("interest accrual failed after %d accruals: %w", report.Accruals, err)
+	}
+	return c.out.print(report, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%d wallets due, %d days accrued, %d months posted, %d wallets failed\n",
+			report.Accounts, report.Accruals, report.Postings, report.Failed)
+	})
+}
+
+func runInterestAudit(ctx context.Context, c *cli, args []string) error {
+	walletID, err := walletArg("interest audit", args)
+	if err != nil {
+		return err
+	}
+	mismatches, err := c.interestAccruer().Audit(ctx, walletID)
+	if err != nil {
+		return err
+	}
+
+	err = c.out.print(mismatches, func(tw *tabwriter.Writer) {
+		if len(mismatches) > 0 {
+			fmt.Fprintln(tw, "DAY\tFIELD\tRECORDED\tREPLAYED")
+			for _, m := range mismatches {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Day, m.Field, m.Recorded, m.Replayed)
+			}
+		}
+		fmt.Fprintf(tw, "%d mismatches\n", len(mismatches))
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return errInterestMismatch
+	}
+	return nil
+}
+
+func runOverdraft(ctx context.Context, c *cli, args []string) error {
+	if len(args) == 0 {
+		return usagef("overdraft: expected the set, show or run subcommand")
+	}
+	switch args[0] {
+	case "set":
+		return runOverdraftSet(ctx, c, args[1:])
+	case "show":
+		return runOverdraftShow(ctx, c, args[1:])
+	case "run":
+		return runOverdraftRun(ctx, c, args[1:])
+	default:
+		return usagef("unknown overdraft subcommand %q", args[0])
+	}
+}
+
+func (c *cli) overdraftCharger() *service.OverdraftFeeCharger {
+	return service.NewOverdraftFeeCharger(c.db, c.db,
+		service.WithOverdraftChunkSize(c.overdraft.ChunkSize),
+		service.WithOverdraftFeeLag(c.overdraft.FeeLag),
+	)
+}
+
+func runOverdraftSet(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("overdraft set", flag.ContinueOnError)
+	limit := fs.Int64("limit", 0, "how far below zero the balance may go, in minor units, 0 removes the overdraft")
+	fee := fs.Int64("fee", 0, "fee charged for every UTC day the wallet ends overdrawn, in minor units, 0 for none")
+	args, err := parseFlags("overdraft set", fs, args, 1)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	switch {
+	case !set["limit"] && !set["fee"]:
+		return usagef("overdraft set: -limit or -fee is required")
+	case *limit < 0:
+		return usagef("overdraft set: -limit must not be negative")
+	case *fee < 0:
+		return usagef("overdraft set: -fee must not be negative")
+	}
+	walletID, err := parseWalletID(args[0])
+	if err != nil {
+		return err
+	}
+
+	// The flag not given keeps its current value
+	charger := c.overdraftCharger()
+	current, err := charger.Get(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	if !set["limit"] {
+		*limit = current.CreditLimit
+	}
+	if !set["fee"] {
+		*fee = current.DailyFee
+	}
+	o, err := charger.Set(ctx, walletID, *limit, *fee)
+	if err != nil {
+		return err
+	}
+	return c.printOverdraft(overdraftView{Overdraft: o, Fees: []model.OverdraftCharge{}})
+}
+
+// overdraftView is the credit line of a wallet and its fees as printed.
+type overdraftView struct {
+	Overdraft model.Overdraft         `json:"overdraft"`
+	Fees      []model.OverdraftCharge `json:"fees"`
+}
+
+func runOverdraftShow(ctx context.Context, c *cli, args []string) error {
+	walletID, err := walletArg("overdraft show", args)
+	if err != nil {
+		return err
+	}
+	charger := c.overdraftCharger()
+	o, err := charger.Get(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	fees, err := charger.Fees(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	return c.printOverdraft(overdraftView{Overdraft: o, Fees: fees})
+}
+
+// printOverdraft prints the credit line and its fees as JSON, or as tables.
+func (c *cli) printOverdraft(v overdraftView) error {
+	o := v.Overdraft
+	chargedThrough := "-"
+	if o.FeesChargedThrough != nil {
+		chargedThrough = o.FeesChargedThrough.Format(time.DateOnly)
+	}
+	return c.out.print(v, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "WALLET\tBALANCE\tCREDIT LIMIT\tUSED\tAVAILABLE\tDAILY FEE\tCHARGED THROUGH")
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", o.WalletID, o.Balance, o.CreditLimit, o.Used(), o.Available(), o.DailyFee, chargedThrough)
+		if len(v.Fees) > 0 {
+			fmt.Fprintln(tw)
+			fmt.Fprintln(tw, "DAY\tCLOSING BALANCE\tCHARGED\tENTRY\tCHARGED AT")
+			for _, f := range v.Fees {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", f.Day.Format(time.DateOnly), f.Balance, f.Amount, f.LedgerEntryID, f.ChargedAt.Format(time.RFC3339))
+			}
+		}
+	})
+}
+
+func runOverdraftRun(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseFlags("overdraft run", flag.NewFlagSet("overdraft run", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	report, err := c.overdraftCharger().Run(ctx)
+	if err != nil {
+		return fmt.Errorf("overdraft fees failed after %d charges: %w", report.Charged, err)
+	}
+	return c.out.print(report, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%d wallets due, %d days checked, %d fees charged, %d wallets failed\n",
+			report.Wallets, report.Days, report.Charged, report.Failed)
+	})
+}
@@ -0,0 +1,250 @@
+// Command walletctl is the operator tool of the wallet service. It works on the
+// database directly, so every change goes through the checks of the repository,
+// or on a running instance through its HTTP API for the commands the API serves.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"WalletApi/internal/config"
+	"WalletApi/internal/handler"
+	"WalletApi/internal/repository"
+
+	_ "github.com/lib/pq"
+)
+
+// database is a repository with the operator commands and the migrations.
+type database interface {
+	repository.WalletRepository
+	repository.Administrator
+	repository.Maintainer
+	repository.LedgerExporter
+	repository.BalanceHistory
+	repository.Interest
+	repository.Overdraft
+}
+
+// cli holds what the commands work with, exactly one of db and api is set.
+type cli struct {
+	db  database
+	api *apiClient
+	out printer
+	// operator is recorded with the adjustments requested and decided
+	operator string
+	// export is where the ledger is exported, with the database
+	export config.ExportConfig
+	// interest sets how "interest run" accrues, with the database
+	interest config.InterestConfig
+	// overdraft sets how "overdraft run" charges the fees, with the database
+	overdraft config.OverdraftConfig
+}
+
+type command struct {
+	name string
+	args string
+	help string
+	// api tells the command also works through the HTTP API
+	api bool
+	run func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands = []command{
+	{"create", "", "create a wallet", true, runCreate},
+	{"balance", "<wallet-id>", "show the balance of a wallet and whether it is frozen", true, runBalance},
+	{"history", "[-limit n] <wallet-id>", "show the ledger entries of a wallet, newest first", false, runHistory},
+	{"freeze", "<wallet-id>", "reject every transaction of a wallet", false, runFreeze},
+	{"unfreeze", "<wallet-id>", "accept transactions of a wallet again", false, runUnfreeze},
+	{"adjust", "request -reason-code code -justification text [-ttl d] <wallet-id> <amount> | list | approve <id> | reject <id>",
+		"request a signed ADJUSTMENT, a negative amount debits, which another operator must approve before it expires", false, runAdjust},
+	{"migrate", "up|status", "apply the pending migrations or list them", false, runMigrate},
+	{"reconcile", "check [-chunk n] [-freeze] | drifts [-limit n]",
+		"compare every balance with the sum of its ledger entries and record the drifts, or list the recorded drifts", false, runReconcile},
+	{"export", "run [-from id] | verify [manifest]",
+		"export the ledger entries since the latest manifest to EXPORT_DIR or EXPORT_S3_*, or check the files of a manifest", false, runExport},
+	{"interest", "create-product -name n -rate bps [-day-count c] [-rounding r] | products | assign [-from date] <wallet-id> <product-id> | show <wallet-id> | run | audit <wallet-id>",
+		"manage the interest products and the wallets assigned one, accrue the due days now, or replay the interest of a wallet from the ledger", false, runInterest},
+	{"overdraft", "set [-limit n] [-fee n] <wallet-id> | show <wallet-id> | run",
+		"set how far below zero a wallet may go and its daily fee, show its overdraft and the fees charged, or charge the due fees now", false, runOverdraft},
+}
+
+var (
+	// errDrift makes walletctl exit with status 1 once the drift is reported.
+	errDrift = errors.New("balances drifted from the ledger")
+	// errInterestMismatch makes walletctl exit with status 1 once the mismatches are reported.
+	errInterestMismatch = errors.New("interest does not replay from the ledger")
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit status: 0 on success,
+// 1 when the command failed or found drift or interest mismatches and 2 on
+// usage errors.
+func run(ctx context.Context, args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("walletctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", getenv("CONFIG_FILE"), "YAML configuration file of the service, for the database settings (env CONFIG_FILE)")
+	apiURL := fs.String("api", "", "base URL of a running instance, commands then go through its HTTP API instead of the database")
+	apiKey := fs.String("api-key", "", "API key sent in the "+handler.APIKeyHeader+" header with -api")
+	certFile := fs.String("cert", "", "client certificate presented with -api, required by an instance with mutual TLS")
+	keyFile := fs.String("key", "", "private key of the -cert client certificate")
+	caFile := fs.String("cacert", "", "CA bundle verifying the certificate of the instance with -api, instead of the system roots")
+	output := fs.String("o", "table", "output format, table or json")
+	timeout := fs.Duration("timeout", time.Minute, "timeout of the command")
+	operator := fs.String("operator", defaultOperator(getenv), "name of the operator requesting or deciding adjustments (env WALLETCTL_OPERATOR, then USER)")
+	fs.Usage = func() { usage(fs) }
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "invalid output format %q, expected table or json\n", *output)
+		return 2
+	}
+
+	cmd, ok := findCommand(fs.Arg(0))
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	c := &cli{out: printer{w: stdout, json: *output == "json"}, operator: *operator}
+	if *apiURL != "" {
+		if !cmd.api {
+			fmt.Fprintf(stderr, "%s is not served by the API, run it against the database\n", cmd.name)
+			return 2
+		}
+		api, err := newAPIClient(*apiURL, *apiKey, *certFile, *keyFile, *caFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		c.api = api
+	} else {
+		cfg, err := loadConfig(*configFile, getenv)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		db, closeDB, err := openDatabase(cfg)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer closeDB()
+		c.db = db
+		c.export = cfg.Export
+		c.interest = cfg.Interest
+		c.overdraft = cfg.Overdraft
+	}
+
+	err := cmd.run(ctx, c, fs.Args()[1:])
+	var usageErr usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(stderr, "%s\nusage: walletctl %s %s\n", err, cmd.name, cmd.args)
+		return 2
+	case errors.Is(err, errDrift), errors.Is(err, errInterestMismatch):
+		return 1
+	default:
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+}
+
+func defaultOperator(getenv func(string) string) string {
+	if operator := getenv("WALLETCTL_OPERATOR"); operator != "" {
+		return operator
+	}
+	return getenv("USER")
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintln(w, "usage: walletctl [flags] <command> [arguments]")
+	fmt.Fprintln(w, "\nThe database is configured like the service: STORAGE, DB_*, SQLITE_PATH or the -config file.")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		via := ""
+		if cmd.api {
+			via = " (database or -api)"
+		}
+		fmt.Fprintf(w, "  %-10s %s\n      %s%s\n", cmd.name, cmd.args, cmd.help, via)
+	}
+	fmt.Fprintln(w, "\nflags:")
+	fs.PrintDefaults()
+}
+
+// loadConfig loads the configuration of the service.
+func loadConfig(configFile string, getenv func(string) string) (config.Config, error) {
+	var args []string
+	if configFile != "" {
+		args = []string{"-config", configFile}
+	}
+	cfg, _, err := config.Load(args, getenv)
+	return cfg, err
+}
+
+// openDatabase connects to the storage configured for the service. It does not
+// run the migrations, that is left to "walletctl migrate up".
+func openDatabase(cfg config.Config) (database, func(), error) {
+	var err error
+	var db *sql.DB
+	var repo database
+	switch cfg.Storage {
+	case "postgres":
+		db, err = sql.Open("postgres", cfg.Database.DSN())
+		if err != nil {
+			return nil, nil, fmt.Errorf("database connection failed: %w", err)
+		}
+		repo = repository.NewPostgresRepository(db)
+	case "sqlite":
+		db, err = repository.OpenSQLite(cfg.SQLite.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("database connection failed: %w", err)
+		}
+		repo = repository.NewSQLiteRepository(db)
+	default:
+		return nil, nil, fmt.Errorf("storage %q has no database to work on, use postgres or sqlite, or -api", cfg.Storage)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("database ping failed: %w", err)
+	}
+	return repo, func() { db.Close() }, nil
+}
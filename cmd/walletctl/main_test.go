@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/export"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/service"
+)
+
+type result struct {
+	code   int
+	stdout string
+	stderr string
+}
+
+func walletctl(t *testing.T, env map[string]string, args ...string) result {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, func(key string) string { return env[key] }, &stdout, &stderr)
+	return result{code: code, stdout: stdout.String(), stderr: stderr.String()}
+}
+
+func decode[T any](t *testing.T, r result) T {
+	t.Helper()
+	require.Equal(t, 0, r.code, r.stderr)
+	var v T
+	require.NoError(t, json.Unmarshal([]byte(r.stdout), &v), r.stdout)
+	return v
+}
+
+func TestWalletctl_Database(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.db")
+	env := map[string]string{"STORAGE": "sqlite", "SQLITE_PATH": path, "USER": "alice"}
+
+	status := walletctl(t, env, "migrate", "status")
+	require.Equal(t, 0, status.code, status.stderr)
+	assert.Contains(t, status.stdout, "004_adjustments")
+
+	pending := decode[map[string][]string](t, walletctl(t, env, "-o", "json", "migrate", "up"))
+	assert.Empty(t, pending["pending"])
+
+	created := decode[walletView](t, walletctl(t, env, "-o", "json", "create"))
+	walletID := created.ID
+
+	// Requested by alice from USER, approved by bob
+	approve := func(amount, justification string) model.AdjustmentRequest {
+		t.Helper()
+		requested := decode[model.AdjustmentRequest](t, walletctl(t, env, "-o", "json", "adjust", "request",
+			"-reason-code", "FEE_REFUND", "-justification", justification, walletID, amount))
+		assert.Equal(t, model.AdjustmentPending, requested.Status)
+		assert.Equal(t, "alice", requested.RequestedBy)
+
+		self := walletctl(t, env, "adjust", "approve", requested.ID)
+		assert.Equal(t, 1, self.code)
+		assert.Contains(t, self.stderr, model.ErrSelfApproval.Error())
+
+		approved := decode[model.AdjustmentRequest](t, walletctl(t, env, "-operator", "bob", "-o", "json", "adjust", "approve", requested.ID))
+		assert.Equal(t, model.AdjustmentApproved, approved.Status)
+		assert.Equal(t, "bob", approved.DecidedBy)
+		return approved
+	}
+	approve("100", "opening balance")
+	refund := approve("-30", "fee refund reversal")
+
+	history := decode[[]model.LedgerEntry](t, walletctl(t, env, "-o", "json", "history", walletID))
+	require.Len(t, history, 2)
+	assert.Equal(t, model.Adjustment, history[0].OperationType)
+	assert.Equal(t, int64(-30), history[0].Amount)
+	assert.Equal(t, refund.LedgerReason(), history[0].Reason)
+
+	table := walletctl(t, env, "history", "-limit", "1", walletID)
+	require.Equal(t, 0, table.code, table.stderr)
+	lines := strings.Split(strings.TrimSpace(table.stdout), "\n")
+	require.Len(t, lines, 2)
+	assert.Regexp(t, `^ID\s+CREATED AT\s+OPERATION\s+AMOUNT\s+REASON$`, lines[0])
+	assert.Regexp(t, `ADJUSTMENT\s+-30\s+FEE_REFUND: fee refund reversal \(adjustment `+refund.ID+`\)$`, lines[1])
+
+	// A request rejected by its requester is withdrawn
+	withdrawn := decode[model.AdjustmentRequest](t, walletctl(t, env, "-o", "json", "adjust", "request",
+		"-reason-code", "GOODWILL", "-justification", "typo", walletID, "5"))
+	list := walletctl(t, env, "adjust", "list")
+	require.Equal(t, 0, list.code, list.stderr)
+	assert.Regexp(t, withdrawn.ID+`\s+`+walletID+`\s+5\s+GOODWILL\s+PENDING\s+alice`, list.stdout)
+	rejected := decode[model.AdjustmentRequest](t, walletctl(t, env, "-o", "json", "adjust", "reject", withdrawn.ID))
+	assert.Equal(t, model.AdjustmentRejected, rejected.Status)
+	assert.Empty(t, decode[[]model.AdjustmentRequest](t, walletctl(t, env, "-o", "json", "adjust", "list")))
+
+	frozen := decode[walletView](t, walletctl(t, env, "-o", "json", "freeze", walletID))
+	require.NotNil(t, frozen.Frozen)
+	assert.True(t, *frozen.Frozen)
+
+	whileFrozen := decode[model.AdjustmentRequest](t, walletctl(t, env, "-o", "json", "adjust", "request",
+		"-reason-code", "GOODWILL", "-justification", "while frozen", walletID, "5"))
+	failed := walletctl(t, env, "-operator", "bob", "adjust", "approve", whileFrozen.ID)
+	assert.Equal(t, 1, failed.code)
+	assert.Contains(t, failed.stderr, model.ErrWalletFrozen.Error())
+	assert.Contains(t, walletctl(t, env, "adjust", "list").stdout, whileFrozen.ID, "A failed approval leaves the request pending")
+
+	balance := walletctl(t, env, "unfreeze", walletID)
+	require.Equal(t, 0, balance.code, balance.stderr)
+	assert.Regexp(t, walletID+`\s+70\s+false`, balance.stdout)
+
+	report := decode[service.ReconcileReport](t, walletctl(t, env, "-o", "json", "reconcile", "check", "-chunk", "1"))
+	assert.Equal(t, 1, report.Checked)
+	assert.Empty(t, report.Drifts)
+
+	// A balance changed behind the ledger's back
+	db, err := repository.OpenSQLite(path)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("UPDATE wallets SET balance = 1000 WHERE id = ?", walletID)
+	require.NoError(t, err)
+
+	drifted := walletctl(t, env, "reconcile", "check")
+	assert.Equal(t, 1, drifted.code)
+	assert.Regexp(t, walletID+`\s+1000\s+70\s+\+930`, drifted.stdout)
+	assert.Contains(t, drifted.stdout, "1 wallets checked, 1 drifted\n")
+
+	frozen = decode[walletView](t, walletctl(t, env, "-o", "json", "balance", walletID))
+	assert.False(t, *frozen.Frozen, "Drifted wallets are only frozen with -freeze")
+	drifted = walletctl(t, env, "reconcile", "check", "-freeze")
+	assert.Equal(t, 1, drifted.code)
+	assert.Contains(t, drifted.stdout, "1 wallets checked, 1 drifted and frozen")
+	frozen = decode[walletView](t, walletctl(t, env, "-o", "json", "balance", walletID))
+	assert.True(t, *frozen.Frozen)
+
+	// Both runs found the same drift
+	drifts := walletctl(t, env, "reconcile", "drifts")
+	require.Equal(t, 0, drifts.code, drifts.stderr)
+	lines = strings.Split(strings.TrimSpace(drifts.stdout), "\n")
+	require.Len(t, lines, 2)
+	assert.Regexp(t, `^WALLET\s+BALANCE\s+LEDGER\s+DRIFT\s+DETECTED AT\s+LAST SEEN AT\s+FROZEN$`, lines[0])
+	assert.Regexp(t, walletID+`\s+1000\s+70\s+\+930\s+\S+\s+\S+\s+true$`, lines[1])
+}
+
+func TestWalletctl_Export(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.db")
+	dir := t.TempDir()
+	env := map[string]string{"STORAGE": "sqlite", "SQLITE_PATH": path, "EXPORT_DIR": dir, "EXPORT_ROWS_PER_FILE": "2", "EXPORT_LAG": "1ns"}
+	require.Equal(t, 0, walletctl(t, env, "migrate", "up").code)
+
+	db, err := repository.OpenSQLite(path)
+	require.NoError(t, err)
+	defer db.Close()
+	repo := repository.NewSQLiteRepository(db)
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 10, true))
+	}
+
+	m := decode[export.Manifest](t, walletctl(t, env, "-o", "json", "export", "run"))
+	assert.Equal(t, int64(3), m.Rows)
+	assert.Len(t, m.Files, 2)
+
+	verified := walletctl(t, env, "export", "verify")
+	require.Equal(t, 0, verified.code, verified.stderr)
+	assert.Regexp(t, `ledger/00000000000000000001-00000000000000000002.ndjson.gz\s+2\s+\d+\s+[0-9a-f]{64}`, verified.stdout)
+	assert.Contains(t, verified.stdout, "2 files of "+m.Name()+" verified, 3 entries")
+
+	// Nothing new since the latest manifest, unless started over
+	again := walletctl(t, env, "export", "run")
+	require.Equal(t, 0, again.code, again.stderr)
+	assert.Contains(t, again.stdout, "0 entries exported after entry 3 up to entry 3")
+	m = decode[export.Manifest](t, walletctl(t, env, "-o", "json", "export", "run", "-from", "1"))
+	assert.Equal(t, int64(2), m.Rows)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ledger", "00000000000000000002-00000000000000000003.ndjson.gz"), []byte("tampered"), 0o644))
+	corrupt := walletctl(t, env, "export", "verify", m.Name())
+	assert.Equal(t, 1, corrupt.code)
+	assert.Contains(t, corrupt.stderr, export.ErrCorrupt.Error())
+
+	disabled := walletctl(t, map[string]string{"STORAGE": "sqlite", "SQLITE_PATH": path}, "export", "run")
+	assert.Equal(t, 1, disabled.code)
+	assert.Contains(t, disabled.stderr, export.ErrDisabled.Error())
+}
+
+func TestWalletctl_Interest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.db")
+	env := map[string]string{"STORAGE": "sqlite", "SQLITE_PATH": path, "INTEREST_LAG": "0s"}
+	require.Equal(t, 0, walletctl(t, env, "migrate", "up").code)
+
+	product := decode[model.InterestProduct](t, walletctl(t, env, "-o", "json", "interest", "create-product",
+		"-name", "Savings", "-rate", "500", "-rounding", "DOWN"))
+	assert.Equal(t, "ACT/365", product.DayCount)
+	taken := walletctl(t, env, "interest", "create-product", "-name", "Savings", "-rate", "100")
+	assert.Equal(t, 2, taken.code)
+	assert.Contains(t, taken.stderr, "exists")
+
+	products := walletctl(t, env, "interest", "products")
+	require.Equal(t, 0, products.code, products.stderr)
+	assert.Regexp(t, product.ID+`\s+Savings\s+500\s+ACT/365\s+DOWN`, products.stdout)
+
+	// A balance held since before the first accrued day
+	db, err := repository.OpenSQLite(path)
+	require.NoError(t, err)
+	defer db.Close()
+	repo := repository.NewSQLiteRepository(db)
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 1_000_000, true))
+	from := time.Now().UTC().AddDate(0, -2, 0)
+	_, err = db.Exec("UPDATE ledger_entries SET created_at = ? WHERE wallet_id = ?", from.AddDate(0, 0, -1).UnixNano(), walletID)
+	require.NoError(t, err)
+
+	assigned := decode[interestView](t, walletctl(t, env, "-o", "json", "interest", "assign", "-from", from.Format(time.DateOnly), walletID, product.ID))
+	assert.Equal(t, product.ID, assigned.Account.Product.ID)
+
+	report := decode[service.InterestReport](t, walletctl(t, env, "-o", "json", "interest", "run"))
+	assert.Equal(t, 1, report.Accounts)
+	assert.GreaterOrEqual(t, report.Accruals, 58)
+	assert.GreaterOrEqual(t, report.Postings, 1)
+	assert.Zero(t, report.Failed)
+
+	shown := decode[interestView](t, walletctl(t, env, "-o", "json", "interest", "show", walletID))
+	require.Len(t, shown.Postings, report.Postings)
+	assert.NotZero(t, shown.Postings[0].Amount)
+	history := decode[[]model.LedgerEntry](t, walletctl(t, env, "-o", "json", "history", walletID))
+	assert.Equal(t, model.Interest, history[0].OperationType)
+
+	audit := walletctl(t, env, "interest", "audit", walletID)
+	require.Equal(t, 0, audit.code, audit.stderr)
+	assert.Contains(t, audit.stdout, "0 mismatches")
+
+	// An accrual changed behind the accruer's back
+	_, err = db.Exec("UPDATE interest_accruals SET balance = balance + 1 WHERE wallet_id = ? AND day = ?",
+		walletID, shown.Account.AccruedThrough.UnixNano())
+	require.NoError(t, err)
+	audit = walletctl(t, env, "interest", "audit", walletID)
+	assert.Equal(t, 1, audit.code)
+	assert.Regexp(t, shown.Account.AccruedThrough.Format(time.DateOnly)+`\s+balance\s+1000001\s+1000000`, audit.stdout)
+
+	unassigned := walletctl(t, env, "interest", "show", decode[walletView](t, walletctl(t, env, "-o", "json", "create")).ID)
+	assert.Equal(t, 1, unassigned.code)
+	assert.Contains(t, unassigned.stderr, model.ErrInterestNotAssigned.Error())
+}
+
+func TestWalletctl_Overdraft(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.db")
+	env := map[string]string{"STORAGE": "sqlite", "SQLITE_PATH": path, "OVERDRAFT_FEE_LAG": "0s"}
+	require.Equal(t, 0, walletctl(t, env, "migrate", "up").code)
+
+	db, err := repository.OpenSQLite(path)
+	require.NoError(t, err)
+	defer db.Close()
+	repo := repository.NewSQLiteRepository(db)
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 100, true))
+
+	set := decode[overdraftView](t, walletctl(t, env, "-o", "json", "overdraft", "set", "-limit", "500", "-fee", "25", walletID))
+	assert.Equal(t, int64(500), set.Overdraft.CreditLimit)
+	assert.Equal(t, int64(25), set.Overdraft.DailyFee)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	require.NotNil(t, set.Overdraft.FeesChargedThrough)
+	assert.Equal(t, today.AddDate(0, 0, -1), *set.Overdraft.FeesChargedThrough)
+
+	// Overdrawn since three days, with the fee charged through the day before yesterday
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 300, false))
+	_, err = db.Exec("UPDATE ledger_entries SET created_at = ? WHERE wallet_id = ?", today.AddDate(0, 0, -3).UnixNano(), walletID)
+	require.NoError(t, err)
+	_, err = db.Exec("UPDATE wallets SET overdraft_fees_through = ? WHERE id = ?", today.AddDate(0, 0, -2).UnixNano(), walletID)
+	require.NoError(t, err)
+
+	report := decode[service.OverdraftReport](t, walletctl(t, env, "-o", "json", "overdraft", "run"))
+	assert.Equal(t, service.OverdraftReport{Wallets: 1, Days: 1, Charged: 1}, report)
+
+	shown := walletctl(t, env, "overdraft", "show", walletID)
+	require.Equal(t, 0, shown.code, shown.stderr)
+	assert.Regexp(t, walletID+`\s+-225\s+500\s+225\s+275\s+25\s+`+today.AddDate(0, 0, -1).Format(time.DateOnly), shown.stdout)
+	assert.Regexp(t, today.AddDate(0, 0, -1).Format(time.DateOnly)+`\s+-200\s+25\s+`, shown.stdout)
+	history := decode[[]model.LedgerEntry](t, walletctl(t, env, "-o", "json", "history", walletID))
+	assert.Equal(t, model.OverdraftFee, history[0].OperationType)
+
+	// The flag not given keeps its value
+	set = decode[overdraftView](t, walletctl(t, env, "-o", "json", "overdraft", "set", "-fee", "0", walletID))
+	assert.Equal(t, int64(500), set.Overdraft.CreditLimit)
+	assert.Zero(t, set.Overdraft.DailyFee)
+
+	below := walletctl(t, env, "overdraft", "set", "-limit", "200", walletID)
+	assert.Equal(t, 1, below.code)
+	assert.Contains(t, below.stderr, "credit limit below the overdraft in use")
+}
+
+func TestWalletctl_UsageErrors(t *testing.T) {
+	env := map[string]string{"STORAGE": "sqlite", "SQLITE_PATH": filepath.Join(t.TempDir(), "wallet.db")}
+	walletID := "0b7e5a36-2f4c-4f3e-9a55-6d1f3f6a3c11"
+
+	testCases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no command", nil, "usage: walletctl"},
+		{"unknown command", []string{"transfer"}, `unknown command "transfer"`},
+		{"invalid output", []string{"-o", "yaml", "create"}, "invalid output format"},
+		{"missing adjust subcommand", []string{"adjust"}, "expected the request, list, approve or reject subcommand"},
+		{"missing reason code", []string{"adjust", "request", "-justification", "x", walletID, "10"}, "-reason-code must be one of"},
+		{"unknown reason code", []string{"adjust", "request", "-reason-code", "BIRTHDAY", "-justification", "x", walletID, "10"}, "-reason-code must be one of"},
+		{"missing justification", []string{"adjust", "request", "-reason-code", "OTHER", walletID, "10"}, "-justification is required"},
+		{"zero amount", []string{"adjust", "request", "-reason-code", "OTHER", "-justification", "x", walletID, "0"}, "invalid amount"},
+		{"unknown operator", []string{"adjust", "approve", walletID}, "the operator is unknown"},
+		{"invalid adjustment ID", []string{"-operator", "bob", "adjust", "reject", "42"}, "invalid adjustment ID"},
+		{"invalid wallet ID", []string{"balance", "42"}, "invalid wallet ID"},
+		{"missing argument", []string{"freeze"}, "freeze takes 1 arguments, got 0"},
+		{"unknown subcommand", []string{"migrate", "down"}, "unknown migrate subcommand"},
+		{"unknown reconcile subcommand", []string{"reconcile", "fix"}, "unknown reconcile subcommand"},
+		{"unknown export subcommand", []string{"export", "upload"}, "unknown export subcommand"},
+		{"unknown interest subcommand", []string{"interest", "accrue"}, "unknown interest subcommand"},
+		{"invalid interest rate", []string{"interest", "create-product", "-name", "x", "-rate", "0"}, "annual rate must be between"},
+		{"invalid product ID", []string{"interest", "assign", walletID, "savings"}, "invalid product ID"},
+		{"invalid from day", []string{"interest", "assign", "-from", "tomorrow", walletID, walletID}, "invalid -from"},
+		{"missing overdraft subcommand", []string{"overdraft"}, "expected the set, show or run subcommand"},
+		{"overdraft without terms", []string{"overdraft", "set", walletID}, "-limit or -fee is required"},
+		{"negative credit limit", []string{"overdraft", "set", "-limit", "-5", walletID}, "-limit must not be negative"},
+		{"too many manifests", []string{"export", "verify", "a.json", "b.json"}, "at most 1 argument"},
+		{"database only", []string{"-api", "http://localhost:8080", "freeze", walletID}, "not served by the API"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := walletctl(t, env, tc.args...)
+			assert.Equal(t, 2, r.code)
+			assert.Contains(t, r.stderr, tc.want)
+		})
+	}
+}
+
+func TestWalletctl_NoDatabase(t *testing.T) {
+	r := walletctl(t, map[string]string{"STORAGE": "memory"}, "create")
+	assert.Equal(t, 1, r.code)
+	assert.Contains(t, r.stderr, "use postgres or sqlite, or -api")
+}
+
+func TestWalletctl_API(t *testing.T) {
+	const walletID = "0b7e5a36-2f4c-4f3e-9a55-6d1f3f6a3c11"
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/wallets", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-API-Key"))
+		w.Write([]byte(`{"data":{"walletId":"` + walletID + `"}}`))
+	})
+	mux.HandleFunc("GET /api/v2/wallets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "strong", r.URL.Query().Get("consistency"))
+		if r.PathValue("id") != walletID {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status":404,"code":"WALLET_NOT_FOUND","detail":"Wallet not found"}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"balance":250}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	created := decode[walletView](t, walletctl(t, nil, "-api", server.URL, "-api-key", "secret", "-o", "json", "create"))
+	assert.Equal(t, walletView{ID: walletID}, created)
+
+	// Whether the wallet is frozen is not served by the API
+	balance := walletctl(t, nil, "-api", server.URL, "balance", walletID)
+	require.Equal(t, 0, balance.code, balance.stderr)
+	assert.Equal(t, "WALLET                                BALANCE\n"+walletID+"  250\n", balance.stdout)
+
+	missing := walletctl(t, nil, "-api", server.URL, "balance", "a1c3d7c4-5d36-4d8e-8f55-1a0e0d8e5f00")
+	assert.Equal(t, 1, missing.code)
+	assert.Contains(t, missing.stderr, "WALLET_NOT_FOUND: Wallet not found (HTTP 404)")
+}
+
+// writeClientCert writes a CA and a client certificate it issued, with the key
+// of the latter, and returns the CA with the paths of the certificate and key.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+	newCert := func(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return cert, key
+	}
+
+	ca, caKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	cert, key := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "operator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return ca, certFile, keyFile
+}
+
+func TestWalletctl_APIMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, certFile, keyFile := writeClientCert(t, dir)
+
+	const walletID = "0b7e5a36-2f4c-4f3e-9a55-6d1f3f6a3c11"
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "operator", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.Write([]byte(`{"data":{"walletId":"` + walletID + `"}}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "server-ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	created := decode[walletView](t, walletctl(t, nil, "-api", server.URL, "-cert", certFile, "-key", keyFile, "-cacert", caFile, "-o", "json", "create"))
+	assert.Equal(t, walletView{ID: walletID}, created)
+
+	r := walletctl(t, nil, "-api", server.URL, "-cacert", caFile, "create")
+	assert.Equal(t, 1, r.code, "The instance requires a client certificate")
+	assert.Contains(t, r.stderr, "request failed")
+
+	r = walletctl(t, nil, "-api", server.URL, "-cert", certFile, "-key", keyFile, "create")
+	assert.Equal(t, 1, r.code, "The certificate of the instance is not trusted without -cacert")
+
+	r = walletctl(t, nil, "-api", server.URL, "-cert", certFile, "create")
+	assert.Equal(t, 1, r.code)
+	assert.Contains(t, r.stderr, "-cert and -key must be set together")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"text/tabwriter"
+)
+
+// printer writes the result of a command as an aligned table or as JSON.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+// print writes v as indented JSON, or calls table to write it as tab separated rows.
+func (p printer) print(v any, table func(tw *tabwriter.Writer)) error {
+	if p.json {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
@@ -0,0 +1,210 @@
+// Package cache keeps wallet balances close to the service so hot reads
+// don't have to reach the database.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalanceCache stores wallet balances. Implementations must be safe for concurrent use.
+// Lookups and updates never fail: an unavailable remote cache behaves like an empty one.
+//
+// Writers take a Version before reading the balance they store, so a balance
+// read before a Delete is not stored after it: a balance changed outside of
+// the writer is removed with Delete, and the writer may have read it before the change.
+type BalanceCache interface {
+	Get(ctx context.Context, walletID string) (Entry, bool)
+	// Version returns the version to give to Set or SetIfAbsent, it must be taken
+	// before the balance to store is read.
+	Version(ctx context.Context, walletID string) Version
+	// Set stores the balance and credit limit, it is used after a committed write.
+	// If the wallet was deleted since version was taken, the balance may predate
+	// the deletion and the wallet is removed instead.
+	Set(ctx context.Context, walletID string, version Version, balance, creditLimit int64)
+	// SetIfAbsent stores the balance and credit limit only if the wallet is not cached and
+	// was neither set nor deleted since version was taken, it is used when filling the
+	// cache after a miss so a slow read can't overwrite a newer write.
+	SetIfAbsent(ctx context.Context, walletID string, version Version, balance, creditLimit int64)
+	Delete(ctx context.Context, walletID string)
+}
+
+// Version orders the writes of a cache, see BalanceCache.
+type Version uint64
+
+// Entry is a cached balance, with the credit limit read along with it.
+type Entry struct {
+	Balance     int64
+	CreditLimit int64
+	StoredAt    time.Time
+}
+
+// Stats are the cumulative counters of a cache.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+type lruItem struct {
+	walletID string
+	entry    Entry
+	version  Version
+}
+
+// LRU is an in-process BalanceCache holding at most size entries for at most ttl each.
+//
+// Its versions are those of the whole cache rather than of each wallet, so it
+// keeps nothing about the wallets it does not hold: a Delete rejects the
+// writes of every wallet whose version was taken before it. They are retried
+// by the next read, so a burst of deletions costs misses but no stale balance.
+type LRU struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List // front is the most recently used
+	now   func() time.Time
+
+	// version is the version of the last write
+	version Version
+	// deleted is the version of the last Delete
+	deleted Version
+	// forgotten is the latest version removed from the cache, by Delete, eviction or expiry
+	forgotten Version
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+func (c *LRU) Get(ctx context.Context, walletID string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[walletID]
+	if !ok {
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+
+	item := el.Value.(*lruItem)
+	if c.expired(item) {
+		c.remove(el)
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+	return item.entry, true
+}
+
+func (c *LRU) Version(ctx context.Context, walletID string) Version {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.version
+}
+
+func (c *LRU) Set(ctx context.Context, walletID string, version Version, balance, creditLimit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deleted > version {
+		if el, ok := c.items[walletID]; ok {
+			c.remove(el)
+		}
+		return
+	}
+	c.store(walletID, balance, creditLimit)
+}
+
+func (c *LRU) SetIfAbsent(ctx context.Context, walletID string, version Version, balance, creditLimit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.forgotten > version {
+		return
+	}
+	if el, ok := c.items[walletID]; ok {
+		// An expired entry counts as absent, unless it was written after the balance was read
+		item := el.Value.(*lruItem)
+		if item.version > version || !c.expired(item) {
+			return
+		}
+	}
+	c.store(walletID, balance, creditLimit)
+}
+
+func (c *LRU) Delete(ctx context.Context, walletID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[walletID]; ok {
+		c.remove(el)
+	}
+	c.version++
+	c.deleted = c.version
+	c.forgotten = c.version
+}
+
+// Len returns the number of cached entries, expired ones included.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *LRU) Stats() Stats {
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+func (c *LRU) expired(item *lruItem) bool {
+	return c.now().Sub(item.entry.StoredAt) > c.ttl
+}
+
+// store inserts or replaces the entry, the caller must hold the lock.
+func (c *LRU) store(walletID string, balance, creditLimit int64) {
+	entry := Entry{Balance: balance, CreditLimit: creditLimit, StoredAt: c.now()}
+	c.version++
+
+	if el, ok := c.items[walletID]; ok {
+		item := el.Value.(*lruItem)
+		item.entry = entry
+		item.version = c.version
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[walletID] = c.order.PushFront(&lruItem{walletID: walletID, entry: entry, version: c.version})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *LRU) remove(el *list.Element) {
+	item := el.Value.(*lruItem)
+	c.order.Remove(el)
+	delete(c.items, item.walletID)
+	c.forgotten = max(c.forgotten, item.version)
+}
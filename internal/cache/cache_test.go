@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU_GetSet(t *testing.T) {
+	c := NewLRU(2, time.Minute)
+	ctx := context.Background()
+
+	_, ok := c.Get(ctx, "a")
+	assert.False(t, ok)
+
+	c.Set(ctx, "a", c.Version(ctx, "a"), -10, 50)
+	entry, ok := c.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-10), entry.Balance)
+	assert.Equal(t, int64(50), entry.CreditLimit)
+
+	c.Delete(ctx, "a")
+	_, ok = c.Get(ctx, "a")
+	assert.False(t, ok)
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 2}, c.Stats())
+}
+
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU(2, time.Minute)
+	ctx := context.Background()
+
+	c.Set(ctx, "a", c.Version(ctx, "a"), 1, 0)
+	c.Set(ctx, "b", c.Version(ctx, "b"), 2, 0)
+	c.Get(ctx, "a") // "b" is now the least recently used
+	c.Set(ctx, "c", c.Version(ctx, "c"), 3, 0)
+
+	_, ok := c.Get(ctx, "b")
+	assert.False(t, ok)
+	_, ok = c.Get(ctx, "a")
+	assert.True(t, ok)
+	_, ok = c.Get(ctx, "c")
+	assert.True(t, ok)
+
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint64(1), c.Stats().Evictions)
+}
+
+func TestLRU_TTL(t *testing.T) {
+	now := time.Now()
+	c := NewLRU(10, time.Second)
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	c.Set(ctx, "a", c.Version(ctx, "a"), 1, 0)
+	now = now.Add(2 * time.Second)
+
+	_, ok := c.Get(ctx, "a")
+	assert.False(t, ok, "Expired entry was returned")
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestLRU_SetIfAbsent(t *testing.T) {
+	now := time.Now()
+	c := NewLRU(10, time.Second)
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	c.SetIfAbsent(ctx, "a", c.Version(ctx, "a"), 1, 0)
+	c.SetIfAbsent(ctx, "a", c.Version(ctx, "a"), 2, 0)
+	entry, _ := c.Get(ctx, "a")
+	assert.Equal(t, int64(1), entry.Balance, "Present entry was overwritten")
+
+	now = now.Add(2 * time.Second)
+	c.SetIfAbsent(ctx, "a", c.Version(ctx, "a"), 3, 0)
+	entry, _ = c.Get(ctx, "a")
+	assert.Equal(t, int64(3), entry.Balance, "Expired entry was not replaced")
+}
+
+func TestLRU_Versions(t *testing.T) {
+	c := NewLRU(10, time.Minute)
+	ctx := context.Background()
+
+	// A write-through that read the balance before a deletion drops the entry
+	c.Set(ctx, "a", c.Version(ctx, "a"), 1, 0)
+	version := c.Version(ctx, "a")
+	c.Delete(ctx, "b")
+	c.Set(ctx, "a", version, 2, 0)
+	_, ok := c.Get(ctx, "a")
+	assert.False(t, ok, "A balance read before a deletion was stored")
+
+	// A fill that read the balance before a deletion is not stored
+	version = c.Version(ctx, "a")
+	c.Delete(ctx, "a")
+	c.SetIfAbsent(ctx, "a", version, 3, 0)
+	_, ok = c.Get(ctx, "a")
+	assert.False(t, ok, "A balance read before a deletion was stored")
+
+	// Versions taken after the deletion are stored
+	c.SetIfAbsent(ctx, "a", c.Version(ctx, "a"), 4, 0)
+	entry, _ := c.Get(ctx, "a")
+	assert.Equal(t, int64(4), entry.Balance)
+}
+
+func TestLRU_VersionsSurviveEviction(t *testing.T) {
+	c := NewLRU(1, time.Minute)
+	ctx := context.Background()
+
+	version := c.Version(ctx, "a")
+	c.Set(ctx, "a", c.Version(ctx, "a"), 2, 0)
+	c.Set(ctx, "b", c.Version(ctx, "b"), 1, 0) // evicts "a"
+
+	c.SetIfAbsent(ctx, "a", version, 1, 0)
+	_, ok := c.Get(ctx, "a")
+	assert.False(t, ok, "A balance read before an evicted write was stored")
+}
@@ -0,0 +1,734 @@
+// Package config loads the service configuration from defaults, an optional
+// YAML file, environment variables and command line flags, in increasing order
+// of precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[REDACTED]"
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Storage   string          `yaml:"storage"` // postgres, sqlite or memory
+	Database  DatabaseConfig  `yaml:"database"`
+	SQLite    SQLiteConfig    `yaml:"sqlite"`
+	Service   ServiceConfig   `yaml:"service"`
+	Cache     CacheConfig     `yaml:"cache"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Reconcile ReconcileConfig `yaml:"reconcile"`
+	Snapshot  SnapshotConfig  `yaml:"snapshot"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Interest  InterestConfig  `yaml:"interest"`
+	Overdraft OverdraftConfig `yaml:"overdraft"`
+	Export    ExportConfig    `yaml:"export"`
+	Health    HealthConfig    `yaml:"health"`
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	Port              int           `yaml:"port"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxBodyBytes      int           `yaml:"max_body_bytes"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	// AdminAddr is the listen address of the operator routes, which are not served without it.
+	AdminAddr string `yaml:"admin_addr"`
+}
+
+// TLSConfig enables HTTPS when CertFile is set, and mutual TLS when ClientCAFile is set too.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientTenants maps client certificate subjects to tenants, unmapped subjects are rejected.
+	// A tenant identifies the client, it is not a scope of the wallets it may use.
+	ClientTenants map[string]string `yaml:"client_tenants"`
+}
+
+// DatabaseConfig configures PostgreSQL. URL takes precedence, otherwise the
+// DSN is composed from the separate fields.
+type DatabaseConfig struct {
+	URL      string `yaml:"url"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Name     string `yaml:"name"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+
+	ReplicaURLs          []string      `yaml:"replica_urls"`
+	ReplicaMaxLag        time.Duration `yaml:"replica_max_lag"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval"`
+}
+
+type SQLiteConfig struct {
+	Path string `yaml:"path"`
+}
+
+type ServiceConfig struct {
+	Workers           int           `yaml:"workers"`
+	QueueSize         int           `yaml:"queue_size"`
+	QueueDrainTimeout time.Duration `yaml:"queue_drain_timeout"`
+}
+
+type CacheConfig struct {
+	Size int           `yaml:"size"` // zero disables the balance cache
+	TTL  time.Duration `yaml:"ttl"`
+}
+
+// RateLimitConfig holds the rate limits of each tier of clients. Tenants not
+// listed in TenantTiers, and clients without a tenant, get DefaultTier.
+type RateLimitConfig struct {
+	DefaultTier string                `yaml:"default_tier"`
+	TenantTiers map[string]string     `yaml:"tenant_tiers"`
+	Tiers       map[string]TierConfig `yaml:"tiers"`
+	// APIKeys identify clients without a tenant, unknown keys are limited by IP address
+	APIKeys []string `yaml:"api_keys"`
+}
+
+type TierConfig struct {
+	// Client limits each client on each route separately
+	Client RateLimit `yaml:"client"`
+	// Routes overrides Client for route patterns such as "POST /api/v1/wallets"
+	Routes map[string]RateLimit `yaml:"routes"`
+	// Wallet limits the transactions of each wallet
+	Wallet RateLimit `yaml:"wallet"`
+}
+
+// RateLimit lets Rate requests per second through with bursts of Burst, a zero rate is unlimited.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// ReconcileConfig schedules the comparison of every balance with its ledger.
+type ReconcileConfig struct {
+	Interval  time.Duration `yaml:"interval"` // zero disables the scheduled runs
+	ChunkSize int           `yaml:"chunk_size"`
+	Freeze    bool          `yaml:"freeze"`
+}
+
+// SnapshotConfig schedules the balance snapshots that point-in-time balances start from.
+type SnapshotConfig struct {
+	Interval  time.Duration `yaml:"interval"` // zero disables the scheduled snapshots
+	ChunkSize int           `yaml:"chunk_size"`
+}
+
+// SchedulerConfig sets how scheduled transactions are run.
+type SchedulerConfig struct {
+	Interval  time.Duration `yaml:"interval"` // zero disables running the schedules in this instance
+	BatchSize int           `yaml:"batch_size"`
+	Lease     time.Duration `yaml:"lease"`
+	// Retries is the number of times an occurrence rejected for insufficient
+	// funds is tried again, RetryBackoff apart
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// InterestConfig schedules the interest accrual of the wallets assigned a product.
+type InterestConfig struct {
+	Interval  time.Duration `yaml:"interval"` // zero disables the accrual in this instance
+	ChunkSize int           `yaml:"chunk_size"`
+	// Lag is how long after the end of a UTC day it is accrued, so its closing
+	// balance includes the transactions still committing at midnight
+	Lag time.Duration `yaml:"lag"`
+}
+
+// OverdraftConfig schedules the daily fee charged to the wallets that end a day overdrawn.
+type OverdraftConfig struct {
+	FeeInterval time.Duration `yaml:"fee_interval"` // zero disables the fees in this instance
+	ChunkSize   int           `yaml:"chunk_size"`
+	// FeeLag is how long after the end of a UTC day its fee is charged, so its
+	// closing balance includes the transactions still committing at midnight
+	FeeLag time.Duration `yaml:"fee_lag"`
+}
+
+// ExportConfig sets the target of the ledger export, a directory or an
+// S3-compatible bucket. The export is disabled when neither is set.
+type ExportConfig struct {
+	Dir         string        `yaml:"dir"`
+	S3          S3Config      `yaml:"s3"`
+	RowsPerFile int           `yaml:"rows_per_file"`
+	Lag         time.Duration `yaml:"lag"` // entries younger than the lag are left to the next run
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// Enabled tells whether an export target is set.
+func (e ExportConfig) Enabled() bool {
+	return e.Dir != "" || e.S3.Bucket != ""
+}
+
+type HealthConfig struct {
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"`
+	DrainDelay       time.Duration `yaml:"drain_delay"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+}
+
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"`
+	Endpoint string `yaml:"endpoint"`
+	File     string `yaml:"file"`
+}
+
+// Default returns the configuration used when nothing else is set.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:              8080,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxBodyBytes:      64 << 10,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Storage: "postgres",
+		Database: DatabaseConfig{
+			Port:                 5432,
+			SSLMode:              "disable",
+			MaxOpenConns:         25,
+			MaxIdleConns:         5,
+			ConnMaxLifetime:      5 * time.Minute,
+			ReplicaMaxLag:        5 * time.Second,
+			ReplicaCheckInterval: 5 * time.Second,
+		},
+		SQLite: SQLiteConfig{Path: "wallet.db"},
+		Service: ServiceConfig{
+			Workers:           16,
+			QueueSize:         10000,
+			QueueDrainTimeout: 10 * time.Second,
+		},
+		Cache:     CacheConfig{TTL: 30 * time.Second},
+		RateLimit: RateLimitConfig{DefaultTier: "default"},
+		Reconcile: ReconcileConfig{
+			Interval:  time.Hour,
+			ChunkSize: 500,
+		},
+		Snapshot: SnapshotConfig{
+			Interval:  24 * time.Hour,
+			ChunkSize: 500,
+		},
+		Scheduler: SchedulerConfig{
+			Interval:     10 * time.Second,
+			BatchSize:    100,
+			Lease:        time.Minute,
+			Retries:      3,
+			RetryBackoff: time.Hour,
+		},
+		Interest: InterestConfig{
+			Interval:  time.Hour,
+			ChunkSize: 500,
+			Lag:       5 * time.Minute,
+		},
+		Overdraft: OverdraftConfig{
+			FeeInterval: time.Hour,
+			ChunkSize:   500,
+			FeeLag:      5 * time.Minute,
+		},
+		Export: ExportConfig{
+			S3:          S3Config{Region: "us-east-1"},
+			RowsPerFile: 100000,
+			Lag:         time.Minute,
+		},
+		Health: HealthConfig{
+			ReadinessTimeout: 2 * time.Second,
+			DrainDelay:       5 * time.Second,
+		},
+		Log: LogConfig{Level: "info"},
+	}
+}
+
+// setting binds an environment variable and the flag of the same name to a field.
+type setting struct {
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// flagName derives the flag from the environment variable, DB_MAX_OPEN_CONNS becomes -db-max-open-conns.
+func (s setting) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(s.env, "_", "-"))
+}
+
+var settings = []setting{
+	{"HTTP_PORT", "HTTP listen port", intField(func(c *Config) *int { return &c.Server.Port })},
+	{"HTTP_ADMIN_ADDR", "listen address of the operator routes, such as 127.0.0.1:9090; empty leaves them unserved", stringField(func(c *Config) *string { return &c.Server.AdminAddr })},
+	{"HTTP_READ_HEADER_TIMEOUT", "time to read the request headers", durationField(func(c *Config) *time.Duration { return &c.Server.ReadHeaderTimeout })},
+	{"HTTP_READ_TIMEOUT", "time to read the whole request", durationField(func(c *Config) *time.Duration { return &c.Server.ReadTimeout })},
+	{"HTTP_WRITE_TIMEOUT", "time to write the response, counted from the end of the request headers", durationField(func(c *Config) *time.Duration { return &c.Server.WriteTimeout })},
+	{"HTTP_IDLE_TIMEOUT", "time a keep-alive connection waits for the next request", durationField(func(c *Config) *time.Duration { return &c.Server.IdleTimeout })},
+	{"HTTP_MAX_BODY_BYTES", "maximum size of a request body", intField(func(c *Config) *int { return &c.Server.MaxBodyBytes })},
+	{"SHUTDOWN_TIMEOUT", "time in-flight requests get to complete on shutdown", durationField(func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout })},
+	{"TLS_CERT_FILE", "TLS certificate file, enables HTTPS", stringField(func(c *Config) *string { return &c.TLS.CertFile })},
+	{"TLS_KEY_FILE", "TLS private key file", stringField(func(c *Config) *string { return &c.TLS.KeyFile })},
+	{"TLS_CLIENT_CA_FILE", "CA bundle of client certificates, enables mutual TLS", stringField(func(c *Config) *string { return &c.TLS.ClientCAFile })},
+	{"TLS_CLIENT_TENANTS", "semicolon-separated subject=tenant pairs", mapField(func(c *Config) *map[string]string { return &c.TLS.ClientTenants })},
+	{"STORAGE", "storage backend: postgres, sqlite or memory", stringField(func(c *Config) *string { return &c.Storage })},
+
+	{"DB_URL", "PostgreSQL DSN, composed from the DB_* settings when empty", stringField(func(c *Config) *string { return &c.Database.URL })},
+	{"DB_HOST", "PostgreSQL host", stringField(func(c *Config) *string { return &c.Database.Host })},
+	{"DB_PORT", "PostgreSQL port", intField(func(c *Config) *int { return &c.Database.Port })},
+	{"DB_NAME", "PostgreSQL database name", stringField(func(c *Config) *string { return &c.Database.Name })},
+	{"DB_USER", "PostgreSQL user", stringField(func(c *Config) *string { return &c.Database.User })},
+	{"DB_PASSWORD", "PostgreSQL password", stringField(func(c *Config) *string { return &c.Database.Password })},
+	{"DB_SSLMODE", "PostgreSQL sslmode", stringField(func(c *Config) *string { return &c.Database.SSLMode })},
+	{"DB_MAX_OPEN_CONNS", "maximum open connections per pool", intField(func(c *Config) *int { return &c.Database.MaxOpenConns })},
+	{"DB_MAX_IDLE_CONNS", "maximum idle connections per pool", intField(func(c *Config) *int { return &c.Database.MaxIdleConns })},
+	{"DB_CONN_MAX_LIFETIME", "maximum lifetime of a connection", durationField(func(c *Config) *time.Duration { return &c.Database.ConnMaxLifetime })},
+	{"DB_REPLICA_URLS", "comma-separated read replica DSNs", listField(func(c *Config) *[]string { return &c.Database.ReplicaURLs })},
+	{"DB_REPLICA_MAX_LAG", "replication lag above which a replica is skipped", durationField(func(c *Config) *time.Duration { return &c.Database.ReplicaMaxLag })},
+	{"DB_REPLICA_CHECK_INTERVAL", "interval between replica health checks", durationField(func(c *Config) *time.Duration { return &c.Database.ReplicaCheckInterval })},
+
+	{"SQLITE_PATH", "SQLite database file", stringField(func(c *Config) *string { return &c.SQLite.Path })},
+
+	{"WORKERS", "number of shard workers processing transactions", intField(func(c *Config) *int { return &c.Service.Workers })},
+	{"QUEUE_SIZE", "capacity of each shard queue", intField(func(c *Config) *int { return &c.Service.QueueSize })},
+	{"QUEUE_DRAIN_TIMEOUT", "time the shard queues get to drain on shutdown", durationField(func(c *Config) *time.Duration { return &c.Service.QueueDrainTimeout })},
+
+	{"BALANCE_CACHE_SIZE", "number of cached balances, 0 disables the cache", intField(func(c *Config) *int { return &c.Cache.Size })},
+	{"BALANCE_CACHE_TTL", "maximum age of a cached balance", durationField(func(c *Config) *time.Duration { return &c.Cache.TTL })},
+
+	{"RATE_LIMIT_CLIENT", "requests per second and burst of each client on each route, as rate:burst", rateLimitField(func(t *TierConfig) *RateLimit { return &t.Client })},
+	{"RATE_LIMIT_WALLET", "transactions per second and burst of each wallet, as rate:burst", rateLimitField(func(t *TierConfig) *RateLimit { return &t.Wallet })},
+	{"RATE_LIMIT_TENANT_TIERS", "semicolon-separated tenant=tier pairs", mapField(func(c *Config) *map[string]string { return &c.RateLimit.TenantTiers })},
+	{"RATE_LIMIT_API_KEYS", "comma-separated API keys identifying clients, unknown keys are limited by IP address", listField(func(c *Config) *[]string { return &c.RateLimit.APIKeys })},
+
+	{"RECONCILE_INTERVAL", "interval between balance reconciliation runs, 0 disables them", durationField(func(c *Config) *time.Duration { return &c.Reconcile.Interval })},
+	{"RECONCILE_CHUNK_SIZE", "number of wallets compared with their ledger per query", intField(func(c *Config) *int { return &c.Reconcile.ChunkSize })},
+	{"RECONCILE_FREEZE", "freeze the wallets whose balance drifted from their ledger", boolField(func(c *Config) *bool { return &c.Reconcile.Freeze })},
+	{"SNAPSHOT_INTERVAL", "interval between balance snapshots, 0 disables them", durationField(func(c *Config) *time.Duration { return &c.Snapshot.Interval })},
+	{"SNAPSHOT_CHUNK_SIZE", "number of wallets snapshotted per query", intField(func(c *Config) *int { return &c.Snapshot.ChunkSize })},
+	{"SCHEDULER_INTERVAL", "interval between runs of the due scheduled transactions, 0 disables them in this instance", durationField(func(c *Config) *time.Duration { return &c.Scheduler.Interval })},
+	{"SCHEDULER_BATCH_SIZE", "number of due schedules claimed at a time", intField(func(c *Config) *int { return &c.Scheduler.BatchSize })},
+	{"SCHEDULER_LEASE", "time a claimed schedule is kept from the other instances", durationField(func(c *Config) *time.Duration { return &c.Scheduler.Lease })},
+	{"SCHEDULER_RETRIES", "retries of a scheduled transaction rejected for insufficient funds", intField(func(c *Config) *int { return &c.Scheduler.Retries })},
+	{"SCHEDULER_RETRY_BACKOFF", "time between the retries of a scheduled transaction", durationField(func(c *Config) *time.Duration { return &c.Scheduler.RetryBackoff })},
+	{"INTEREST_INTERVAL", "interval between interest accrual runs, 0 disables them in this instance", durationField(func(c *Config) *time.Duration { return &c.Interest.Interval })},
+	{"INTEREST_CHUNK_SIZE", "number of wallets read per query by the interest accrual", intField(func(c *Config) *int { return &c.Interest.ChunkSize })},
+	{"INTEREST_LAG", "time after the end of a UTC day before its interest is accrued", durationField(func(c *Config) *time.Duration { return &c.Interest.Lag })},
+	{"OVERDRAFT_FEE_INTERVAL", "interval between overdraft fee runs, 0 disables them in this instance", durationField(func(c *Config) *time.Duration { return &c.Overdraft.FeeInterval })},
+	{"OVERDRAFT_CHUNK_SIZE", "number of wallets read per query by the overdraft fee runs", intField(func(c *Config) *int { return &c.Overdraft.ChunkSize })},
+	{"OVERDRAFT_FEE_LAG", "time after the end of a UTC day before its overdraft fee is charged", durationField(func(c *Config) *time.Duration { return &c.Overdraft.FeeLag })},
+
+	{"EXPORT_DIR", "directory receiving the ledger export", stringField(func(c *Config) *string { return &c.Export.Dir })},
+	{"EXPORT_S3_ENDPOINT", "URL of the S3-compatible storage receiving the ledger export", stringField(func(c *Config) *string { return &c.Export.S3.Endpoint })},
+	{"EXPORT_S3_REGION", "region the export requests are signed for", stringField(func(c *Config) *string { return &c.Export.S3.Region })},
+	{"EXPORT_S3_BUCKET", "bucket receiving the ledger export", stringField(func(c *Config) *string { return &c.Export.S3.Bucket })},
+	{"EXPORT_S3_PREFIX", "prefix of the exported object keys", stringField(func(c *Config) *string { return &c.Export.S3.Prefix })},
+	{"EXPORT_S3_ACCESS_KEY", "access key of the export bucket", stringField(func(c *Config) *string { return &c.Export.S3.AccessKey })},
+	{"EXPORT_S3_SECRET_KEY", "secret key of the export bucket", stringField(func(c *Config) *string { return &c.Export.S3.SecretKey })},
+	{"EXPORT_ROWS_PER_FILE", "maximum number of ledger entries per export file", intField(func(c *Config) *int { return &c.Export.RowsPerFile })},
+	{"EXPORT_LAG", "age below which ledger entries are left to the next export", durationField(func(c *Config) *time.Duration { return &c.Export.Lag })},
+
+	{"READINESS_TIMEOUT", "time budget of the readiness checks", durationField(func(c *Config) *time.Duration { return &c.Health.ReadinessTimeout })},
+	{"READINESS_DRAIN_DELAY", "time between failing readiness and closing the listener", durationField(func(c *Config) *time.Duration { return &c.Health.DrainDelay })},
+
+	{"LOG_LEVEL", "log level: debug, info, warn or error", stringField(func(c *Config) *string { return &c.Log.Level })},
+
+	{"TRACING_EXPORTER", "trace exporter: otlp or stdout, empty disables tracing", stringField(func(c *Config) *string { return &c.Tracing.Exporter })},
+	{"TRACING_OTLP_ENDPOINT", "OTLP/HTTP collector URL", stringField(func(c *Config) *string { return &c.Tracing.Endpoint })},
+	{"TRACING_FILE", "file receiving the spans of the stdout exporter", stringField(func(c *Config) *string { return &c.Tracing.File })},
+}
+
+func stringField(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intField(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not a valid integer: %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolField(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a valid boolean: %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationField(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a valid duration: %q", value)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func listField(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+}
+
+// mapField parses "key=value;key=value". Keys are certificate subjects that
+// contain '=' themselves, so each pair is split on its last '='.
+func mapField(field func(*Config) *map[string]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ";") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			i := strings.LastIndex(pair, "=")
+			if i <= 0 || i == len(pair)-1 {
+				return fmt.Errorf("not a key=value pair: %q", pair)
+			}
+			m[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		}
+		*field(c) = m
+		return nil
+	}
+}
+
+// rateLimitField parses "rate:burst" into a limit of the default tier.
+func rateLimitField(field func(*TierConfig) *RateLimit) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		rateValue, burstValue, ok := strings.Cut(value, ":")
+		rate, rateErr := strconv.ParseFloat(rateValue, 64)
+		burst, burstErr := strconv.Atoi(burstValue)
+		if !ok || rateErr != nil || burstErr != nil {
+			return fmt.Errorf("not a rate:burst pair: %q", value)
+		}
+
+		if c.RateLimit.Tiers == nil {
+			c.RateLimit.Tiers = make(map[string]TierConfig)
+		}
+		tier := c.RateLimit.Tiers[c.RateLimit.DefaultTier]
+		*field(&tier) = RateLimit{Rate: rate, Burst: burst}
+		c.RateLimit.Tiers[c.RateLimit.DefaultTier] = tier
+		return nil
+	}
+}
+
+// Options are the command line options that are not configuration settings.
+type Options struct {
+	// PrintConfig asks to print the effective configuration and exit
+	PrintConfig bool
+}
+
+// Load builds the configuration from the defaults, the YAML file given by -config
+// or CONFIG_FILE, the environment and the command line arguments, each overriding
+// the previous ones, and validates it. Empty environment variables count as unset.
+func Load(args []string, getenv func(string) string) (Config, Options, error) {
+	var opts Options
+	var configFile string
+	flagValues := make(map[string]string)
+
+	fs := flag.NewFlagSet("wallet-api", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", getenv("CONFIG_FILE"), "YAML configuration file (env CONFIG_FILE)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	for _, s := range settings {
+		name := s.flagName()
+		fs.Func(name, s.usage+" (env "+s.env+")", func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, err
+	}
+
+	cfg := Default()
+	if configFile != "" {
+		if err := loadFile(&cfg, configFile); err != nil {
+			return Config{}, opts, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	// Flags are applied after the environment, whatever order they were parsed in
+	for _, s := range settings {
+		if value, ok := flagValues[s.flagName()]; ok {
+			if err := s.set(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", s.flagName(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return Config{}, opts, errors.Join(errs...)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, opts, err
+	}
+	return cfg, opts, nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// A misspelled key would otherwise be silently ignored
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server port %d is out of range", c.Server.Port)
+	if c.Server.AdminAddr != "" {
+		_, port, err := net.SplitHostPort(c.Server.AdminAddr)
+		check(err == nil && port != "", "admin address %q must be host:port", c.Server.AdminAddr)
+	}
+	check(c.Server.ReadHeaderTimeout > 0, "read header timeout must be positive")
+	check(c.Server.ReadTimeout > 0, "read timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "write timeout must be positive")
+	check(c.Server.IdleTimeout > 0, "idle timeout must be positive")
+	check(c.Server.MaxBodyBytes > 0, "max body bytes must be positive")
+	check(c.Server.ShutdownTimeout > 0, "shutdown timeout must be positive")
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls cert file and key file must be set together")
+	check(c.TLS.ClientCAFile == "" || c.TLS.CertFile != "", "tls client ca file requires a tls cert file")
+	check(len(c.TLS.ClientTenants) == 0 || c.TLS.ClientCAFile != "", "tls client tenants require a tls client ca file")
+	check(c.TLS.ClientCAFile == "" || len(c.TLS.ClientTenants) > 0, "tls client tenants are required with a tls client ca file")
+
+	switch c.Storage {
+	case "postgres":
+		if c.Database.URL == "" {
+			check(c.Database.Host != "", "database host or url is required for postgres storage")
+			check(c.Database.Name != "", "database name or url is required for postgres storage")
+			check(c.Database.User != "", "database user or url is required for postgres storage")
+			check(c.Database.Port > 0 && c.Database.Port <= 65535, "database port %d is out of range", c.Database.Port)
+		}
+		check(c.Database.MaxOpenConns > 0, "database max open connections must be positive")
+		check(c.Database.MaxIdleConns >= 0 && c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+			"database max idle connections must be between 0 and max open connections")
+		check(c.Database.ConnMaxLifetime >= 0, "database connection max lifetime must not be negative")
+		if len(c.Database.ReplicaURLs) > 0 {
+			check(c.Database.ReplicaMaxLag > 0, "replica max lag must be positive")
+			check(c.Database.ReplicaCheckInterval > 0, "replica check interval must be positive")
+		}
+	case "sqlite":
+		check(c.SQLite.Path != "", "sqlite path is required for sqlite storage")
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage %q, expected postgres, sqlite or memory", c.Storage))
+	}
+
+	check(c.Service.Workers > 0, "workers must be positive")
+	check(c.Service.QueueSize > 0, "queue size must be positive")
+	check(c.Service.QueueDrainTimeout > 0, "queue drain timeout must be positive")
+
+	check(c.Cache.Size >= 0, "balance cache size must not be negative")
+	check(c.Cache.Size == 0 || c.Cache.TTL > 0, "balance cache ttl must be positive")
+
+	if len(c.RateLimit.Tiers) > 0 {
+		_, ok := c.RateLimit.Tiers[c.RateLimit.DefaultTier]
+		check(ok, "rate limit default tier %q is not defined", c.RateLimit.DefaultTier)
+	}
+	for tenant, tier := range c.RateLimit.TenantTiers {
+		_, ok := c.RateLimit.Tiers[tier]
+		check(ok, "rate limit tier %q of tenant %q is not defined", tier, tenant)
+	}
+	for name, tier := range c.RateLimit.Tiers {
+		limits := map[string]RateLimit{"client": tier.Client, "wallet": tier.Wallet}
+		for route, limit := range tier.Routes {
+			limits["route "+route] = limit
+		}
+		for scope, limit := range limits {
+			check(limit.Rate >= 0 && (limit.Rate == 0 || limit.Burst >= 1),
+				"rate limit %s of tier %q needs a non-negative rate and a burst of at least 1", scope, name)
+		}
+	}
+
+	check(c.Reconcile.Interval >= 0, "reconcile interval must not be negative")
+	check(c.Reconcile.ChunkSize > 0, "reconcile chunk size must be positive")
+	check(c.Snapshot.Interval >= 0, "snapshot interval must not be negative")
+	check(c.Snapshot.ChunkSize > 0, "snapshot chunk size must be positive")
+	check(c.Scheduler.Interval >= 0, "scheduler interval must not be negative")
+	check(c.Scheduler.BatchSize > 0, "scheduler batch size must be positive")
+	check(c.Scheduler.Lease > 0, "scheduler lease must be positive")
+	check(c.Scheduler.Retries >= 0, "scheduler retries must not be negative")
+	check(c.Scheduler.RetryBackoff > 0, "scheduler retry backoff must be positive")
+	check(c.Interest.Interval >= 0, "interest interval must not be negative")
+	check(c.Interest.ChunkSize > 0, "interest chunk size must be positive")
+	check(c.Interest.Lag >= 0, "interest lag must not be negative")
+	check(c.Overdraft.FeeInterval >= 0, "overdraft fee interval must not be negative")
+	check(c.Overdraft.ChunkSize > 0, "overdraft chunk size must be positive")
+	check(c.Overdraft.FeeLag >= 0, "overdraft fee lag must not be negative")
+
+	check(c.Export.Dir == "" || c.Export.S3.Bucket == "", "export dir and s3 bucket are mutually exclusive")
+	if c.Export.S3.Bucket != "" {
+		check(c.Export.S3.Endpoint != "", "export s3 endpoint is required with a bucket")
+		check(c.Export.S3.Region != "", "export s3 region is required with a bucket")
+		check(c.Export.S3.AccessKey != "" && c.Export.S3.SecretKey != "", "export s3 access key and secret key are required with a bucket")
+	}
+	check(c.Export.RowsPerFile > 0, "export rows per file must be positive")
+	// Entries get their ID before they commit, the lag lets the lower IDs commit first
+	check(c.Export.Lag > 0, "export lag must be positive")
+
+	check(c.Health.ReadinessTimeout > 0, "readiness timeout must be positive")
+	check(c.Health.DrainDelay >= 0, "readiness drain delay must not be negative")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "invalid log level %q", c.Log.Level)
+
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		errs = append(errs, fmt.Errorf("unknown trace exporter %q, expected otlp or stdout", c.Tracing.Exporter))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// LogLevel returns the parsed log level, the configuration must be valid.
+func (c Config) LogLevel() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Log.Level))
+	return level
+}
+
+// DSN returns the PostgreSQL connection string, composed from the separate
+// fields unless URL is set.
+func (d DatabaseConfig) DSN() string {
+	if d.URL != "" {
+		return d.URL
+	}
+
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(d.User, d.Password),
+		Host:   net.JoinHostPort(d.Host, strconv.Itoa(d.Port)),
+		Path:   "/" + d.Name,
+	}
+	if d.Password == "" {
+		u.User = url.User(d.User)
+	}
+	if d.SSLMode != "" {
+		u.RawQuery = url.Values{"sslmode": {d.SSLMode}}.Encode()
+	}
+	return u.String()
+}
+
+// Redacted returns a copy of the configuration safe to print, with passwords
+// removed from the password field and from every DSN, and API keys removed.
+func (c Config) Redacted() Config {
+	if c.Database.Password != "" {
+		c.Database.Password = redacted
+	}
+	c.Database.URL = redactDSN(c.Database.URL)
+	replicas := make([]string, len(c.Database.ReplicaURLs))
+	for i, replicaURL := range c.Database.ReplicaURLs {
+		replicas[i] = redactDSN(replicaURL)
+	}
+	c.Database.ReplicaURLs = replicas
+	if c.Export.S3.SecretKey != "" {
+		c.Export.S3.SecretKey = redacted
+	}
+	apiKeys := make([]string, len(c.RateLimit.APIKeys))
+	for i := range apiKeys {
+		apiKeys[i] = redacted
+	}
+	c.RateLimit.APIKeys = apiKeys
+	return c
+}
+
+// String renders the redacted configuration as YAML.
+func (c Config) String() string {
+	var out strings.Builder
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err.Error()
+	}
+	return out.String()
+}
+
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		// Not a URL, possibly a key=value DSN that may hold a password
+		return redacted
+	}
+	// Passwords can also be passed as a query parameter
+	query := u.Query()
+	if query.Has("password") {
+		query.Set("password", redacted)
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,370 @@
+// Package export writes the ledger in bulk for the data warehouse, as gzipped
+// NDJSON files of ledger entries in ID order. Every run starts after the
+// watermark of the previous one and ends with a manifest listing its files with
+// their row counts and checksums.
+//
+// Files are written before the manifest, and latest.json is written last: a run
+// that fails leaves no manifest, the next one starts from the same watermark
+// and overwrites its files, which are named after the entries they hold.
+//
+// Runs hold the export lease of the repository, so one runs at a time across
+// the instances and walletctl, and a run only moves latest.json forward from
+// the watermark it started from.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ManifestVersion changes when the manifest or the rows change incompatibly
+	ManifestVersion = 1
+
+	// LatestManifest is the name of the copy of the last manifest
+	LatestManifest = "manifests/latest.json"
+
+	DefaultRowsPerFile = 100000
+	DefaultLag         = time.Minute
+	// DefaultLease is the time a run gets to write each file before its lease ends
+	DefaultLease = 10 * time.Minute
+)
+
+var (
+	// ErrRunning is returned when another run holds the export lease.
+	ErrRunning = errors.New("another export is running")
+	// ErrWatermarkMoved is returned when the latest manifest changed during
+	// the run, whose manifest would then move the watermark back.
+	ErrWatermarkMoved = errors.New("the latest manifest changed during the export")
+)
+
+// Manifest describes an export run.
+type Manifest struct {
+	Version int `json:"version"`
+	// FromID is the watermark the run started after
+	FromID int64 `json:"fromId"`
+	// ToID is the last exported entry, the watermark of the next run
+	ToID int64 `json:"toId"`
+	// Before is the creation time after which entries were left to the next run
+	Before     time.Time `json:"before"`
+	Rows       int64     `json:"rows"`
+	Files      []File    `json:"files"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Name is the name the manifest is stored under.
+func (m Manifest) Name() string {
+	return fmt.Sprintf("manifests/%020d-%020d.json", m.FromID, m.ToID)
+}
+
+// File is a gzipped NDJSON file of ledger entries, one JSON object per line.
+type File struct {
+	Name    string `json:"name"`
+	Rows    int64  `json:"rows"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+	FirstID int64  `json:"firstId"`
+	LastID  int64  `json:"lastId"`
+}
+
+// Exporter writes the ledger entries created since the last run to a sink.
+type Exporter struct {
+	repo        repository.LedgerExporter
+	sink        Sink
+	rowsPerFile int
+	lag         time.Duration
+	lease       time.Duration
+}
+
+// Option configures optional Exporter settings
+type Option func(*Exporter)
+
+// WithRowsPerFile bounds the number of entries per file, a file is built in memory
+func WithRowsPerFile(n int) Option {
+	return func(e *Exporter) {
+		e.rowsPerFile = n
+	}
+}
+
+// WithLag leaves the entries younger than lag to the next run. It must exceed
+// the duration of a transaction, whose entry may commit after entries with
+// higher IDs, and the lag of the read replicas.
+func WithLag(lag time.Duration) Option {
+	return func(e *Exporter) {
+		e.lag = lag
+	}
+}
+
+// WithLease sets the time a run gets to write each file, the lease is extended
+// before every write. A run that outlives it fails with ErrRunning.
+func WithLease(lease time.Duration) Option {
+	return func(e *Exporter) {
+		e.lease = lease
+	}
+}
+
+func NewExporter(repo repository.LedgerExporter, sink Sink, opts ...Option) *Exporter {
+	e := &Exporter{repo: repo, sink: sink, rowsPerFile: DefaultRowsPerFile, lag: DefaultLag, lease: DefaultLease}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Run exports the entries after the watermark of the latest manifest, or the
+// whole ledger if there is none.
+func (e *Exporter) Run(ctx context.Context) (Manifest, error) {
+	return e.start(ctx, func(latest Manifest) int64 { return latest.ToID })
+}
+
+// RunFrom exports the entries whose ID is above afterID.
+func (e *Exporter) RunFrom(ctx context.Context, afterID int64) (Manifest, error) {
+	return e.start(ctx, func(Manifest) int64 { return afterID })
+}
+
+// start runs an export from the watermark from picks given the latest manifest.
+func (e *Exporter) start(ctx context.Context, from func(latest Manifest) int64) (Manifest, error) {
+	m, err := e.leased(ctx, from)
+	metrics.ObserveExport(m.Rows, m.ToID, err)
+	return m, err
+}
+
+func (e *Exporter) leased(ctx context.Context, from func(latest Manifest) int64) (Manifest, error) {
+	owner := uuid.NewString()
+	if err := e.extend(ctx, owner); err != nil {
+		return Manifest{}, err
+	}
+	// A canceled run still releases its lease, which would otherwise hold off the next one
+	defer e.repo.ReleaseExport(context.WithoutCancel(ctx), owner)
+
+	// Read under the lease, so no other run moves it before this one ends
+	latest, err := ReadLatest(ctx, e.sink)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Manifest{}, err
+	}
+	return e.run(ctx, owner, latest.ToID, from(latest))
+}
+
+// extend takes or extends the export lease of owner.
+func (e *Exporter) extend(ctx context.Context, owner string) error {
+	ok, err := e.repo.LeaseExport(ctx, owner, time.Now(), e.lease)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRunning
+	}
+	return nil
+}
+
+// run exports the entries above afterID. watermark is the ToID of the latest
+// manifest when the run started, which it must still be for the run to replace it.
+func (e *Exporter) run(ctx context.Context, owner string, watermark, afterID int64) (Manifest, error) {
+	start := time.Now().UTC()
+	m := Manifest{
+		Version:   ManifestVersion,
+		FromID:    afterID,
+		ToID:      afterID,
+		Before:    start.Add(-e.lag),
+		Files:     []File{},
+		StartedAt: start,
+	}
+
+	var part *part
+	err := e.repo.StreamLedger(ctx, afterID, m.Before, func(entry model.LedgerEntry) error {
+		if part == nil {
+			part = newPart()
+		}
+		if err := part.add(entry); err != nil {
+			return err
+		}
+		if part.rows < int64(e.rowsPerFile) {
+			return nil
+		}
+		err := e.flush(ctx, owner, &m, part)
+		part = nil
+		return err
+	})
+	if err != nil {
+		return m, err
+	}
+	if part != nil {
+		if err := e.flush(ctx, owner, &m, part); err != nil {
+			return m, err
+		}
+	}
+
+	// The lease is meant to keep other runs away, but one that outlived its
+	// lease, or a sink shared by another database, may still have moved it
+	if err := e.extend(ctx, owner); err != nil {
+		return m, err
+	}
+	latest, err := ReadLatest(ctx, e.sink)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return m, err
+	}
+	if latest.ToID != watermark || m.ToID < latest.ToID {
+		return m, fmt.Errorf("%w: its watermark is %d, the run started at %d and exported up to %d", ErrWatermarkMoved, latest.ToID, watermark, m.ToID)
+	}
+
+	m.FinishedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	if err := e.sink.Put(ctx, m.Name(), data); err != nil {
+		return m, err
+	}
+	return m, e.sink.Put(ctx, LatestManifest, data)
+}
+
+func (e *Exporter) flush(ctx context.Context, owner string, m *Manifest, p *part) error {
+	f, data, err := p.close()
+	if err != nil {
+		return err
+	}
+	if err := e.extend(ctx, owner); err != nil {
+		return err
+	}
+	if err := e.sink.Put(ctx, f.Name, data); err != nil {
+		return err
+	}
+	m.Files = append(m.Files, f)
+	m.Rows += f.Rows
+	m.ToID = f.LastID
+	return nil
+}
+
+// part is a file being built.
+type part struct {
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	rows    int64
+	firstID int64
+	lastID  int64
+}
+
+func newPart() *part {
+	p := &part{}
+	p.gz = gzip.NewWriter(&p.buf)
+	p.enc = json.NewEncoder(p.gz)
+	return p
+}
+
+func (p *part) add(e model.LedgerEntry) error {
+	if p.rows == 0 {
+		p.firstID = e.ID
+	}
+	p.rows++
+	p.lastID = e.ID
+	return p.enc.Encode(e)
+}
+
+func (p *part) close() (File, []byte, error) {
+	if err := p.gz.Close(); err != nil {
+		return File{}, nil, err
+	}
+	data := p.buf.Bytes()
+	sum := sha256.Sum256(data)
+	return File{
+		Name:    fmt.Sprintf("ledger/%020d-%020d.ndjson.gz", p.firstID, p.lastID),
+		Rows:    p.rows,
+		Bytes:   int64(len(data)),
+		SHA256:  hex.EncodeToString(sum[:]),
+		FirstID: p.firstID,
+		LastID:  p.lastID,
+	}, data, nil
+}
+
+// ReadLatest returns the manifest of the last run, an error wrapping
+// fs.ErrNotExist if nothing was exported yet.
+func ReadLatest(ctx context.Context, sink Sink) (Manifest, error) {
+	return ReadManifest(ctx, sink, LatestManifest)
+}
+
+func ReadManifest(ctx context.Context, sink Sink, name string) (Manifest, error) {
+	data, err := sink.Get(ctx, name)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("invalid manifest %s: %w", name, err)
+	}
+	if m.Version != ManifestVersion {
+		return Manifest{}, fmt.Errorf("manifest %s has version %d, expected %d", name, m.Version, ManifestVersion)
+	}
+	return m, nil
+}
+
+// ErrCorrupt is returned by Verify when a file does not match the manifest.
+var ErrCorrupt = errors.New("export file does not match its manifest")
+
+// Verify reads back every file of the manifest and checks its size, checksum
+// and rows, which must be valid entries in ID order within the file's range.
+func Verify(ctx context.Context, sink Sink, m Manifest) error {
+	for _, f := range m.Files {
+		data, err := sink.Get(ctx, f.Name)
+		if err != nil {
+			return err
+		}
+		if err := verifyFile(f, data); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorrupt, f.Name, err)
+		}
+	}
+	return nil
+}
+
+func verifyFile(f File, data []byte) error {
+	if int64(len(data)) != f.Bytes {
+		return fmt.Errorf("%d bytes, expected %d", len(data), f.Bytes)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != f.SHA256 {
+		return errors.New("checksum mismatch")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var rows int64
+	lastID := f.FirstID - 1
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e model.LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("row %d: %w", rows+1, err)
+		}
+		if e.ID <= lastID || e.ID > f.LastID {
+			return fmt.Errorf("row %d: entry %d out of order", rows+1, e.ID)
+		}
+		lastID = e.ID
+		rows++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if rows != f.Rows {
+		return fmt.Errorf("%d rows, expected %d", rows, f.Rows)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package export_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/export"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+)
+
+// newLedger returns a repository with n deposits of 1 to 3 wallets.
+func newLedger(t *testing.T, n int) *repository.MemoryRepository {
+	t.Helper()
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	walletIDs := make([]string, 3)
+	for i := range walletIDs {
+		var err error
+		walletIDs[i], err = repo.CreateWallet(ctx)
+		require.NoError(t, err)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, repo.ProcessTransaction(ctx, walletIDs[i%3], 1, true))
+	}
+	return repo
+}
+
+func readRows(t *testing.T, path string) []model.LedgerEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	var entries []model.LedgerEntry
+	dec := json.NewDecoder(gz)
+	for {
+		var e model.LedgerEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries
+		} else {
+			require.NoError(t, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestExporter_Run(t *testing.T) {
+	ctx := context.Background()
+	repo := newLedger(t, 7)
+	dir := t.TempDir()
+	sink := export.NewDirSink(dir)
+	exporter := export.NewExporter(repo, sink, export.WithRowsPerFile(3), export.WithLag(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	m, err := exporter.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), m.FromID)
+	assert.Equal(t, int64(7), m.ToID)
+	assert.Equal(t, int64(7), m.Rows)
+	require.Len(t, m.Files, 3)
+	assert.Equal(t, "ledger/00000000000000000001-00000000000000000003.ndjson.gz", m.Files[0].Name)
+	assert.Equal(t, []int64{3, 3, 1}, []int64{m.Files[0].Rows, m.Files[1].Rows, m.Files[2].Rows})
+	require.NoError(t, export.Verify(ctx, sink, m))
+
+	entries := readRows(t, filepath.Join(dir, "ledger", "00000000000000000004-00000000000000000006.ndjson.gz"))
+	require.Len(t, entries, 3)
+	assert.Equal(t, int64(4), entries[0].ID)
+	assert.Equal(t, model.Deposit, entries[0].OperationType)
+
+	latest, err := export.ReadLatest(ctx, sink)
+	require.NoError(t, err)
+	assert.Equal(t, m.ToID, latest.ToID)
+	named, err := export.ReadManifest(ctx, sink, "manifests/00000000000000000000-00000000000000000007.json")
+	require.NoError(t, err)
+	assert.Equal(t, m.Files, named.Files)
+
+	// The next run resumes after the watermark
+	require.NoError(t, repo.ProcessTransaction(ctx, entries[0].WalletID, 2, false))
+	time.Sleep(time.Millisecond)
+	m, err = exporter.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), m.FromID)
+	assert.Equal(t, int64(8), m.ToID)
+	require.Len(t, m.Files, 1)
+	assert.Equal(t, int64(1), m.Files[0].Rows)
+
+	// Nothing new is still a run with a manifest
+	m, err = exporter.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), m.FromID)
+	assert.Equal(t, int64(8), m.ToID)
+	assert.Empty(t, m.Files)
+	_, err = os.Stat(filepath.Join(dir, "manifests", "00000000000000000008-00000000000000000008.json"))
+	assert.NoError(t, err)
+}
+
+func TestExporter_Lag(t *testing.T) {
+	ctx := context.Background()
+	sink := export.NewDirSink(t.TempDir())
+
+	m, err := export.NewExporter(newLedger(t, 4), sink, export.WithLag(time.Hour)).Run(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, m.Rows, "Entries younger than the lag are left to the next run")
+	assert.Zero(t, m.ToID)
+}
+
+func TestExporter_RunFrom(t *testing.T) {
+	ctx := context.Background()
+	sink := export.NewDirSink(t.TempDir())
+	exporter := export.NewExporter(newLedger(t, 5), sink, export.WithLag(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	m, err := exporter.RunFrom(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), m.Rows)
+	assert.Equal(t, int64(4), m.Files[0].FirstID)
+}
+
+func TestExporter_Lease(t *testing.T) {
+	ctx := context.Background()
+	repo := newLedger(t, 3)
+	dir := t.TempDir()
+	exporter := export.NewExporter(repo, export.NewDirSink(dir), export.WithLag(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	// Another instance, or walletctl, is exporting
+	ok, err := repo.LeaseExport(ctx, "other", time.Now(), time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = exporter.Run(ctx)
+	assert.ErrorIs(t, err, export.ErrRunning)
+	_, err = exporter.RunFrom(ctx, 0)
+	assert.ErrorIs(t, err, export.ErrRunning)
+	_, err = os.Stat(filepath.Join(dir, "ledger"))
+	assert.ErrorIs(t, err, fs.ErrNotExist, "A run without the lease writes nothing")
+
+	require.NoError(t, repo.ReleaseExport(ctx, "other"))
+	_, err = exporter.Run(ctx)
+	require.NoError(t, err)
+	_, err = exporter.Run(ctx)
+	require.NoError(t, err, "A run releases the lease when it ends")
+}
+
+// racingSink finishes another run, which exported further, when the first
+// ledger file of this one is written.
+type racingSink struct {
+	export.Sink
+	other export.Manifest
+	done  bool
+}
+
+func (s *racingSink) Put(ctx context.Context, name string, data []byte) error {
+	if !s.done && strings.HasPrefix(name, "ledger/") {
+		s.done = true
+		other, err := json.Marshal(s.other)
+		if err != nil {
+			return err
+		}
+		if err := s.Sink.Put(ctx, export.LatestManifest, other); err != nil {
+			return err
+		}
+	}
+	return s.Sink.Put(ctx, name, data)
+}
+
+func TestExporter_WatermarkMoved(t *testing.T) {
+	ctx := context.Background()
+	sink := &racingSink{
+		Sink:  export.NewDirSink(t.TempDir()),
+		other: export.Manifest{Version: export.ManifestVersion, FromID: 0, ToID: 5, Files: []export.File{}},
+	}
+	exporter := export.NewExporter(newLedger(t, 3), sink, export.WithLag(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	_, err := exporter.Run(ctx)
+	assert.ErrorIs(t, err, export.ErrWatermarkMoved)
+
+	latest, err := export.ReadLatest(ctx, sink)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), latest.ToID, "The watermark of the other run is kept")
+	_, err = export.ReadManifest(ctx, sink, "manifests/00000000000000000000-00000000000000000003.json")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "The run failed, it wrote no manifest")
+
+	// The next run starts where the other one stopped
+	m, err := exporter.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), m.FromID)
+}
+
+func TestVerify_Corrupt(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sink := export.NewDirSink(dir)
+	time.Sleep(time.Millisecond)
+	m, err := export.NewExporter(newLedger(t, 3), sink, export.WithLag(time.Nanosecond)).Run(ctx)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 1)
+
+	// Same size, different content
+	path := filepath.Join(dir, filepath.FromSlash(m.Files[0].Name))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte{0}, len(data)), 0o644))
+	assert.ErrorIs(t, export.Verify(ctx, sink, m), export.ErrCorrupt)
+
+	require.NoError(t, os.Remove(path))
+	assert.ErrorIs(t, export.Verify(ctx, sink, m), fs.ErrNotExist)
+}
+
+func TestReadLatest_NothingExported(t *testing.T) {
+	_, err := export.ReadLatest(context.Background(), export.NewDirSink(t.TempDir()))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,82 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"WalletApi/internal/config"
+)
+
+// Sink stores the files of the export. Names are slash-separated paths.
+type Sink interface {
+	// Put stores data under name, replacing what was stored there.
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns what is stored under name, an error wrapping fs.ErrNotExist if nothing is.
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// ErrDisabled is returned by OpenSink when no export target is configured.
+var ErrDisabled = errors.New("no export target is configured, set EXPORT_DIR or EXPORT_S3_BUCKET")
+
+// OpenSink returns the sink configured by cfg.
+func OpenSink(cfg config.ExportConfig) (Sink, error) {
+	switch {
+	case cfg.Dir != "":
+		return NewDirSink(cfg.Dir), nil
+	case cfg.S3.Bucket != "":
+		return NewS3Sink(cfg.S3)
+	default:
+		return nil, ErrDisabled
+	}
+}
+
+// DirSink stores the files in a local directory.
+type DirSink struct {
+	dir string
+}
+
+func NewDirSink(dir string) *DirSink {
+	return &DirSink{dir: dir}
+}
+
+// Put writes a temporary file then renames it, so readers never see a partial file.
+func (d *DirSink) Put(ctx context.Context, name string, data []byte) error {
+	path := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *DirSink) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(d.dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return data, err
+}
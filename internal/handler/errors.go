@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"WalletApi/internal/logging"
+	"WalletApi/internal/model"
+)
+
+// Codes of the errors found by the handlers themselves, the errors of the
+// model have their codes in the model package. Both are part of the API contract.
+const (
+	codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	codeBodyTooLarge         = "BODY_TOO_LARGE"
+	codeEmptyBody            = "EMPTY_BODY"
+	codeMalformedJSON        = "MALFORMED_JSON"
+	codeInvalidFieldType     = "INVALID_FIELD_TYPE"
+	codeUnknownField         = "UNKNOWN_FIELD"
+	codeDuplicateKey         = "DUPLICATE_KEY"
+	codeMultipleValues       = "MULTIPLE_VALUES"
+
+	codeInvalidWalletID    = "INVALID_WALLET_ID"
+	codeInvalidConsistency = "INVALID_CONSISTENCY"
+	codeInvalidTimestamp   = "INVALID_TIMESTAMP"
+	codeInvalidFormat      = "INVALID_FORMAT"
+	codeExportDisabled     = "EXPORT_DISABLED"
+	codeExportRunning      = "EXPORT_RUNNING"
+	codeRateLimited        = "RATE_LIMITED"
+	codeInternal           = "INTERNAL_ERROR"
+
+	codeClientCertRequired = "CLIENT_CERTIFICATE_REQUIRED"
+	codeTenantUnauthorized = "TENANT_NOT_AUTHORIZED"
+)
+
+// titles summarize each code, they do not change from one occurrence to the
+// next. A code without a title gets the text of its status.
+var titles = map[string]string{
+	model.CodeWalletNotFound:    "Wallet not found",
+	model.CodeInsufficientFunds: "Insufficient funds",
+	model.CodeInvalidAmount:     "Invalid amount",
+	model.CodeInvalidOperation:  "Invalid operation type",
+	model.CodeShuttingDown:      "Service is shutting down",
+	model.CodeWalletFrozen:      "Wallet is frozen",
+	model.CodeReasonRequired:    "Reason required",
+
+	model.CodeAdjustmentNotFound:   "Adjustment not found",
+	model.CodeAdjustmentNotPending: "Adjustment is not pending",
+	model.CodeAdjustmentExpired:    "Adjustment expired",
+	model.CodeSelfApproval:         "Self approval not allowed",
+	model.CodeInvalidReasonCode:    "Invalid reason code",
+
+	model.CodeScheduleNotFound:   "Schedule not found",
+	model.CodeInvalidSchedule:    "Invalid schedule",
+	model.CodeScheduleClosed:     "Schedule is closed",
+	model.CodeDuplicateReference: "Duplicate transaction reference",
+
+	model.CodeInterestProductNotFound: "Interest product not found",
+	model.CodeInvalidInterestProduct:  "Invalid interest product",
+	model.CodeInterestNotAssigned:     "Interest not assigned",
+
+	model.CodeInvalidOverdraft: "Invalid overdraft",
+
+	codeUnsupportedMediaType: "Unsupported media type",
+	codeBodyTooLarge:         "Request body too large",
+	codeEmptyBody:            "Empty request body",
+	codeMalformedJSON:        "Malformed JSON",
+	codeInvalidFieldType:     "Invalid field type",
+	codeUnknownField:         "Unknown field",
+	codeDuplicateKey:         "Duplicate key",
+	codeMultipleValues:       "Multiple JSON values",
+	codeInvalidWalletID:      "Invalid wallet ID",
+	codeInvalidConsistency:   "Invalid consistency",
+	codeInvalidTimestamp:     "Invalid timestamp",
+	codeInvalidFormat:        "Invalid format",
+	codeExportDisabled:       "Export disabled",
+	codeExportRunning:        "Export already running",
+	codeRateLimited:          "Rate limit exceeded",
+	codeInternal:             "Internal error",
+	codeClientCertRequired:   "Client certificate required",
+	codeTenantUnauthorized:   "Tenant not authorized",
+}
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// problemTypePrefix makes the problem type URI of a code
+const problemTypePrefix = "urn:wallet-api:problem:"
+
+// wantsProblem reports whether the error of r is sent as problem details: always
+// on /api/v2, and on /api/v1 when the client accepts application/problem+json.
+// Otherwise /api/v1 keeps its original error format.
+func wantsProblem(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == ProblemContentType {
+			return true
+		}
+	}
+	return false
+}
+
+func sendErrorResponse(w http.ResponseWriter, r *http.Request, code, message string, statusCode int) {
+	sendErrorResponseWith(w, r, code, message, statusCode, nil)
+}
+
+// sendErrorResponseWith sends the error with extension members, which only
+// the problem details format carries.
+func sendErrorResponseWith(w http.ResponseWriter, r *http.Request, code, message string, statusCode int, extensions map[string]any) {
+	// The request ID middleware has already put the ID on the response
+	requestID := w.Header().Get(logging.RequestIDHeader)
+
+	if !wantsProblem(r) {
+		body := map[string]interface{}{
+			"code":    statusCode,
+			"reason":  strings.ToLower(code),
+			"message": message,
+		}
+		if requestID != "" {
+			body["requestId"] = requestID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": body,
+		})
+		return
+	}
+
+	body := make(map[string]any, len(extensions)+7)
+	for name, value := range extensions {
+		body[name] = value
+	}
+	body["type"] = problemTypePrefix + code
+	title, ok := titles[code]
+	if !ok {
+		title = http.StatusText(statusCode)
+	}
+	body["title"] = title
+	body["status"] = statusCode
+	body["detail"] = message
+	body["instance"] = r.URL.Path
+	body["code"] = code
+	if requestID != "" {
+		body["requestId"] = requestID
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
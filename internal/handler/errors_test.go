@@ -0,0 +1,167 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"WalletApi/internal/handler"
+	"WalletApi/internal/logging"
+	"WalletApi/internal/model"
+)
+
+func TestWalletHandler_ProblemDetails(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	mockService.On("ProcessTransaction", mock.Anything, mock.Anything).
+		Return(&model.InsufficientFundsError{Available: 42})
+	walletHandler := handler.NewWalletHandler(mockService)
+
+	testCases := []struct {
+		name    string
+		version string
+		accept  string
+		problem bool
+	}{
+		{name: "v2", version: "v2", problem: true},
+		{name: "v1 accepting problem details", version: "v1", accept: "application/problem+json, application/json;q=0.9", problem: true},
+		{name: "v1", version: "v1", accept: "application/json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/api/" + tc.version + "/wallets/" + testUUID + "/transactions"
+			req := httptest.NewRequest("POST", path, strings.NewReader(`{"operationType": "WITHDRAW", "amount": 100}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set(logging.RequestIDHeader, "req-1")
+
+			walletHandler.HandleTransaction(w, req)
+
+			assert.Equal(t, http.StatusConflict, w.Code)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+
+			if !tc.problem {
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				assert.Equal(t, map[string]interface{}{
+					"code":      float64(http.StatusConflict),
+					"reason":    "insufficient_funds",
+					"message":   "Insufficient funds",
+					"requestId": "req-1",
+				}, body["error"])
+				return
+			}
+
+			assert.Equal(t, handler.ProblemContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, map[string]interface{}{
+				"type":      "urn:wallet-api:problem:INSUFFICIENT_FUNDS",
+				"title":     "Insufficient funds",
+				"status":    float64(http.StatusConflict),
+				"detail":    "Insufficient funds",
+				"instance":  path,
+				"code":      "INSUFFICIENT_FUNDS",
+				"requestId": "req-1",
+				"available": float64(42),
+			}, body)
+		})
+	}
+}
+
+func TestWalletHandler_ProblemDetailsCodes(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	walletHandler := handler.NewWalletHandler(mockService)
+
+	testCases := []struct {
+		name         string
+		serviceError error
+		body         string
+		expectedCode int
+		code         string
+	}{
+		{
+			name:         "Wallet not found",
+			serviceError: model.ErrWalletNotFound,
+			expectedCode: http.StatusNotFound,
+			code:         "WALLET_NOT_FOUND",
+		},
+		{
+			name:         "Insufficient funds without the balance",
+			serviceError: model.ErrInsufficientFunds,
+			expectedCode: http.StatusConflict,
+			code:         "INSUFFICIENT_FUNDS",
+		},
+		{
+			name:         "Wallet frozen",
+			serviceError: model.ErrWalletFrozen,
+			expectedCode: http.StatusConflict,
+			code:         "WALLET_FROZEN",
+		},
+		{
+			name:         "Duplicate reference",
+			serviceError: model.ErrDuplicateReference,
+			expectedCode: http.StatusConflict,
+			code:         "DUPLICATE_REFERENCE",
+		},
+		{
+			name:         "Shutting down",
+			serviceError: model.ErrShuttingDown,
+			expectedCode: http.StatusServiceUnavailable,
+			code:         "SHUTTING_DOWN",
+		},
+		{
+			name:         "Invalid operation",
+			body:         `{"operationType": "TRANSFER", "amount": 100}`,
+			expectedCode: http.StatusBadRequest,
+			code:         "INVALID_OPERATION",
+		},
+		{
+			name:         "Unknown field",
+			body:         `{"operationType": "DEPOSIT", "amount": 100, "memo": "x"}`,
+			expectedCode: http.StatusBadRequest,
+			code:         "UNKNOWN_FIELD",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService.ExpectedCalls = nil
+			mockService.On("ProcessTransaction", mock.Anything, mock.Anything).Return(tc.serviceError)
+
+			body := tc.body
+			if body == "" {
+				body = `{"operationType": "WITHDRAW", "amount": 100}`
+			}
+			req := httptest.NewRequest("POST", "/api/v2/wallets/"+testUUID+"/transactions", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			walletHandler.HandleTransaction(w, req)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			var problem map[string]interface{}
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&problem))
+			assert.Equal(t, tc.code, problem["code"])
+			assert.Equal(t, "urn:wallet-api:problem:"+tc.code, problem["type"])
+			assert.NotEmpty(t, problem["title"])
+			_, hasAvailable := problem["available"]
+			assert.False(t, hasAvailable)
+		})
+	}
+}
+
+func TestTitles_ModelCodes(t *testing.T) {
+	for _, code := range model.ErrorCodes() {
+		assert.NotEmpty(t, handler.Titles[code], "Code %s has no title", code)
+	}
+}
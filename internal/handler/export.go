@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"WalletApi/internal/export"
+	"WalletApi/internal/logging"
+)
+
+// ExportHandler starts ledger exports and reports on them. A run outlives the
+// request that started it, only one runs at a time in the instance.
+type ExportHandler struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	exporter *export.Exporter
+	sink     export.Sink
+
+	mu      sync.Mutex
+	running bool
+	lastErr string
+	wg      sync.WaitGroup
+}
+
+// NewExportHandler creates a handler running exports of sink. A nil exporter
+// means no export target is configured, the endpoints then answer 404.
+func NewExportHandler(exporter *export.Exporter, sink export.Sink) *ExportHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ExportHandler{ctx: ctx, cancel: cancel, exporter: exporter, sink: sink}
+}
+
+// Wait blocks until the running export, if any, is over.
+func (h *ExportHandler) Wait() {
+	h.wg.Wait()
+}
+
+// Shutdown cancels the running export and waits for it. The next run starts
+// over from the watermark it started from.
+func (h *ExportHandler) Shutdown() {
+	h.cancel()
+	h.wg.Wait()
+}
+
+// exportStatus is the body of both endpoints. Manifest is the one of the last
+// successful run, in this instance or another, missing until there is one.
+type exportStatus struct {
+	Running   bool             `json:"running"`
+	LastError string           `json:"lastError,omitempty"`
+	Manifest  *export.Manifest `json:"manifest,omitempty"`
+}
+
+// HandleStartExport starts an export from the watermark of the latest manifest
+// and answers 202 without waiting for it.
+func (h *ExportHandler) HandleStartExport(w http.ResponseWriter, r *http.Request) {
+	if h.exporter == nil {
+		sendErrorResponse(w, r, codeExportDisabled, "No export target is configured", http.StatusNotFound)
+		return
+	}
+
+	h.mu.Lock()
+	if h.running {
+		h.mu.Unlock()
+		sendErrorResponse(w, r, codeExportRunning, "An export is already running", http.StatusConflict)
+		return
+	}
+	h.running = true
+	h.mu.Unlock()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		m, err := h.exporter.Run(h.ctx)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.running = false
+		h.lastErr = ""
+		if err != nil {
+			h.lastErr = err.Error()
+			slog.Error("Ledger export failed", "from_id", m.FromID, "error", err)
+			return
+		}
+		slog.Info("Ledger export completed", "from_id", m.FromID, "to_id", m.ToID, "rows", m.Rows, "files", len(m.Files))
+	}()
+
+	logging.FromContext(r.Context()).Info("Ledger export started")
+	sendExportStatus(w, http.StatusAccepted, exportStatus{Running: true})
+}
+
+// HandleExportStatus reports whether an export is running, the error of the
+// last run if it failed and the latest manifest.
+func (h *ExportHandler) HandleExportStatus(w http.ResponseWriter, r *http.Request) {
+	if h.exporter == nil {
+		sendErrorResponse(w, r, codeExportDisabled, "No export target is configured", http.StatusNotFound)
+		return
+	}
+
+	h.mu.Lock()
+	status := exportStatus{Running: h.running, LastError: h.lastErr}
+	h.mu.Unlock()
+
+	m, err := export.ReadLatest(r.Context(), h.sink)
+	switch {
+	case err == nil:
+		status.Manifest = &m
+	case !errors.Is(err, fs.ErrNotExist):
+		logging.FromContext(r.Context()).Error("Failed to read the latest export manifest", "error", err)
+		sendErrorResponse(w, r, codeInternal, "Failed to read the latest export manifest", http.StatusInternalServerError)
+		return
+	}
+	sendExportStatus(w, http.StatusOK, status)
+}
+
+func sendExportStatus(w http.ResponseWriter, statusCode int, status exportStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": status,
+	})
+}
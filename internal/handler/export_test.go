@@ -0,0 +1,146 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/export"
+	"WalletApi/internal/handler"
+	"WalletApi/internal/model"
+)
+
+// fakeLedger streams the entries up to n, after release is closed if it is set
+type fakeLedger struct {
+	n       int64
+	release chan struct{}
+	err     error
+}
+
+// LeaseExport always grants the lease, the handler runs one export at a time anyway
+func (f *fakeLedger) LeaseExport(ctx context.Context, owner string, now time.Time, lease time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeLedger) ReleaseExport(ctx context.Context, owner string) error {
+	return nil
+}
+
+func (f *fakeLedger) StreamLedger(ctx context.Context, afterID int64, before time.Time, fn func(model.LedgerEntry) error) error {
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return f.err
+	}
+	for id := afterID + 1; id <= f.n; id++ {
+		if err := fn(model.LedgerEntry{ID: id, WalletID: "w", OperationType: model.Deposit, Amount: 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type exportStatus struct {
+	Data struct {
+		Running   bool             `json:"running"`
+		LastError string           `json:"lastError"`
+		Manifest  *export.Manifest `json:"manifest"`
+	} `json:"data"`
+}
+
+func callExport(t *testing.T, h http.HandlerFunc, method string) (*httptest.ResponseRecorder, exportStatus) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, "/api/v1/exports", nil))
+	var status exportStatus
+	if w.Code < 300 {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	}
+	return w, status
+}
+
+func TestExportHandler(t *testing.T) {
+	ledger := &fakeLedger{n: 3, release: make(chan struct{})}
+	sink := export.NewDirSink(t.TempDir())
+	h := handler.NewExportHandler(export.NewExporter(ledger, sink), sink)
+
+	w, status := callExport(t, h.HandleExportStatus, http.MethodGet)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, status.Data.Running)
+	assert.Nil(t, status.Data.Manifest, "Nothing was exported yet")
+
+	w, status = callExport(t, h.HandleStartExport, http.MethodPost)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.True(t, status.Data.Running)
+
+	w, _ = callExport(t, h.HandleStartExport, http.MethodPost)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "export_running")
+
+	_, status = callExport(t, h.HandleExportStatus, http.MethodGet)
+	assert.True(t, status.Data.Running)
+
+	close(ledger.release)
+	h.Wait()
+
+	_, status = callExport(t, h.HandleExportStatus, http.MethodGet)
+	assert.False(t, status.Data.Running)
+	assert.Empty(t, status.Data.LastError)
+	require.NotNil(t, status.Data.Manifest)
+	assert.Equal(t, int64(3), status.Data.Manifest.Rows)
+	assert.Equal(t, int64(3), status.Data.Manifest.ToID)
+}
+
+func TestExportHandler_Failed(t *testing.T) {
+	sink := export.NewDirSink(t.TempDir())
+	h := handler.NewExportHandler(export.NewExporter(&fakeLedger{err: errors.New("replica gone")}, sink), sink)
+
+	w, _ := callExport(t, h.HandleStartExport, http.MethodPost)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	h.Wait()
+
+	_, status := callExport(t, h.HandleExportStatus, http.MethodGet)
+	assert.False(t, status.Data.Running)
+	assert.Equal(t, "replica gone", status.Data.LastError)
+	assert.Nil(t, status.Data.Manifest)
+}
+
+func TestExportHandler_Shutdown(t *testing.T) {
+	ledger := &fakeLedger{n: 3, release: make(chan struct{})}
+	sink := export.NewDirSink(t.TempDir())
+	h := handler.NewExportHandler(export.NewExporter(ledger, sink), sink)
+
+	w, _ := callExport(t, h.HandleStartExport, http.MethodPost)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	h.Shutdown()
+
+	_, status := callExport(t, h.HandleExportStatus, http.MethodGet)
+	assert.False(t, status.Data.Running)
+	assert.Equal(t, context.Canceled.Error(), status.Data.LastError)
+	assert.Nil(t, status.Data.Manifest)
+}
+
+func TestExportHandler_Disabled(t *testing.T) {
+	h := handler.NewExportHandler(nil, nil)
+
+	for _, call := range []struct {
+		method string
+		h      http.HandlerFunc
+	}{{http.MethodPost, h.HandleStartExport}, {http.MethodGet, h.HandleExportStatus}} {
+		w, _ := callExport(t, call.h, call.method)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "export_disabled")
+	}
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"WalletApi/internal/logging"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/service"
+)
+
+// Check is a readiness check, a nil error means the dependency is ready.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// HealthHandler serves the liveness and readiness probes.
+type HealthHandler struct {
+	timeout      time.Duration
+	checks       []namedCheck
+	shuttingDown atomic.Bool
+}
+
+// NewHealthHandler creates a handler whose readiness checks must finish within timeout.
+func NewHealthHandler(timeout time.Duration) *HealthHandler {
+	return &HealthHandler{timeout: timeout}
+}
+
+// AddCheck registers a readiness check, all checks run on every probe.
+func (h *HealthHandler) AddCheck(name string, check Check) {
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// SetShuttingDown makes the readiness probe fail, so load balancers stop
+// routing traffic here before the server stops accepting connections.
+func (h *HealthHandler) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// HandleLiveness reports that the process is up and serving HTTP.
+func (h *HealthHandler) HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	sendHealthResponse(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// HandleReadiness reports whether the service can take traffic.
+func (h *HealthHandler) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		sendHealthResponse(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	errs := make([]error, len(h.checks))
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func(i int, c namedCheck) {
+			defer wg.Done()
+			errs[i] = c.check(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	// The probe is not authenticated, so the errors, which may tell about the
+	// database, are only logged
+	status, code := "ready", http.StatusOK
+	checks := make(map[string]string, len(h.checks))
+	for i, c := range h.checks {
+		checks[c.name] = "ok"
+		if errs[i] != nil {
+			checks[c.name] = "failed"
+			status, code = "not ready", http.StatusServiceUnavailable
+			logging.FromContext(r.Context()).Warn("Readiness check failed", "check", c.name, "error", errs[i])
+		}
+	}
+
+	sendHealthResponse(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// DatabaseCheck pings the database of the repository.
+func DatabaseCheck(repo repository.Maintainer) Check {
+	return repo.Ping
+}
+
+// MigrationsCheck fails while any embedded migration is not applied.
+func MigrationsCheck(repo repository.Maintainer) Check {
+	return func(ctx context.Context) error {
+		pending, err := repo.PendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+		}
+		return nil
+	}
+}
+
+// QueueCheck fails when any shard queue is filled beyond threshold (0..1) of
+// its capacity, or holds a task at all when the threshold rounds down to none.
+func QueueCheck(svc service.WalletService, threshold float64) Check {
+	return func(ctx context.Context) error {
+		limit := max(1, int(float64(svc.QueueCapacity())*threshold))
+		for shard, depth := range svc.QueueDepths() {
+			if depth >= limit {
+				return fmt.Errorf("shard %d queue is saturated: %d of %d", shard, depth, svc.QueueCapacity())
+			}
+		}
+		return nil
+	}
+}
+
+func sendHealthResponse(w http.ResponseWriter, statusCode int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,146 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"WalletApi/internal/handler"
+)
+
+type fakeMaintainer struct {
+	pingErr error
+	pending []string
+}
+
+func (f *fakeMaintainer) Ping(ctx context.Context) error          { return f.pingErr }
+func (f *fakeMaintainer) RunMigrations(ctx context.Context) error { return nil }
+func (f *fakeMaintainer) PendingMigrations(ctx context.Context) ([]string, error) {
+	return f.pending, nil
+}
+
+func probe(h http.HandlerFunc) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&body)
+	return w.Code, body
+}
+
+func TestHealthHandler_Liveness(t *testing.T) {
+	healthHandler := handler.NewHealthHandler(time.Second)
+	healthHandler.AddCheck("database", func(ctx context.Context) error { return errors.New("down") })
+
+	code, body := probe(healthHandler.HandleLiveness)
+
+	assert.Equal(t, http.StatusOK, code, "Liveness must not depend on readiness checks")
+	assert.Equal(t, "ok", body["status"])
+}
+
+func TestHealthHandler_Readiness(t *testing.T) {
+	testCases := []struct {
+		name         string
+		maintainer   *fakeMaintainer
+		expectedCode int
+		failedCheck  string
+	}{
+		{
+			name:         "Ready",
+			maintainer:   &fakeMaintainer{},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Database down",
+			maintainer:   &fakeMaintainer{pingErr: errors.New("dial tcp 10.0.0.5:5432: connection refused")},
+			expectedCode: http.StatusServiceUnavailable,
+			failedCheck:  "database",
+		},
+		{
+			name:         "Pending migrations",
+			maintainer:   &fakeMaintainer{pending: []string{"002_ledger"}},
+			expectedCode: http.StatusServiceUnavailable,
+			failedCheck:  "migrations",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			healthHandler := handler.NewHealthHandler(time.Second)
+			healthHandler.AddCheck("database", handler.DatabaseCheck(tc.maintainer))
+			healthHandler.AddCheck("migrations", handler.MigrationsCheck(tc.maintainer))
+
+			code, body := probe(healthHandler.HandleReadiness)
+
+			assert.Equal(t, tc.expectedCode, code)
+			checks := body["checks"].(map[string]interface{})
+			for name, result := range checks {
+				if name == tc.failedCheck {
+					assert.Equal(t, "failed", result, "The error stays in the logs")
+				} else {
+					assert.Equal(t, "ok", result)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthHandler_ReadinessTimeout(t *testing.T) {
+	healthHandler := handler.NewHealthHandler(10 * time.Millisecond)
+	healthHandler.AddCheck("database", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code, _ := probe(healthHandler.HandleReadiness)
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestHealthHandler_QueueSaturation(t *testing.T) {
+	mockService := new(MockWalletService)
+	mockService.On("QueueCapacity").Return(100)
+	mockService.On("QueueDepths").Return([]int{10, 95}).Once()
+	mockService.On("QueueDepths").Return([]int{10, 20})
+
+	check := handler.QueueCheck(mockService, 0.9)
+
+	assert.ErrorContains(t, check(context.Background()), "shard 1")
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestHealthHandler_QueueSaturationSmallQueue(t *testing.T) {
+	mockService := new(MockWalletService)
+	mockService.On("QueueCapacity").Return(1)
+	mockService.On("QueueDepths").Return([]int{0, 0}).Once()
+	mockService.On("QueueDepths").Return([]int{0, 1})
+
+	// 90% of one task rounds down to none, an empty queue must not count as saturated
+	check := handler.QueueCheck(mockService, 0.9)
+
+	assert.NoError(t, check(context.Background()))
+	assert.ErrorContains(t, check(context.Background()), "shard 1")
+}
+
+func TestHealthHandler_ShuttingDown(t *testing.T) {
+	healthHandler := handler.NewHealthHandler(time.Second)
+	healthHandler.AddCheck("database", handler.DatabaseCheck(&fakeMaintainer{}))
+
+	code, _ := probe(healthHandler.HandleReadiness)
+	assert.Equal(t, http.StatusOK, code)
+
+	healthHandler.SetShuttingDown()
+
+	code, body := probe(healthHandler.HandleReadiness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "shutting down", body["status"])
+
+	code, _ = probe(healthHandler.HandleLiveness)
+	assert.Equal(t, http.StatusOK, code)
+}
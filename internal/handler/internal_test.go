@@ -0,0 +1,4 @@
+package handler
+
+// Titles exposes the problem titles to the tests of package handler_test.
+var Titles = titles
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"WalletApi/internal/logging"
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/mtls"
+	"WalletApi/internal/ratelimit"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyHeader identifies the client for rate limiting when it has no tenant,
+// provided the key is one of the policy's API keys.
+const APIKeyHeader = "X-API-Key"
+
+// RateLimiter applies the limits of a ratelimit.Policy to the routes it wraps.
+type RateLimiter struct {
+	store  ratelimit.Store
+	policy ratelimit.Policy
+	// apiKeys holds the hashes of the policy's API keys
+	apiKeys map[string]bool
+}
+
+// NewRateLimiter returns a limiter of policy. The route overrides of the
+// policy apply to every API version of their route.
+func NewRateLimiter(store ratelimit.Store, policy ratelimit.Policy) *RateLimiter {
+	tiers := make(map[string]ratelimit.Tier, len(policy.Tiers))
+	for name, tier := range policy.Tiers {
+		routes := make(map[string]ratelimit.Limit, len(tier.Routes))
+		for route, limit := range tier.Routes {
+			routes[unversioned(route)] = limit
+		}
+		tier.Routes = routes
+		tiers[name] = tier
+	}
+	policy.Tiers = tiers
+
+	apiKeys := make(map[string]bool, len(policy.APIKeys))
+	for _, apiKey := range policy.APIKeys {
+		apiKeys[hashAPIKey(apiKey)] = true
+	}
+	return &RateLimiter{store: store, policy: policy, apiKeys: apiKeys}
+}
+
+// Limit limits each client on the route, the client being its tenant, API key
+// or IP address in that order. It must wrap a handler registered on the
+// ServeMux, the limit depends on the pattern of the matched route, whatever
+// its API version.
+func (l *RateLimiter) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unversioned(r.Pattern)
+		limit := l.policy.ClientLimit(mtls.Tenant(r.Context()), route)
+		if !l.allow(w, r, "client", "client:"+l.clientKey(r)+":"+route, limit) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitWallet limits the requests made on the {id} wallet of the route by each
+// tenant, at the wallet limit of its tier. Clients without a tenant share one bucket.
+func (l *RateLimiter) LimitWallet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Invalid IDs are rejected by the handler, they must not create buckets
+		if walletID, err := uuid.Parse(r.PathValue("id")); err == nil {
+			tenant := mtls.Tenant(r.Context())
+			key := "wallet:" + tenant + ":" + walletID.String()
+			if !l.allow(w, r, "wallet", key, l.policy.WalletLimit(tenant)) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *RateLimiter) allow(w http.ResponseWriter, r *http.Request, scope, key string, limit ratelimit.Limit) bool {
+	if limit.Unlimited() {
+		return true
+	}
+
+	d, err := l.store.Take(r.Context(), key, limit)
+	if err != nil {
+		// An unavailable shared store must not take the API down with it
+		logging.FromContext(r.Context()).Warn("Rate limit store failed, letting the request through", "error", err)
+		return true
+	}
+
+	setRateLimitHeaders(w, d)
+	if !d.Allowed {
+		metrics.ObserveRateLimited(r.Pattern, scope)
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter.Seconds())))
+		sendErrorResponse(w, r, codeRateLimited, "Rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// setRateLimitHeaders reports the most restrictive of the limits applied to
+// the request, following the RateLimit header fields draft.
+func setRateLimitHeaders(w http.ResponseWriter, d ratelimit.Decision) {
+	if current := w.Header().Get("RateLimit-Remaining"); current != "" {
+		if remaining, err := strconv.Atoi(current); err == nil && remaining <= d.Remaining {
+			return
+		}
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset.Seconds())))
+}
+
+func ceilSeconds(s float64) int {
+	return int(math.Ceil(s))
+}
+
+// clientKey identifies the client of r. Unknown API keys are ignored, a client
+// sending a new key with each request would otherwise get a new bucket each time.
+func (l *RateLimiter) clientKey(r *http.Request) string {
+	if tenant := mtls.Tenant(r.Context()); tenant != "" {
+		return "tenant:" + tenant
+	}
+	if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" {
+		if hash := hashAPIKey(apiKey); l.apiKeys[hash] {
+			return "key:" + hash
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// hashAPIKey hashes an API key so a shared store never holds it.
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// unversioned removes the API version from a route pattern, so that
+// "GET /api/v1/wallets/{id}" and "GET /api/v2/wallets/{id}" share their limits.
+func unversioned(pattern string) string {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	if rest, ok := strings.CutPrefix(path, "/api/v"); ok {
+		if version, tail, ok := strings.Cut(rest, "/"); ok && isDigits(version) {
+			path = "/api/" + tail
+		}
+	}
+	if method == "" {
+		return path
+	}
+	return method + " " + path
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
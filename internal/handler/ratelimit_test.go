@@ -0,0 +1,227 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"WalletApi/internal/handler"
+	"WalletApi/internal/mtls"
+	"WalletApi/internal/ratelimit"
+)
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Decision, error) {
+	return ratelimit.Decision{}, errors.New("store unavailable")
+}
+
+func rateLimitedMux(store ratelimit.Store, policy ratelimit.Policy) http.Handler {
+	limiter := handler.NewRateLimiter(store, policy)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/api/v1", "/api/v2"} {
+		mux.Handle("POST "+prefix+"/wallets/{id}/transactions", limiter.Limit(limiter.LimitWallet(ok)))
+		mux.Handle("GET "+prefix+"/wallets/{id}", limiter.Limit(ok))
+	}
+	return mux
+}
+
+func send(h http.Handler, method, path, remoteAddr string) *httptest.ResponseRecorder {
+	return sendWithKey(h, method, path, remoteAddr, "")
+}
+
+func sendWithKey(h http.Handler, method, path, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	if apiKey != "" {
+		req.Header.Set(handler.APIKeyHeader, apiKey)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimiter_Client(t *testing.T) {
+	h := rateLimitedMux(ratelimit.NewMemoryStore(), ratelimit.Policy{
+		DefaultTier: "default",
+		Tiers: map[string]ratelimit.Tier{
+			"default": {Client: ratelimit.Limit{Rate: 1, Burst: 2}},
+		},
+		APIKeys: []string{"key-1"},
+	})
+	path := "/api/v1/wallets/" + uuid.NewString()
+
+	w := send(h, "GET", path, "10.0.0.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, send(h, "GET", path, "10.0.0.1:1234").Code)
+
+	w = send(h, "GET", path, "10.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "The client is its IP, whatever the port")
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Contains(t, w.Body.String(), `"reason":"rate_limited"`)
+
+	assert.Equal(t, http.StatusOK, send(h, "GET", path, "10.0.0.2:1234").Code, "Other clients are not affected")
+	assert.Equal(t, http.StatusOK, send(h, "POST", path+"/transactions", "10.0.0.1:1234").Code, "Each route is limited separately")
+
+	assert.Equal(t, http.StatusOK, sendWithKey(h, "GET", path, "10.0.0.1:1234", "key-1").Code,
+		"An API key identifies the client instead of its IP")
+	assert.Equal(t, http.StatusTooManyRequests, sendWithKey(h, "GET", path, "10.0.0.1:1234", "key-2").Code,
+		"An unknown API key leaves the client identified by its IP")
+}
+
+func TestRateLimiter_RotatingAPIKeys(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	h := rateLimitedMux(store, ratelimit.Policy{
+		DefaultTier: "default",
+		Tiers: map[string]ratelimit.Tier{
+			"default": {Client: ratelimit.Limit{Rate: 1, Burst: 3}},
+		},
+		APIKeys: []string{"key-1"},
+	})
+	path := "/api/v1/wallets/" + uuid.NewString()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, sendWithKey(h, "GET", path, "10.0.0.1:1234", uuid.NewString()).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, sendWithKey(h, "GET", path, "10.0.0.1:1234", uuid.NewString()).Code,
+		"A new key with each request does not get a new bucket")
+	assert.Equal(t, 1, store.Len(), "Unknown keys do not create buckets")
+}
+
+func TestRateLimiter_Versions(t *testing.T) {
+	h := rateLimitedMux(ratelimit.NewMemoryStore(), ratelimit.Policy{
+		DefaultTier: "default",
+		Tiers: map[string]ratelimit.Tier{
+			"default": {
+				Client: ratelimit.Limit{Rate: 1, Burst: 4},
+				Routes: map[string]ratelimit.Limit{
+					"POST /api/v1/wallets/{id}/transactions": {Rate: 1, Burst: 1},
+				},
+			},
+		},
+	})
+	id := uuid.NewString()
+
+	for i := 0; i < 4; i++ {
+		version := []string{"v1", "v2"}[i%2]
+		assert.Equal(t, http.StatusOK, send(h, "GET", "/api/"+version+"/wallets/"+id, "10.0.0.1:1234").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send(h, "GET", "/api/v1/wallets/"+id, "10.0.0.1:1234").Code,
+		"The versions of a route share its limit")
+	assert.Equal(t, http.StatusTooManyRequests, send(h, "GET", "/api/v2/wallets/"+id, "10.0.0.1:1234").Code)
+
+	w := send(h, "POST", "/api/v2/wallets/"+id+"/transactions", "10.0.0.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"), "A route override applies to every version")
+	assert.Equal(t, http.StatusTooManyRequests, send(h, "POST", "/api/v1/wallets/"+id+"/transactions", "10.0.0.1:1234").Code)
+}
+
+func TestRateLimiter_Wallet(t *testing.T) {
+	h := rateLimitedMux(ratelimit.NewMemoryStore(), ratelimit.Policy{
+		DefaultTier: "default",
+		Tiers: map[string]ratelimit.Tier{
+			"default": {
+				Client: ratelimit.Limit{Rate: 100, Burst: 100},
+				Wallet: ratelimit.Limit{Rate: 1, Burst: 1},
+			},
+		},
+	})
+	walletPath := "/api/v1/wallets/" + uuid.NewString() + "/transactions"
+
+	w := send(h, "POST", walletPath, "10.0.0.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"), "The most restrictive limit is reported")
+
+	assert.Equal(t, http.StatusTooManyRequests, send(h, "POST", walletPath, "10.0.0.2:1234").Code,
+		"The wallet limit is shared by all clients")
+	assert.Equal(t, http.StatusOK, send(h, "POST", "/api/v1/wallets/"+uuid.NewString()+"/transactions", "10.0.0.2:1234").Code)
+}
+
+func TestRateLimiter_TenantTier(t *testing.T) {
+	limiter := handler.NewRateLimiter(ratelimit.NewMemoryStore(), ratelimit.Policy{
+		DefaultTier: "default",
+		TenantTiers: map[string]string{"payments": "premium"},
+		Tiers: map[string]ratelimit.Tier{
+			"default": {Client: ratelimit.Limit{Rate: 1, Burst: 1}},
+			"premium": {Client: ratelimit.Limit{Rate: 10, Burst: 10}},
+		},
+	})
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/wallets/{id}", limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	send := func(tenant string) int {
+		req := httptest.NewRequest("GET", "/api/v1/wallets/"+uuid.NewString(), nil)
+		req = req.WithContext(mtls.WithTenant(req.Context(), tenant))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("billing"))
+	assert.Equal(t, http.StatusTooManyRequests, send("billing"))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, send("payments"))
+	}
+}
+
+func TestRateLimiter_WalletTenantTier(t *testing.T) {
+	h := rateLimitedMux(ratelimit.NewMemoryStore(), ratelimit.Policy{
+		DefaultTier: "default",
+		TenantTiers: map[string]string{"payments": "premium"},
+		Tiers: map[string]ratelimit.Tier{
+			"default": {Wallet: ratelimit.Limit{Rate: 1, Burst: 1}},
+			"premium": {Wallet: ratelimit.Limit{Rate: 3, Burst: 3}},
+		},
+	})
+	walletPath := "/api/v1/wallets/" + uuid.NewString() + "/transactions"
+
+	send := func(tenant string) int {
+		req := httptest.NewRequest("POST", walletPath, nil)
+		req = req.WithContext(mtls.WithTenant(req.Context(), tenant))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Each tenant has a bucket for the wallet, sized by its own tier
+	assert.Equal(t, http.StatusOK, send("billing"))
+	assert.Equal(t, http.StatusTooManyRequests, send("billing"))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send("payments"), "The premium limit is not used up by another tenant")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send("payments"))
+	assert.Equal(t, http.StatusOK, send("reporting"))
+}
+
+func TestRateLimiter_StoreFailure(t *testing.T) {
+	h := rateLimitedMux(failingStore{}, ratelimit.Policy{
+		DefaultTier: "default",
+		Tiers: map[string]ratelimit.Tier{
+			"default": {Client: ratelimit.Limit{Rate: 1, Burst: 1}},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send(h, "GET", "/api/v1/wallets/"+uuid.NewString(), "10.0.0.1:1234").Code)
+	}
+}
+
+func TestRateLimiter_Unlimited(t *testing.T) {
+	h := rateLimitedMux(failingStore{}, ratelimit.Policy{})
+
+	w := send(h, "GET", "/api/v1/wallets/"+uuid.NewString(), "10.0.0.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
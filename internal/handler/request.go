@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxBodyBytes bounds request bodies unless WithMaxBodyBytes is given
+const DefaultMaxBodyBytes = 64 << 10
+
+// requestError is a client error found while reading a request.
+type requestError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(code, message string) *requestError {
+	return &requestError{code: code, message: message, status: http.StatusBadRequest}
+}
+
+// decodeJSON strictly decodes the body of r into v: the body must be declared
+// as JSON, hold a single JSON value without unknown fields or duplicate keys,
+// and fit in maxBytes.
+func decodeJSON(w http.ResponseWriter, r *http.Request, maxBytes int64, v any) *requestError {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &requestError{
+			code:    codeUnsupportedMediaType,
+			message: "Content-Type must be application/json",
+			status:  http.StatusUnsupportedMediaType,
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return &requestError{
+				code:    codeBodyTooLarge,
+				message: fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit),
+				status:  http.StatusRequestEntityTooLarge,
+			}
+		}
+		return badRequest(codeMalformedJSON, "Failed to read request body")
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return badRequest(codeEmptyBody, "Request body is empty")
+	}
+
+	if err := checkDuplicateKeys(json.NewDecoder(bytes.NewReader(body))); err != nil {
+		var dupErr *duplicateKeyError
+		if errors.As(err, &dupErr) {
+			return badRequest(codeDuplicateKey, fmt.Sprintf("Duplicate key %q", dupErr.key))
+		}
+		return badRequest(codeMalformedJSON, "Invalid JSON format")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr):
+			return badRequest(codeInvalidFieldType, fmt.Sprintf("Field %q must be %s", typeErr.Field, typeErr.Type))
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return badRequest(codeUnknownField, "Unknown field "+field)
+		default:
+			return badRequest(codeMalformedJSON, "Invalid JSON format")
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return badRequest(codeMultipleValues, "Request body must hold a single JSON value")
+	}
+	return nil
+}
+
+type duplicateKeyError struct {
+	key string
+}
+
+func (e *duplicateKeyError) Error() string {
+	return "duplicate key " + e.key
+}
+
+// checkDuplicateKeys walks the next JSON value of dec and fails on an object
+// with a key given twice. encoding/json matches keys to fields ignoring case,
+// so keys differing only in case are duplicates too.
+func checkDuplicateKeys(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		keys := make(map[string]bool)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+			if keys[strings.ToLower(key)] {
+				return &duplicateKeyError{key: key}
+			}
+			keys[strings.ToLower(key)] = true
+
+			if err := checkDuplicateKeys(dec); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for dec.More() {
+			if err := checkDuplicateKeys(dec); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// walletIDFromPath returns the {id} of the matched route, falling back to the
+// URL path for requests that did not go through the ServeMux.
+func walletIDFromPath(r *http.Request) string {
+	if walletID := r.PathValue("id"); walletID != "" {
+		return walletID
+	}
+	_, walletID, _ := strings.Cut(r.URL.Path, "/wallets/")
+	walletID, _, _ = strings.Cut(walletID, "/")
+	return walletID
+}
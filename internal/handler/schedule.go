@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"WalletApi/internal/logging"
+	"WalletApi/internal/model"
+	"WalletApi/internal/service"
+
+	"github.com/google/uuid"
+)
+
+// scheduleRunsLimit bounds the runs returned for a schedule, newest first
+const scheduleRunsLimit = 100
+
+// ScheduleHandler serves the scheduled transactions of a wallet.
+type ScheduleHandler struct {
+	scheduler    *service.Scheduler
+	maxBodyBytes int64
+}
+
+func NewScheduleHandler(scheduler *service.Scheduler, maxBodyBytes int64) *ScheduleHandler {
+	return &ScheduleHandler{scheduler: scheduler, maxBodyBytes: maxBodyBytes}
+}
+
+// createScheduleRequest is the body of HandleCreateSchedule. The times are RFC
+// 3339 timestamps, a missing startAt means now.
+type createScheduleRequest struct {
+	OperationType model.OperationType `json:"operationType"`
+	Amount        int64               `json:"amount"`
+	Recurrence    string              `json:"recurrence"`
+	StartAt       string              `json:"startAt"`
+	EndAt         string              `json:"endAt"`
+}
+
+// updateScheduleRequest is the body of HandleUpdateSchedule, missing fields are left as they are.
+type updateScheduleRequest struct {
+	Amount *int64                `json:"amount"`
+	Status *model.ScheduleStatus `json:"status"`
+}
+
+func (h *ScheduleHandler) HandleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	var body createScheduleRequest
+	if err := decodeJSON(w, r, h.maxBodyBytes, &body); err != nil {
+		sendErrorResponse(w, r, err.code, err.message, err.status)
+		return
+	}
+
+	req := service.ScheduleRequest{
+		WalletID:      walletID,
+		OperationType: body.OperationType,
+		Amount:        body.Amount,
+		Recurrence:    body.Recurrence,
+	}
+	if body.StartAt != "" {
+		startAt, err := time.Parse(time.RFC3339, body.StartAt)
+		if err != nil {
+			sendErrorResponse(w, r, codeInvalidTimestamp, "Invalid startAt, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		req.StartAt = startAt
+	}
+	if body.EndAt != "" {
+		endAt, err := time.Parse(time.RFC3339, body.EndAt)
+		if err != nil {
+			sendErrorResponse(w, r, codeInvalidTimestamp, "Invalid endAt, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		req.EndAt = &endAt
+	}
+
+	s, err := h.scheduler.Create(r.Context(), req)
+	if err != nil {
+		sendScheduleError(w, r, err, "Failed to create schedule")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Schedule created",
+		"wallet_id", walletID, "schedule_id", s.ID, "operation", s.OperationType, "amount", s.Amount, "recurrence", s.Recurrence)
+	sendSuccessResponse(w, s)
+}
+
+func (h *ScheduleHandler) HandleListSchedules(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	schedules, err := h.scheduler.List(r.Context(), walletID)
+	if err != nil {
+		sendScheduleError(w, r, err, "Failed to list schedules")
+		return
+	}
+	sendSuccessResponse(w, schedules)
+}
+
+func (h *ScheduleHandler) HandleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	s, err := h.scheduler.Get(r.Context(), walletID, r.PathValue("scheduleId"))
+	if err != nil {
+		sendScheduleError(w, r, err, "Failed to get schedule")
+		return
+	}
+	sendSuccessResponse(w, s)
+}
+
+// HandleUpdateSchedule changes the amount of a schedule, or pauses or resumes it.
+func (h *ScheduleHandler) HandleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	var body updateScheduleRequest
+	if err := decodeJSON(w, r, h.maxBodyBytes, &body); err != nil {
+		sendErrorResponse(w, r, err.code, err.message, err.status)
+		return
+	}
+
+	s, err := h.scheduler.Update(r.Context(), walletID, r.PathValue("scheduleId"), service.ScheduleUpdate{
+		Amount: body.Amount,
+		Status: body.Status,
+	})
+	if err != nil {
+		sendScheduleError(w, r, err, "Failed to update schedule")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Schedule updated",
+		"wallet_id", walletID, "schedule_id", s.ID, "amount", s.Amount, "status", s.Status)
+	sendSuccessResponse(w, s)
+}
+
+// HandleCancelSchedule cancels a schedule, which stays readable with its runs.
+func (h *ScheduleHandler) HandleCancelSchedule(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	s, err := h.scheduler.Cancel(r.Context(), walletID, r.PathValue("scheduleId"))
+	if err != nil {
+		sendScheduleError(w, r, err, "Failed to cancel schedule")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Schedule cancelled", "wallet_id", walletID, "schedule_id", s.ID)
+	sendSuccessResponse(w, s)
+}
+
+// HandleScheduleRuns returns the latest runs of a schedule, newest first.
+func (h *ScheduleHandler) HandleScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	runs, err := h.scheduler.Runs(r.Context(), walletID, r.PathValue("scheduleId"), scheduleRunsLimit)
+	if err != nil {
+		sendScheduleError(w, r, err, "Failed to get schedule runs")
+		return
+	}
+	sendSuccessResponse(w, runs)
+}
+
+// sendScheduleError answers with the error of the scheduler, message is sent
+// for errors that are not the client's.
+func sendScheduleError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, model.ErrWalletNotFound):
+		sendErrorResponse(w, r, model.CodeWalletNotFound, "Wallet not found", http.StatusNotFound)
+	case errors.Is(err, model.ErrScheduleNotFound):
+		sendErrorResponse(w, r, model.CodeScheduleNotFound, "Schedule not found", http.StatusNotFound)
+	case errors.Is(err, model.ErrInvalidSchedule):
+		sendErrorResponse(w, r, model.CodeInvalidSchedule, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, model.ErrScheduleClosed):
+		sendErrorResponse(w, r, model.CodeScheduleClosed, "Schedule is cancelled or completed", http.StatusConflict)
+	default:
+		logging.FromContext(r.Context()).Error(message, "wallet_id", walletIDFromPath(r), "error", err)
+		sendErrorResponse(w, r, codeInternal, message, http.StatusInternalServerError)
+	}
+}
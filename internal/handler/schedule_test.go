@@ -0,0 +1,158 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/handler"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/service"
+)
+
+// newScheduleMux serves the schedule routes of a wallet with funds.
+func newScheduleMux(t *testing.T) (*http.ServeMux, *service.Scheduler, string) {
+	t.Helper()
+	repo := repository.NewMemoryRepository()
+	wallets := service.NewWalletService(repo, 1)
+	t.Cleanup(func() { wallets.Shutdown(context.Background()) })
+
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 100, true))
+
+	scheduler := service.NewScheduler(repo, wallets)
+	h := handler.NewScheduleHandler(scheduler, handler.DefaultMaxBodyBytes)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/wallets/{id}/schedules", h.HandleCreateSchedule)
+	mux.HandleFunc("GET /api/v1/wallets/{id}/schedules", h.HandleListSchedules)
+	mux.HandleFunc("GET /api/v1/wallets/{id}/schedules/{scheduleId}", h.HandleGetSchedule)
+	mux.HandleFunc("PATCH /api/v1/wallets/{id}/schedules/{scheduleId}", h.HandleUpdateSchedule)
+	mux.HandleFunc("DELETE /api/v1/wallets/{id}/schedules/{scheduleId}", h.HandleCancelSchedule)
+	mux.HandleFunc("GET /api/v1/wallets/{id}/schedules/{scheduleId}/runs", h.HandleScheduleRuns)
+	return mux, scheduler, walletID
+}
+
+func callSchedules(t *testing.T, mux *http.ServeMux, method, path, body string, data any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code == http.StatusOK && data != nil {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&struct {
+			Data any `json:"data"`
+		}{Data: data}))
+	}
+	return w
+}
+
+func TestScheduleHandler(t *testing.T) {
+	mux, scheduler, walletID := newScheduleMux(t)
+	base := "/api/v1/wallets/" + walletID + "/schedules"
+
+	var created model.Schedule
+	w := callSchedules(t, mux, "POST", base, `{"operationType": "WITHDRAW", "amount": 25, "recurrence": "monthly"}`, &created)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, walletID, created.WalletID)
+	assert.Equal(t, model.Withdraw, created.OperationType)
+	assert.Equal(t, model.ScheduleActive, created.Status)
+	assert.Equal(t, "monthly", created.Recurrence)
+	require.NotNil(t, created.NextRunAt)
+
+	// The first occurrence is due right away
+	runs, err := scheduler.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, runs)
+
+	var got model.Schedule
+	w = callSchedules(t, mux, "GET", base+"/"+created.ID, "", &got)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, created.StartAt.AddDate(0, 1, 0), *got.NextRunAt)
+
+	var history []model.ScheduleRun
+	w = callSchedules(t, mux, "GET", base+"/"+created.ID+"/runs", "", &history)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, history, 1)
+	assert.Equal(t, model.RunSucceeded, history[0].Status)
+
+	var paused model.Schedule
+	w = callSchedules(t, mux, "PATCH", base+"/"+created.ID, `{"status": "PAUSED", "amount": 30}`, &paused)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, model.SchedulePaused, paused.Status)
+	assert.Equal(t, int64(30), paused.Amount)
+
+	start := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w = callSchedules(t, mux, "POST", base, `{"operationType": "DEPOSIT", "amount": 5, "startAt": "`+start+`"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var list []model.Schedule
+	w = callSchedules(t, mux, "GET", base, "", &list)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, list, 2)
+	assert.Equal(t, created.ID, list[0].ID)
+	assert.Empty(t, list[1].Recurrence)
+
+	var cancelled model.Schedule
+	w = callSchedules(t, mux, "DELETE", base+"/"+created.ID, "", &cancelled)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, model.ScheduleCancelled, cancelled.Status)
+	assert.Nil(t, cancelled.NextRunAt)
+
+	w = callSchedules(t, mux, "PATCH", base+"/"+created.ID, `{"status": "ACTIVE"}`, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "schedule_closed")
+}
+
+func TestScheduleHandler_Errors(t *testing.T) {
+	mux, _, walletID := newScheduleMux(t)
+	base := "/api/v1/wallets/" + walletID + "/schedules"
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		reason string
+	}{
+		{"invalid wallet ID", "POST", "/api/v1/wallets/nope/schedules", `{"operationType": "DEPOSIT", "amount": 1}`, http.StatusBadRequest, "invalid_wallet_id"},
+		{"unknown wallet", "POST", "/api/v1/wallets/" + uuid.NewString() + "/schedules", `{"operationType": "DEPOSIT", "amount": 1}`, http.StatusNotFound, "wallet_not_found"},
+		{"unknown field", "POST", base, `{"operationType": "DEPOSIT", "amount": 1, "reference": "x"}`, http.StatusBadRequest, "unknown_field"},
+		{"invalid operation", "POST", base, `{"operationType": "TRANSFER", "amount": 1}`, http.StatusBadRequest, "invalid_schedule"},
+		{"invalid amount", "POST", base, `{"operationType": "DEPOSIT", "amount": 0}`, http.StatusBadRequest, "invalid_schedule"},
+		{"invalid recurrence", "POST", base, `{"operationType": "DEPOSIT", "amount": 1, "recurrence": "* * *"}`, http.StatusBadRequest, "invalid_schedule"},
+		{"invalid startAt", "POST", base, `{"operationType": "DEPOSIT", "amount": 1, "startAt": "tomorrow"}`, http.StatusBadRequest, "invalid_timestamp"},
+		{"past startAt", "POST", base, `{"operationType": "DEPOSIT", "amount": 1, "startAt": "2020-01-01T00:00:00Z"}`, http.StatusBadRequest, "invalid_schedule"},
+		{"list of unknown wallet", "GET", "/api/v1/wallets/" + uuid.NewString() + "/schedules", "", http.StatusNotFound, "wallet_not_found"},
+		{"unknown schedule", "GET", base + "/" + uuid.NewString(), "", http.StatusNotFound, "schedule_not_found"},
+		{"runs of unknown schedule", "GET", base + "/" + uuid.NewString() + "/runs", "", http.StatusNotFound, "schedule_not_found"},
+		{"cancel unknown schedule", "DELETE", base + "/" + uuid.NewString(), "", http.StatusNotFound, "schedule_not_found"},
+		{"invalid status", "PATCH", base + "/" + uuid.NewString(), `{"status": "COMPLETED"}`, http.StatusBadRequest, "invalid_schedule"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := callSchedules(t, mux, tc.method, tc.path, tc.body, nil)
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+			var body struct {
+				Error struct {
+					Reason string `json:"reason"`
+				} `json:"error"`
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.Equal(t, tc.reason, body.Error.Reason)
+		})
+	}
+}
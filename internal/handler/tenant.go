@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net/http"
+
+	"WalletApi/internal/logging"
+	"WalletApi/internal/mtls"
+)
+
+// TenantMiddleware attaches the tenant mapped to the client certificate to the
+// request context, which identifies the client but does not restrict the wallets
+// it may use, and rejects with 403 the requests whose certificate subject
+// has no tenant, or that have no certificate. The TLS handshake has already
+// verified the certificate. It creates a new request, so it must wrap the
+// handler of a route: the mux sets the pattern the tracing and metrics
+// middleware read on the request it was given.
+func TenantMiddleware(tenants mtls.Tenants) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				sendErrorResponse(w, r, codeClientCertRequired, "Client certificate required", http.StatusForbidden)
+				return
+			}
+
+			cert := r.TLS.PeerCertificates[0]
+			tenant, ok := tenants.Lookup(cert)
+			if !ok {
+				logging.FromContext(r.Context()).Warn("Client certificate is not mapped to a tenant",
+					"subject", cert.Subject.String())
+				sendErrorResponse(w, r, codeTenantUnauthorized, "Client certificate is not authorized", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(mtls.WithTenant(r.Context(), tenant)))
+		})
+	}
+}
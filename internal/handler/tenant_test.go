@@ -0,0 +1,65 @@
+package handler_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"WalletApi/internal/handler"
+	"WalletApi/internal/mtls"
+)
+
+func TestTenantMiddleware(t *testing.T) {
+	tenants := mtls.Tenants{"CN=payments": "payments-team"}
+
+	var gotTenant string
+	h := handler.TenantMiddleware(tenants)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTenant = mtls.Tenant(r.Context())
+	}))
+
+	withCert := func(subject string) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: subject}}}}
+	}
+
+	testCases := []struct {
+		name         string
+		tls          *tls.ConnectionState
+		expectedCode int
+		tenant       string
+	}{
+		{
+			name:         "Mapped subject",
+			tls:          withCert("payments"),
+			expectedCode: http.StatusOK,
+			tenant:       "payments-team",
+		},
+		{
+			name:         "Unmapped subject",
+			tls:          withCert("reporting"),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Plain HTTP",
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotTenant = ""
+			req := httptest.NewRequest("GET", "/api/v1/wallets", nil)
+			req.TLS = tc.tls
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.tenant, gotTenant)
+		})
+	}
+}
@@ -1,30 +1,53 @@
 package handler
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
+	"WalletApi/internal/logging"
+	"WalletApi/internal/metrics"
 	"WalletApi/internal/model"
+	"WalletApi/internal/mtls"
 	"WalletApi/internal/service"
+	"WalletApi/internal/statement"
 
 	"github.com/google/uuid"
 )
 
 type WalletHandler struct {
-	service service.WalletService
+	service      service.WalletService
+	maxBodyBytes int64
 }
 
-func NewWalletHandler(service service.WalletService) *WalletHandler {
-	return &WalletHandler{service: service}
+// Option configures optional WalletHandler settings
+type Option func(*WalletHandler)
+
+// WithMaxBodyBytes bounds the size of request bodies, larger ones are rejected with 413
+func WithMaxBodyBytes(n int64) Option {
+	return func(h *WalletHandler) {
+		h.maxBodyBytes = n
+	}
+}
+
+func NewWalletHandler(service service.WalletService, opts ...Option) *WalletHandler {
+	h := &WalletHandler{service: service, maxBodyBytes: DefaultMaxBodyBytes}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *WalletHandler) CreateWallet(w http.ResponseWriter, r *http.Request) {
 	walletID, err := h.service.CreateWallet(r.Context())
 	if err != nil {
-		sendErrorResponse(w, "Failed to create wallet", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to create wallet", "error", err)
+		sendErrorResponse(w, r, codeInternal, "Failed to create wallet", http.StatusInternalServerError)
 		return
 	}
 
@@ -33,29 +56,28 @@ func (h *WalletHandler) CreateWallet(w http.ResponseWriter, r *http.Request) {
 
 func (h *WalletHandler) HandleTransaction(w http.ResponseWriter, r *http.Request) {
 	// Extracting the walletID from the URL
-	walletID := strings.TrimPrefix(r.URL.Path, "/api/v1/wallets/")
-	walletID = strings.TrimSuffix(walletID, "/transactions")
+	walletID := walletIDFromPath(r)
 
 	if _, err := uuid.Parse(walletID); err != nil {
-		sendErrorResponse(w, "Invalid wallet ID format", http.StatusBadRequest)
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID format", http.StatusBadRequest)
 		return
 	}
 
 	// Parsing the request body
 	var t model.Transaction
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		sendErrorResponse(w, "Invalid JSON format", http.StatusBadRequest)
+	if err := decodeJSON(w, r, h.maxBodyBytes, &t); err != nil {
+		sendErrorResponse(w, r, err.code, err.message, err.status)
 		return
 	}
 
 	// Validation of fields
 	if t.OperationType != model.Deposit && t.OperationType != model.Withdraw {
-		sendErrorResponse(w, "Invalid operation type", http.StatusBadRequest)
+		sendErrorResponse(w, r, model.CodeInvalidOperation, "Invalid operation type", http.StatusBadRequest)
 		return
 	}
 
 	if t.Amount <= 0 {
-		sendErrorResponse(w, "Amount must be positive", http.StatusBadRequest)
+		sendErrorResponse(w, r, model.CodeInvalidAmount, "Amount must be positive", http.StatusBadRequest)
 		return
 	}
 
@@ -63,16 +85,34 @@ func (h *WalletHandler) HandleTransaction(w http.ResponseWriter, r *http.Request
 	t.WalletID = walletID
 
 	// Processing the transaction
-	if err := h.service.ProcessTransaction(r.Context(), t); err != nil {
+	start := time.Now()
+	err := h.service.ProcessTransaction(r.Context(), t)
+	logTransaction(r.Context(), t, time.Since(start), err)
+
+	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrWalletNotFound):
-			sendErrorResponse(w, "Wallet not found", http.StatusNotFound)
+			sendErrorResponse(w, r, model.CodeWalletNotFound, "Wallet not found", http.StatusNotFound)
 		case errors.Is(err, model.ErrInsufficientFunds):
-			sendErrorResponse(w, "Insufficient funds", http.StatusConflict)
+			var extensions map[string]any
+			var fundsErr *model.InsufficientFundsError
+			if errors.As(err, &fundsErr) {
+				extensions = map[string]any{"available": fundsErr.Available}
+			}
+			sendErrorResponseWith(w, r, model.CodeInsufficientFunds, "Insufficient funds", http.StatusConflict, extensions)
+		case errors.Is(err, model.ErrWalletFrozen):
+			sendErrorResponse(w, r, model.CodeWalletFrozen, "Wallet is frozen", http.StatusConflict)
+		case errors.Is(err, model.ErrDuplicateReference):
+			sendErrorResponse(w, r, model.CodeDuplicateReference, "Transaction reference already applied", http.StatusConflict)
 		case errors.Is(err, model.ErrInvalidAmount):
-			sendErrorResponse(w, "Invalid amount", http.StatusBadRequest)
+			sendErrorResponse(w, r, model.CodeInvalidAmount, "Invalid amount", http.StatusBadRequest)
+		case errors.Is(err, model.ErrShuttingDown):
+			// Not processed, the client can safely retry against another instance
+			w.Header().Set("Retry-After", "1")
+			sendErrorResponse(w, r, model.CodeShuttingDown, "Service is shutting down", http.StatusServiceUnavailable)
 		default:
-			sendErrorResponse(w, "Transaction failed: "+err.Error(), http.StatusInternalServerError)
+			// The details stay in the log, the client gets the request ID to refer to them
+			sendErrorResponse(w, r, codeInternal, "Transaction failed", http.StatusInternalServerError)
 		}
 		return
 	}
@@ -86,36 +126,208 @@ func (h *WalletHandler) HandleTransaction(w http.ResponseWriter, r *http.Request
 }
 
 func (h *WalletHandler) HandleGetBalance(w http.ResponseWriter, r *http.Request) {
-	walletID := strings.TrimPrefix(r.URL.Path, "/api/v1/wallets/")
+	walletID := walletIDFromPath(r)
 	if _, err := uuid.Parse(walletID); err != nil {
-		sendErrorResponse(w, "Invalid wallet ID", http.StatusBadRequest)
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
 		return
 	}
 
-	balance, err := h.service.GetBalance(r.Context(), walletID)
+	ctx := r.Context()
+	switch r.URL.Query().Get("consistency") {
+	case "", "eventual":
+	case "strong":
+		ctx = service.WithStrongConsistency(ctx)
+	default:
+		sendErrorResponse(w, r, codeInvalidConsistency, "Invalid consistency, expected strong or eventual", http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.service.GetBalanceInfo(ctx, walletID)
 	if err != nil {
 		if errors.Is(err, model.ErrWalletNotFound) {
-			sendErrorResponse(w, "Wallet not found", http.StatusNotFound)
+			sendErrorResponse(w, r, model.CodeWalletNotFound, "Wallet not found", http.StatusNotFound)
 		} else {
-			sendErrorResponse(w, "Failed to get balance", http.StatusInternalServerError)
+			logging.FromContext(ctx).Error("Failed to get balance", "wallet_id", walletID, "error", err)
+			sendErrorResponse(w, r, codeInternal, "Failed to get balance", http.StatusInternalServerError)
 		}
 		return
 	}
 
-	sendSuccessResponse(w, map[string]int64{"balance": balance})
+	setCacheHeaders(w, info)
+	sendSuccessResponse(w, map[string]int64{
+		"balance":       info.Balance,
+		"creditLimit":   info.CreditLimit,
+		"available":     model.Available(info.Balance, info.CreditLimit),
+		"overdraftUsed": model.OverdraftUsed(info.Balance),
+	})
 }
 
-func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]interface{}{
-			"code":    statusCode,
-			"message": message,
-		},
+// HandleGetBalanceAt serves the balance of a wallet as of the RFC 3339 timestamp
+// of the at parameter, computed from the ledger. It is never cached.
+func (h *WalletHandler) HandleGetBalanceAt(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		sendErrorResponse(w, r, codeInvalidTimestamp, "Invalid at, expected an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+	if at.After(time.Now()) {
+		sendErrorResponse(w, r, codeInvalidTimestamp, "at must not be in the future", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	balance, err := h.service.GetBalanceAt(ctx, walletID, at)
+	if err != nil {
+		if errors.Is(err, model.ErrWalletNotFound) {
+			sendErrorResponse(w, r, model.CodeWalletNotFound, "Wallet not found", http.StatusNotFound)
+		} else {
+			logging.FromContext(ctx).Error("Failed to get balance", "wallet_id", walletID, "at", at, "error", err)
+			sendErrorResponse(w, r, codeInternal, "Failed to get balance", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	sendSuccessResponse(w, map[string]any{
+		"walletId": walletID,
+		"balance":  balance,
+		"at":       at.UTC().Format(time.RFC3339Nano),
 	})
 }
 
+// statementWriteTimeout bounds each write of a statement instead of the server's
+// write timeout, which would cut long statements however fast the client reads.
+const statementWriteTimeout = 30 * time.Second
+
+// HandleStatement streams the statement of a wallet between the from and to
+// parameters, to defaulting to now, in the format parameter: csv (the default),
+// jsonl or txt.
+func (h *WalletHandler) HandleStatement(w http.ResponseWriter, r *http.Request) {
+	walletID := walletIDFromPath(r)
+	if _, err := uuid.Parse(walletID); err != nil {
+		sendErrorResponse(w, r, codeInvalidWalletID, "Invalid wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	format, err := statement.ParseFormat(cmp.Or(query.Get("format"), string(statement.CSV)))
+	if err != nil {
+		sendErrorResponse(w, r, codeInvalidFormat, "Invalid format, expected csv, jsonl or txt", http.StatusBadRequest)
+		return
+	}
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		sendErrorResponse(w, r, codeInvalidTimestamp, "Invalid from, expected an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	to := now
+	if query.Has("to") {
+		if to, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			sendErrorResponse(w, r, codeInvalidTimestamp, "Invalid to, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.After(now) {
+		sendErrorResponse(w, r, codeInvalidTimestamp, "to must not be in the future", http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		sendErrorResponse(w, r, codeInvalidTimestamp, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	out := &statementResponse{w: w, rc: http.NewResponseController(w), format: format, walletID: walletID}
+	err = h.service.WriteStatement(ctx, walletID, from, to, statement.NewWriter(format, out))
+	switch {
+	case err == nil:
+	case out.written == 0 && errors.Is(err, model.ErrWalletNotFound):
+		sendErrorResponse(w, r, model.CodeWalletNotFound, "Wallet not found", http.StatusNotFound)
+	case out.written == 0:
+		logging.FromContext(ctx).Error("Failed to get statement", "wallet_id", walletID, "error", err)
+		sendErrorResponse(w, r, codeInternal, "Failed to get statement", http.StatusInternalServerError)
+	default:
+		// The status is sent, aborting the response tells the client it is incomplete
+		if ctx.Err() == nil {
+			logging.FromContext(ctx).Error("Statement interrupted", "wallet_id", walletID, "written", out.written, "error", err)
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// statementResponse sets the headers of a statement on its first write, so an
+// error found before anything is written still gets an error response, and
+// pushes the write deadline back on every write.
+type statementResponse struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	format   statement.Format
+	walletID string
+	written  int64
+}
+
+func (s *statementResponse) Write(p []byte) (int, error) {
+	if s.written == 0 {
+		header := s.w.Header()
+		header.Set("Content-Type", s.format.ContentType())
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s.%s"`, s.walletID, s.format))
+		header.Set("Cache-Control", "no-store")
+	}
+	// Not every ResponseWriter supports deadlines, recorders in tests don't
+	_ = s.rc.SetWriteDeadline(time.Now().Add(statementWriteTimeout))
+
+	n, err := s.w.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// setCacheHeaders reports the balance freshness with the Cache-Status header (RFC 9211).
+func setCacheHeaders(w http.ResponseWriter, info service.BalanceInfo) {
+	switch info.CacheStatus {
+	case service.CacheHit:
+		w.Header().Set("Cache-Status", "wallet-api; hit")
+		w.Header().Set("Age", strconv.FormatInt(int64(info.Age.Seconds()), 10))
+	case service.CacheMiss:
+		w.Header().Set("Cache-Status", "wallet-api; fwd=miss; stored")
+	case service.CacheBypass:
+		w.Header().Set("Cache-Status", "wallet-api; fwd=bypass")
+	}
+}
+
+// logTransaction records the outcome of a transaction for auditing.
+func logTransaction(ctx context.Context, t model.Transaction, latency time.Duration, err error) {
+	attrs := []any{
+		"wallet_id", t.WalletID,
+		"operation", t.OperationType,
+		"amount", t.Amount,
+		"latency_ms", float64(latency.Microseconds()) / 1000,
+		"outcome", metrics.Outcome(err),
+	}
+	if tenant := mtls.Tenant(ctx); tenant != "" {
+		attrs = append(attrs, "tenant", tenant)
+	}
+
+	logger := logging.FromContext(ctx)
+	switch {
+	case err == nil:
+		logger.Info("Transaction completed", attrs...)
+	case errors.Is(err, model.ErrWalletNotFound),
+		errors.Is(err, model.ErrInsufficientFunds),
+		errors.Is(err, model.ErrInvalidAmount),
+		errors.Is(err, model.ErrWalletFrozen),
+		errors.Is(err, model.ErrDuplicateReference):
+		logger.Info("Transaction rejected", attrs...)
+	default:
+		logger.Error("Transaction failed", append(attrs, "error", err)...)
+	}
+}
+
 func sendSuccessResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -5,17 +5,23 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
 	"WalletApi/internal/handler"
+	"WalletApi/internal/logging"
 	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/service"
+	"WalletApi/internal/statement"
 )
 
 type MockWalletService struct {
@@ -37,8 +43,35 @@ func (m *MockWalletService) GetBalance(ctx context.Context, walletID string) (in
 	return args.Get(0).(int64), args.Error(1)
 }
 
-func (m *MockWalletService) Shutdown() {
-	m.Called()
+func (m *MockWalletService) GetBalanceInfo(ctx context.Context, walletID string) (service.BalanceInfo, error) {
+	args := m.Called(ctx, walletID)
+	return args.Get(0).(service.BalanceInfo), args.Error(1)
+}
+
+func (m *MockWalletService) GetBalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error) {
+	args := m.Called(ctx, walletID, at)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockWalletService) WriteStatement(ctx context.Context, walletID string, from, to time.Time, w statement.Writer) error {
+	args := m.Called(ctx, walletID, from, to, w)
+	return args.Error(0)
+}
+
+func (m *MockWalletService) QueueDepths() []int {
+	args := m.Called()
+	depths, _ := args.Get(0).([]int)
+	return depths
+}
+
+func (m *MockWalletService) QueueCapacity() int {
+	args := m.Called()
+	return args.Int(0)
+}
+
+func (m *MockWalletService) Shutdown(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
 }
 
 func TestWalletHandler_CreateWallet_Success(t *testing.T) {
@@ -105,6 +138,7 @@ func TestWalletHandler_HandleTransaction_Success(t *testing.T) {
 
 	url := "/api/v1/wallets/" + testUUID + "/transactions"
 	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
 	handler.HandleTransaction(w, req)
@@ -137,6 +171,7 @@ func TestWalletHandler_HandleTransaction_InvalidUUID(t *testing.T) {
 
 	url := "/api/v1/wallets/invalid-uuid/transactions"
 	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
 	handler.HandleTransaction(w, req)
@@ -162,6 +197,7 @@ func TestWalletHandler_HandleTransaction_InvalidJSON(t *testing.T) {
 	body := []byte(`{"operationType": "DEPOSIT", "amount": "should_be_number"}`)
 	url := "/api/v1/wallets/" + testUUID + "/transactions"
 	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
 	handler.HandleTransaction(w, req)
@@ -176,7 +212,129 @@ func TestWalletHandler_HandleTransaction_InvalidJSON(t *testing.T) {
 	assert.NoError(t, err)
 
 	errorData := responseBody["error"].(map[string]interface{})
-	assert.Equal(t, "Invalid JSON format", errorData["message"])
+	assert.Equal(t, `Field "amount" must be int64`, errorData["message"])
+	assert.Equal(t, "invalid_field_type", errorData["reason"])
+}
+
+func TestWalletHandler_HandleTransaction_StrictDecoding(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	handler := handler.NewWalletHandler(mockService, handler.WithMaxBodyBytes(128))
+
+	testCases := []struct {
+		name         string
+		contentType  string
+		body         string
+		expectedCode int
+		reason       string
+	}{
+		{
+			name:         "Missing content type",
+			body:         `{"operationType": "DEPOSIT", "amount": 100}`,
+			expectedCode: http.StatusUnsupportedMediaType,
+			reason:       "unsupported_media_type",
+		},
+		{
+			name:         "Form content type",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         `{"operationType": "DEPOSIT", "amount": 100}`,
+			expectedCode: http.StatusUnsupportedMediaType,
+			reason:       "unsupported_media_type",
+		},
+		{
+			name:         "Body too large",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT", "amount": 100` + strings.Repeat(" ", 200) + `}`,
+			expectedCode: http.StatusRequestEntityTooLarge,
+			reason:       "body_too_large",
+		},
+		{
+			name:         "Empty body",
+			contentType:  "application/json",
+			expectedCode: http.StatusBadRequest,
+			reason:       "empty_body",
+		},
+		{
+			name:         "Malformed JSON",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT",`,
+			expectedCode: http.StatusBadRequest,
+			reason:       "malformed_json",
+		},
+		{
+			name:         "Unknown field",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT", "amount": 100, "currency": "USD"}`,
+			expectedCode: http.StatusBadRequest,
+			reason:       "unknown_field",
+		},
+		{
+			name:         "Duplicate key",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT", "amount": 1, "amount": 100}`,
+			expectedCode: http.StatusBadRequest,
+			reason:       "duplicate_key",
+		},
+		{
+			name:         "Duplicate key differing in case",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT", "amount": 1, "Amount": 100}`,
+			expectedCode: http.StatusBadRequest,
+			reason:       "duplicate_key",
+		},
+		{
+			name:         "Multiple values",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT", "amount": 100} {"amount": 1}`,
+			expectedCode: http.StatusBadRequest,
+			reason:       "multiple_values",
+		},
+		{
+			name:         "Trailing garbage",
+			contentType:  "application/json",
+			body:         `{"operationType": "DEPOSIT", "amount": 100}garbage`,
+			expectedCode: http.StatusBadRequest,
+			reason:       "multiple_values",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url := "/api/v1/wallets/" + testUUID + "/transactions"
+			req := httptest.NewRequest("POST", url, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			handler.HandleTransaction(w, req)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+
+			var responseBody map[string]interface{}
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&responseBody))
+			errorData := responseBody["error"].(map[string]interface{})
+			assert.Equal(t, tc.reason, errorData["reason"])
+		})
+	}
+
+	mockService.AssertNotCalled(t, "ProcessTransaction", mock.Anything, mock.Anything)
+}
+
+func TestWalletHandler_HandleTransaction_ContentTypeWithCharset(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	mockService.On("ProcessTransaction", mock.Anything, mock.Anything).Return(nil)
+	handler := handler.NewWalletHandler(mockService)
+
+	url := "/api/v1/wallets/" + testUUID + "/transactions"
+	req := httptest.NewRequest("POST", url, strings.NewReader(`{"operationType": "DEPOSIT", "amount": 100}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+
+	handler.HandleTransaction(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
 }
 
 func TestWalletHandler_HandleTransaction_ValidationErrors(t *testing.T) {
@@ -210,6 +368,7 @@ func TestWalletHandler_HandleTransaction_ValidationErrors(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			url := "/api/v1/wallets/" + testUUID + "/transactions"
 			req := httptest.NewRequest("POST", url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
 			w := httptest.NewRecorder()
 
 			handler.HandleTransaction(w, req)
@@ -258,11 +417,17 @@ func TestWalletHandler_HandleTransaction_ServiceErrors(t *testing.T) {
 			expectedCode: http.StatusBadRequest,
 			expectedMsg:  "Invalid amount",
 		},
+		{
+			name:         "Shutting down",
+			serviceError: model.ErrShuttingDown,
+			expectedCode: http.StatusServiceUnavailable,
+			expectedMsg:  "Service is shutting down",
+		},
 		{
 			name:         "Other error",
 			serviceError: errors.New("database error"),
 			expectedCode: http.StatusInternalServerError,
-			expectedMsg:  "Transaction failed: database error",
+			expectedMsg:  "Transaction failed",
 		},
 	}
 
@@ -279,6 +444,7 @@ func TestWalletHandler_HandleTransaction_ServiceErrors(t *testing.T) {
 
 			url := "/api/v1/wallets/" + testUUID + "/transactions"
 			req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
 			w := httptest.NewRecorder()
 
 			handler.HandleTransaction(w, req)
@@ -301,7 +467,7 @@ func TestWalletHandler_HandleTransaction_ServiceErrors(t *testing.T) {
 func TestWalletHandler_HandleGetBalance_Success(t *testing.T) {
 	testUUID := uuid.NewString()
 	mockService := new(MockWalletService)
-	mockService.On("GetBalance", mock.Anything, testUUID).Return(int64(150), nil)
+	mockService.On("GetBalanceInfo", mock.Anything, testUUID).Return(service.BalanceInfo{Balance: 150}, nil)
 
 	handler := handler.NewWalletHandler(mockService)
 
@@ -322,12 +488,31 @@ func TestWalletHandler_HandleGetBalance_Success(t *testing.T) {
 
 	data := responseBody["data"].(map[string]interface{})
 	assert.Equal(t, float64(150), data["balance"])
+	assert.Equal(t, float64(0), data["creditLimit"])
+	assert.Equal(t, float64(150), data["available"])
+	assert.Equal(t, float64(0), data["overdraftUsed"])
+}
+
+func TestWalletHandler_HandleGetBalance_Overdrawn(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	mockService.On("GetBalanceInfo", mock.Anything, testUUID).Return(service.BalanceInfo{Balance: -40, CreditLimit: 100}, nil)
+
+	handler := handler.NewWalletHandler(mockService)
+
+	req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID, nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleGetBalance(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":{"balance":-40,"creditLimit":100,"available":60,"overdraftUsed":40}}`, w.Body.String())
 }
 
 func TestWalletHandler_HandleGetBalance_WalletNotFound(t *testing.T) {
 	testUUID := uuid.NewString()
 	mockService := new(MockWalletService)
-	mockService.On("GetBalance", mock.Anything, testUUID).Return(int64(0), model.ErrWalletNotFound)
+	mockService.On("GetBalanceInfo", mock.Anything, testUUID).Return(service.BalanceInfo{}, model.ErrWalletNotFound)
 
 	handler := handler.NewWalletHandler(mockService)
 
@@ -353,7 +538,7 @@ func TestWalletHandler_HandleGetBalance_WalletNotFound(t *testing.T) {
 func TestWalletHandler_HandleGetBalance_ServiceError(t *testing.T) {
 	testUUID := uuid.NewString()
 	mockService := new(MockWalletService)
-	mockService.On("GetBalance", mock.Anything, testUUID).Return(int64(0), errors.New("db error"))
+	mockService.On("GetBalanceInfo", mock.Anything, testUUID).Return(service.BalanceInfo{}, errors.New("db error"))
 
 	handler := handler.NewWalletHandler(mockService)
 
@@ -375,3 +560,308 @@ func TestWalletHandler_HandleGetBalance_ServiceError(t *testing.T) {
 	errorData := responseBody["error"].(map[string]interface{})
 	assert.Equal(t, "Failed to get balance", errorData["message"])
 }
+
+func TestWalletHandler_HandleGetBalance_Consistency(t *testing.T) {
+	testUUID := uuid.NewString()
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStrong bool
+	}{
+		{name: "Default", query: "", expectedStrong: false},
+		{name: "Eventual", query: "?consistency=eventual", expectedStrong: false},
+		{name: "Strong", query: "?consistency=strong", expectedStrong: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockWalletService)
+			mockService.On("GetBalanceInfo", mock.MatchedBy(func(ctx context.Context) bool {
+				return repository.IsStrongConsistency(ctx) == tc.expectedStrong
+			}), testUUID).Return(service.BalanceInfo{Balance: 150}, nil)
+
+			handler := handler.NewWalletHandler(mockService)
+
+			req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID+tc.query, nil)
+			w := httptest.NewRecorder()
+
+			handler.HandleGetBalance(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestWalletHandler_HandleGetBalance_InvalidConsistency(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	handler := handler.NewWalletHandler(mockService)
+
+	req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID+"?consistency=sometimes", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleGetBalance(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockService.AssertNotCalled(t, "GetBalanceInfo", mock.Anything, mock.Anything)
+}
+
+func TestWalletHandler_HandleGetBalanceAt(t *testing.T) {
+	testUUID := uuid.NewString()
+	at := time.Date(2025, time.January, 31, 23, 59, 59, 0, time.UTC)
+	mockService := new(MockWalletService)
+	mockService.On("GetBalanceAt", mock.Anything, testUUID, mock.MatchedBy(at.Equal)).Return(int64(150), nil)
+
+	handler := handler.NewWalletHandler(mockService)
+
+	// The offset is kept apart from the instant, the response is in UTC
+	req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID+"/balance?at=2025-02-01T00:59:59%2B01:00", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleGetBalanceAt(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":{"walletId":"`+testUUID+`","balance":150,"at":"2025-01-31T23:59:59Z"}}`, w.Body.String())
+	mockService.AssertExpectations(t)
+}
+
+func TestWalletHandler_HandleGetBalanceAt_Errors(t *testing.T) {
+	testUUID := uuid.NewString()
+	missingUUID := uuid.NewString()
+	brokenUUID := uuid.NewString()
+
+	mockService := new(MockWalletService)
+	mockService.On("GetBalanceAt", mock.Anything, missingUUID, mock.Anything).Return(int64(0), model.ErrWalletNotFound)
+	mockService.On("GetBalanceAt", mock.Anything, brokenUUID, mock.Anything).Return(int64(0), errors.New("db error"))
+	handler := handler.NewWalletHandler(mockService)
+
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+		reason string
+	}{
+		{"Invalid wallet ID", "/api/v1/wallets/42/balance?at=2025-01-31T00:00:00Z", http.StatusBadRequest, "invalid_wallet_id"},
+		{"Missing at", "/api/v1/wallets/" + testUUID + "/balance", http.StatusBadRequest, "invalid_timestamp"},
+		{"Date only", "/api/v1/wallets/" + testUUID + "/balance?at=2025-01-31", http.StatusBadRequest, "invalid_timestamp"},
+		{"Future", "/api/v1/wallets/" + testUUID + "/balance?at=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), http.StatusBadRequest, "invalid_timestamp"},
+		{"Wallet not found", "/api/v1/wallets/" + missingUUID + "/balance?at=2025-01-31T00:00:00Z", http.StatusNotFound, "wallet_not_found"},
+		{"Service error", "/api/v1/wallets/" + brokenUUID + "/balance?at=2025-01-31T00:00:00Z", http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.HandleGetBalanceAt(w, httptest.NewRequest("GET", tc.path, nil))
+
+			assert.Equal(t, tc.status, w.Code)
+			var body struct {
+				Error struct {
+					Reason string `json:"reason"`
+				} `json:"error"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tc.reason, body.Error.Reason)
+		})
+	}
+	mockService.AssertNotCalled(t, "GetBalanceAt", mock.Anything, testUUID, mock.Anything)
+}
+
+func TestWalletHandler_HandleStatement(t *testing.T) {
+	testUUID := uuid.NewString()
+	from := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+	mockService := new(MockWalletService)
+	mockService.On("WriteStatement", mock.Anything, testUUID, mock.MatchedBy(from.Equal), mock.MatchedBy(to.Equal), mock.Anything).
+		Run(func(args mock.Arguments) {
+			w := args.Get(4).(statement.Writer)
+			assert.NoError(t, w.Begin(statement.Header{WalletID: testUUID, From: from, To: to, Opening: 100}))
+			assert.NoError(t, w.End(100))
+		}).
+		Return(nil)
+	handler := handler.NewWalletHandler(mockService)
+
+	req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID+"/statement?from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z&format=jsonl", nil)
+	w := httptest.NewRecorder()
+	handler.HandleStatement(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/jsonl", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="statement-`+testUUID+`.jsonl"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, `{"record":"opening","walletId":"`+testUUID+`","at":"2025-01-01T00:00:00Z","balance":100}
+{"record":"closing","walletId":"`+testUUID+`","at":"2025-02-01T00:00:00Z","balance":100,"entries":0}
+`, w.Body.String())
+
+	// CSV unless asked otherwise
+	w = httptest.NewRecorder()
+	handler.HandleStatement(w, httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID+"/statement?from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "record,wallet_id,"), w.Body.String())
+}
+
+func TestWalletHandler_HandleStatement_Errors(t *testing.T) {
+	testUUID := uuid.NewString()
+	missingUUID := uuid.NewString()
+	brokenUUID := uuid.NewString()
+
+	mockService := new(MockWalletService)
+	mockService.On("WriteStatement", mock.Anything, missingUUID, mock.Anything, mock.Anything, mock.Anything).Return(model.ErrWalletNotFound)
+	mockService.On("WriteStatement", mock.Anything, brokenUUID, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("db error"))
+	handler := handler.NewWalletHandler(mockService)
+
+	const period = "from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z"
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+		reason string
+	}{
+		{"Invalid wallet ID", "/api/v1/wallets/42/statement?" + period, http.StatusBadRequest, "invalid_wallet_id"},
+		{"Unknown format", "/api/v1/wallets/" + testUUID + "/statement?format=pdf&" + period, http.StatusBadRequest, "invalid_format"},
+		{"Missing from", "/api/v1/wallets/" + testUUID + "/statement", http.StatusBadRequest, "invalid_timestamp"},
+		{"Invalid to", "/api/v1/wallets/" + testUUID + "/statement?from=2025-01-01T00:00:00Z&to=tomorrow", http.StatusBadRequest, "invalid_timestamp"},
+		{"Future to", "/api/v1/wallets/" + testUUID + "/statement?from=2025-01-01T00:00:00Z&to=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), http.StatusBadRequest, "invalid_timestamp"},
+		{"From after to", "/api/v1/wallets/" + testUUID + "/statement?from=2025-02-01T00:00:00Z&to=2025-01-01T00:00:00Z", http.StatusBadRequest, "invalid_timestamp"},
+		{"Wallet not found", "/api/v1/wallets/" + missingUUID + "/statement?" + period, http.StatusNotFound, "wallet_not_found"},
+		{"Service error", "/api/v1/wallets/" + brokenUUID + "/statement?" + period, http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.HandleStatement(w, httptest.NewRequest("GET", tc.path, nil))
+
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Empty(t, w.Header().Get("Content-Disposition"))
+			var body struct {
+				Error struct {
+					Reason string `json:"reason"`
+				} `json:"error"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tc.reason, body.Error.Reason)
+		})
+	}
+	mockService.AssertNotCalled(t, "WriteStatement", mock.Anything, testUUID, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestWalletHandler_HandleStatement_Interrupted(t *testing.T) {
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	mockService.On("WriteStatement", mock.Anything, testUUID, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			w := args.Get(4).(statement.Writer)
+			assert.NoError(t, w.Begin(statement.Header{WalletID: testUUID}))
+			// More than the writer buffers, so the opening lines reach the client
+			for i := range 100 {
+				assert.NoError(t, w.Entry(model.LedgerEntry{ID: int64(i), WalletID: testUUID, OperationType: model.Deposit, Amount: 1}, int64(i)))
+			}
+		}).
+		Return(errors.New("connection reset"))
+	handler := handler.NewWalletHandler(mockService)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID+"/statement?from=2025-01-01T00:00:00Z", nil)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { handler.HandleStatement(w, req) })
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "closing")
+}
+
+func TestWalletHandler_HandleGetBalance_CacheHeaders(t *testing.T) {
+	testUUID := uuid.NewString()
+
+	testCases := []struct {
+		name           string
+		info           service.BalanceInfo
+		expectedStatus string
+		expectedAge    string
+	}{
+		{
+			name:           "Cache disabled",
+			info:           service.BalanceInfo{Balance: 10},
+			expectedStatus: "",
+		},
+		{
+			name:           "Hit",
+			info:           service.BalanceInfo{Balance: 10, CacheStatus: service.CacheHit, Age: 3 * time.Second},
+			expectedStatus: "wallet-api; hit",
+			expectedAge:    "3",
+		},
+		{
+			name:           "Miss",
+			info:           service.BalanceInfo{Balance: 10, CacheStatus: service.CacheMiss},
+			expectedStatus: "wallet-api; fwd=miss; stored",
+		},
+		{
+			name:           "Bypass",
+			info:           service.BalanceInfo{Balance: 10, CacheStatus: service.CacheBypass},
+			expectedStatus: "wallet-api; fwd=bypass",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockWalletService)
+			mockService.On("GetBalanceInfo", mock.Anything, testUUID).Return(tc.info, nil)
+
+			handler := handler.NewWalletHandler(mockService)
+
+			req := httptest.NewRequest("GET", "/api/v1/wallets/"+testUUID, nil)
+			w := httptest.NewRecorder()
+
+			handler.HandleGetBalance(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tc.expectedStatus, w.Header().Get("Cache-Status"))
+			assert.Equal(t, tc.expectedAge, w.Header().Get("Age"))
+		})
+	}
+}
+
+func TestWalletHandler_HandleTransaction_LogsOutcomeWithoutLeakingErrors(t *testing.T) {
+	var logs bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prevLogger)
+
+	testUUID := uuid.NewString()
+	mockService := new(MockWalletService)
+	mockService.On("ProcessTransaction", mock.Anything, mock.Anything).
+		Return(errors.New("pq: connection refused to 10.0.0.5"))
+
+	h := logging.Middleware(http.HandlerFunc(handler.NewWalletHandler(mockService).HandleTransaction))
+
+	body := `{"operationType": "WITHDRAW", "amount": 25}`
+	req := httptest.NewRequest("POST", "/api/v1/wallets/"+testUUID+"/transactions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(logging.RequestIDHeader, "req-7")
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "req-7", w.Header().Get(logging.RequestIDHeader))
+	assert.NotContains(t, w.Body.String(), "10.0.0.5")
+
+	var responseBody map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+	errorData := responseBody["error"].(map[string]interface{})
+	assert.Equal(t, "Transaction failed", errorData["message"])
+	assert.Equal(t, "req-7", errorData["requestId"])
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &line))
+	assert.Equal(t, "Transaction failed", line["msg"])
+	assert.Equal(t, "req-7", line["request_id"])
+	assert.Equal(t, testUUID, line["wallet_id"])
+	assert.Equal(t, "WITHDRAW", line["operation"])
+	assert.Equal(t, float64(25), line["amount"])
+	assert.Contains(t, line, "latency_ms")
+	assert.Contains(t, line["error"], "10.0.0.5")
+}
@@ -0,0 +1,180 @@
+// Package interest computes the interest accrued by wallets in exact integer
+// arithmetic. An accrual is an Amount of whole minor units and a fraction of one
+// over Denominator, which every day count convention divides evenly, so no
+// rounding happens until the interest is posted.
+package interest
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// DayCount is the convention that sets the share of the annual rate a day earns.
+type DayCount string
+
+const (
+	// Actual365 earns 1/365 of the rate per day, leap years included
+	Actual365 DayCount = "ACT/365"
+	// Actual360 earns 1/360 of the rate per day
+	Actual360 DayCount = "ACT/360"
+	// ActualActual earns 1/365 of the rate per day, 1/366 in leap years
+	ActualActual DayCount = "ACT/ACT"
+	// Thirty360 counts 30 days per month and 360 per year: the 31st earns
+	// nothing and the last day of February earns the days up to the 30th
+	Thirty360 DayCount = "30/360"
+)
+
+// Rounding is how the accrued interest is rounded to minor units when it is posted.
+type Rounding string
+
+const (
+	RoundDown     Rounding = "DOWN"
+	RoundUp       Rounding = "UP"
+	RoundHalfUp   Rounding = "HALF_UP"
+	RoundHalfEven Rounding = "HALF_EVEN"
+)
+
+// MaxRateBps is the highest annual rate, 100%.
+const MaxRateBps = 10_000
+
+// yearDays is the least common multiple of the 360, 365 and 366 days years.
+const yearDays = 1_603_080
+
+// Denominator is the denominator of the fractions of minor units: a basis point
+// of the rate over any year length divides it.
+const Denominator int64 = 10_000 * yearDays
+
+var (
+	ErrInvalidDayCount = errors.New("invalid day count convention")
+	ErrInvalidRounding = errors.New("invalid rounding mode")
+)
+
+// ParseDayCount returns the convention named s.
+func ParseDayCount(s string) (DayCount, error) {
+	switch dc := DayCount(s); dc {
+	case Actual365, Actual360, ActualActual, Thirty360:
+		return dc, nil
+	default:
+		return "", fmt.Errorf("%w %q, expected ACT/365, ACT/360, ACT/ACT or 30/360", ErrInvalidDayCount, s)
+	}
+}
+
+// ParseRounding returns the rounding mode named s.
+func ParseRounding(s string) (Rounding, error) {
+	switch r := Rounding(s); r {
+	case RoundDown, RoundUp, RoundHalfUp, RoundHalfEven:
+		return r, nil
+	default:
+		return "", fmt.Errorf("%w %q, expected DOWN, UP, HALF_UP or HALF_EVEN", ErrInvalidRounding, s)
+	}
+}
+
+// Amount is Units minor units plus Fraction/Denominator of one, exactly.
+// Fraction is always in [0, Denominator), so a negative amount has negative
+// Units: -0.25 is -1 and 0.75.
+type Amount struct {
+	Units    int64 `json:"units"`
+	Fraction int64 `json:"fraction"`
+}
+
+// normalize carries the fraction into the units.
+func (a Amount) normalize() Amount {
+	a.Units += a.Fraction / Denominator
+	a.Fraction %= Denominator
+	if a.Fraction < 0 {
+		a.Units--
+		a.Fraction += Denominator
+	}
+	return a
+}
+
+// Add returns a + b.
+func (a Amount) Add(b Amount) Amount {
+	return Amount{Units: a.Units + b.Units, Fraction: a.Fraction + b.Fraction}.normalize()
+}
+
+// Sub returns a less units whole minor units.
+func (a Amount) Sub(units int64) Amount {
+	a.Units -= units
+	return a
+}
+
+// Round returns a rounded to whole minor units. Halves are rounded up, toward
+// the greater amount, by RoundHalfUp.
+func (a Amount) Round(mode Rounding) int64 {
+	twice := 2 * a.Fraction
+	switch {
+	case a.Fraction == 0, mode == RoundDown:
+		return a.Units
+	case mode == RoundUp:
+		return a.Units + 1
+	case twice > Denominator, twice == Denominator && mode == RoundHalfUp:
+		return a.Units + 1
+	case twice == Denominator && mode == RoundHalfEven && a.Units%2 != 0:
+		return a.Units + 1
+	default:
+		return a.Units
+	}
+}
+
+// String formats a as its units and fraction, 12+3/Denominator.
+func (a Amount) String() string {
+	return fmt.Sprintf("%d+%d/%d", a.Units, a.Fraction, Denominator)
+}
+
+// Post rounds the accrued amount to the minor units to post and returns them
+// with the remainder carried to the next period, accrued less the posted units.
+// Nothing is posted while the accrued amount rounds below zero, which a carry
+// rounded up in an earlier period can do.
+func Post(accrued Amount, mode Rounding) (int64, Amount) {
+	posted := max(accrued.Round(mode), 0)
+	return posted, accrued.Sub(posted)
+}
+
+// DayFactor returns the days day earns, over the days of its year, by the convention.
+func DayFactor(dc DayCount, day time.Time) (days, year int64) {
+	day = day.UTC()
+	switch dc {
+	case Actual360:
+		return 1, 360
+	case ActualActual:
+		if isLeap(day.Year()) {
+			return 1, 366
+		}
+		return 1, 365
+	case Thirty360:
+		switch {
+		case day.Day() == 31:
+			return 0, 360
+		case day.Month() == time.February && day.AddDate(0, 0, 1).Month() == time.March:
+			return int64(30 - day.Day() + 1), 360
+		default:
+			return 1, 360
+		}
+	default:
+		return 1, 365
+	}
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// Accrue returns the interest earned on day by a balance held through it at the
+// annual rate in basis points. Balances of zero or less earn nothing. The rate
+// must be between 0 and MaxRateBps.
+func Accrue(balance, rateBps int64, dc DayCount, day time.Time) Amount {
+	days, year := DayFactor(dc, day)
+	if balance <= 0 || rateBps <= 0 || days == 0 {
+		return Amount{}
+	}
+	// balance * rate / 10_000 * days / year, over Denominator. The factor is at
+	// most 10_000 * 3 * 4_453 < 2^27, so the product fits in 128 bits with its
+	// high word below Denominator, and the quotient is below the balance.
+	factor := uint64(rateBps * days * (yearDays / year))
+	hi, lo := bits.Mul64(uint64(balance), factor)
+	units, fraction := bits.Div64(hi, lo, uint64(Denominator))
+	return Amount{Units: int64(units), Fraction: int64(fraction)}
+}
@@ -0,0 +1,181 @@
+package interest_test
+
+import (
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/interest"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// fraction returns the amount num/den of a minor unit above units.
+func fraction(units, num, den int64) interest.Amount {
+	return interest.Amount{Units: units, Fraction: interest.Denominator / den * num}
+}
+
+// accrueYear sums the daily interest on balance over the year.
+func accrueYear(balance, rateBps int64, dc interest.DayCount, year int) interest.Amount {
+	var total interest.Amount
+	for d := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC); d.Year() == year; d = d.AddDate(0, 0, 1) {
+		total = total.Add(interest.Accrue(balance, rateBps, dc, d))
+	}
+	return total
+}
+
+func TestAccrue_Year(t *testing.T) {
+	// 10,000.00 at 5% earns 500.00 over a year of the convention
+	testCases := []struct {
+		name string
+		dc   interest.DayCount
+		year int
+		want interest.Amount
+	}{
+		{"ACT/365", interest.Actual365, 2025, fraction(50_000, 0, 1)},
+		{"ACT/365 over a leap year", interest.Actual365, 2024, fraction(50_136, 72, 73)},
+		{"ACT/360", interest.Actual360, 2025, fraction(50_694, 4, 9)},
+		{"ACT/ACT", interest.ActualActual, 2025, fraction(50_000, 0, 1)},
+		{"ACT/ACT over a leap year", interest.ActualActual, 2024, fraction(50_000, 0, 1)},
+		{"30/360", interest.Thirty360, 2025, fraction(50_000, 0, 1)},
+		{"30/360 over a leap year", interest.Thirty360, 2024, fraction(50_000, 0, 1)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, accrueYear(1_000_000, 500, tc.dc, tc.year))
+		})
+	}
+}
+
+func TestDayFactor_Thirty360(t *testing.T) {
+	testCases := []struct {
+		day  string
+		want int64
+	}{
+		{"2025-01-30", 1},
+		{"2025-01-31", 0},
+		{"2025-02-27", 1},
+		{"2025-02-28", 3},
+		{"2024-02-28", 1},
+		{"2024-02-29", 2},
+		{"2025-04-30", 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.day, func(t *testing.T) {
+			days, year := interest.DayFactor(interest.Thirty360, day(tc.day))
+			assert.Equal(t, tc.want, days)
+			assert.Equal(t, int64(360), year)
+		})
+	}
+}
+
+func TestAccrue(t *testing.T) {
+	// A day of 1.00 at 1% under ACT/365 is 1/365 of a cent
+	assert.Equal(t, fraction(0, 1, 365), interest.Accrue(100, 100, interest.Actual365, day("2025-03-01")))
+	assert.Equal(t, interest.Amount{}, interest.Accrue(0, 500, interest.Actual365, day("2025-03-01")))
+	assert.Equal(t, interest.Amount{}, interest.Accrue(-5_000, 500, interest.Actual365, day("2025-03-01")))
+
+	// The largest balance at the largest rate over the longest day does not overflow
+	got := interest.Accrue(math.MaxInt64, interest.MaxRateBps, interest.Thirty360, day("2025-02-28"))
+	units, rem := new(big.Int).QuoRem(
+		new(big.Int).Mul(big.NewInt(math.MaxInt64), big.NewInt(3)),
+		big.NewInt(360),
+		new(big.Int),
+	)
+	assert.Equal(t, units.Int64(), got.Units)
+	assert.Equal(t, rem.Int64()*(interest.Denominator/360), got.Fraction)
+}
+
+func TestAmount_Round(t *testing.T) {
+	testCases := []struct {
+		name   string
+		amount interest.Amount
+		want   map[interest.Rounding]int64
+	}{
+		{"whole", fraction(7, 0, 1), map[interest.Rounding]int64{
+			interest.RoundDown: 7, interest.RoundUp: 7, interest.RoundHalfUp: 7, interest.RoundHalfEven: 7}},
+		{"below half", fraction(7, 1, 4), map[interest.Rounding]int64{
+			interest.RoundDown: 7, interest.RoundUp: 8, interest.RoundHalfUp: 7, interest.RoundHalfEven: 7}},
+		{"half of even", fraction(6, 1, 2), map[interest.Rounding]int64{
+			interest.RoundDown: 6, interest.RoundUp: 7, interest.RoundHalfUp: 7, interest.RoundHalfEven: 6}},
+		{"half of odd", fraction(7, 1, 2), map[interest.Rounding]int64{
+			interest.RoundDown: 7, interest.RoundUp: 8, interest.RoundHalfUp: 8, interest.RoundHalfEven: 8}},
+		{"above half", fraction(7, 3, 4), map[interest.Rounding]int64{
+			interest.RoundDown: 7, interest.RoundUp: 8, interest.RoundHalfUp: 8, interest.RoundHalfEven: 8}},
+		{"negative half", fraction(-1, 1, 2), map[interest.Rounding]int64{
+			interest.RoundDown: -1, interest.RoundUp: 0, interest.RoundHalfUp: 0, interest.RoundHalfEven: 0}},
+	}
+
+	for _, tc := range testCases {
+		for mode, want := range tc.want {
+			t.Run(tc.name+"/"+string(mode), func(t *testing.T) {
+				assert.Equal(t, want, tc.amount.Round(mode))
+			})
+		}
+	}
+}
+
+func TestPost_CarriesRemainder(t *testing.T) {
+	// 0.4 of a unit per period: the remainder carried keeps the posted total
+	// within a unit of the accrued one, and the carry never goes below -1
+	perPeriod := fraction(0, 2, 5)
+	for _, mode := range []interest.Rounding{interest.RoundDown, interest.RoundUp, interest.RoundHalfUp, interest.RoundHalfEven} {
+		t.Run(string(mode), func(t *testing.T) {
+			var carry interest.Amount
+			var posted int64
+			for period := 1; period <= 12; period++ {
+				amount, next := interest.Post(carry.Add(perPeriod), mode)
+				require.GreaterOrEqual(t, amount, int64(0))
+				posted += amount
+				carry = next
+
+				// posted + carry is exactly what accrued
+				assert.Equal(t, fraction(int64(period)*2/5, int64(period)*2%5, 5), carry.Add(interest.Amount{Units: posted}))
+				assert.GreaterOrEqual(t, carry.Units, int64(-1))
+				assert.LessOrEqual(t, carry.Units, int64(0))
+			}
+		})
+	}
+
+	// Rounding down posts a unit every 2.5 periods
+	var carry interest.Amount
+	var amounts []int64
+	for range 5 {
+		var amount int64
+		amount, carry = interest.Post(carry.Add(perPeriod), interest.RoundDown)
+		amounts = append(amounts, amount)
+	}
+	assert.Equal(t, []int64{0, 0, 1, 0, 1}, amounts)
+	assert.Equal(t, interest.Amount{}, carry)
+
+	// A carry below zero is not posted as a debit
+	amount, carry := interest.Post(fraction(-1, 3, 4), interest.RoundDown)
+	assert.Zero(t, amount)
+	assert.Equal(t, fraction(-1, 3, 4), carry)
+}
+
+func TestParse(t *testing.T) {
+	dc, err := interest.ParseDayCount("30/360")
+	require.NoError(t, err)
+	assert.Equal(t, interest.Thirty360, dc)
+	_, err = interest.ParseDayCount("ACT/364")
+	assert.ErrorIs(t, err, interest.ErrInvalidDayCount)
+
+	mode, err := interest.ParseRounding("HALF_EVEN")
+	require.NoError(t, err)
+	assert.Equal(t, interest.RoundHalfEven, mode)
+	_, err = interest.ParseRounding("half_even")
+	assert.ErrorIs(t, err, interest.ErrInvalidRounding)
+}
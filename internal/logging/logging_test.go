@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware_RequestID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "Generated", incoming: "", keep: false},
+		{name: "Propagated", incoming: "req-123", keep: true},
+		{name: "Too long", incoming: strings.Repeat("a", maxRequestIDLength+1), keep: false},
+		{name: "Unprintable", incoming: "req\x01", keep: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var seen string
+			h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestID(r.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.incoming != "" {
+				req.Header.Set(RequestIDHeader, tc.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			echoed := w.Header().Get(RequestIDHeader)
+			assert.Equal(t, seen, echoed)
+			if tc.keep {
+				assert.Equal(t, tc.incoming, echoed)
+			} else {
+				_, err := uuid.Parse(echoed)
+				assert.NoError(t, err, "Generated request ID is not a UUID")
+			}
+		})
+	}
+}
+
+func TestFromContext_AddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(prev)
+
+	FromContext(WithRequestID(context.Background(), "req-42")).Info("hello")
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "req-42", line["request_id"])
+	assert.Equal(t, "hello", line["msg"])
+}
@@ -0,0 +1,368 @@
+// Package metrics holds the Prometheus collectors of the service.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "wallet"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "shard_queue_wait_seconds",
+		Help:      "Time a transaction waited in its shard queue before a worker picked it up.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"shard"})
+
+	transactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transactions_total",
+		Help:      "Processed transactions by operation type and outcome.",
+	}, []string{"operation", "outcome"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "repository_query_duration_seconds",
+		Help:      "Latency of the SQL statements run by the repository.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"query", "outcome"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by a rate limit, by route and limit scope.",
+	}, []string{"route", "scope"})
+
+	reconcileRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_runs_total",
+		Help:      "Balance reconciliation runs by outcome: clean, drift or error.",
+	}, []string{"outcome"})
+
+	reconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the balance reconciliation runs.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900},
+	})
+
+	reconcileChecked = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_wallets_checked",
+		Help:      "Wallets compared with their ledger by the last completed reconciliation run.",
+	})
+
+	reconcileDrifted = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_drifted_wallets",
+		Help:      "Wallets whose balance drifted from their ledger in the last completed reconciliation run.",
+	})
+
+	reconcileLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_last_run_timestamp_seconds",
+		Help:      "Unix time the last reconciliation run completed.",
+	})
+
+	exportRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "export_runs_total",
+		Help:      "Ledger export runs by outcome: success or error.",
+	}, []string{"outcome"})
+
+	exportRows = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "export_rows_total",
+		Help:      "Ledger entries written by completed export runs.",
+	})
+
+	exportWatermark = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "export_watermark",
+		Help:      "ID of the last ledger entry exported by the last completed export run.",
+	})
+
+	scheduledRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduled_runs_total",
+		Help:      "Attempts to run an occurrence of a scheduled transaction by outcome: succeeded, retrying, failed or error.",
+	}, []string{"outcome"})
+
+	interestRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interest_runs_total",
+		Help:      "Interest accrual runs by outcome: success, partial when some wallets failed, or error.",
+	}, []string{"outcome"})
+
+	interestAccruals = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interest_accruals_total",
+		Help:      "Days of interest accrued on wallets.",
+	})
+
+	interestPostings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interest_postings_total",
+		Help:      "Months of interest posted to wallets, including the ones with nothing to post.",
+	})
+
+	overdraftFeeRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "overdraft_fee_runs_total",
+		Help:      "Overdraft fee runs by outcome: success, partial when some wallets failed, or error.",
+	}, []string{"outcome"})
+
+	overdraftFees = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "overdraft_fees_total",
+		Help:      "Daily overdraft fees debited from wallets.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware counts and times requests. It wraps the ServeMux, whose
+// pattern of the matched route is used as the route label.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(rec.status),
+		}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveQueueWait records how long a transaction waited for the shard worker.
+func ObserveQueueWait(shard int, d time.Duration) {
+	queueWait.WithLabelValues(strconv.Itoa(shard)).Observe(d.Seconds())
+}
+
+// ObserveTransaction counts a processed transaction by its outcome.
+func ObserveTransaction(operation model.OperationType, err error) {
+	label := string(operation)
+	if operation != model.Deposit && operation != model.Withdraw {
+		// Keeps arbitrary client input out of the label values
+		label = "unknown"
+	}
+	transactions.WithLabelValues(label, Outcome(err)).Inc()
+}
+
+// ObserveRateLimited counts a request rejected by the client or wallet rate limit.
+func ObserveRateLimited(route, scope string) {
+	rateLimited.WithLabelValues(route, scope).Inc()
+}
+
+// ObserveReconciliation records a balance reconciliation run. The gauges only
+// reflect runs that went through every wallet.
+func ObserveReconciliation(checked, drifted int, d time.Duration, err error) {
+	reconcileDuration.Observe(d.Seconds())
+	switch {
+	case err != nil:
+		reconcileRuns.WithLabelValues("error").Inc()
+		return
+	case drifted > 0:
+		reconcileRuns.WithLabelValues("drift").Inc()
+	default:
+		reconcileRuns.WithLabelValues("clean").Inc()
+	}
+	reconcileChecked.Set(float64(checked))
+	reconcileDrifted.Set(float64(drifted))
+	reconcileLastRun.SetToCurrentTime()
+}
+
+// ObserveExport records a ledger export run. Rows of failed runs are not
+// counted, the next run exports them again.
+func ObserveExport(rows, watermark int64, err error) {
+	if err != nil {
+		exportRuns.WithLabelValues("error").Inc()
+		return
+	}
+	exportRuns.WithLabelValues("success").Inc()
+	exportRows.Add(float64(rows))
+	exportWatermark.Set(float64(watermark))
+}
+
+// ObserveScheduledRun counts an attempt to run an occurrence of a schedule.
+// Attempts that end with an error record no run and count as error.
+func ObserveScheduledRun(status model.RunStatus, err error) {
+	if err != nil {
+		scheduledRuns.WithLabelValues("error").Inc()
+		return
+	}
+	scheduledRuns.WithLabelValues(strings.ToLower(string(status))).Inc()
+}
+
+// ObserveInterestRun records an interest accrual run. The accruals and postings
+// recorded before an error are counted, they are committed.
+func ObserveInterestRun(accruals, postings, failed int, err error) {
+	interestAccruals.Add(float64(accruals))
+	interestPostings.Add(float64(postings))
+	switch {
+	case err != nil:
+		interestRuns.WithLabelValues("error").Inc()
+	case failed > 0:
+		interestRuns.WithLabelValues("partial").Inc()
+	default:
+		interestRuns.WithLabelValues("success").Inc()
+	}
+}
+
+// ObserveOverdraftFeeRun records an overdraft fee run. The fees charged before
+// an error are counted, they are committed.
+func ObserveOverdraftFeeRun(charged, failed int, err error) {
+	overdraftFees.Add(float64(charged))
+	switch {
+	case err != nil:
+		overdraftFeeRuns.WithLabelValues("error").Inc()
+	case failed > 0:
+		overdraftFeeRuns.WithLabelValues("partial").Inc()
+	default:
+		overdraftFeeRuns.WithLabelValues("success").Inc()
+	}
+}
+
+// Outcome names the error kind of a transaction result.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, model.ErrWalletNotFound):
+		return "wallet_not_found"
+	case errors.Is(err, model.ErrInsufficientFunds):
+		return "insufficient_funds"
+	case errors.Is(err, model.ErrInvalidAmount):
+		return "invalid_amount"
+	case errors.Is(err, model.ErrInvalidOperation):
+		return "invalid_operation"
+	case errors.Is(err, model.ErrShuttingDown):
+		return "shutting_down"
+	case errors.Is(err, model.ErrWalletFrozen):
+		return "wallet_frozen"
+	case errors.Is(err, model.ErrDuplicateReference):
+		return "duplicate_reference"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+// QueryHook times repository statements, it is meant for repository.WithQueryHook.
+func QueryHook(ctx context.Context, name string) (context.Context, func(error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		outcome := "success"
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			outcome = "error"
+		}
+		queryDuration.WithLabelValues(name, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterQueueDepth exposes the number of transactions waiting in each shard queue.
+func RegisterQueueDepth(depths func() []int) {
+	prometheus.MustRegister(&queueDepthCollector{depths: depths})
+}
+
+var queueDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "shard_queue_depth"),
+	"Transactions waiting in the shard queue.",
+	[]string{"shard"}, nil,
+)
+
+type queueDepthCollector struct {
+	depths func() []int
+}
+
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	for shard, depth := range c.depths() {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), strconv.Itoa(shard))
+	}
+}
+
+// RegisterDB exposes the connection pool statistics of db, name tells the pools apart.
+func RegisterDB(db *sql.DB, name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterCacheStats exposes the balance cache counters.
+func RegisterCacheStats(stats func() cache.Stats) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "balance_cache_hits_total",
+			Help:      "Balance reads served from the cache.",
+		}, func() float64 { return float64(stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "balance_cache_misses_total",
+			Help:      "Balance reads that missed the cache.",
+		}, func() float64 { return float64(stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "balance_cache_evictions_total",
+			Help:      "Balances evicted from the cache to make room.",
+		}, func() float64 { return float64(stats().Evictions) }),
+	)
+}
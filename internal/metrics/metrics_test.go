@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"WalletApi/internal/model"
+)
+
+func TestMiddleware_LabelsByRoutePattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/wallets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	h := Middleware(mux)
+
+	route := "GET /api/v1/wallets/{id}"
+	before := testutil.ToFloat64(httpRequests.WithLabelValues(route, "GET", "404"))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/wallets/wallet-%d", i), nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, before+3, testutil.ToFloat64(httpRequests.WithLabelValues(route, "GET", "404")))
+
+	unmatchedBefore := testutil.ToFloat64(httpRequests.WithLabelValues("unmatched", "GET", "404"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nope", nil))
+	assert.Equal(t, unmatchedBefore+1, testutil.ToFloat64(httpRequests.WithLabelValues("unmatched", "GET", "404")))
+}
+
+func TestObserveTransaction_Outcomes(t *testing.T) {
+	testCases := []struct {
+		err     error
+		outcome string
+	}{
+		{nil, "success"},
+		{model.ErrInsufficientFunds, "insufficient_funds"},
+		{fmt.Errorf("wrapped: %w", model.ErrWalletNotFound), "wallet_not_found"},
+		{model.ErrWalletFrozen, "wallet_frozen"},
+		{errors.New("connection reset"), "error"},
+	}
+
+	for _, tc := range testCases {
+		counter := transactions.WithLabelValues("WITHDRAW", tc.outcome)
+		before := testutil.ToFloat64(counter)
+		ObserveTransaction(model.Withdraw, tc.err)
+		assert.Equal(t, before+1, testutil.ToFloat64(counter), tc.outcome)
+	}
+
+	before := testutil.ToFloat64(transactions.WithLabelValues("unknown", "invalid_operation"))
+	ObserveTransaction("SOMETHING_ELSE", model.ErrInvalidOperation)
+	assert.Equal(t, before+1, testutil.ToFloat64(transactions.WithLabelValues("unknown", "invalid_operation")))
+}
+
+func TestObserveReconciliation(t *testing.T) {
+	clean := testutil.ToFloat64(reconcileRuns.WithLabelValues("clean"))
+	drift := testutil.ToFloat64(reconcileRuns.WithLabelValues("drift"))
+	failed := testutil.ToFloat64(reconcileRuns.WithLabelValues("error"))
+
+	ObserveReconciliation(10, 2, time.Second, nil)
+	assert.Equal(t, drift+1, testutil.ToFloat64(reconcileRuns.WithLabelValues("drift")))
+	assert.Equal(t, float64(10), testutil.ToFloat64(reconcileChecked))
+	assert.Equal(t, float64(2), testutil.ToFloat64(reconcileDrifted))
+
+	// A failed run leaves the result of the last complete one
+	ObserveReconciliation(3, 0, time.Second, errors.New("connection reset"))
+	assert.Equal(t, failed+1, testutil.ToFloat64(reconcileRuns.WithLabelValues("error")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(reconcileDrifted))
+
+	ObserveReconciliation(10, 0, time.Second, nil)
+	assert.Equal(t, clean+1, testutil.ToFloat64(reconcileRuns.WithLabelValues("clean")))
+	assert.Zero(t, testutil.ToFloat64(reconcileDrifted))
+	assert.NotZero(t, testutil.ToFloat64(reconcileLastRun))
+}
+
+func TestObserveExport(t *testing.T) {
+	succeeded := testutil.ToFloat64(exportRuns.WithLabelValues("success"))
+	failed := testutil.ToFloat64(exportRuns.WithLabelValues("error"))
+	rows := testutil.ToFloat64(exportRows)
+
+	ObserveExport(100, 1200, nil)
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(exportRuns.WithLabelValues("success")))
+	assert.Equal(t, rows+100, testutil.ToFloat64(exportRows))
+	assert.Equal(t, float64(1200), testutil.ToFloat64(exportWatermark))
+
+	ObserveExport(50, 1250, errors.New("bucket not found"))
+	assert.Equal(t, failed+1, testutil.ToFloat64(exportRuns.WithLabelValues("error")))
+	assert.Equal(t, rows+100, testutil.ToFloat64(exportRows))
+	assert.Equal(t, float64(1200), testutil.ToFloat64(exportWatermark))
+}
+
+func TestObserveInterestRun(t *testing.T) {
+	succeeded := testutil.ToFloat64(interestRuns.WithLabelValues("success"))
+	partial := testutil.ToFloat64(interestRuns.WithLabelValues("partial"))
+	failed := testutil.ToFloat64(interestRuns.WithLabelValues("error"))
+	accruals := testutil.ToFloat64(interestAccruals)
+	postings := testutil.ToFloat64(interestPostings)
+
+	ObserveInterestRun(30, 1, 0, nil)
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(interestRuns.WithLabelValues("success")))
+	assert.Equal(t, accruals+30, testutil.ToFloat64(interestAccruals))
+	assert.Equal(t, postings+1, testutil.ToFloat64(interestPostings))
+
+	ObserveInterestRun(2, 0, 1, nil)
+	assert.Equal(t, partial+1, testutil.ToFloat64(interestRuns.WithLabelValues("partial")))
+
+	ObserveInterestRun(1, 0, 0, errors.New("connection reset"))
+	assert.Equal(t, failed+1, testutil.ToFloat64(interestRuns.WithLabelValues("error")))
+	assert.Equal(t, accruals+33, testutil.ToFloat64(interestAccruals))
+}
+
+func TestObserveOverdraftFeeRun(t *testing.T) {
+	succeeded := testutil.ToFloat64(overdraftFeeRuns.WithLabelValues("success"))
+	partial := testutil.ToFloat64(overdraftFeeRuns.WithLabelValues("partial"))
+	failed := testutil.ToFloat64(overdraftFeeRuns.WithLabelValues("error"))
+	fees := testutil.ToFloat64(overdraftFees)
+
+	ObserveOverdraftFeeRun(4, 0, nil)
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(overdraftFeeRuns.WithLabelValues("success")))
+	assert.Equal(t, fees+4, testutil.ToFloat64(overdraftFees))
+
+	ObserveOverdraftFeeRun(0, 1, nil)
+	assert.Equal(t, partial+1, testutil.ToFloat64(overdraftFeeRuns.WithLabelValues("partial")))
+
+	ObserveOverdraftFeeRun(1, 0, errors.New("connection reset"))
+	assert.Equal(t, failed+1, testutil.ToFloat64(overdraftFeeRuns.WithLabelValues("error")))
+	assert.Equal(t, fees+5, testutil.ToFloat64(overdraftFees))
+}
+
+func TestQueueDepthCollector(t *testing.T) {
+	c := &queueDepthCollector{depths: func() []int { return []int{3, 0} }}
+
+	expected := `
+# HELP wallet_shard_queue_depth Transactions waiting in the shard queue.
+# TYPE wallet_shard_queue_depth gauge
+wallet_shard_queue_depth{shard="0"} 3
+wallet_shard_queue_depth{shard="1"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	assert.NoError(t, prometheus.NewPedanticRegistry().Register(c))
+}
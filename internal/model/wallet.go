@@ -2,6 +2,10 @@ package model
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
 )
 
 var (
@@ -9,17 +13,465 @@ var (
 	ErrInsufficientFunds = errors.New("insufficient funds")
 	ErrInvalidAmount     = errors.New("invalid amount")
 	ErrInvalidOperation  = errors.New("invalid operation type")
+	ErrShuttingDown      = errors.New("service is shutting down")
+	ErrWalletFrozen      = errors.New("wallet is frozen")
+	ErrReasonRequired    = errors.New("reason is required")
+
+	ErrAdjustmentNotFound   = errors.New("adjustment not found")
+	ErrAdjustmentNotPending = errors.New("adjustment is not pending")
+	ErrAdjustmentExpired    = errors.New("adjustment expired")
+	ErrSelfApproval         = errors.New("adjustment cannot be approved by the operator who requested it")
+	ErrInvalidReasonCode    = errors.New("invalid reason code")
+
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+	ErrScheduleClosed   = errors.New("schedule is cancelled or completed")
+	// ErrDuplicateReference rejects a transaction whose reference was already applied
+	ErrDuplicateReference = errors.New("transaction reference already applied")
+
+	ErrInterestProductNotFound = errors.New("interest product not found")
+	ErrInvalidInterestProduct  = errors.New("invalid interest product")
+	ErrInterestNotAssigned     = errors.New("wallet has no interest product")
+
+	ErrInvalidOverdraft = errors.New("invalid overdraft")
 )
 
+// Stable codes of the errors above, clients branch on them instead of messages
+const (
+	CodeWalletNotFound    = "WALLET_NOT_FOUND"
+	CodeInsufficientFunds = "INSUFFICIENT_FUNDS"
+	CodeInvalidAmount     = "INVALID_AMOUNT"
+	CodeInvalidOperation  = "INVALID_OPERATION"
+	CodeShuttingDown      = "SHUTTING_DOWN"
+	CodeWalletFrozen      = "WALLET_FROZEN"
+	CodeReasonRequired    = "REASON_REQUIRED"
+
+	CodeAdjustmentNotFound   = "ADJUSTMENT_NOT_FOUND"
+	CodeAdjustmentNotPending = "ADJUSTMENT_NOT_PENDING"
+	CodeAdjustmentExpired    = "ADJUSTMENT_EXPIRED"
+	CodeSelfApproval         = "SELF_APPROVAL"
+	CodeInvalidReasonCode    = "INVALID_REASON_CODE"
+
+	CodeScheduleNotFound   = "SCHEDULE_NOT_FOUND"
+	CodeInvalidSchedule    = "INVALID_SCHEDULE"
+	CodeScheduleClosed     = "SCHEDULE_CLOSED"
+	CodeDuplicateReference = "DUPLICATE_REFERENCE"
+
+	CodeInterestProductNotFound = "INTEREST_PRODUCT_NOT_FOUND"
+	CodeInvalidInterestProduct  = "INVALID_INTEREST_PRODUCT"
+	CodeInterestNotAssigned     = "INTEREST_NOT_ASSIGNED"
+
+	CodeInvalidOverdraft = "INVALID_OVERDRAFT"
+)
+
+// errorCodes pairs each error above with its code, in the order ErrorCode tries them
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrWalletNotFound, CodeWalletNotFound},
+	{ErrInsufficientFunds, CodeInsufficientFunds},
+	{ErrInvalidAmount, CodeInvalidAmount},
+	{ErrInvalidOperation, CodeInvalidOperation},
+	{ErrShuttingDown, CodeShuttingDown},
+	{ErrWalletFrozen, CodeWalletFrozen},
+	{ErrReasonRequired, CodeReasonRequired},
+	{ErrAdjustmentNotFound, CodeAdjustmentNotFound},
+	{ErrAdjustmentNotPending, CodeAdjustmentNotPending},
+	{ErrAdjustmentExpired, CodeAdjustmentExpired},
+	{ErrSelfApproval, CodeSelfApproval},
+	{ErrInvalidReasonCode, CodeInvalidReasonCode},
+	{ErrScheduleNotFound, CodeScheduleNotFound},
+	{ErrInvalidSchedule, CodeInvalidSchedule},
+	{ErrScheduleClosed, CodeScheduleClosed},
+	{ErrDuplicateReference, CodeDuplicateReference},
+	{ErrInterestProductNotFound, CodeInterestProductNotFound},
+	{ErrInvalidInterestProduct, CodeInvalidInterestProduct},
+	{ErrInterestNotAssigned, CodeInterestNotAssigned},
+	{ErrInvalidOverdraft, CodeInvalidOverdraft},
+}
+
+// ErrorCode returns the stable code of err, or "" when err is not one of the errors above.
+func ErrorCode(err error) string {
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return ""
+}
+
+// ErrorCodes returns every code ErrorCode can return.
+func ErrorCodes() []string {
+	codes := make([]string, len(errorCodes))
+	for i, e := range errorCodes {
+		codes[i] = e.code
+	}
+	return codes
+}
+
+// InsufficientFundsError is an ErrInsufficientFunds that tells the amount
+// available for the debit, the balance plus the credit limit of the wallet.
+type InsufficientFundsError struct {
+	Available int64
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return ErrInsufficientFunds.Error()
+}
+
+func (e *InsufficientFundsError) Is(target error) bool {
+	return target == ErrInsufficientFunds
+}
+
 type OperationType string
 
 const (
 	Deposit  OperationType = "DEPOSIT"
 	Withdraw OperationType = "WITHDRAW"
+	// Opening carries the balance a wallet had when the ledger was introduced,
+	// written once by the migration that created it.
+	Opening OperationType = "OPENING"
+	// Adjustment is a correction requested by an operator and approved by
+	// another one, see AdjustmentRequest. It always carries a reason.
+	Adjustment OperationType = "ADJUSTMENT"
+	// Interest credits the interest accrued by a wallet over a month, see InterestPosting.
+	Interest OperationType = "INTEREST"
+	// OverdraftFee debits the daily fee of a wallet that ended a day overdrawn, see OverdraftCharge.
+	OverdraftFee OperationType = "OVERDRAFT_FEE"
 )
 
 type Transaction struct {
 	WalletID      string        `json:"walletId"`
 	OperationType OperationType `json:"operationType"`
 	Amount        int64         `json:"amount"`
+	// Reference makes the transaction apply at most once, a second one with the
+	// same reference fails with ErrDuplicateReference. Scheduled transactions
+	// reference their occurrence; clients cannot set it.
+	Reference string `json:"-"`
+}
+
+// LedgerEntry is a committed change of a wallet balance.
+// Amount is signed: credits are positive and debits are negative.
+type LedgerEntry struct {
+	ID            int64         `json:"id"`
+	WalletID      string        `json:"walletId"`
+	OperationType OperationType `json:"operationType"`
+	Amount        int64         `json:"amount"`
+	Reason        string        `json:"reason,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+}
+
+// Wallet is the stored state of a wallet. A frozen wallet rejects every transaction.
+type Wallet struct {
+	ID      string `json:"walletId"`
+	Balance int64  `json:"balance"`
+	Frozen  bool   `json:"frozen"`
+	// CreditLimit is how far below zero the balance may go, see Overdraft
+	CreditLimit int64 `json:"creditLimit"`
+}
+
+// BalanceCheck compares the balance of a wallet with the sum of its ledger entries.
+type BalanceCheck struct {
+	WalletID      string `json:"walletId"`
+	Balance       int64  `json:"balance"`
+	LedgerBalance int64  `json:"ledgerBalance"`
+}
+
+// Drift is how much the balance exceeds what the ledger accounts for, zero when they agree.
+func (c BalanceCheck) Drift() int64 {
+	return c.Balance - c.LedgerBalance
+}
+
+// DriftReport records a drift found by the balance reconciliation. Finding the
+// same drift amount again, even after later transactions, updates the balances
+// and LastSeenAt instead of adding a report.
+type DriftReport struct {
+	ID            int64     `json:"id"`
+	WalletID      string    `json:"walletId"`
+	Balance       int64     `json:"balance"`
+	LedgerBalance int64     `json:"ledgerBalance"`
+	DetectedAt    time.Time `json:"detectedAt"`
+	LastSeenAt    time.Time `json:"lastSeenAt"`
+	// Frozen tells the reconciliation froze the wallet
+	Frozen bool `json:"frozen"`
+}
+
+// Drift is how much the balance exceeded what the ledger accounted for.
+func (r DriftReport) Drift() int64 {
+	return r.Balance - r.LedgerBalance
+}
+
+// ReasonCode classifies why a balance is adjusted.
+type ReasonCode string
+
+const (
+	ReasonDuplicateTransaction ReasonCode = "DUPLICATE_TRANSACTION"
+	ReasonFailedTransaction    ReasonCode = "FAILED_TRANSACTION"
+	ReasonFeeRefund            ReasonCode = "FEE_REFUND"
+	ReasonGoodwill             ReasonCode = "GOODWILL"
+	ReasonChargeback           ReasonCode = "CHARGEBACK"
+	ReasonOther                ReasonCode = "OTHER"
+)
+
+// ReasonCodes lists the valid reason codes.
+var ReasonCodes = []ReasonCode{
+	ReasonDuplicateTransaction,
+	ReasonFailedTransaction,
+	ReasonFeeRefund,
+	ReasonGoodwill,
+	ReasonChargeback,
+	ReasonOther,
+}
+
+func (c ReasonCode) Valid() bool {
+	for _, code := range ReasonCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+type AdjustmentStatus string
+
+const (
+	AdjustmentPending  AdjustmentStatus = "PENDING"
+	AdjustmentApproved AdjustmentStatus = "APPROVED"
+	AdjustmentRejected AdjustmentStatus = "REJECTED"
+	AdjustmentExpired  AdjustmentStatus = "EXPIRED"
+)
+
+// AdjustmentRequest is a signed ADJUSTMENT of a wallet balance. One operator
+// requests it, and it is applied only once a different operator approves it
+// before it expires. Amount is signed like the ledger entries.
+type AdjustmentRequest struct {
+	ID            string           `json:"id"`
+	WalletID      string           `json:"walletId"`
+	Amount        int64            `json:"amount"`
+	ReasonCode    ReasonCode       `json:"reasonCode"`
+	Justification string           `json:"justification"`
+	Status        AdjustmentStatus `json:"status"`
+	RequestedBy   string           `json:"requestedBy"`
+	RequestedAt   time.Time        `json:"requestedAt"`
+	ExpiresAt     time.Time        `json:"expiresAt"`
+	DecidedBy     string           `json:"decidedBy,omitempty"`
+	DecidedAt     *time.Time       `json:"decidedAt,omitempty"`
+	// LedgerEntryID is the entry posted on approval
+	LedgerEntryID int64 `json:"ledgerEntryId,omitempty"`
+}
+
+// Validate checks the fields set by the requesting operator.
+func (a AdjustmentRequest) Validate() error {
+	switch {
+	case a.Amount == 0:
+		return ErrInvalidAmount
+	case !a.ReasonCode.Valid():
+		return ErrInvalidReasonCode
+	case strings.TrimSpace(a.Justification) == "":
+		return ErrReasonRequired
+	case strings.TrimSpace(a.RequestedBy) == "":
+		return errors.New("requesting operator is required")
+	case a.ExpiresAt.IsZero():
+		return errors.New("expiry is required")
+	}
+	return nil
+}
+
+// LedgerReason is the reason recorded with the ledger entry of the adjustment.
+func (a AdjustmentRequest) LedgerReason() string {
+	return fmt.Sprintf("%s: %s (adjustment %s)", a.ReasonCode, a.Justification, a.ID)
+}
+
+// SameOperator reports whether two operator names designate the same person,
+// ignoring case and surrounding spaces.
+func SameOperator(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "ACTIVE"
+	SchedulePaused    ScheduleStatus = "PAUSED"
+	ScheduleCompleted ScheduleStatus = "COMPLETED"
+	ScheduleCancelled ScheduleStatus = "CANCELLED"
+)
+
+// Closed reports whether the schedule will never run again.
+func (s ScheduleStatus) Closed() bool {
+	return s == ScheduleCompleted || s == ScheduleCancelled
+}
+
+// Schedule is a deposit or withdrawal run at StartAt, and then on every
+// occurrence of Recurrence until EndAt if it repeats. Each occurrence is
+// applied at most once, see ScheduleRun.
+type Schedule struct {
+	ID            string        `json:"id"`
+	WalletID      string        `json:"walletId"`
+	OperationType OperationType `json:"operationType"`
+	Amount        int64         `json:"amount"`
+	// Recurrence is daily, weekly, monthly or a cron expression, empty for a single run
+	Recurrence string         `json:"recurrence,omitempty"`
+	StartAt    time.Time      `json:"startAt"`
+	EndAt      *time.Time     `json:"endAt,omitempty"`
+	Status     ScheduleStatus `json:"status"`
+	// NextRunAt is the occurrence to run next, unset once the schedule is closed
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	// DueAt is when NextRunAt is attempted, later than it while retrying
+	DueAt *time.Time `json:"dueAt,omitempty"`
+	// Attempts counts the failed attempts of NextRunAt
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Version changes on every write, updates based on an older one are rejected
+	Version int64 `json:"-"`
+}
+
+// Reference is the transaction reference of the occurrence at, which keeps
+// it from being applied twice.
+func (s Schedule) Reference(at time.Time) string {
+	return fmt.Sprintf("schedule:%s:%d", s.ID, at.UTC().UnixNano())
+}
+
+type RunStatus string
+
+const (
+	RunSucceeded RunStatus = "SUCCEEDED"
+	// RunRetrying is a failed attempt that will be retried
+	RunRetrying RunStatus = "RETRYING"
+	// RunFailed is the last failed attempt, the occurrence is skipped
+	RunFailed RunStatus = "FAILED"
+)
+
+// ScheduleRun records an attempt to run an occurrence of a schedule.
+type ScheduleRun struct {
+	ID         int64     `json:"id"`
+	ScheduleID string    `json:"scheduleId"`
+	Occurrence time.Time `json:"occurrence"`
+	Attempt    int       `json:"attempt"`
+	Status     RunStatus `json:"status"`
+	// ErrorCode is the code of the error that failed the attempt
+	ErrorCode  string    `json:"errorCode,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// InterestProduct sets how wallets assigned to it accrue interest. Products do
+// not change once created, a wallet is assigned another product instead, so
+// every accrual keeps the terms it was computed with.
+type InterestProduct struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// AnnualRateBps is the annual rate in basis points, 325 is 3.25%
+	AnnualRateBps int64 `json:"annualRateBps"`
+	// DayCount is the day count convention, see interest.DayCount
+	DayCount string `json:"dayCount"`
+	// Rounding rounds the accrued interest to minor units when it is posted, see interest.Rounding
+	Rounding  string    `json:"rounding"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// InterestAccount is the interest state of a wallet assigned a product.
+type InterestAccount struct {
+	WalletID string          `json:"walletId"`
+	Product  InterestProduct `json:"product"`
+	// AccruedThrough is the last day accrued, midnight UTC
+	AccruedThrough time.Time `json:"accruedThrough"`
+	// AccruedUnits and AccruedFraction are the interest accrued and not posted
+	// yet, including the remainder of the last posting, see interest.Amount
+	AccruedUnits    int64     `json:"accruedUnits"`
+	AccruedFraction int64     `json:"accruedFraction"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// InterestAccrual is the interest earned by a wallet on a day, with the terms
+// and the end of day balance it was computed from.
+type InterestAccrual struct {
+	WalletID      string    `json:"walletId"`
+	Day           time.Time `json:"day"`
+	ProductID     string    `json:"productId"`
+	AnnualRateBps int64     `json:"annualRateBps"`
+	DayCount      string    `json:"dayCount"`
+	Balance       int64     `json:"balance"`
+	Units         int64     `json:"units"`
+	Fraction      int64     `json:"fraction"`
+}
+
+// InterestPosting credits the interest accrued by a wallet up to the end of a
+// month, rounded to minor units. What rounding left is carried to the next month.
+type InterestPosting struct {
+	WalletID string `json:"walletId"`
+	// Period is the month posted, as 2006-01
+	Period          string `json:"period"`
+	AccruedUnits    int64  `json:"accruedUnits"`
+	AccruedFraction int64  `json:"accruedFraction"`
+	Rounding        string `json:"rounding"`
+	Amount          int64  `json:"amount"`
+	// LedgerEntryID is the INTEREST entry, zero when nothing was posted
+	LedgerEntryID int64     `json:"ledgerEntryId,omitempty"`
+	PostedAt      time.Time `json:"postedAt"`
+}
+
+// Reference is the transaction reference of the posting, which keeps it from being applied twice.
+func (p InterestPosting) Reference() string {
+	return fmt.Sprintf("interest:%s:%s", p.WalletID, p.Period)
+}
+
+// Overdraft is the balance of a wallet with its credit line: the balance may go
+// down to -CreditLimit, and DailyFee is charged for every UTC day that ends
+// below zero.
+type Overdraft struct {
+	WalletID    string `json:"walletId"`
+	Balance     int64  `json:"balance"`
+	CreditLimit int64  `json:"creditLimit"`
+	DailyFee    int64  `json:"dailyFee"`
+	// FeesChargedThrough is the last day the fee was charged for, midnight UTC,
+	// unset until a fee is set
+	FeesChargedThrough *time.Time `json:"feesChargedThrough,omitempty"`
+}
+
+// Used is the part of the credit line in use, zero while the balance is not negative.
+func (o Overdraft) Used() int64 {
+	return OverdraftUsed(o.Balance)
+}
+
+// Available is how much the wallet can be debited.
+func (o Overdraft) Available() int64 {
+	return Available(o.Balance, o.CreditLimit)
+}
+
+// OverdraftUsed returns the part of a credit line used by balance.
+func OverdraftUsed(balance int64) int64 {
+	if balance < 0 {
+		return -balance
+	}
+	return 0
+}
+
+// Available returns how much a wallet with balance and creditLimit can be
+// debited, capped at the largest int64.
+func Available(balance, creditLimit int64) int64 {
+	if balance > 0 && creditLimit > math.MaxInt64-balance {
+		return math.MaxInt64
+	}
+	return balance + creditLimit
+}
+
+// OverdraftCharge is the fee debited from a wallet for a day it ended
+// overdrawn. Amount is what was charged: the daily fee, or the credit left if less.
+type OverdraftCharge struct {
+	WalletID string    `json:"walletId"`
+	Day      time.Time `json:"day"`
+	// Balance is the closing balance of the day
+	Balance int64 `json:"balance"`
+	Amount  int64 `json:"amount"`
+	// LedgerEntryID is the OVERDRAFT_FEE entry
+	LedgerEntryID int64     `json:"ledgerEntryId,omitempty"`
+	ChargedAt     time.Time `json:"chargedAt"`
+}
+
+// Reference is the transaction reference of the fee, which keeps it from being charged twice.
+func (f OverdraftCharge) Reference() string {
+	return fmt.Sprintf("overdraft-fee:%s:%s", f.WalletID, f.Day.Format(time.DateOnly))
 }
@@ -0,0 +1,136 @@
+// Package mtls provides the TLS configuration of the server, with certificates
+// that can be reloaded without a restart, and the mapping of client
+// certificates to tenants.
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Reloader holds the server certificate and the client CA bundle loaded from
+// files, Reload swaps them for the current content of the files.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+// NewReloader loads the certificate and key, and the client CA bundle when
+// clientCAFile is set, which enables mutual TLS.
+func NewReloader(certFile, keyFile, clientCAFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the certificates in use are kept,
+// so a half-written file never takes the server down.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("client CA bundle holds no PEM certificate")
+		}
+	}
+
+	r.cert.Store(&cert)
+	if clientCAs != nil {
+		r.clientCAs.Store(clientCAs)
+	}
+	return nil
+}
+
+// MutualTLS reports whether client certificates are verified.
+func (r *Reloader) MutualTLS() bool {
+	return r.clientCAFile != ""
+}
+
+// TLSConfig returns a server configuration that always uses the latest loaded
+// certificates. With mutual TLS, a client certificate must be issued by the
+// client CA bundle for client authentication. Connections without one are
+// accepted, so the probes and metrics need none: the routes that require a
+// certificate reject the requests without one, see handler.TenantMiddleware.
+func (r *Reloader) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.cert.Load(), nil
+		},
+	}
+	if r.MutualTLS() {
+		// The chain is verified against the bundle loaded last rather than by
+		// ClientCAs, in VerifyConnection since it also runs when a session is
+		// resumed, which VerifyPeerCertificate does not: a client must not keep
+		// its access through a ticket once its CA is removed
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyConnection = r.verifyClient
+	}
+	return cfg
+}
+
+func (r *Reloader) verifyClient(cs tls.ConnectionState) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         r.clientCAs.Load(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// Tenants maps client certificate subjects, in the RFC 2253 form printed by
+// `openssl x509 -noout -subject -nameopt RFC2253`, to tenant identities. A
+// tenant identifies the client for logs and rate limits, it grants no scope.
+type Tenants map[string]string
+
+// Lookup returns the tenant of the client certificate.
+func (t Tenants) Lookup(cert *x509.Certificate) (string, bool) {
+	tenant, ok := t[cert.Subject.String()]
+	return tenant, ok
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context carrying the tenant of the request.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// Tenant returns the tenant carried by ctx, empty without mutual TLS.
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
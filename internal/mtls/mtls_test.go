@@ -0,0 +1,256 @@
+package mtls_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/mtls"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate signed by parent, or a self-signed CA when parent is nil.
+func issue(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Wallet"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	require.NoError(t, err)
+	return cert
+}
+
+func writeFiles(t *testing.T, dir string, c *testCert) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, c.certPEM(), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, c.keyPEM(t), 0o600))
+	return certFile, keyFile
+}
+
+// startServer serves on a TLS listener, httptest.Server would install its own certificate.
+func startServer(t *testing.T, certs *mtls.Reloader) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.TLSConfig())
+	require.NoError(t, err)
+
+	server := &http.Server{
+		Handler:  http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func client(roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: certs,
+	}}}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	ca := issue(t, "server-ca", nil, 0)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	dir := t.TempDir()
+	first := issue(t, "first", ca, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeFiles(t, dir, first)
+
+	certs, err := mtls.NewReloader(certFile, keyFile, "")
+	require.NoError(t, err)
+	assert.False(t, certs.MutualTLS())
+	serverURL := startServer(t, certs)
+
+	servedCert := func() string {
+		resp, err := client(roots).Get(serverURL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "first", servedCert())
+
+	second := issue(t, "second", ca, x509.ExtKeyUsageServerAuth)
+	writeFiles(t, dir, second)
+	require.NoError(t, certs.Reload())
+	assert.Equal(t, "second", servedCert(), "New connections use the reloaded certificate")
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, certs.Reload())
+	assert.Equal(t, "second", servedCert(), "A failed reload keeps the current certificate")
+}
+
+func TestReloader_MutualTLS(t *testing.T) {
+	serverCA := issue(t, "server-ca", nil, 0)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+
+	clientCA := issue(t, "client-ca", nil, 0)
+	otherCA := issue(t, "other-ca", nil, 0)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeFiles(t, dir, issue(t, "server", serverCA, x509.ExtKeyUsageServerAuth))
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, clientCA.certPEM(), 0o600))
+
+	certs, err := mtls.NewReloader(certFile, keyFile, caFile)
+	require.NoError(t, err)
+	assert.True(t, certs.MutualTLS())
+	serverURL := startServer(t, certs)
+
+	testCases := []struct {
+		name    string
+		certs   []tls.Certificate
+		success bool
+	}{
+		{
+			name:    "Trusted client",
+			certs:   []tls.Certificate{issue(t, "payments", clientCA, x509.ExtKeyUsageClientAuth).tlsCertificate(t)},
+			success: true,
+		},
+		{
+			// Left to the routes, the probes need no certificate
+			name:    "No client certificate",
+			success: true,
+		},
+		{
+			name:  "Client from another CA",
+			certs: []tls.Certificate{issue(t, "payments", otherCA, x509.ExtKeyUsageClientAuth).tlsCertificate(t)},
+		},
+		{
+			name:  "Server certificate used as client",
+			certs: []tls.Certificate{issue(t, "payments", clientCA, x509.ExtKeyUsageServerAuth).tlsCertificate(t)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client(roots, tc.certs...).Get(serverURL)
+			if !tc.success {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestTenants_Lookup(t *testing.T) {
+	tenants := mtls.Tenants{"CN=payments,O=Wallet": "payments-team"}
+
+	tenant, ok := tenants.Lookup(&x509.Certificate{Subject: pkix.Name{CommonName: "payments", Organization: []string{"Wallet"}}})
+	assert.True(t, ok)
+	assert.Equal(t, "payments-team", tenant)
+
+	_, ok = tenants.Lookup(&x509.Certificate{Subject: pkix.Name{CommonName: "payments"}})
+	assert.False(t, ok, "The whole subject must match")
+}
+
+func TestReloader_MutualTLS_ResumedSession(t *testing.T) {
+	serverCA := issue(t, "server-ca", nil, 0)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+
+	clientCA := issue(t, "client-ca", nil, 0)
+	otherCA := issue(t, "other-ca", nil, 0)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeFiles(t, dir, issue(t, "server", serverCA, x509.ExtKeyUsageServerAuth))
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, clientCA.certPEM(), 0o600))
+
+	certs, err := mtls.NewReloader(certFile, keyFile, caFile)
+	require.NoError(t, err)
+	serverURL := startServer(t, certs)
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:            roots,
+		Certificates:       []tls.Certificate{issue(t, "payments", clientCA, x509.ExtKeyUsageClientAuth).tlsCertificate(t)},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}}
+	resumes := func() (bool, error) {
+		// Each request opens a new connection, which resumes the session of the last one
+		transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(serverURL)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		return resp.TLS.DidResume, nil
+	}
+
+	_, err = resumes()
+	require.NoError(t, err)
+	resumed, err := resumes()
+	require.NoError(t, err)
+	require.True(t, resumed, "The session must be resumed for the test to hold")
+
+	require.NoError(t, os.WriteFile(caFile, otherCA.certPEM(), 0o600))
+	require.NoError(t, certs.Reload())
+	_, err = resumes()
+	assert.Error(t, err, "A resumed session is verified against the reloaded CA bundle")
+}
@@ -0,0 +1,161 @@
+// Package ratelimit implements token bucket rate limits behind a Store, kept
+// in process by MemoryStore or shared between replicas by another implementation.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit lets Rate requests per second through on average, and bursts of up to Burst requests.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports whether the limit lets every request through.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Decision is the outcome of taking a token from a bucket.
+type Decision struct {
+	Allowed   bool
+	Limit     int // the burst of the bucket
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token, zero when allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets. Implementations must be safe for concurrent use.
+type Store interface {
+	// Take removes a token from the bucket of key, which starts full.
+	Take(ctx context.Context, key string, limit Limit) (Decision, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// refill adds the tokens earned since the last update.
+func (b *bucket) refill(now time.Time, limit Limit) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	b.last = now
+	b.limit = limit
+}
+
+// MemoryStore keeps the buckets in process memory, every replica limits on its own.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	// now is replaceable in tests
+	now func() time.Time
+}
+
+// sweepInterval is how often full buckets are forgotten, a full bucket is the same as no bucket
+const sweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Decision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.refill(now, limit)
+
+	d := Decision{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return d, nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		b.refill(now, b.limit)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Len returns the number of buckets held.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Tier holds the limits of a class of clients.
+type Tier struct {
+	// Client limits each client on each route separately
+	Client Limit
+	// Routes overrides Client for the route patterns it holds
+	Routes map[string]Limit
+	// Wallet limits the transactions of each wallet
+	Wallet Limit
+}
+
+// Policy assigns the limits of a request from the tier of its tenant.
+type Policy struct {
+	DefaultTier string
+	TenantTiers map[string]string
+	Tiers       map[string]Tier
+	// APIKeys are the keys that identify a client, the others are ignored
+	APIKeys []string
+}
+
+func (p Policy) tier(tenant string) Tier {
+	if name, ok := p.TenantTiers[tenant]; ok && tenant != "" {
+		return p.Tiers[name]
+	}
+	return p.Tiers[p.DefaultTier]
+}
+
+// ClientLimit returns the limit of a client of tenant on route.
+func (p Policy) ClientLimit(tenant, route string) Limit {
+	tier := p.tier(tenant)
+	if limit, ok := tier.Routes[route]; ok {
+		return limit
+	}
+	return tier.Client
+}
+
+// WalletLimit returns the limit of the wallets a client of tenant makes transactions on.
+func (p Policy) WalletLimit(tenant string) Limit {
+	return p.tier(tenant).Wallet
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore_Take(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	limit := Limit{Rate: 2, Burst: 3}
+
+	// The bucket starts full
+	for i := 2; i >= 0; i-- {
+		d, err := store.Take(ctx, "client", limit)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 3, d.Limit)
+		assert.Equal(t, i, d.Remaining)
+	}
+
+	d, err := store.Take(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter, "A token comes back every 1/rate seconds")
+	assert.Equal(t, 1500*time.Millisecond, d.Reset)
+
+	// Other keys have their own bucket
+	d, err = store.Take(ctx, "other", limit)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+
+	now = now.Add(500 * time.Millisecond)
+	d, err = store.Take(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// Refilling never exceeds the burst
+	now = now.Add(time.Hour)
+	d, err = store.Take(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Remaining)
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	store.Take(ctx, "idle", Limit{Rate: 1, Burst: 1})
+	store.Take(ctx, "busy", Limit{Rate: 0.001, Burst: 1})
+	assert.Equal(t, 2, store.Len())
+
+	now = now.Add(sweepInterval)
+	store.Take(ctx, "new", Limit{Rate: 1, Burst: 1})
+
+	// The idle bucket is full again and forgotten, the busy one is still refilling
+	assert.Equal(t, 2, store.Len())
+	_, ok := store.buckets["idle"]
+	assert.False(t, ok)
+}
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{
+		DefaultTier: "standard",
+		TenantTiers: map[string]string{"payments": "premium"},
+		Tiers: map[string]Tier{
+			"standard": {
+				Client: Limit{Rate: 10, Burst: 20},
+				Routes: map[string]Limit{"POST /api/v1/wallets": {Rate: 1, Burst: 2}},
+				Wallet: Limit{Rate: 5, Burst: 5},
+			},
+			"premium": {
+				Client: Limit{Rate: 100, Burst: 200},
+				Wallet: Limit{Rate: 50, Burst: 50},
+			},
+		},
+	}
+
+	assert.Equal(t, Limit{Rate: 10, Burst: 20}, policy.ClientLimit("", "GET /api/v1/wallets/{id}"))
+	assert.Equal(t, Limit{Rate: 1, Burst: 2}, policy.ClientLimit("", "POST /api/v1/wallets"))
+	assert.Equal(t, Limit{Rate: 10, Burst: 20}, policy.ClientLimit("billing", "GET /api/v1/wallets/{id}"), "Unknown tenants get the default tier")
+	assert.Equal(t, Limit{Rate: 100, Burst: 200}, policy.ClientLimit("payments", "POST /api/v1/wallets"))
+	assert.Equal(t, Limit{Rate: 50, Burst: 50}, policy.WalletLimit("payments"))
+	assert.True(t, Policy{}.ClientLimit("", "POST /api/v1/wallets").Unlimited())
+}
@@ -0,0 +1,216 @@
+// Package recurrence computes the occurrences of scheduled transactions. A rule
+// is daily, weekly or monthly, repeating the time of day (and weekday or day of
+// month) of its first occurrence, or a cron expression. All times are in UTC.
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+var ErrInvalid = errors.New("invalid recurrence")
+
+// Rule is a parsed recurrence. The zero Rule has a single occurrence, its anchor.
+type Rule struct {
+	spec string
+	cron *cron
+}
+
+// Parse parses daily, weekly, monthly or a cron expression of five fields:
+// minute, hour, day of month, month and day of week (0 or 7 is Sunday). Fields
+// take *, values, ranges (1-5), lists (1,15) and steps (*/15, 0-30/10). An empty
+// spec is the zero Rule.
+func Parse(spec string) (Rule, error) {
+	spec = strings.TrimSpace(spec)
+	switch strings.ToLower(spec) {
+	case "":
+		return Rule{}, nil
+	case Daily, Weekly, Monthly:
+		return Rule{spec: strings.ToLower(spec)}, nil
+	}
+
+	c, err := parseCron(spec)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w %q: %v", ErrInvalid, spec, err)
+	}
+	if _, ok := c.next(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)); !ok {
+		return Rule{}, fmt.Errorf("%w %q: it never occurs", ErrInvalid, spec)
+	}
+	return Rule{spec: strings.Join(strings.Fields(spec), " "), cron: c}, nil
+}
+
+// String returns the normalized spec, empty for a single occurrence.
+func (r Rule) String() string {
+	return r.spec
+}
+
+// Repeats reports whether the rule has more than one occurrence.
+func (r Rule) Repeats() bool {
+	return r.spec != ""
+}
+
+// Next returns the first occurrence after after of the rule anchored at anchor,
+// the first occurrence. Daily, weekly and monthly occurrences repeat the anchor,
+// a monthly one falls on the last day of the months shorter than its day; cron
+// occurrences are the matching minutes from the anchor on. It reports false
+// when there is none.
+func (r Rule) Next(anchor, after time.Time) (time.Time, bool) {
+	anchor, after = anchor.UTC(), after.UTC()
+	if after.Before(anchor) {
+		if r.cron == nil {
+			return anchor, true
+		}
+		after = anchor.Add(-time.Nanosecond)
+	}
+
+	switch {
+	case r.cron != nil:
+		return r.cron.next(after)
+	case r.spec == Daily, r.spec == Weekly:
+		days := 1
+		if r.spec == Weekly {
+			days = 7
+		}
+		period := time.Duration(days) * 24 * time.Hour
+		// UTC days are all 24 hours long
+		k := int(after.Sub(anchor)/period) + 1
+		return anchor.AddDate(0, 0, k*days), true
+	case r.spec == Monthly:
+		k := (after.Year()-anchor.Year())*12 + int(after.Month()-anchor.Month())
+		for k = max(k, 1); ; k++ {
+			if t := addMonths(anchor, k); t.After(after) {
+				return t, true
+			}
+		}
+	default:
+		return time.Time{}, false
+	}
+}
+
+// addMonths returns t k months later, on the last day of the month when it is
+// shorter than the day of t.
+func addMonths(t time.Time, k int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(k), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
+
+// cron holds the allowed values of each field as bit sets.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// Like cron, when both days are restricted a day matching either one matches
+	domStar, dowStar bool
+}
+
+// maxSearch bounds the search for the next occurrence, rules such as the 31st
+// of February never match
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+func parseCron(spec string) (*cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	var c cron
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return &c, nil
+}
+
+// parseField returns the set of values of a field between lo and hi.
+func parseField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		from, to := lo, hi
+		if expr != "*" {
+			first, last, isRange := strings.Cut(expr, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute after after.
+func (c *cron) next(after time.Time) (time.Time, bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,108 @@
+package recurrence_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/recurrence"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// occurrences returns the first n occurrences of spec anchored at anchor
+func occurrences(t *testing.T, spec, anchor string, n int) []string {
+	t.Helper()
+	rule, err := recurrence.Parse(spec)
+	require.NoError(t, err)
+
+	var got []string
+	after := date(anchor).Add(-time.Nanosecond)
+	for len(got) < n {
+		next, ok := rule.Next(date(anchor), after)
+		if !ok {
+			break
+		}
+		got = append(got, next.Format(time.RFC3339))
+		after = next
+	}
+	return got
+}
+
+func TestRule_Next(t *testing.T) {
+	testCases := []struct {
+		name   string
+		spec   string
+		anchor string
+		want   []string
+	}{
+		{"once", "", "2025-01-31T09:00:00Z", []string{"2025-01-31T09:00:00Z"}},
+		{"daily", "daily", "2025-02-27T09:00:00Z", []string{"2025-02-27T09:00:00Z", "2025-02-28T09:00:00Z", "2025-03-01T09:00:00Z"}},
+		{"weekly", "WEEKLY", "2025-01-03T18:30:00Z", []string{"2025-01-03T18:30:00Z", "2025-01-10T18:30:00Z", "2025-01-17T18:30:00Z"}},
+		{"monthly on the 31st", "monthly", "2025-01-31T00:00:00Z", []string{"2025-01-31T00:00:00Z", "2025-02-28T00:00:00Z", "2025-03-31T00:00:00Z", "2025-04-30T00:00:00Z"}},
+		{"monthly over a leap year", "monthly", "2023-12-30T12:00:00Z", []string{"2023-12-30T12:00:00Z", "2024-01-30T12:00:00Z", "2024-02-29T12:00:00Z", "2024-03-30T12:00:00Z"}},
+		{"every 15 minutes", "*/15 * * * *", "2025-01-01T10:07:00Z", []string{"2025-01-01T10:15:00Z", "2025-01-01T10:30:00Z", "2025-01-01T10:45:00Z", "2025-01-01T11:00:00Z"}},
+		{"weekdays at 9", "0 9 * * 1-5", "2025-01-03T09:00:00Z", []string{"2025-01-03T09:00:00Z", "2025-01-06T09:00:00Z", "2025-01-07T09:00:00Z"}},
+		{"sunday as 7", "30 8 * * 7", "2025-01-01T00:00:00Z", []string{"2025-01-05T08:30:00Z", "2025-01-12T08:30:00Z"}},
+		{"1st and 15th", "0 0 1,15 * *", "2025-01-02T00:00:00Z", []string{"2025-01-15T00:00:00Z", "2025-02-01T00:00:00Z", "2025-02-15T00:00:00Z"}},
+		{"day of month or of week", "0 0 13 * 5", "2025-06-01T00:00:00Z", []string{"2025-06-06T00:00:00Z", "2025-06-13T00:00:00Z", "2025-06-20T00:00:00Z"}},
+		{"leap day", "0 12 29 2 *", "2025-01-01T00:00:00Z", []string{"2028-02-29T12:00:00Z", "2032-02-29T12:00:00Z"}},
+		{"anchor between minutes", "* * * * *", "2025-01-01T10:00:30Z", []string{"2025-01-01T10:01:00Z", "2025-01-01T10:02:00Z"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, occurrences(t, tc.spec, tc.anchor, len(tc.want)+1)[:len(tc.want)])
+		})
+	}
+}
+
+func TestRule_NextSkipsAhead(t *testing.T) {
+	rule, err := recurrence.Parse("monthly")
+	require.NoError(t, err)
+
+	next, ok := rule.Next(date("2020-01-31T08:00:00Z"), date("2025-02-28T08:00:00Z"))
+	require.True(t, ok)
+	assert.Equal(t, date("2025-03-31T08:00:00Z"), next, "Months are counted from the anchor, not from the shortened one")
+
+	rule, err = recurrence.Parse("daily")
+	require.NoError(t, err)
+	next, ok = rule.Next(date("2020-01-01T08:00:00Z"), date("2025-06-15T07:59:59Z"))
+	require.True(t, ok)
+	assert.Equal(t, date("2025-06-15T08:00:00Z"), next)
+
+	_, ok = recurrence.Rule{}.Next(date("2025-01-01T00:00:00Z"), date("2025-01-01T00:00:00Z"))
+	assert.False(t, ok, "A single occurrence has nothing after it")
+}
+
+func TestParse(t *testing.T) {
+	rule, err := recurrence.Parse("  0  9 * *   1-5 ")
+	require.NoError(t, err)
+	assert.Equal(t, "0 9 * * 1-5", rule.String())
+	assert.True(t, rule.Repeats())
+
+	for _, spec := range []string{
+		"hourly",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"0 0 30 2 *",
+	} {
+		_, err := recurrence.Parse(spec)
+		assert.ErrorIs(t, err, recurrence.ErrInvalid, spec)
+	}
+}
@@ -0,0 +1,844 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"WalletApi/internal/model"
+
+	"github.com/google/uuid"
+)
+
+// MemoryRepository is a concurrency-safe in-memory WalletRepository.
+// It is intended for local development, demos and integration tests.
+type MemoryRepository struct {
+	mu      sync.RWMutex
+	wallets map[string]int64
+	frozen  map[string]bool
+	ledger  map[string][]model.LedgerEntry
+	lastID  int64
+
+	adjustments map[string]model.AdjustmentRequest
+	drifts      []model.DriftReport
+
+	references map[string]bool
+	schedules  map[string]memorySchedule
+	runs       []model.ScheduleRun
+
+	interestProducts map[string]model.InterestProduct
+	interestAccounts map[string]model.InterestAccount
+	interestAccruals map[string][]model.InterestAccrual
+	interestPostings map[string][]model.InterestPosting
+
+	// overdrafts holds the credit lines set, their Balance is not kept up to date
+	overdrafts    map[string]model.Overdraft
+	overdraftFees map[string][]model.OverdraftCharge
+
+	exportOwner      string
+	exportLeaseUntil time.Time
+}
+
+// memorySchedule is a stored schedule and its lease.
+type memorySchedule struct {
+	model.Schedule
+	leaseUntil time.Time
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		wallets: make(map[string]int64),
+		frozen:  make(map[string]bool),
+		ledger:  make(map[string][]model.LedgerEntry),
+
+		adjustments: make(map[string]model.AdjustmentRequest),
+
+		references: make(map[string]bool),
+		schedules:  make(map[string]memorySchedule),
+
+		interestProducts: make(map[string]model.InterestProduct),
+		interestAccounts: make(map[string]model.InterestAccount),
+		interestAccruals: make(map[string][]model.InterestAccrual),
+		interestPostings: make(map[string][]model.InterestPosting),
+
+		overdrafts:    make(map[string]model.Overdraft),
+		overdraftFees: make(map[string][]model.OverdraftCharge),
+	}
+}
+
+func (r *MemoryRepository) CreateWallet(ctx context.Context) (string, error) {
+	walletID := uuid.NewString()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.wallets[walletID] = 0
+	return walletID, nil
+}
+
+func (r *MemoryRepository) ProcessTransaction(ctx context.Context, walletID string, amount int64, isDeposit bool) error {
+	return r.processTransaction(walletID, amount, isDeposit, "")
+}
+
+func (r *MemoryRepository) ProcessTransactionOnce(ctx context.Context, walletID string, amount int64, isDeposit bool, reference string) error {
+	return r.processTransaction(walletID, amount, isDeposit, reference)
+}
+
+func (r *MemoryRepository) processTransaction(walletID string, amount int64, isDeposit bool, reference string) error {
+	// Validation of the amount
+	if amount <= 0 {
+		return model.ErrInvalidAmount
+	}
+
+	delta := amount
+	if !isDeposit {
+		delta = -amount
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.apply(walletID, operationType(isDeposit), delta, "", reference)
+	return err
+}
+
+// apply changes the balance by delta and records the ledger entry, whose ID it
+// returns. A non-empty reference must not have been applied yet. The caller
+// must hold the write lock.
+func (r *MemoryRepository) apply(walletID string, operation model.OperationType, delta int64, reason, reference string) (int64, error) {
+	balance, ok := r.wallets[walletID]
+	if !ok {
+		return 0, model.ErrWalletNotFound
+	}
+	if r.frozen[walletID] {
+		return 0, model.ErrWalletFrozen
+	}
+	if reference != "" && r.references[reference] {
+		return 0, model.ErrDuplicateReference
+	}
+
+	if err := checkFunds(balance, r.overdrafts[walletID].CreditLimit, delta); err != nil {
+		return 0, err
+	}
+
+	r.wallets[walletID] = balance + delta
+	if reference != "" {
+		r.references[reference] = true
+	}
+	return r.appendEntry(walletID, operation, delta, reason), nil
+}
+
+// appendEntry records a ledger entry and returns its ID, the caller must hold the write lock.
+func (r *MemoryRepository) appendEntry(walletID string, operation model.OperationType, amount int64, reason string) int64 {
+	r.lastID++
+	r.ledger[walletID] = append(r.ledger[walletID], model.LedgerEntry{
+		ID:            r.lastID,
+		WalletID:      walletID,
+		OperationType: operation,
+		Amount:        amount,
+		Reason:        reason,
+		CreatedAt:     time.Now().UTC(),
+	})
+	return r.lastID
+}
+
+func (r *MemoryRepository) GetBalance(ctx context.Context, walletID string) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	balance, ok := r.wallets[walletID]
+	if !ok {
+		return 0, model.ErrWalletNotFound
+	}
+	return balance, nil
+}
+
+func (r *MemoryRepository) GetHistory(ctx context.Context, walletID string, limit int) ([]model.LedgerEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return nil, model.ErrWalletNotFound
+	}
+
+	entries := r.ledger[walletID]
+	if limit <= 0 || limit > len(entries) {
+		limit = len(entries)
+	}
+
+	// Entries are stored oldest first
+	history := make([]model.LedgerEntry, 0, limit)
+	for i := len(entries) - 1; i >= len(entries)-limit; i-- {
+		history = append(history, entries[i])
+	}
+	return history, nil
+}
+
+// BalanceAt sums the entries of the wallet, the history lives in memory so it needs no snapshots.
+func (r *MemoryRepository) BalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return 0, model.ErrWalletNotFound
+	}
+	var balance int64
+	for _, e := range r.ledger[walletID] {
+		if e.CreatedAt.After(at) {
+			break
+		}
+		balance += e.Amount
+	}
+	return balance, nil
+}
+
+// StreamStatement copies the entries of the statement under the lock, so slow
+// callbacks do not hold back transactions.
+func (r *MemoryRepository) StreamStatement(ctx context.Context, walletID string, from, to time.Time, opening func(int64) error, entry func(model.LedgerEntry) error) error {
+	r.mu.RLock()
+	if _, ok := r.wallets[walletID]; !ok {
+		r.mu.RUnlock()
+		return model.ErrWalletNotFound
+	}
+	var balance int64
+	var entries []model.LedgerEntry
+	for _, e := range r.ledger[walletID] {
+		if e.CreatedAt.After(to) {
+			break
+		}
+		if e.CreatedAt.After(from) {
+			entries = append(entries, e)
+		} else {
+			balance += e.Amount
+		}
+	}
+	r.mu.RUnlock()
+
+	if err := opening(balance); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := entry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamLedger copies the entries to export under the lock, like StreamStatement.
+func (r *MemoryRepository) StreamLedger(ctx context.Context, afterID int64, before time.Time, fn func(model.LedgerEntry) error) error {
+	r.mu.RLock()
+	var entries []model.LedgerEntry
+	for _, ledger := range r.ledger {
+		for _, e := range ledger {
+			if e.ID > afterID {
+				entries = append(entries, e)
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	fn = stopAfter(before, fn)
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			if errors.Is(err, errStopStream) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) LeaseExport(ctx context.Context, owner string, now time.Time, lease time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.exportOwner != owner && r.exportLeaseUntil.After(now) {
+		return false, nil
+	}
+	r.exportOwner, r.exportLeaseUntil = owner, now.Add(lease)
+	return true, nil
+}
+
+func (r *MemoryRepository) ReleaseExport(ctx context.Context, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.exportOwner == owner {
+		r.exportOwner, r.exportLeaseUntil = "", time.Time{}
+	}
+	return nil
+}
+
+// SnapshotBalances only walks the chunks, BalanceAt does not use snapshots.
+func (r *MemoryRepository) SnapshotBalances(ctx context.Context, afterID string, limit int) (string, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.wallets))
+	for id := range r.wallets {
+		if id > afterID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "", 0, nil
+	}
+	sort.Strings(ids)
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids[len(ids)-1], 0, nil
+}
+
+func (r *MemoryRepository) GetWallet(ctx context.Context, walletID string) (model.Wallet, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	balance, ok := r.wallets[walletID]
+	if !ok {
+		return model.Wallet{}, model.ErrWalletNotFound
+	}
+	return model.Wallet{ID: walletID, Balance: balance, Frozen: r.frozen[walletID], CreditLimit: r.overdrafts[walletID].CreditLimit}, nil
+}
+
+func (r *MemoryRepository) SetFrozen(ctx context.Context, walletID string, frozen bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return model.ErrWalletNotFound
+	}
+	if frozen {
+		r.frozen[walletID] = true
+	} else {
+		delete(r.frozen, walletID)
+	}
+	return nil
+}
+
+func (r *MemoryRepository) RequestAdjustment(ctx context.Context, req model.AdjustmentRequest) (model.AdjustmentRequest, error) {
+	a, err := newAdjustment(req, time.Now().UTC())
+	if err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.wallets[a.WalletID]; !ok {
+		return model.AdjustmentRequest{}, model.ErrWalletNotFound
+	}
+	r.adjustments[a.ID] = a
+	return a, nil
+}
+
+func (r *MemoryRepository) PendingAdjustments(ctx context.Context) ([]model.AdjustmentRequest, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	pending := []model.AdjustmentRequest{}
+	for _, a := range r.adjustments {
+		if a.Status == model.AdjustmentPending && now.Before(a.ExpiresAt) {
+			pending = append(pending, a)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].RequestedAt.Equal(pending[j].RequestedAt) {
+			return pending[i].RequestedAt.Before(pending[j].RequestedAt)
+		}
+		return pending[i].ID < pending[j].ID
+	})
+	return pending, nil
+}
+
+func (r *MemoryRepository) ApproveAdjustment(ctx context.Context, id, approver string) (model.AdjustmentRequest, error) {
+	return r.decideAdjustment(id, approver, true)
+}
+
+func (r *MemoryRepository) RejectAdjustment(ctx context.Context, id, operator string) (model.AdjustmentRequest, error) {
+	return r.decideAdjustment(id, operator, false)
+}
+
+func (r *MemoryRepository) decideAdjustment(id, operator string, approve bool) (model.AdjustmentRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.adjustments[id]
+	if !ok {
+		return model.AdjustmentRequest{}, model.ErrAdjustmentNotFound
+	}
+
+	now := time.Now().UTC()
+	if err := decideAdjustment(a, operator, approve, now); err != nil {
+		if errors.Is(err, model.ErrAdjustmentExpired) {
+			a.Status = model.AdjustmentExpired
+			r.adjustments[id] = a
+		}
+		return model.AdjustmentRequest{}, err
+	}
+
+	a.Status = model.AdjustmentRejected
+	if approve {
+		entryID, err := r.apply(a.WalletID, model.Adjustment, a.Amount, a.LedgerReason(), "")
+		if err != nil {
+			return model.AdjustmentRequest{}, err
+		}
+		a.Status = model.AdjustmentApproved
+		a.LedgerEntryID = entryID
+	}
+	a.DecidedBy = strings.TrimSpace(operator)
+	a.DecidedAt = &now
+	r.adjustments[id] = a
+	return a, nil
+}
+
+func (r *MemoryRepository) CheckBalances(ctx context.Context, afterID string, limit int) ([]model.BalanceCheck, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.wallets))
+	for id := range r.wallets {
+		if id > afterID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	checks := make([]model.BalanceCheck, len(ids))
+	for i, id := range ids {
+		var sum int64
+		for _, e := range r.ledger[id] {
+			sum += e.Amount
+		}
+		checks[i] = model.BalanceCheck{WalletID: id, Balance: r.wallets[id], LedgerBalance: sum}
+	}
+	return checks, nil
+}
+
+func (r *MemoryRepository) ReportDrift(ctx context.Context, check model.BalanceCheck, frozen bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.wallets[check.WalletID]; !ok {
+		return model.ErrWalletNotFound
+	}
+
+	now := time.Now().UTC()
+	for i, d := range r.drifts {
+		if d.WalletID == check.WalletID && d.Drift() == check.Drift() {
+			r.drifts[i].Balance = check.Balance
+			r.drifts[i].LedgerBalance = check.LedgerBalance
+			r.drifts[i].LastSeenAt = now
+			r.drifts[i].Frozen = d.Frozen || frozen
+			return nil
+		}
+	}
+	r.drifts = append(r.drifts, model.DriftReport{
+		ID:            int64(len(r.drifts) + 1),
+		WalletID:      check.WalletID,
+		Balance:       check.Balance,
+		LedgerBalance: check.LedgerBalance,
+		DetectedAt:    now,
+		LastSeenAt:    now,
+		Frozen:        frozen,
+	})
+	return nil
+}
+
+func (r *MemoryRepository) DriftReports(ctx context.Context, limit int) ([]model.DriftReport, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reports := append([]model.DriftReport{}, r.drifts...)
+	sort.Slice(reports, func(i, j int) bool {
+		if !reports[i].LastSeenAt.Equal(reports[j].LastSeenAt) {
+			return reports[i].LastSeenAt.After(reports[j].LastSeenAt)
+		}
+		return reports[i].ID > reports[j].ID
+	})
+	if limit > 0 && len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+func (r *MemoryRepository) CreateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error) {
+	s = newSchedule(s, time.Now().UTC())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.wallets[s.WalletID]; !ok {
+		return model.Schedule{}, model.ErrWalletNotFound
+	}
+	r.schedules[s.ID] = memorySchedule{Schedule: s}
+	return s, nil
+}
+
+func (r *MemoryRepository) GetSchedule(ctx context.Context, walletID, id string) (model.Schedule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.schedules[id]
+	if !ok || s.WalletID != walletID {
+		return model.Schedule{}, model.ErrScheduleNotFound
+	}
+	return s.Schedule, nil
+}
+
+func (r *MemoryRepository) ListSchedules(ctx context.Context, walletID string) ([]model.Schedule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return nil, model.ErrWalletNotFound
+	}
+	schedules := []model.Schedule{}
+	for _, s := range r.schedules {
+		if s.WalletID == walletID {
+			schedules = append(schedules, s.Schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if !schedules[i].CreatedAt.Equal(schedules[j].CreatedAt) {
+			return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+		}
+		return schedules[i].ID < schedules[j].ID
+	})
+	return schedules, nil
+}
+
+func (r *MemoryRepository) UpdateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, err := r.updateSchedule(s)
+	return stored.Schedule, err
+}
+
+// updateSchedule stores the mutable fields of s, the caller must hold the write lock.
+func (r *MemoryRepository) updateSchedule(s model.Schedule) (memorySchedule, error) {
+	stored, ok := r.schedules[s.ID]
+	if !ok || stored.Version != s.Version {
+		return memorySchedule{}, ErrScheduleChanged
+	}
+	stored.Amount = s.Amount
+	stored.EndAt = s.EndAt
+	stored.Status = s.Status
+	stored.NextRunAt = s.NextRunAt
+	stored.DueAt = s.DueAt
+	stored.Attempts = s.Attempts
+	stored.UpdatedAt = time.Now().UTC()
+	stored.Version++
+	r.schedules[s.ID] = stored
+	return stored, nil
+}
+
+func (r *MemoryRepository) ClaimDueSchedules(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Schedule, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	due := []model.Schedule{}
+	for _, s := range r.schedules {
+		if s.Status == model.ScheduleActive && s.DueAt != nil && !s.DueAt.After(now) && !s.leaseUntil.After(now) {
+			due = append(due, s.Schedule)
+		}
+	}
+	sortDue(due)
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i, s := range due {
+		s.Version++
+		r.schedules[s.ID] = memorySchedule{Schedule: s, leaseUntil: now.Add(lease)}
+		due[i] = s
+	}
+	return due, nil
+}
+
+func (r *MemoryRepository) FinishScheduleRun(ctx context.Context, s model.Schedule, run model.ScheduleRun) (model.Schedule, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.recordRun(s.ID, run)
+
+	stored, err := r.updateSchedule(s)
+	if err != nil {
+		return model.Schedule{}, err
+	}
+	stored.leaseUntil = time.Time{}
+	r.schedules[s.ID] = stored
+	return stored.Schedule, nil
+}
+
+// recordRun stores the run, the caller must hold the write lock. An attempt
+// recorded already is kept unless the run succeeded, see Schedules.FinishScheduleRun.
+func (r *MemoryRepository) recordRun(scheduleID string, run model.ScheduleRun) {
+	for i, recorded := range r.runs {
+		if recorded.ScheduleID == scheduleID && recorded.Occurrence.Equal(run.Occurrence) && recorded.Attempt == run.Attempt {
+			if run.Status == model.RunSucceeded {
+				run.ID = recorded.ID
+				run.ScheduleID = scheduleID
+				r.runs[i] = run
+			}
+			return
+		}
+	}
+	run.ID = int64(len(r.runs) + 1)
+	run.ScheduleID = scheduleID
+	r.runs = append(r.runs, run)
+}
+
+func (r *MemoryRepository) ScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]model.ScheduleRun, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Runs are stored oldest first
+	runs := []model.ScheduleRun{}
+	for i := len(r.runs) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+		if r.runs[i].ScheduleID == scheduleID {
+			runs = append(runs, r.runs[i])
+		}
+	}
+	return runs, nil
+}
+
+func (r *MemoryRepository) CreateInterestProduct(ctx context.Context, p model.InterestProduct) (model.InterestProduct, error) {
+	p = newInterestProduct(p, time.Now().UTC())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.interestProducts[p.ID] = p
+	return p, nil
+}
+
+func (r *MemoryRepository) InterestProducts(ctx context.Context) ([]model.InterestProduct, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	products := []model.InterestProduct{}
+	for _, p := range r.interestProducts {
+		products = append(products, p)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		if !products[i].CreatedAt.Equal(products[j].CreatedAt) {
+			return products[i].CreatedAt.Before(products[j].CreatedAt)
+		}
+		return products[i].ID < products[j].ID
+	})
+	return products, nil
+}
+
+func (r *MemoryRepository) AssignInterestProduct(ctx context.Context, walletID, productID string, from time.Time) (model.InterestAccount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return model.InterestAccount{}, model.ErrWalletNotFound
+	}
+	product, ok := r.interestProducts[productID]
+	if !ok {
+		return model.InterestAccount{}, model.ErrInterestProductNotFound
+	}
+
+	account, ok := r.interestAccounts[walletID]
+	if !ok {
+		account = model.InterestAccount{WalletID: walletID, AccruedThrough: from.UTC().AddDate(0, 0, -1)}
+	}
+	account.Product = product
+	account.UpdatedAt = time.Now().UTC()
+	r.interestAccounts[walletID] = account
+	return account, nil
+}
+
+func (r *MemoryRepository) GetInterestAccount(ctx context.Context, walletID string) (model.InterestAccount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return model.InterestAccount{}, model.ErrWalletNotFound
+	}
+	account, ok := r.interestAccounts[walletID]
+	if !ok {
+		return model.InterestAccount{}, model.ErrInterestNotAssigned
+	}
+	return account, nil
+}
+
+func (r *MemoryRepository) DueInterestAccounts(ctx context.Context, afterID string, through time.Time, limit int) ([]model.InterestAccount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	due := []model.InterestAccount{}
+	for id, account := range r.interestAccounts {
+		if id > afterID && account.AccruedThrough.Before(through) {
+			due = append(due, account)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].WalletID < due[j].WalletID })
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (r *MemoryRepository) AccrueInterest(ctx context.Context, accrual model.InterestAccrual, posting *model.InterestPosting) (model.InterestAccount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	account, ok := r.interestAccounts[accrual.WalletID]
+	if !ok {
+		return model.InterestAccount{}, model.ErrInterestNotAssigned
+	}
+	account, err := accrueInto(account, accrual, posting)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+
+	if posting != nil {
+		p := *posting
+		if p.Amount > 0 {
+			if p.LedgerEntryID, err = r.apply(p.WalletID, model.Interest, p.Amount, "", p.Reference()); err != nil {
+				return model.InterestAccount{}, err
+			}
+		}
+		p.PostedAt = time.Now().UTC()
+		r.interestPostings[p.WalletID] = append(r.interestPostings[p.WalletID], p)
+	}
+	r.interestAccruals[accrual.WalletID] = append(r.interestAccruals[accrual.WalletID], accrual)
+	r.interestAccounts[accrual.WalletID] = account
+	return account, nil
+}
+
+func (r *MemoryRepository) InterestAccruals(ctx context.Context, walletID string) ([]model.InterestAccrual, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return nil, model.ErrWalletNotFound
+	}
+	return append([]model.InterestAccrual{}, r.interestAccruals[walletID]...), nil
+}
+
+func (r *MemoryRepository) InterestPostings(ctx context.Context, walletID string) ([]model.InterestPosting, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return nil, model.ErrWalletNotFound
+	}
+	return append([]model.InterestPosting{}, r.interestPostings[walletID]...), nil
+}
+
+// overdraft returns the credit line of the wallet with its balance, the caller must hold the lock.
+func (r *MemoryRepository) overdraft(walletID string) (model.Overdraft, error) {
+	balance, ok := r.wallets[walletID]
+	if !ok {
+		return model.Overdraft{}, model.ErrWalletNotFound
+	}
+	o := r.overdrafts[walletID]
+	o.WalletID = walletID
+	o.Balance = balance
+	return o, nil
+}
+
+func (r *MemoryRepository) GetOverdraft(ctx context.Context, walletID string) (model.Overdraft, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.overdraft(walletID)
+}
+
+func (r *MemoryRepository) SetOverdraft(ctx context.Context, walletID string, creditLimit, dailyFee int64, from time.Time) (model.Overdraft, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, err := r.overdraft(walletID)
+	if err != nil {
+		return model.Overdraft{}, err
+	}
+	if o, err = setOverdraft(o, creditLimit, dailyFee, from); err != nil {
+		return model.Overdraft{}, err
+	}
+	r.overdrafts[walletID] = o
+	return o, nil
+}
+
+func (r *MemoryRepository) DueOverdraftFees(ctx context.Context, afterID string, through time.Time, limit int) ([]model.Overdraft, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	due := []model.Overdraft{}
+	for id, o := range r.overdrafts {
+		if id > afterID && o.DailyFee > 0 && o.FeesChargedThrough.Before(through) {
+			o.Balance = r.wallets[id]
+			due = append(due, o)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].WalletID < due[j].WalletID })
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (r *MemoryRepository) ChargeOverdraftFee(ctx context.Context, fee model.OverdraftCharge) (model.OverdraftCharge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, err := r.overdraft(fee.WalletID)
+	if err != nil {
+		return model.OverdraftCharge{}, err
+	}
+	if fee, err = chargeFee(o, fee); err != nil {
+		return model.OverdraftCharge{}, err
+	}
+
+	if fee.Amount > 0 {
+		if fee.LedgerEntryID, err = r.apply(fee.WalletID, model.OverdraftFee, -fee.Amount, "", fee.Reference()); err != nil {
+			return model.OverdraftCharge{}, err
+		}
+		r.overdraftFees[fee.WalletID] = append(r.overdraftFees[fee.WalletID], fee)
+	}
+	day := fee.Day
+	o.FeesChargedThrough = &day
+	r.overdrafts[fee.WalletID] = o
+	return fee, nil
+}
+
+func (r *MemoryRepository) OverdraftFees(ctx context.Context, walletID string) ([]model.OverdraftCharge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.wallets[walletID]; !ok {
+		return nil, model.ErrWalletNotFound
+	}
+	return append([]model.OverdraftCharge{}, r.overdraftFees[walletID]...), nil
+}
+
+// RunMigrations is a no-op kept for parity with the SQL-backed repositories.
+func (r *MemoryRepository) RunMigrations(ctx context.Context) error {
+	return nil
+}
+
+// PendingMigrations always returns nothing, there is no schema to migrate.
+func (r *MemoryRepository) PendingMigrations(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+// Ping always succeeds, the storage lives in the process.
+func (r *MemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"WalletApi/migrations"
+)
+
+// migrationDialect holds the statements that differ between the SQL backends.
+type migrationDialect struct {
+	dir         string
+	createTable string
+	tableExists string
+	lock        string
+	isApplied   string
+	markApplied string
+}
+
+var postgresMigrations = migrationDialect{
+	dir: ".",
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	tableExists: `SELECT EXISTS(SELECT 1 FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = 'schema_migrations')`,
+	// Serializes concurrent instances starting at the same time
+	lock:        "SELECT pg_advisory_xact_lock(20250101)",
+	isApplied:   "SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)",
+	markApplied: "INSERT INTO schema_migrations (version) VALUES ($1)",
+}
+
+var sqliteMigrations = migrationDialect{
+	dir: "sqlite",
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version TEXT PRIMARY KEY,
+		applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	tableExists: "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')",
+	isApplied:   "SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = ?)",
+	markApplied: "INSERT INTO schema_migrations (version) VALUES (?)",
+}
+
+// migrationVersions lists the embedded migration files of the dialect in the order they are applied.
+func migrationVersions(d migrationDialect) ([]string, error) {
+	files, err := fs.Glob(migrations.FS, path.Join(d.dir, "*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Strings(files)
+
+	versions := make([]string, len(files))
+	for i, file := range files {
+		versions[i] = strings.TrimSuffix(path.Base(file), ".sql")
+	}
+	return versions, nil
+}
+
+// applyMigrations runs every migration that is not recorded in schema_migrations yet,
+// each one in its own transaction.
+func applyMigrations(ctx context.Context, db *sql.DB, d migrationDialect) error {
+	if _, err := db.ExecContext(ctx, d.createTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	versions, err := migrationVersions(d)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if err := applyMigration(ctx, db, d, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, d migrationDialect, version string) error {
+	// Reading the migration file
+	migration, err := migrations.FS.ReadFile(path.Join(d.dir, version+".sql"))
+	if err != nil {
+		return fmt.Errorf("failed to read migration %s: %w", version, err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if d.lock != "" {
+		if _, err := tx.ExecContext(ctx, d.lock); err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+	}
+
+	var applied bool
+	if err := tx.QueryRowContext(ctx, d.isApplied, version).Scan(&applied); err != nil {
+		return fmt.Errorf("failed to check migration %s: %w", version, err)
+	}
+	if applied {
+		return nil
+	}
+
+	// Migrating
+	if _, err := tx.ExecContext(ctx, string(migration)); err != nil {
+		return fmt.Errorf("failed to execute migration %s: %w", version, err)
+	}
+	if _, err := tx.ExecContext(ctx, d.markApplied, version); err != nil {
+		return fmt.Errorf("failed to record migration %s: %w", version, err)
+	}
+
+	return tx.Commit()
+}
+
+// pendingMigrations lists the embedded migrations that are not recorded in
+// schema_migrations. It only reads, as it backs the readiness probe: on a new
+// database without schema_migrations every migration is pending.
+func pendingMigrations(ctx context.Context, db *sql.DB, d migrationDialect) ([]string, error) {
+	versions, err := migrationVersions(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, d.tableExists).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up schema_migrations: %w", err)
+	}
+	if !exists {
+		return versions, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan migration version: %w", err)
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, version := range versions {
+		if !applied[version] {
+			pending = append(pending, version)
+		}
+	}
+	return pending, nil
+}
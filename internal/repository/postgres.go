@@ -5,24 +5,75 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"WalletApi/internal/model"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type PostgresRepository struct {
-	db *sql.DB
+	db       *sql.DB
+	replicas *ReplicaSet
+	hooks    []QueryHook
+}
+
+// PostgresOption configures optional PostgresRepository features.
+type PostgresOption func(*PostgresRepository)
+
+// WithReplicas routes balance and history reads through the replica set.
+func WithReplicas(replicas *ReplicaSet) PostgresOption {
+	return func(r *PostgresRepository) {
+		r.replicas = replicas
+	}
+}
+
+// WithQueryHook calls hook around every statement the repository runs.
+// Hooks run in the order they are added, each one sees the context of the previous.
+func WithQueryHook(hook QueryHook) PostgresOption {
+	return func(r *PostgresRepository) {
+		r.hooks = append(r.hooks, hook)
+	}
 }
 
-func NewPostgresRepository(db *sql.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+func NewPostgresRepository(db *sql.DB, opts ...PostgresOption) *PostgresRepository {
+	r := &PostgresRepository{db: db}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// reader returns the database that serves reads made with ctx,
+// writes always go to r.db.
+func (r *PostgresRepository) reader(ctx context.Context) *sql.DB {
+	if r.replicas == nil {
+		return r.db
+	}
+	return r.replicas.reader(ctx)
+}
+
+// observe starts the query hooks for the named statement.
+func (r *PostgresRepository) observe(ctx context.Context, name string) (context.Context, func(error)) {
+	dones := make([]func(error), len(r.hooks))
+	for i, hook := range r.hooks {
+		ctx, dones[i] = hook(ctx, name)
+	}
+	return ctx, func(err error) {
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i](err)
+		}
+	}
 }
 
 func (r *PostgresRepository) CreateWallet(ctx context.Context) (string, error) {
 	var walletID string
-	err := r.db.QueryRowContext(ctx,
+	stmtCtx, done := r.observe(ctx, "insert_wallet")
+	err := r.db.QueryRowContext(stmtCtx,
 		`INSERT INTO wallets (balance) VALUES (0) RETURNING id::text`).Scan(&walletID)
+	done(err)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -35,79 +86,170 @@ func (r *PostgresRepository) CreateWallet(ctx context.Context) (string, error) {
 }
 
 func (r *PostgresRepository) ProcessTransaction(ctx context.Context, walletID string, amount int64, isDeposit bool) error {
+	return r.processTransaction(ctx, walletID, amount, isDeposit, "")
+}
+
+func (r *PostgresRepository) ProcessTransactionOnce(ctx context.Context, walletID string, amount int64, isDeposit bool, reference string) error {
+	return r.processTransaction(ctx, walletID, amount, isDeposit, reference)
+}
+
+func (r *PostgresRepository) processTransaction(ctx context.Context, walletID string, amount int64, isDeposit bool, reference string) error {
 	// Validation of the amount
 	if amount <= 0 {
 		return model.ErrInvalidAmount
 	}
 
-	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	delta := amount
+	if !isDeposit {
+		delta = -amount
+	}
+
+	tx, err := r.begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return err
 	}
 	defer tx.Rollback()
 
+	if _, err := r.apply(ctx, tx, walletID, operationType(isDeposit), delta, "", reference); err != nil {
+		return err
+	}
+	return r.commit(ctx, tx)
+}
+
+func (r *PostgresRepository) begin(ctx context.Context) (*sql.Tx, error) {
+	stmtCtx, done := r.observe(ctx, "begin")
+	tx, err := r.db.BeginTx(stmtCtx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	done(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	return tx, nil
+}
+
+func (r *PostgresRepository) commit(ctx context.Context, tx *sql.Tx) error {
+	_, done := r.observe(ctx, "commit")
+	err := tx.Commit()
+	done(err)
+	if err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return nil
+}
+
+// apply changes the balance by delta and records the ledger entry within tx,
+// it returns the ID of the entry. A non-empty reference must not have been
+// applied yet.
+func (r *PostgresRepository) apply(ctx context.Context, tx *sql.Tx, walletID string, operation model.OperationType, delta int64, reason, reference string) (int64, error) {
 	// 1. Checking the wallet's existence
 	var exists bool
-	err = tx.QueryRowContext(ctx,
+	stmtCtx, done := r.observe(ctx, "wallet_exists")
+	err := tx.QueryRowContext(stmtCtx,
 		"SELECT EXISTS(SELECT 1 FROM wallets WHERE id = $1)",
 		walletID,
 	).Scan(&exists)
+	done(err)
 
 	if err != nil {
-		return fmt.Errorf("wallet existence check failed: %w", err)
+		return 0, fmt.Errorf("wallet existence check failed: %w", err)
 	}
 	if !exists {
-		return model.ErrWalletNotFound
+		return 0, model.ErrWalletNotFound
 	}
 
 	// 2. Getting the current balance with the lock
-	var balance int64
-	err = tx.QueryRowContext(ctx,
-		"SELECT balance FROM wallets WHERE id = $1 FOR UPDATE",
+	var balance, creditLimit int64
+	var frozen bool
+	stmtCtx, done = r.observe(ctx, "lock_balance")
+	err = tx.QueryRowContext(stmtCtx,
+		"SELECT balance, credit_limit, frozen FROM wallets WHERE id = $1 FOR UPDATE",
 		walletID,
-	).Scan(&balance)
+	).Scan(&balance, &creditLimit, &frozen)
+	done(err)
 
 	if err != nil {
-		return fmt.Errorf("failed to get balance: %w", err)
+		return 0, fmt.Errorf("failed to get balance: %w", err)
+	}
+	if frozen {
+		return 0, model.ErrWalletFrozen
+	}
+	if reference != "" {
+		// References are unique across wallets, so the lock of this one does not keep
+		// a transaction on another wallet from applying the same reference
+		// concurrently: the unique index rejects the later insert, see isReferenceConflict
+		var applied bool
+		stmtCtx, done = r.observe(ctx, "reference_exists")
+		err = tx.QueryRowContext(stmtCtx,
+			"SELECT EXISTS(SELECT 1 FROM ledger_entries WHERE reference = $1)",
+			reference,
+		).Scan(&applied)
+		done(err)
+		if err != nil {
+			return 0, fmt.Errorf("reference check failed: %w", err)
+		}
+		if applied {
+			return 0, model.ErrDuplicateReference
+		}
 	}
 
-	// 3. We check whether there are enough funds to debit
-	if !isDeposit && balance < amount {
-		return model.ErrInsufficientFunds
+	// 3. We check whether there are enough funds to debit, the credit line included
+	if err := checkFunds(balance, creditLimit, delta); err != nil {
+		return 0, err
 	}
 
 	// 4. Calculating the new balance
-	var newBalance int64
-	if isDeposit {
-		newBalance = balance + amount
-	} else {
-		newBalance = balance - amount
-	}
+	newBalance := balance + delta
 
 	// 5. Updating the balance
-	_, err = tx.ExecContext(ctx,
+	stmtCtx, done = r.observe(ctx, "update_balance")
+	_, err = tx.ExecContext(stmtCtx,
 		"UPDATE wallets SET balance = $1 WHERE id = $2",
 		newBalance,
 		walletID,
 	)
+	done(err)
 	if err != nil {
-		return fmt.Errorf("balance update failed: %w", err)
+		return 0, fmt.Errorf("balance update failed: %w", err)
 	}
 
-	// 6. Fixing the transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("transaction commit failed: %w", err)
+	// 6. Recording the ledger entry
+	var entryID int64
+	stmtCtx, done = r.observe(ctx, "insert_ledger_entry")
+	// clock_timestamp, unlike the transaction start time of now(), is taken with the
+	// wallet locked, so the entries of a wallet are in the same order by time and by ID
+	err = tx.QueryRowContext(stmtCtx,
+		"INSERT INTO ledger_entries (wallet_id, operation_type, amount, reason, reference, created_at) VALUES ($1, $2, $3, $4, $5, clock_timestamp()) RETURNING id",
+		walletID,
+		operation,
+		delta,
+		nullString(reason),
+		nullString(reference),
+	).Scan(&entryID)
+	done(err)
+	if isReferenceConflict(err) {
+		return 0, model.ErrDuplicateReference
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ledger entry insert failed: %w", err)
 	}
 
-	return nil
+	return entryID, nil
+}
+
+// isReferenceConflict reports whether err violates the unique index on ledger
+// entry references, which a transaction on another wallet committed first.
+func isReferenceConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "ledger_entries_reference_idx"
 }
 
 func (r *PostgresRepository) GetBalance(ctx context.Context, walletID string) (int64, error) {
 	var balance int64
-	err := r.db.QueryRowContext(ctx,
+	stmtCtx, done := r.observe(ctx, "select_balance")
+	err := r.reader(ctx).QueryRowContext(stmtCtx,
 		"SELECT balance FROM wallets WHERE id = $1",
 		walletID,
 	).Scan(&balance)
+	done(err)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -118,26 +260,1310 @@ func (r *PostgresRepository) GetBalance(ctx context.Context, walletID string) (i
 	return balance, nil
 }
 
-func (r *PostgresRepository) RunMigrations(ctx context.Context) error {
-	// Getting the current working directory
-	wd, err := os.Getwd()
+func (r *PostgresRepository) GetHistory(ctx context.Context, walletID string, limit int) ([]model.LedgerEntry, error) {
+	if err := r.checkWalletExists(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, wallet_id::text, operation_type, amount, COALESCE(reason, ''), created_at
+		FROM ledger_entries WHERE wallet_id = $1 ORDER BY id DESC`
+	args := []interface{}{walletID}
+	if limit > 0 {
+		query += " LIMIT $2"
+		args = append(args, limit)
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_history")
+	history, err := r.queryHistory(stmtCtx, query, args...)
+	done(err)
+	return history, err
+}
+
+func (r *PostgresRepository) queryHistory(ctx context.Context, query string, args ...interface{}) ([]model.LedgerEntry, error) {
+	rows, err := r.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []model.LedgerEntry{}
+	for rows.Next() {
+		var e model.LedgerEntry
+		if err := rows.Scan(&e.ID, &e.WalletID, &e.OperationType, &e.Amount, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+func (r *PostgresRepository) checkWalletExists(ctx context.Context, walletID string) error {
+	var exists bool
+	stmtCtx, done := r.observe(ctx, "wallet_exists")
+	err := r.reader(ctx).QueryRowContext(stmtCtx,
+		"SELECT EXISTS(SELECT 1 FROM wallets WHERE id = $1)",
+		walletID,
+	).Scan(&exists)
+	done(err)
+
+	if err != nil {
+		return fmt.Errorf("wallet existence check failed: %w", err)
+	}
+	if !exists {
+		return model.ErrWalletNotFound
+	}
+	return nil
+}
+
+// postgresBalanceAt tells whether wallet $1 exists and computes its balance at
+// $2, starting from the latest snapshot before $2.
+const postgresBalanceAt = `
+	WITH snapshot AS (
+		SELECT entry_id, balance FROM balance_snapshots
+		WHERE wallet_id = $1 AND created_at <= $2
+		ORDER BY created_at DESC, entry_id DESC
+		LIMIT 1
+	)
+	SELECT
+		EXISTS (SELECT 1 FROM wallets WHERE id = $1),
+		COALESCE((SELECT balance FROM snapshot), 0) + COALESCE((
+			SELECT SUM(amount) FROM ledger_entries
+			WHERE wallet_id = $1 AND created_at <= $2 AND id > COALESCE((SELECT entry_id FROM snapshot), 0)
+		), 0)`
+
+func (r *PostgresRepository) BalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error) {
+	var exists bool
+	var balance int64
+	stmtCtx, done := r.observe(ctx, "select_balance_at")
+	err := r.reader(ctx).QueryRowContext(stmtCtx, postgresBalanceAt, walletID, at).Scan(&exists, &balance)
+	done(err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute balance: %w", err)
+	}
+	if !exists {
+		return 0, model.ErrWalletNotFound
+	}
+	return balance, nil
+}
+
+func (r *PostgresRepository) StreamStatement(ctx context.Context, walletID string, from, to time.Time, opening func(int64) error, entry func(model.LedgerEntry) error) error {
+	// The opening balance and the entries are read from one snapshot, replicas included
+	tx, err := r.reader(ctx).BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	var balance int64
+	stmtCtx, done := r.observe(ctx, "select_balance_at")
+	err = tx.QueryRowContext(stmtCtx, postgresBalanceAt, walletID, from).Scan(&exists, &balance)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to compute balance: %w", err)
+	}
+	if !exists {
+		return model.ErrWalletNotFound
+	}
+	if err := opening(balance); err != nil {
+		return err
+	}
+
+	stmtCtx, done = r.observe(ctx, "select_statement_entries")
+	rows, err := tx.QueryContext(stmtCtx, `
+		SELECT id, wallet_id::text, operation_type, amount, COALESCE(reason, ''), created_at
+		FROM ledger_entries
+		WHERE wallet_id = $1 AND created_at > $2 AND created_at <= $3
+		ORDER BY created_at, id`,
+		walletID,
+		from,
+		to,
+	)
+	if err != nil {
+		done(err)
+		return fmt.Errorf("failed to get statement entries: %w", err)
+	}
+	return scanPostgresEntries(rows, done, entry)
+}
+
+func (r *PostgresRepository) StreamLedger(ctx context.Context, afterID int64, before time.Time, fn func(model.LedgerEntry) error) error {
+	stmtCtx, done := r.observe(ctx, "select_ledger_export")
+	rows, err := r.reader(ctx).QueryContext(stmtCtx, `
+		SELECT id, wallet_id::text, operation_type, amount, COALESCE(reason, ''), created_at
+		FROM ledger_entries
+		WHERE id > $1
+		ORDER BY id`,
+		afterID,
+	)
+	if err != nil {
+		done(err)
+		return fmt.Errorf("failed to get ledger entries: %w", err)
+	}
+	err = scanPostgresEntries(rows, done, stopAfter(before, fn))
+	if errors.Is(err, errStopStream) {
+		return nil
+	}
+	return err
+}
+
+func (r *PostgresRepository) LeaseExport(ctx context.Context, owner string, now time.Time, lease time.Duration) (bool, error) {
+	stmtCtx, done := r.observe(ctx, "lease_export")
+	res, err := r.db.ExecContext(stmtCtx, `
+		INSERT INTO export_lease (id, owner, lease_until) VALUES (TRUE, $1, $2)
+		ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, lease_until = excluded.lease_until
+		WHERE export_lease.owner = excluded.owner OR export_lease.lease_until <= $3`,
+		owner,
+		now.Add(lease).UTC(),
+		now.UTC(),
+	)
+	done(err)
+	if err != nil {
+		return false, fmt.Errorf("failed to lease the export: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *PostgresRepository) ReleaseExport(ctx context.Context, owner string) error {
+	stmtCtx, done := r.observe(ctx, "release_export")
+	_, err := r.db.ExecContext(stmtCtx, "DELETE FROM export_lease WHERE owner = $1", owner)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to release the export lease: %w", err)
+	}
+	return nil
+}
+
+// scanPostgresEntries calls fn with every ledger entry of rows and closes them.
+// Only errors of the database are reported to done, not those of fn, which are
+// returned as they are.
+func scanPostgresEntries(rows *sql.Rows, done func(error), fn func(model.LedgerEntry) error) error {
+	defer rows.Close()
+
+	var err, fnErr error
+	for rows.Next() {
+		var e model.LedgerEntry
+		if err = rows.Scan(&e.ID, &e.WalletID, &e.OperationType, &e.Amount, &e.Reason, &e.CreatedAt); err != nil {
+			break
+		}
+		if fnErr = fn(e); fnErr != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	done(err)
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ledger entries: %w", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) SnapshotBalances(ctx context.Context, afterID string, limit int) (string, int, error) {
+	if afterID == "" {
+		afterID = uuid.Nil.String()
+	}
+
+	var lastID sql.NullString
+	stmtCtx, done := r.observe(ctx, "select_snapshot_chunk")
+	err := r.db.QueryRowContext(stmtCtx,
+		"SELECT MAX(id)::text FROM (SELECT id FROM wallets WHERE id > $1 ORDER BY id LIMIT $2) chunk",
+		afterID,
+		postgresLimit(limit),
+	).Scan(&lastID)
+	done(err)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to select wallets: %w", err)
+	}
+	if !lastID.Valid {
+		return "", 0, nil
+	}
+
+	// Only the entries since the latest snapshot of each wallet are summed. The
+	// entries of a wallet are committed in ID order, so the visible ones always
+	// make a prefix of its history.
+	stmtCtx, done = r.observe(ctx, "insert_balance_snapshots")
+	res, err := r.db.ExecContext(stmtCtx, `
+		WITH latest AS (
+			SELECT DISTINCT ON (wallet_id) wallet_id, entry_id, balance
+			FROM balance_snapshots
+			WHERE wallet_id > $1 AND wallet_id <= $2
+			ORDER BY wallet_id, entry_id DESC
+		), delta AS (
+			SELECT e.wallet_id, MAX(e.id) AS entry_id, SUM(e.amount) AS amount
+			FROM ledger_entries e
+			LEFT JOIN latest s ON s.wallet_id = e.wallet_id
+			WHERE e.wallet_id > $1 AND e.wallet_id <= $2 AND e.id > COALESCE(s.entry_id, 0)
+			GROUP BY e.wallet_id
+		)
+		INSERT INTO balance_snapshots (wallet_id, entry_id, balance, created_at)
+		SELECT d.wallet_id, d.entry_id, COALESCE(s.balance, 0) + d.amount, e.created_at
+		FROM delta d
+		JOIN ledger_entries e ON e.id = d.entry_id
+		LEFT JOIN latest s ON s.wallet_id = d.wallet_id
+		ON CONFLICT DO NOTHING`,
+		afterID,
+		lastID.String,
+	)
+	done(err)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+	taken, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to get working directory: %w", err)
+		return "", 0, err
 	}
+	return lastID.String, int(taken), nil
+}
 
-	// Creating the absolute path to the migration file
-	migrationPath := filepath.Join(wd, "migrations", "001_init.sql")
+func (r *PostgresRepository) GetWallet(ctx context.Context, walletID string) (model.Wallet, error) {
+	w := model.Wallet{ID: walletID}
+	stmtCtx, done := r.observe(ctx, "select_wallet")
+	err := r.db.QueryRowContext(stmtCtx,
+		"SELECT balance, frozen, credit_limit FROM wallets WHERE id = $1",
+		walletID,
+	).Scan(&w.Balance, &w.Frozen, &w.CreditLimit)
+	done(err)
 
-	// Reading the migration file
-	migration, err := os.ReadFile(migrationPath)
 	if err != nil {
-		return fmt.Errorf("failed to read migration file at %s: %w", migrationPath, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Wallet{}, model.ErrWalletNotFound
+		}
+		return model.Wallet{}, fmt.Errorf("failed to get wallet: %w", err)
 	}
+	return w, nil
+}
+
+func (r *PostgresRepository) SetFrozen(ctx context.Context, walletID string, frozen bool) error {
+	stmtCtx, done := r.observe(ctx, "update_frozen")
+	res, err := r.db.ExecContext(stmtCtx,
+		"UPDATE wallets SET frozen = $1 WHERE id = $2",
+		frozen,
+		walletID,
+	)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to update wallet: %w", err)
+	}
+	return checkUpdated(res)
+}
+
+func (r *PostgresRepository) RequestAdjustment(ctx context.Context, req model.AdjustmentRequest) (model.AdjustmentRequest, error) {
+	a, err := newAdjustment(req, time.Now().UTC())
+	if err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	if _, err := uuid.Parse(a.WalletID); err != nil {
+		return model.AdjustmentRequest{}, model.ErrWalletNotFound
+	}
+
+	stmtCtx, done := r.observe(ctx, "insert_adjustment")
+	res, err := r.db.ExecContext(stmtCtx, `
+		INSERT INTO adjustments (id, wallet_id, amount, reason_code, justification, status, requested_by, requested_at, expires_at)
+		SELECT $1::uuid, id, $3::bigint, $4::text, $5::text, $6::text, $7::text, $8::timestamptz, $9::timestamptz
+		FROM wallets WHERE id = $2`,
+		a.ID, a.WalletID, a.Amount, a.ReasonCode, a.Justification, a.Status, a.RequestedBy, a.RequestedAt, a.ExpiresAt,
+	)
+	done(err)
+	if err != nil {
+		return model.AdjustmentRequest{}, fmt.Errorf("failed to insert adjustment: %w", err)
+	}
+	if err := checkUpdated(res); err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	return a, nil
+}
+
+const postgresAdjustmentColumns = `id::text, wallet_id::text, amount, reason_code, justification, status,
+	requested_by, requested_at, expires_at, decided_by, decided_at, ledger_entry_id`
+
+func scanPostgresAdjustment(row interface{ Scan(...any) error }) (model.AdjustmentRequest, error) {
+	var a model.AdjustmentRequest
+	var decidedBy sql.NullString
+	var decidedAt sql.NullTime
+	var entryID sql.NullInt64
+	err := row.Scan(&a.ID, &a.WalletID, &a.Amount, &a.ReasonCode, &a.Justification, &a.Status,
+		&a.RequestedBy, &a.RequestedAt, &a.ExpiresAt, &decidedBy, &decidedAt, &entryID)
+	if err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	a.RequestedAt = a.RequestedAt.UTC()
+	a.ExpiresAt = a.ExpiresAt.UTC()
+	a.DecidedBy = decidedBy.String
+	if decidedAt.Valid {
+		t := decidedAt.Time.UTC()
+		a.DecidedAt = &t
+	}
+	a.LedgerEntryID = entryID.Int64
+	return a, nil
+}
+
+func (r *PostgresRepository) PendingAdjustments(ctx context.Context) ([]model.AdjustmentRequest, error) {
+	stmtCtx, done := r.observe(ctx, "select_pending_adjustments")
+	rows, err := r.db.QueryContext(stmtCtx,
+		"SELECT "+postgresAdjustmentColumns+" FROM adjustments WHERE status = $1 AND expires_at > $2 ORDER BY requested_at, id",
+		model.AdjustmentPending,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list adjustments: %w", err)
+	}
+	defer rows.Close()
+
+	pending := []model.AdjustmentRequest{}
+	for rows.Next() {
+		a, err := scanPostgresAdjustment(rows)
+		if err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan adjustment: %w", err)
+		}
+		pending = append(pending, a)
+	}
+	done(rows.Err())
+	return pending, rows.Err()
+}
+
+func (r *PostgresRepository) ApproveAdjustment(ctx context.Context, id, approver string) (model.AdjustmentRequest, error) {
+	return r.decideAdjustment(ctx, id, approver, true)
+}
+
+func (r *PostgresRepository) RejectAdjustment(ctx context.Context, id, operator string) (model.AdjustmentRequest, error) {
+	return r.decideAdjustment(ctx, id, operator, false)
+}
 
-	// Migrating
-	if _, err := r.db.ExecContext(ctx, string(migration)); err != nil {
-		return fmt.Errorf("failed to execute migration: %w", err)
+func (r *PostgresRepository) decideAdjustment(ctx context.Context, id, operator string, approve bool) (model.AdjustmentRequest, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return model.AdjustmentRequest{}, model.ErrAdjustmentNotFound
 	}
 
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	defer tx.Rollback()
+
+	// The row lock makes concurrent decisions on the same adjustment wait for each other
+	stmtCtx, done := r.observe(ctx, "lock_adjustment")
+	a, err := scanPostgresAdjustment(tx.QueryRowContext(stmtCtx,
+		"SELECT "+postgresAdjustmentColumns+" FROM adjustments WHERE id = $1 FOR UPDATE", id))
+	done(err)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.AdjustmentRequest{}, model.ErrAdjustmentNotFound
+		}
+		return model.AdjustmentRequest{}, fmt.Errorf("failed to get adjustment: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if err := decideAdjustment(a, operator, approve, now); err != nil {
+		if errors.Is(err, model.ErrAdjustmentExpired) {
+			a.Status = model.AdjustmentExpired
+			if err := r.updateAdjustment(ctx, tx, a); err != nil {
+				return model.AdjustmentRequest{}, err
+			}
+			if err := r.commit(ctx, tx); err != nil {
+				return model.AdjustmentRequest{}, err
+			}
+		}
+		return model.AdjustmentRequest{}, err
+	}
+
+	a.Status = model.AdjustmentRejected
+	if approve {
+		entryID, err := r.apply(ctx, tx, a.WalletID, model.Adjustment, a.Amount, a.LedgerReason(), "")
+		if err != nil {
+			return model.AdjustmentRequest{}, err
+		}
+		a.Status = model.AdjustmentApproved
+		a.LedgerEntryID = entryID
+	}
+	a.DecidedBy = strings.TrimSpace(operator)
+	a.DecidedAt = &now
+
+	if err := r.updateAdjustment(ctx, tx, a); err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	if err := r.commit(ctx, tx); err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	return a, nil
+}
+
+func (r *PostgresRepository) updateAdjustment(ctx context.Context, tx *sql.Tx, a model.AdjustmentRequest) error {
+	var entryID sql.NullInt64
+	if a.LedgerEntryID != 0 {
+		entryID = sql.NullInt64{Int64: a.LedgerEntryID, Valid: true}
+	}
+	var decidedAt sql.NullTime
+	if a.DecidedAt != nil {
+		decidedAt = sql.NullTime{Time: *a.DecidedAt, Valid: true}
+	}
+
+	stmtCtx, done := r.observe(ctx, "update_adjustment")
+	_, err := tx.ExecContext(stmtCtx,
+		"UPDATE adjustments SET status = $2, decided_by = $3, decided_at = $4, ledger_entry_id = $5 WHERE id = $1",
+		a.ID, a.Status, nullString(a.DecidedBy), decidedAt, entryID,
+	)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to update adjustment: %w", err)
+	}
 	return nil
 }
+
+func (r *PostgresRepository) CheckBalances(ctx context.Context, afterID string, limit int) ([]model.BalanceCheck, error) {
+	if afterID == "" {
+		afterID = uuid.Nil.String()
+	}
+
+	// Only the wallets of the chunk are aggregated, each chunk is a short read
+	stmtCtx, done := r.observe(ctx, "check_balances")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT w.id::text, w.balance, COALESCE(SUM(e.amount), 0)
+		FROM (SELECT id, balance FROM wallets WHERE id > $1 ORDER BY id LIMIT $2) w
+		LEFT JOIN ledger_entries e ON e.wallet_id = w.id
+		GROUP BY w.id, w.balance
+		ORDER BY w.id`,
+		afterID,
+		postgresLimit(limit),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to check balances: %w", err)
+	}
+	checks, err := scanBalanceChecks(rows)
+	done(err)
+	return checks, err
+}
+
+func (r *PostgresRepository) ReportDrift(ctx context.Context, check model.BalanceCheck, frozen bool) error {
+	if _, err := uuid.Parse(check.WalletID); err != nil {
+		return model.ErrWalletNotFound
+	}
+
+	stmtCtx, done := r.observe(ctx, "upsert_balance_drift")
+	res, err := r.db.ExecContext(stmtCtx, `
+		INSERT INTO balance_drifts (wallet_id, balance, ledger_balance, drift, detected_at, last_seen_at, frozen)
+		SELECT id, $2::bigint, $3::bigint, $4::bigint, $5::timestamptz, $5::timestamptz, $6::boolean
+		FROM wallets WHERE id = $1
+		ON CONFLICT (wallet_id, drift) DO UPDATE SET
+			balance = excluded.balance,
+			ledger_balance = excluded.ledger_balance,
+			last_seen_at = excluded.last_seen_at,
+			frozen = balance_drifts.frozen OR excluded.frozen`,
+		check.WalletID,
+		check.Balance,
+		check.LedgerBalance,
+		check.Drift(),
+		time.Now().UTC(),
+		frozen,
+	)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to record balance drift: %w", err)
+	}
+	return checkUpdated(res)
+}
+
+func (r *PostgresRepository) DriftReports(ctx context.Context, limit int) ([]model.DriftReport, error) {
+	stmtCtx, done := r.observe(ctx, "select_balance_drifts")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT id, wallet_id::text, balance, ledger_balance, detected_at, last_seen_at, frozen
+		FROM balance_drifts ORDER BY last_seen_at DESC, id DESC LIMIT $1`,
+		postgresLimit(limit),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list balance drifts: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []model.DriftReport{}
+	for rows.Next() {
+		var d model.DriftReport
+		if err := rows.Scan(&d.ID, &d.WalletID, &d.Balance, &d.LedgerBalance, &d.DetectedAt, &d.LastSeenAt, &d.Frozen); err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan balance drift: %w", err)
+		}
+		d.DetectedAt = d.DetectedAt.UTC()
+		d.LastSeenAt = d.LastSeenAt.UTC()
+		reports = append(reports, d)
+	}
+	done(rows.Err())
+	return reports, rows.Err()
+}
+
+func (r *PostgresRepository) CreateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error) {
+	if _, err := uuid.Parse(s.WalletID); err != nil {
+		return model.Schedule{}, model.ErrWalletNotFound
+	}
+	s = newSchedule(s, time.Now().UTC())
+
+	stmtCtx, done := r.observe(ctx, "insert_schedule")
+	res, err := r.db.ExecContext(stmtCtx, `
+		INSERT INTO schedules (id, wallet_id, operation_type, amount, recurrence, start_at, end_at, status,
+			next_run_at, due_at, attempts, version, created_at, updated_at)
+		SELECT $1::uuid, id, $3::text, $4::bigint, $5::text, $6::timestamptz, $7::timestamptz, $8::text,
+			$9::timestamptz, $10::timestamptz, $11::integer, $12::bigint, $13::timestamptz, $13::timestamptz
+		FROM wallets WHERE id = $2`,
+		s.ID, s.WalletID, s.OperationType, s.Amount, s.Recurrence, s.StartAt, s.EndAt, s.Status,
+		s.NextRunAt, s.DueAt, s.Attempts, s.Version, s.CreatedAt,
+	)
+	done(err)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("failed to insert schedule: %w", err)
+	}
+	if err := checkUpdated(res); err != nil {
+		return model.Schedule{}, err
+	}
+	return s, nil
+}
+
+const postgresScheduleColumns = `id::text, wallet_id::text, operation_type, amount, recurrence, start_at, end_at, status,
+	next_run_at, due_at, attempts, version, created_at, updated_at`
+
+func scanPostgresSchedule(row interface{ Scan(...any) error }) (model.Schedule, error) {
+	var s model.Schedule
+	var endAt, nextRunAt, dueAt sql.NullTime
+	err := row.Scan(&s.ID, &s.WalletID, &s.OperationType, &s.Amount, &s.Recurrence, &s.StartAt, &endAt, &s.Status,
+		&nextRunAt, &dueAt, &s.Attempts, &s.Version, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return model.Schedule{}, err
+	}
+	s.StartAt = s.StartAt.UTC()
+	s.EndAt = postgresTimePtr(endAt)
+	s.NextRunAt = postgresTimePtr(nextRunAt)
+	s.DueAt = postgresTimePtr(dueAt)
+	s.CreatedAt = s.CreatedAt.UTC()
+	s.UpdatedAt = s.UpdatedAt.UTC()
+	return s, nil
+}
+
+func scanPostgresSchedules(rows *sql.Rows) ([]model.Schedule, error) {
+	defer rows.Close()
+
+	schedules := []model.Schedule{}
+	for rows.Next() {
+		s, err := scanPostgresSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+func postgresTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	v := t.Time.UTC()
+	return &v
+}
+
+func (r *PostgresRepository) GetSchedule(ctx context.Context, walletID, id string) (model.Schedule, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return model.Schedule{}, model.ErrScheduleNotFound
+	}
+	if _, err := uuid.Parse(walletID); err != nil {
+		return model.Schedule{}, model.ErrScheduleNotFound
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_schedule")
+	s, err := scanPostgresSchedule(r.db.QueryRowContext(stmtCtx,
+		"SELECT "+postgresScheduleColumns+" FROM schedules WHERE id = $1 AND wallet_id = $2", id, walletID))
+	done(err)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Schedule{}, model.ErrScheduleNotFound
+		}
+		return model.Schedule{}, fmt.Errorf("failed to get schedule: %w", err)
+	}
+	return s, nil
+}
+
+func (r *PostgresRepository) ListSchedules(ctx context.Context, walletID string) ([]model.Schedule, error) {
+	if err := r.checkWalletExists(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_schedules")
+	rows, err := r.db.QueryContext(stmtCtx,
+		"SELECT "+postgresScheduleColumns+" FROM schedules WHERE wallet_id = $1 ORDER BY created_at, id", walletID)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	schedules, err := scanPostgresSchedules(rows)
+	done(err)
+	return schedules, err
+}
+
+func (r *PostgresRepository) UpdateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error) {
+	return r.updateSchedule(ctx, r.db, s, false)
+}
+
+// updateSchedule stores the mutable fields of s if its version is the stored
+// one, and ends the lease if endLease is set.
+func (r *PostgresRepository) updateSchedule(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, s model.Schedule, endLease bool) (model.Schedule, error) {
+	stmtCtx, done := r.observe(ctx, "update_schedule")
+	stored, err := scanPostgresSchedule(db.QueryRowContext(stmtCtx, `
+		UPDATE schedules SET amount = $3, end_at = $4, status = $5, next_run_at = $6, due_at = $7, attempts = $8,
+			lease_until = CASE WHEN $9::boolean THEN NULL ELSE lease_until END, version = version + 1, updated_at = $10
+		WHERE id = $1 AND version = $2
+		RETURNING `+postgresScheduleColumns,
+		s.ID, s.Version, s.Amount, s.EndAt, s.Status, s.NextRunAt, s.DueAt, s.Attempts, endLease, time.Now().UTC(),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		done(nil)
+		return model.Schedule{}, ErrScheduleChanged
+	}
+	done(err)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("failed to update schedule: %w", err)
+	}
+	return stored, nil
+}
+
+// ClaimDueSchedules leases the schedules with a single statement. SKIP LOCKED
+// lets instances claiming at the same time take different schedules instead of
+// waiting for each other.
+func (r *PostgresRepository) ClaimDueSchedules(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Schedule, error) {
+	stmtCtx, done := r.observe(ctx, "claim_schedules")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		UPDATE schedules SET lease_until = $1, version = version + 1
+		WHERE id IN (
+			SELECT id FROM schedules
+			WHERE status = $2 AND due_at <= $3 AND (lease_until IS NULL OR lease_until <= $3)
+			ORDER BY due_at, id
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+postgresScheduleColumns,
+		now.Add(lease).UTC(),
+		model.ScheduleActive,
+		now.UTC(),
+		postgresLimit(limit),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to claim schedules: %w", err)
+	}
+	schedules, err := scanPostgresSchedules(rows)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	sortDue(schedules)
+	return schedules, nil
+}
+
+func (r *PostgresRepository) FinishScheduleRun(ctx context.Context, s model.Schedule, run model.ScheduleRun) (model.Schedule, error) {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return model.Schedule{}, err
+	}
+	defer tx.Rollback()
+
+	// A schedule changed meanwhile is left as it is, the run is recorded all the same
+	stored, err := r.updateSchedule(ctx, tx, s, true)
+	changed := errors.Is(err, ErrScheduleChanged)
+	if err != nil && !changed {
+		return model.Schedule{}, err
+	}
+
+	stmtCtx, done := r.observe(ctx, "insert_schedule_run")
+	_, err = tx.ExecContext(stmtCtx, `
+		INSERT INTO schedule_runs (schedule_id, occurrence, attempt, status, error_code, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (schedule_id, occurrence, attempt) DO UPDATE SET
+			status = EXCLUDED.status, error_code = EXCLUDED.error_code,
+			started_at = EXCLUDED.started_at, finished_at = EXCLUDED.finished_at
+		WHERE EXCLUDED.status = $8`,
+		s.ID, run.Occurrence, run.Attempt, run.Status, nullString(run.ErrorCode), run.StartedAt, run.FinishedAt,
+		model.RunSucceeded,
+	)
+	done(err)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("failed to insert schedule run: %w", err)
+	}
+	if err := r.commit(ctx, tx); err != nil {
+		return model.Schedule{}, err
+	}
+	if changed {
+		return model.Schedule{}, ErrScheduleChanged
+	}
+	return stored, nil
+}
+
+func (r *PostgresRepository) ScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]model.ScheduleRun, error) {
+	if _, err := uuid.Parse(scheduleID); err != nil {
+		return []model.ScheduleRun{}, nil
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_schedule_runs")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT id, schedule_id::text, occurrence, attempt, status, COALESCE(error_code, ''), started_at, finished_at
+		FROM schedule_runs WHERE schedule_id = $1 ORDER BY id DESC LIMIT $2`,
+		scheduleID,
+		postgresLimit(limit),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list schedule runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []model.ScheduleRun{}
+	for rows.Next() {
+		var run model.ScheduleRun
+		if err := rows.Scan(&run.ID, &run.ScheduleID, &run.Occurrence, &run.Attempt, &run.Status, &run.ErrorCode, &run.StartedAt, &run.FinishedAt); err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan schedule run: %w", err)
+		}
+		run.Occurrence = run.Occurrence.UTC()
+		run.StartedAt = run.StartedAt.UTC()
+		run.FinishedAt = run.FinishedAt.UTC()
+		runs = append(runs, run)
+	}
+	done(rows.Err())
+	return runs, rows.Err()
+}
+
+func (r *PostgresRepository) CreateInterestProduct(ctx context.Context, p model.InterestProduct) (model.InterestProduct, error) {
+	p = newInterestProduct(p, time.Now().UTC())
+
+	stmtCtx, done := r.observe(ctx, "insert_interest_product")
+	_, err := r.db.ExecContext(stmtCtx, `
+		INSERT INTO interest_products (id, name, annual_rate_bps, day_count, rounding, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		p.ID, p.Name, p.AnnualRateBps, p.DayCount, p.Rounding, p.CreatedAt,
+	)
+	done(err)
+	if err != nil {
+		return model.InterestProduct{}, fmt.Errorf("failed to insert interest product: %w", err)
+	}
+	return p, nil
+}
+
+func (r *PostgresRepository) InterestProducts(ctx context.Context) ([]model.InterestProduct, error) {
+	stmtCtx, done := r.observe(ctx, "select_interest_products")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT id::text, name, annual_rate_bps, day_count, rounding, created_at
+		FROM interest_products ORDER BY created_at, id`)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list interest products: %w", err)
+	}
+	defer rows.Close()
+
+	products := []model.InterestProduct{}
+	for rows.Next() {
+		var p model.InterestProduct
+		if err := rows.Scan(&p.ID, &p.Name, &p.AnnualRateBps, &p.DayCount, &p.Rounding, &p.CreatedAt); err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan interest product: %w", err)
+		}
+		p.CreatedAt = p.CreatedAt.UTC()
+		products = append(products, p)
+	}
+	done(rows.Err())
+	return products, rows.Err()
+}
+
+func (r *PostgresRepository) AssignInterestProduct(ctx context.Context, walletID, productID string, from time.Time) (model.InterestAccount, error) {
+	if _, err := uuid.Parse(walletID); err != nil {
+		return model.InterestAccount{}, model.ErrWalletNotFound
+	}
+	if _, err := uuid.Parse(productID); err != nil {
+		return model.InterestAccount{}, model.ErrInterestProductNotFound
+	}
+
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	defer tx.Rollback()
+
+	// The wallet lock serializes the assignment with the accruals of the wallet
+	var productExists bool
+	stmtCtx, done := r.observe(ctx, "lock_wallet_interest")
+	err = tx.QueryRowContext(stmtCtx, `
+		SELECT EXISTS (SELECT 1 FROM interest_products WHERE id = $2)
+		FROM wallets WHERE id = $1 FOR UPDATE`,
+		walletID, productID,
+	).Scan(&productExists)
+	if errors.Is(err, sql.ErrNoRows) {
+		done(nil)
+		return model.InterestAccount{}, model.ErrWalletNotFound
+	}
+	done(err)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to check interest product: %w", err)
+	}
+	if !productExists {
+		return model.InterestAccount{}, model.ErrInterestProductNotFound
+	}
+
+	stmtCtx, done = r.observe(ctx, "upsert_interest_account")
+	_, err = tx.ExecContext(stmtCtx, `
+		INSERT INTO interest_accounts (wallet_id, product_id, accrued_through, updated_at) VALUES ($1, $2, $3::date, $4)
+		ON CONFLICT (wallet_id) DO UPDATE SET product_id = excluded.product_id, updated_at = excluded.updated_at`,
+		walletID, productID, from.UTC().AddDate(0, 0, -1).Format(time.DateOnly), time.Now().UTC(),
+	)
+	done(err)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to assign interest product: %w", err)
+	}
+	account, err := r.getInterestAccount(ctx, tx, walletID, false)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	if err := r.commit(ctx, tx); err != nil {
+		return model.InterestAccount{}, err
+	}
+	return account, nil
+}
+
+const postgresInterestAccountQuery = `
+	SELECT a.wallet_id::text, a.accrued_through, a.accrued_units, a.accrued_fraction, a.updated_at,
+		p.id::text, p.name, p.annual_rate_bps, p.day_count, p.rounding, p.created_at
+	FROM interest_accounts a JOIN interest_products p ON p.id = a.product_id`
+
+func scanPostgresInterestAccount(row interface{ Scan(...any) error }) (model.InterestAccount, error) {
+	var a model.InterestAccount
+	err := row.Scan(&a.WalletID, &a.AccruedThrough, &a.AccruedUnits, &a.AccruedFraction, &a.UpdatedAt,
+		&a.Product.ID, &a.Product.Name, &a.Product.AnnualRateBps, &a.Product.DayCount, &a.Product.Rounding, &a.Product.CreatedAt)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	a.AccruedThrough = postgresDate(a.AccruedThrough)
+	a.UpdatedAt = a.UpdatedAt.UTC()
+	a.Product.CreatedAt = a.Product.CreatedAt.UTC()
+	return a, nil
+}
+
+// postgresDate returns the midnight UTC of a DATE column.
+func postgresDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// getInterestAccount reads the account of the wallet, and locks it if lock is set.
+func (r *PostgresRepository) getInterestAccount(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, walletID string, lock bool) (model.InterestAccount, error) {
+	query := postgresInterestAccountQuery + " WHERE a.wallet_id = $1"
+	if lock {
+		query += " FOR UPDATE OF a"
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_interest_account")
+	a, err := scanPostgresInterestAccount(db.QueryRowContext(stmtCtx, query, walletID))
+	if errors.Is(err, sql.ErrNoRows) {
+		done(nil)
+		return model.InterestAccount{}, model.ErrInterestNotAssigned
+	}
+	done(err)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to get interest account: %w", err)
+	}
+	return a, nil
+}
+
+func (r *PostgresRepository) GetInterestAccount(ctx context.Context, walletID string) (model.InterestAccount, error) {
+	if _, err := uuid.Parse(walletID); err != nil {
+		return model.InterestAccount{}, model.ErrWalletNotFound
+	}
+	if err := r.checkWalletExists(ctx, walletID); err != nil {
+		return model.InterestAccount{}, err
+	}
+	return r.getInterestAccount(ctx, r.db, walletID, false)
+}
+
+func (r *PostgresRepository) DueInterestAccounts(ctx context.Context, afterID string, through time.Time, limit int) ([]model.InterestAccount, error) {
+	if afterID == "" {
+		afterID = uuid.Nil.String()
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_due_interest_accounts")
+	rows, err := r.db.QueryContext(stmtCtx,
+		postgresInterestAccountQuery+" WHERE a.wallet_id > $1 AND a.accrued_through < $2::date ORDER BY a.wallet_id LIMIT $3",
+		afterID, through.UTC().Format(time.DateOnly), postgresLimit(limit),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list due interest accounts: %w", err)
+	}
+	defer rows.Close()
+
+	accounts := []model.InterestAccount{}
+	for rows.Next() {
+		a, err := scanPostgresInterestAccount(rows)
+		if err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan interest account: %w", err)
+		}
+		accounts = append(accounts, a)
+	}
+	done(rows.Err())
+	return accounts, rows.Err()
+}
+
+func (r *PostgresRepository) AccrueInterest(ctx context.Context, accrual model.InterestAccrual, posting *model.InterestPosting) (model.InterestAccount, error) {
+	if _, err := uuid.Parse(accrual.WalletID); err != nil {
+		return model.InterestAccount{}, model.ErrInterestNotAssigned
+	}
+
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	defer tx.Rollback()
+
+	// The row lock makes concurrent accruals of the wallet wait for each other
+	account, err := r.getInterestAccount(ctx, tx, accrual.WalletID, true)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	account, err = accrueInto(account, accrual, posting)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+
+	stmtCtx, done := r.observe(ctx, "insert_interest_accrual")
+	_, err = tx.ExecContext(stmtCtx, `
+		INSERT INTO interest_accruals (wallet_id, day, product_id, annual_rate_bps, day_count, balance, units, fraction)
+		VALUES ($1, $2::date, $3, $4, $5, $6, $7, $8)`,
+		accrual.WalletID, accrual.Day.Format(time.DateOnly), accrual.ProductID, accrual.AnnualRateBps, accrual.DayCount,
+		accrual.Balance, accrual.Units, accrual.Fraction,
+	)
+	done(err)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to insert interest accrual: %w", err)
+	}
+
+	if posting != nil {
+		var entryID sql.NullInt64
+		if posting.Amount > 0 {
+			id, err := r.apply(ctx, tx, posting.WalletID, model.Interest, posting.Amount, "", posting.Reference())
+			if err != nil {
+				return model.InterestAccount{}, err
+			}
+			entryID = sql.NullInt64{Int64: id, Valid: true}
+		}
+		stmtCtx, done := r.observe(ctx, "insert_interest_posting")
+		_, err = tx.ExecContext(stmtCtx, `
+			INSERT INTO interest_postings (wallet_id, period, accrued_units, accrued_fraction, rounding, amount, ledger_entry_id, posted_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			posting.WalletID, posting.Period, posting.AccruedUnits, posting.AccruedFraction, posting.Rounding,
+			posting.Amount, entryID, time.Now().UTC(),
+		)
+		done(err)
+		if err != nil {
+			return model.InterestAccount{}, fmt.Errorf("failed to insert interest posting: %w", err)
+		}
+	}
+
+	stmtCtx, done = r.observe(ctx, "update_interest_account")
+	_, err = tx.ExecContext(stmtCtx, `
+		UPDATE interest_accounts SET accrued_through = $2::date, accrued_units = $3, accrued_fraction = $4, updated_at = $5
+		WHERE wallet_id = $1`,
+		account.WalletID, account.AccruedThrough.Format(time.DateOnly), account.AccruedUnits, account.AccruedFraction, account.UpdatedAt,
+	)
+	done(err)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to update interest account: %w", err)
+	}
+	if err := r.commit(ctx, tx); err != nil {
+		return model.InterestAccount{}, err
+	}
+	return account, nil
+}
+
+func (r *PostgresRepository) InterestAccruals(ctx context.Context, walletID string) ([]model.InterestAccrual, error) {
+	if _, err := uuid.Parse(walletID); err != nil {
+		return nil, model.ErrWalletNotFound
+	}
+	if err := r.checkWalletExists(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_interest_accruals")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT wallet_id::text, day, product_id::text, annual_rate_bps, day_count, balance, units, fraction
+		FROM interest_accruals WHERE wallet_id = $1 ORDER BY day`,
+		walletID,
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list interest accruals: %w", err)
+	}
+	defer rows.Close()
+
+	accruals := []model.InterestAccrual{}
+	for rows.Next() {
+		var a model.InterestAccrual
+		if err := rows.Scan(&a.WalletID, &a.Day, &a.ProductID, &a.AnnualRateBps, &a.DayCount, &a.Balance, &a.Units, &a.Fraction); err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan interest accrual: %w", err)
+		}
+		a.Day = postgresDate(a.Day)
+		accruals = append(accruals, a)
+	}
+	done(rows.Err())
+	return accruals, rows.Err()
+}
+
+func (r *PostgresRepository) InterestPostings(ctx context.Context, walletID string) ([]model.InterestPosting, error) {
+	if _, err := uuid.Parse(walletID); err != nil {
+		return nil, model.ErrWalletNotFound
+	}
+	if err := r.checkWalletExists(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_interest_postings")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT wallet_id::text, period, accrued_units, accrued_fraction, rounding, amount, COALESCE(ledger_entry_id, 0), posted_at
+		FROM interest_postings WHERE wallet_id = $1 ORDER BY period`,
+		walletID,
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list interest postings: %w", err)
+	}
+	defer rows.Close()
+
+	postings := []model.InterestPosting{}
+	for rows.Next() {
+		var p model.InterestPosting
+		if err := rows.Scan(&p.WalletID, &p.Period, &p.AccruedUnits, &p.AccruedFraction, &p.Rounding, &p.Amount, &p.LedgerEntryID, &p.PostedAt); err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan interest posting: %w", err)
+		}
+		p.PostedAt = p.PostedAt.UTC()
+		postings = append(postings, p)
+	}
+	done(rows.Err())
+	return postings, rows.Err()
+}
+
+const postgresOverdraftQuery = "SELECT id::text, balance, credit_limit, overdraft_fee, overdraft_fees_through FROM wallets"
+
+func scanPostgresOverdraft(row interface{ Scan(...any) error }) (model.Overdraft, error) {
+	var o model.Overdraft
+	var feesThrough sql.NullTime
+	if err := row.Scan(&o.WalletID, &o.Balance, &o.CreditLimit, &o.DailyFee, &feesThrough); err != nil {
+		return model.Overdraft{}, err
+	}
+	if feesThrough.Valid {
+		day := postgresDate(feesThrough.Time)
+		o.FeesChargedThrough = &day
+	}
+	return o, nil
+}
+
+// getOverdraft reads the credit line of the wallet, and locks the wallet if lock is set.
+func (r *PostgresRepository) getOverdraft(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, walletID string, lock bool) (model.Overdraft, error) {
+	if _, err := uuid.Parse(walletID); err != nil {
+		return model.Overdraft{}, model.ErrWalletNotFound
+	}
+	query := postgresOverdraftQuery + " WHERE id = $1"
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_overdraft")
+	o, err := scanPostgresOverdraft(db.QueryRowContext(stmtCtx, query, walletID))
+	if errors.Is(err, sql.ErrNoRows) {
+		done(nil)
+		return model.Overdraft{}, model.ErrWalletNotFound
+	}
+	done(err)
+	if err != nil {
+		return model.Overdraft{}, fmt.Errorf("failed to get overdraft: %w", err)
+	}
+	return o, nil
+}
+
+// GetOverdraft reads from a replica like GetBalance, unless ctx requires the primary.
+func (r *PostgresRepository) GetOverdraft(ctx context.Context, walletID string) (model.Overdraft, error) {
+	return r.getOverdraft(ctx, r.reader(ctx), walletID, false)
+}
+
+func (r *PostgresRepository) SetOverdraft(ctx context.Context, walletID string, creditLimit, dailyFee int64, from time.Time) (model.Overdraft, error) {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return model.Overdraft{}, err
+	}
+	defer tx.Rollback()
+
+	// The wallet lock keeps the balance checked against the limit until it is written
+	o, err := r.getOverdraft(ctx, tx, walletID, true)
+	if err != nil {
+		return model.Overdraft{}, err
+	}
+	if o, err = setOverdraft(o, creditLimit, dailyFee, from); err != nil {
+		return model.Overdraft{}, err
+	}
+
+	var feesThrough interface{}
+	if o.FeesChargedThrough != nil {
+		feesThrough = o.FeesChargedThrough.Format(time.DateOnly)
+	}
+	stmtCtx, done := r.observe(ctx, "update_overdraft")
+	_, err = tx.ExecContext(stmtCtx,
+		"UPDATE wallets SET credit_limit = $2, overdraft_fee = $3, overdraft_fees_through = $4::date WHERE id = $1",
+		walletID, o.CreditLimit, o.DailyFee, feesThrough,
+	)
+	done(err)
+	if err != nil {
+		return model.Overdraft{}, fmt.Errorf("failed to update overdraft: %w", err)
+	}
+	if err := r.commit(ctx, tx); err != nil {
+		return model.Overdraft{}, err
+	}
+	return o, nil
+}
+
+func (r *PostgresRepository) DueOverdraftFees(ctx context.Context, afterID string, through time.Time, limit int) ([]model.Overdraft, error) {
+	if afterID == "" {
+		afterID = uuid.Nil.String()
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_due_overdraft_fees")
+	rows, err := r.db.QueryContext(stmtCtx,
+		postgresOverdraftQuery+" WHERE id > $1 AND overdraft_fee > 0 AND overdraft_fees_through < $2::date ORDER BY id LIMIT $3",
+		afterID, through.UTC().Format(time.DateOnly), postgresLimit(limit),
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list due overdraft fees: %w", err)
+	}
+	defer rows.Close()
+
+	due := []model.Overdraft{}
+	for rows.Next() {
+		o, err := scanPostgresOverdraft(rows)
+		if err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan overdraft: %w", err)
+		}
+		due = append(due, o)
+	}
+	done(rows.Err())
+	return due, rows.Err()
+}
+
+func (r *PostgresRepository) ChargeOverdraftFee(ctx context.Context, fee model.OverdraftCharge) (model.OverdraftCharge, error) {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return model.OverdraftCharge{}, err
+	}
+	defer tx.Rollback()
+
+	// The row lock makes concurrent charges of the wallet wait for each other
+	o, err := r.getOverdraft(ctx, tx, fee.WalletID, true)
+	if err != nil {
+		return model.OverdraftCharge{}, err
+	}
+	if fee, err = chargeFee(o, fee); err != nil {
+		return model.OverdraftCharge{}, err
+	}
+
+	if fee.Amount > 0 {
+		if fee.LedgerEntryID, err = r.apply(ctx, tx, fee.WalletID, model.OverdraftFee, -fee.Amount, "", fee.Reference()); err != nil {
+			return model.OverdraftCharge{}, err
+		}
+		stmtCtx, done := r.observe(ctx, "insert_overdraft_fee")
+		_, err = tx.ExecContext(stmtCtx, `
+			INSERT INTO overdraft_fees (wallet_id, day, balance, amount, ledger_entry_id, charged_at)
+			VALUES ($1, $2::date, $3, $4, $5, $6)`,
+			fee.WalletID, fee.Day.Format(time.DateOnly), fee.Balance, fee.Amount, fee.LedgerEntryID, fee.ChargedAt,
+		)
+		done(err)
+		if err != nil {
+			return model.OverdraftCharge{}, fmt.Errorf("failed to insert overdraft fee: %w", err)
+		}
+	}
+
+	stmtCtx, done := r.observe(ctx, "update_overdraft_fees_through")
+	_, err = tx.ExecContext(stmtCtx,
+		"UPDATE wallets SET overdraft_fees_through = $2::date WHERE id = $1",
+		fee.WalletID, fee.Day.Format(time.DateOnly),
+	)
+	done(err)
+	if err != nil {
+		return model.OverdraftCharge{}, fmt.Errorf("failed to update overdraft: %w", err)
+	}
+	if err := r.commit(ctx, tx); err != nil {
+		return model.OverdraftCharge{}, err
+	}
+	return fee, nil
+}
+
+func (r *PostgresRepository) OverdraftFees(ctx context.Context, walletID string) ([]model.OverdraftCharge, error) {
+	if _, err := uuid.Parse(walletID); err != nil {
+		return nil, model.ErrWalletNotFound
+	}
+	if err := r.checkWalletExists(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	stmtCtx, done := r.observe(ctx, "select_overdraft_fees")
+	rows, err := r.db.QueryContext(stmtCtx, `
+		SELECT wallet_id::text, day, balance, amount, ledger_entry_id, charged_at
+		FROM overdraft_fees WHERE wallet_id = $1 ORDER BY day`,
+		walletID,
+	)
+	if err != nil {
+		done(err)
+		return nil, fmt.Errorf("failed to list overdraft fees: %w", err)
+	}
+	defer rows.Close()
+
+	fees := []model.OverdraftCharge{}
+	for rows.Next() {
+		var f model.OverdraftCharge
+		if err := rows.Scan(&f.WalletID, &f.Day, &f.Balance, &f.Amount, &f.LedgerEntryID, &f.ChargedAt); err != nil {
+			done(err)
+			return nil, fmt.Errorf("failed to scan overdraft fee: %w", err)
+		}
+		f.Day = postgresDate(f.Day)
+		f.ChargedAt = f.ChargedAt.UTC()
+		fees = append(fees, f)
+	}
+	done(rows.Err())
+	return fees, rows.Err()
+}
+
+// postgresLimit turns a limit of zero or less into no limit, PostgreSQL takes NULL for it.
+func postgresLimit(limit int) interface{} {
+	if limit <= 0 {
+		return nil
+	}
+	return limit
+}
+
+func (r *PostgresRepository) RunMigrations(ctx context.Context) error {
+	return applyMigrations(ctx, r.db, postgresMigrations)
+}
+
+// PendingMigrations returns the versions of the migrations that are not applied yet.
+func (r *PostgresRepository) PendingMigrations(ctx context.Context) ([]string, error) {
+	return pendingMigrations(ctx, r.db, postgresMigrations)
+}
+
+// Ping verifies the database connection is alive.
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsReferenceConflict(t *testing.T) {
+	conflict := &pq.Error{Code: "23505", Constraint: "ledger_entries_reference_idx"}
+	assert.True(t, isReferenceConflict(fmt.Errorf("insert: %w", conflict)))
+	assert.False(t, isReferenceConflict(&pq.Error{Code: "23505", Constraint: "wallets_pkey"}))
+	assert.False(t, isReferenceConflict(errors.New("connection reset")))
+	assert.False(t, isReferenceConflict(nil))
+}
+
+func TestIsSQLiteReferenceConflict(t *testing.T) {
+	db := openTestDB(t, "wallet.db")
+	repo := NewSQLiteRepository(db)
+	ctx := context.Background()
+	require.NoError(t, repo.RunMigrations(ctx))
+
+	walletA, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	walletB, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransactionOnce(ctx, walletA, 10, true, "ref-1"))
+
+	// The reference of another wallet conflicts as well
+	_, err = db.Exec(
+		"INSERT INTO ledger_entries (wallet_id, operation_type, amount, reference, created_at) VALUES (?, 'deposit', 10, 'ref-1', ?)",
+		walletB, time.Now().UnixNano(),
+	)
+	require.Error(t, err)
+	assert.True(t, isSQLiteReferenceConflict(err))
+
+	_, err = db.Exec("INSERT INTO wallets (id) VALUES (?)", walletA)
+	require.Error(t, err)
+	assert.False(t, isSQLiteReferenceConflict(err), "Only the reference index is a duplicate reference")
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+type consistencyKey struct{}
+
+// WithStrongConsistency marks reads made with the returned context to be served by the primary.
+func WithStrongConsistency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, true)
+}
+
+// IsStrongConsistency reports whether reads made with ctx must be served by the primary.
+func IsStrongConsistency(ctx context.Context) bool {
+	strong, _ := ctx.Value(consistencyKey{}).(bool)
+	return strong
+}
+
+// replicaLagQuery reports zero when the replica has replayed everything it received,
+// so an idle primary is not mistaken for replication lag. A replica that is
+// not streaming from the primary has replayed everything it received too,
+// so it reports NULL instead, which is read as disconnectedLag. Seeing the
+// receiver status takes the pg_read_all_stats role, or pg_monitor.
+const replicaLagQuery = `SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming') THEN NULL
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+// disconnectedLag is the lag of a replica that does not receive the WAL of the primary.
+const disconnectedLag = time.Duration(math.MaxInt64)
+
+type replica struct {
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// ReplicaSet routes reads to healthy read replicas and falls back to the primary
+// when none of them is available or lagging less than maxLag.
+type ReplicaSet struct {
+	primary       *sql.DB
+	replicas      []*replica
+	maxLag        time.Duration
+	checkInterval time.Duration
+	next          atomic.Uint32
+
+	// measureLag is replaceable in tests, which have no PostgreSQL replica at hand
+	measureLag func(ctx context.Context, db *sql.DB) (time.Duration, error)
+}
+
+func NewReplicaSet(primary *sql.DB, replicas []*sql.DB, maxLag, checkInterval time.Duration) *ReplicaSet {
+	s := &ReplicaSet{
+		primary:       primary,
+		maxLag:        maxLag,
+		checkInterval: checkInterval,
+		measureLag:    postgresReplicaLag,
+	}
+	for _, db := range replicas {
+		s.replicas = append(s.replicas, &replica{db: db})
+	}
+	return s
+}
+
+func postgresReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	var seconds sql.NullFloat64
+	if err := db.QueryRowContext(ctx, replicaLagQuery).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return replicaLag(seconds), nil
+}
+
+func replicaLag(seconds sql.NullFloat64) time.Duration {
+	if !seconds.Valid {
+		return disconnectedLag
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second))
+}
+
+// Start checks the replicas once and then keeps checking them every
+// checkInterval until ctx is cancelled.
+func (s *ReplicaSet) Start(ctx context.Context) {
+	s.checkReplicas(ctx)
+
+	go func() {
+		ticker := time.NewTicker(s.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkReplicas(ctx)
+			}
+		}
+	}()
+}
+
+func (s *ReplicaSet) checkReplicas(ctx context.Context) {
+	for i, r := range s.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, s.checkInterval)
+		lag, err := s.measureLag(checkCtx, r.db)
+		cancel()
+
+		healthy := err == nil && lag <= s.maxLag
+		if was := r.healthy.Swap(healthy); was != healthy {
+			if healthy {
+				slog.Info("Read replica is healthy again", "replica", i, "lag", lag.String())
+			} else {
+				slog.Warn("Read replica is unhealthy, reading from the primary", "replica", i, "lag", lag.String(), "error", err)
+			}
+		}
+	}
+}
+
+// reader returns the database that should serve a read made with ctx.
+func (s *ReplicaSet) reader(ctx context.Context) *sql.DB {
+	if IsStrongConsistency(ctx) || len(s.replicas) == 0 {
+		return s.primary
+	}
+
+	// Round robin over the replicas, skipping the unhealthy ones
+	start := s.next.Add(1)
+	for i := range s.replicas {
+		r := s.replicas[(int(start)+i)%len(s.replicas)]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return s.primary
+}
+
+// Close closes the replica connection pools, the primary is left to its owner.
+func (s *ReplicaSet) Close() error {
+	var firstErr error
+	for _, r := range s.replicas {
+		if err := r.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDB(t *testing.T, name string) *sql.DB {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), name))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReplicaSet_Routing(t *testing.T) {
+	primary := openTestDB(t, "primary.db")
+	replicaA := openTestDB(t, "a.db")
+	replicaB := openTestDB(t, "b.db")
+
+	lags := map[*sql.DB]time.Duration{replicaA: time.Second, replicaB: time.Minute}
+	set := NewReplicaSet(primary, []*sql.DB{replicaA, replicaB}, 5*time.Second, time.Second)
+	set.measureLag = func(ctx context.Context, db *sql.DB) (time.Duration, error) {
+		return lags[db], nil
+	}
+	set.checkReplicas(context.Background())
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		assert.Same(t, replicaA, set.reader(ctx), "Lagging replica must be skipped")
+	}
+
+	assert.Same(t, primary, set.reader(WithStrongConsistency(ctx)))
+
+	lags[replicaB] = 0
+	set.checkReplicas(context.Background())
+	seen := map[*sql.DB]bool{}
+	for i := 0; i < 4; i++ {
+		seen[set.reader(ctx)] = true
+	}
+	assert.True(t, seen[replicaA] && seen[replicaB], "Reads are not spread across healthy replicas")
+}
+
+func TestReplicaSet_FallbackToPrimary(t *testing.T) {
+	primary := openTestDB(t, "primary.db")
+	replica := openTestDB(t, "replica.db")
+
+	set := NewReplicaSet(primary, []*sql.DB{replica}, 5*time.Second, time.Second)
+
+	// Replicas are not trusted before the first check
+	assert.Same(t, primary, set.reader(context.Background()))
+
+	set.measureLag = func(ctx context.Context, db *sql.DB) (time.Duration, error) {
+		return 0, errors.New("connection refused")
+	}
+	set.checkReplicas(context.Background())
+	assert.Same(t, primary, set.reader(context.Background()))
+
+	set.measureLag = func(ctx context.Context, db *sql.DB) (time.Duration, error) {
+		return 0, nil
+	}
+	set.checkReplicas(context.Background())
+	assert.Same(t, replica, set.reader(context.Background()))
+}
+
+func TestReplicaSet_DisconnectedReplica(t *testing.T) {
+	primary := openTestDB(t, "primary.db")
+	replica := openTestDB(t, "replica.db")
+
+	assert.Equal(t, 1500*time.Millisecond, replicaLag(sql.NullFloat64{Float64: 1.5, Valid: true}))
+	assert.Zero(t, replicaLag(sql.NullFloat64{Valid: true}))
+
+	// A replica without a streaming WAL receiver has nothing left to replay,
+	// but it is as far behind as it will ever be
+	set := NewReplicaSet(primary, []*sql.DB{replica}, time.Hour, time.Second)
+	set.measureLag = func(ctx context.Context, db *sql.DB) (time.Duration, error) {
+		return replicaLag(sql.NullFloat64{}), nil
+	}
+	set.checkReplicas(context.Background())
+	assert.Same(t, primary, set.reader(context.Background()))
+}
@@ -0,0 +1,177 @@
+package repotest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+	"WalletApi/migrations"
+)
+
+// LegacyFactory returns a migrated repository whose database held a wallet of
+// each balance before the ledger existed, with the IDs of those wallets.
+type LegacyFactory func(t *testing.T, balances ...int64) (repository.WalletRepository, []string)
+
+// RunLegacy executes the cases about wallets funded before the ledger existed
+// against the repositories returned by newRepo.
+func RunLegacy(t *testing.T, newRepo LegacyFactory) {
+	t.Run("OpeningEntry", func(t *testing.T) { testOpeningEntry(t, newRepo) })
+	t.Run("LegacyWallets", func(t *testing.T) { testLegacyWallets(t, newRepo) })
+}
+
+// SeedLegacySQLite creates the schema of the first SQLite migration in the
+// empty db, with a wallet of each balance, as a database from before the
+// ledger existed. RunMigrations migrates it from there.
+func SeedLegacySQLite(t *testing.T, db *sql.DB, balances ...int64) []string {
+	return seedLegacy(t, db, "sqlite/001_init.sql", "INSERT INTO wallets (id, balance) VALUES (?, ?)", balances)
+}
+
+// SeedLegacyPostgres is SeedLegacySQLite for PostgreSQL, db must have an empty schema first in its search path.
+func SeedLegacyPostgres(t *testing.T, db *sql.DB, balances ...int64) []string {
+	return seedLegacy(t, db, "001_init.sql", "INSERT INTO wallets (id, balance) VALUES ($1, $2)", balances)
+}
+
+func seedLegacy(t *testing.T, db *sql.DB, file, insert string, balances []int64) []string {
+	t.Helper()
+	schema, err := migrations.FS.ReadFile(file)
+	require.NoError(t, err)
+	_, err = db.Exec(string(schema))
+	require.NoError(t, err)
+
+	walletIDs := make([]string, len(balances))
+	for i, balance := range balances {
+		walletIDs[i] = uuid.NewString()
+		_, err := db.Exec(insert, walletIDs[i], balance)
+		require.NoError(t, err)
+	}
+	return walletIDs
+}
+
+func testOpeningEntry(t *testing.T, newRepo LegacyFactory) {
+	ctx := context.Background()
+	repo, walletIDs := newRepo(t, 250, 0)
+	funded, empty := walletIDs[0], walletIDs[1]
+
+	history, err := repo.GetHistory(ctx, funded, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, model.Opening, history[0].OperationType)
+	assert.Equal(t, int64(250), history[0].Amount)
+
+	history, err = repo.GetHistory(ctx, empty, 0)
+	require.NoError(t, err)
+	assert.Empty(t, history, "A wallet without funds needs no opening entry")
+
+	// Later entries add up from the opening balance
+	require.NoError(t, repo.ProcessTransaction(ctx, funded, 100, false))
+	history, err = repo.GetHistory(ctx, funded, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	balance, err := repo.GetBalance(ctx, funded)
+	require.NoError(t, err)
+	assert.Equal(t, int64(150), balance)
+	assert.Equal(t, balance, history[0].Amount+history[1].Amount)
+}
+
+// testLegacyWallets checks that what reads the ledger counts the balance a
+// wallet had before the ledger existed, through its opening entry.
+func testLegacyWallets(t *testing.T, newRepo LegacyFactory) {
+	ctx := context.Background()
+	// The database clock may be ahead of ours
+	later := func() time.Time { return time.Now().Add(time.Hour) }
+
+	testCases := []struct {
+		name string
+		test func(t *testing.T, repo repository.WalletRepository, walletID string, opening model.LedgerEntry)
+	}{
+		{
+			// What the reconciler compares
+			name: "CheckBalances",
+			test: func(t *testing.T, repo repository.WalletRepository, walletID string, _ model.LedgerEntry) {
+				checks, err := admin(t, repo).CheckBalances(ctx, "", 0)
+				require.NoError(t, err)
+				assert.Contains(t, checks, model.BalanceCheck{WalletID: walletID, Balance: 210, LedgerBalance: 210},
+					"The balance a wallet had before the ledger existed is not a drift")
+			},
+		},
+		{
+			// What interest accrues on and snapshots start from
+			name: "BalanceAt",
+			test: func(t *testing.T, repo repository.WalletRepository, walletID string, opening model.LedgerEntry) {
+				history := balanceHistory(t, repo)
+				balance, err := history.BalanceAt(ctx, walletID, opening.CreatedAt)
+				require.NoError(t, err)
+				assert.Equal(t, int64(250), balance)
+
+				_, snapshots, err := history.SnapshotBalances(ctx, "", 10)
+				require.NoError(t, err)
+				assert.Equal(t, 1, snapshots)
+
+				// Replayed from the snapshot, which includes the opening balance
+				require.NoError(t, repo.ProcessTransaction(ctx, walletID, 15, true))
+				balance, err = history.BalanceAt(ctx, walletID, later())
+				require.NoError(t, err)
+				assert.Equal(t, int64(225), balance)
+			},
+		},
+		{
+			name: "StreamStatement",
+			test: func(t *testing.T, repo repository.WalletRepository, walletID string, opening model.LedgerEntry) {
+				history := balanceHistory(t, repo)
+				stream := func(from time.Time) (int64, []model.OperationType) {
+					var balance int64
+					types := []model.OperationType{}
+					err := history.StreamStatement(ctx, walletID, from, later(),
+						func(b int64) error {
+							balance = b
+							return nil
+						},
+						func(e model.LedgerEntry) error {
+							types = append(types, e.OperationType)
+							return nil
+						})
+					require.NoError(t, err)
+					return balance, types
+				}
+
+				// The opening entry is in the opening balance
+				balance, types := stream(opening.CreatedAt)
+				assert.Equal(t, int64(250), balance)
+				assert.Equal(t, []model.OperationType{model.Withdraw}, types)
+
+				// Or an entry of the statement when it starts earlier
+				balance, types = stream(opening.CreatedAt.Add(-time.Second))
+				assert.Zero(t, balance)
+				assert.Equal(t, []model.OperationType{model.Opening, model.Withdraw}, types)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, walletIDs := newRepo(t, 250)
+			walletID := walletIDs[0]
+			require.NoError(t, repo.ProcessTransaction(ctx, walletID, 40, false))
+			entries, err := repo.GetHistory(ctx, walletID, 0)
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			tc.test(t, repo, walletID, entries[1])
+		})
+	}
+}
+
+func balanceHistory(t *testing.T, repo repository.WalletRepository) repository.BalanceHistory {
+	t.Helper()
+	history, ok := repo.(repository.BalanceHistory)
+	if !ok {
+		t.Skip("repository does not implement repository.BalanceHistory")
+	}
+	return history
+}
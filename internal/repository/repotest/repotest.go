@@ -0,0 +1,1402 @@
+// Package repotest provides a conformance suite that every
+// repository.WalletRepository implementation is expected to pass.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/interest"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+)
+
+// Factory returns a ready to use repository. It is called once per test case,
+// implementations may share the underlying storage between calls.
+type Factory func(t *testing.T) repository.WalletRepository
+
+// Run executes the conformance suite against the repositories returned by newRepo.
+func Run(t *testing.T, newRepo Factory) {
+	t.Run("CreateWallet", func(t *testing.T) { testCreateWallet(t, newRepo(t)) })
+	t.Run("Deposit", func(t *testing.T) { testDeposit(t, newRepo(t)) })
+	t.Run("Withdraw", func(t *testing.T) { testWithdraw(t, newRepo(t)) })
+	t.Run("InvalidAmount", func(t *testing.T) { testInvalidAmount(t, newRepo(t)) })
+	t.Run("WalletNotFound", func(t *testing.T) { testWalletNotFound(t, newRepo(t)) })
+	t.Run("InsufficientFunds", func(t *testing.T) { testInsufficientFunds(t, newRepo(t)) })
+	t.Run("ConcurrentWithdrawals", func(t *testing.T) { testConcurrentWithdrawals(t, newRepo(t)) })
+	t.Run("History", func(t *testing.T) { testHistory(t, newRepo(t)) })
+	t.Run("BalanceAt", func(t *testing.T) { testBalanceAt(t, newRepo(t)) })
+	t.Run("StreamStatement", func(t *testing.T) { testStreamStatement(t, newRepo(t)) })
+	t.Run("StreamLedger", func(t *testing.T) { testStreamLedger(t, newRepo(t)) })
+	t.Run("LeaseExport", func(t *testing.T) { testLeaseExport(t, newRepo(t)) })
+	t.Run("ProcessTransactionOnce", func(t *testing.T) { testProcessTransactionOnce(t, newRepo(t)) })
+	t.Run("Schedules", func(t *testing.T) { testSchedules(t, newRepo(t)) })
+	t.Run("ClaimDueSchedules", func(t *testing.T) { testClaimDueSchedules(t, newRepo(t)) })
+	t.Run("InterestAccounts", func(t *testing.T) { testInterestAccounts(t, newRepo(t)) })
+	t.Run("AccrueInterest", func(t *testing.T) { testAccrueInterest(t, newRepo(t)) })
+	t.Run("AccrueInterestFrozen", func(t *testing.T) { testAccrueInterestFrozen(t, admin(t, newRepo(t))) })
+	t.Run("Overdraft", func(t *testing.T) { testOverdraft(t, newRepo(t)) })
+	t.Run("OverdraftFees", func(t *testing.T) { testOverdraftFees(t, newRepo(t)) })
+	t.Run("Freeze", func(t *testing.T) { testFreeze(t, admin(t, newRepo(t))) })
+	t.Run("Adjust", func(t *testing.T) { testAdjust(t, admin(t, newRepo(t))) })
+	t.Run("AdjustRejected", func(t *testing.T) { testAdjustRejected(t, admin(t, newRepo(t))) })
+	t.Run("AdjustExpired", func(t *testing.T) { testAdjustExpired(t, admin(t, newRepo(t))) })
+	t.Run("AdjustInvalid", func(t *testing.T) { testAdjustInvalid(t, admin(t, newRepo(t))) })
+	t.Run("CheckBalances", func(t *testing.T) { testCheckBalances(t, admin(t, newRepo(t))) })
+	t.Run("DriftReports", func(t *testing.T) { testDriftReports(t, admin(t, newRepo(t))) })
+}
+
+// adminRepository is a repository with the operator commands.
+type adminRepository interface {
+	repository.WalletRepository
+	repository.Administrator
+}
+
+func admin(t *testing.T, repo repository.WalletRepository) adminRepository {
+	t.Helper()
+	adminRepo, ok := repo.(adminRepository)
+	if !ok {
+		t.Skip("repository does not implement repository.Administrator")
+	}
+	return adminRepo
+}
+
+func createFundedWallet(t *testing.T, repo repository.WalletRepository, balance int64) string {
+	t.Helper()
+
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	if balance > 0 {
+		require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, balance, true))
+	}
+	return walletID
+}
+
+func testCreateWallet(t *testing.T, repo repository.WalletRepository) {
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+
+	_, err = uuid.Parse(walletID)
+	assert.NoError(t, err, "Returned ID is not a valid UUID")
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+func testDeposit(t *testing.T, repo repository.WalletRepository) {
+	walletID := createFundedWallet(t, repo, 0)
+
+	assert.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 100, true))
+	assert.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 50, true))
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(150), balance)
+}
+
+func testWithdraw(t *testing.T, repo repository.WalletRepository) {
+	walletID := createFundedWallet(t, repo, 100)
+
+	assert.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 30, false))
+	assert.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 70, false))
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+func testInvalidAmount(t *testing.T, repo repository.WalletRepository) {
+	walletID := createFundedWallet(t, repo, 100)
+
+	assert.ErrorIs(t, repo.ProcessTransaction(context.Background(), walletID, 0, true), model.ErrInvalidAmount)
+	assert.ErrorIs(t, repo.ProcessTransaction(context.Background(), walletID, -10, false), model.ErrInvalidAmount)
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), balance)
+}
+
+func testWalletNotFound(t *testing.T, repo repository.WalletRepository) {
+	missingID := uuid.NewString()
+
+	assert.ErrorIs(t, repo.ProcessTransaction(context.Background(), missingID, 10, true), model.ErrWalletNotFound)
+	assert.ErrorIs(t, repo.ProcessTransaction(context.Background(), missingID, 10, false), model.ErrWalletNotFound)
+
+	_, err := repo.GetBalance(context.Background(), missingID)
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+
+	_, err = repo.GetHistory(context.Background(), missingID, 0)
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func testInsufficientFunds(t *testing.T, repo repository.WalletRepository) {
+	walletID := createFundedWallet(t, repo, 50)
+
+	err := repo.ProcessTransaction(context.Background(), walletID, 51, false)
+	assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+	var fundsErr *model.InsufficientFundsError
+	if assert.ErrorAs(t, err, &fundsErr) {
+		assert.Equal(t, int64(50), fundsErr.Available)
+	}
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), balance)
+
+	// A rejected withdrawal must not show up in the history
+	history, err := repo.GetHistory(context.Background(), walletID, 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func testConcurrentWithdrawals(t *testing.T, repo repository.WalletRepository) {
+	const (
+		initial     = 100
+		amount      = 10
+		withdrawals = 25
+	)
+	walletID := createFundedWallet(t, repo, initial)
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int64
+	for i := 0; i < withdrawals; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := repo.ProcessTransaction(context.Background(), walletID, amount, false)
+			if err == nil {
+				succeeded.Add(1)
+				return
+			}
+			assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+		}()
+	}
+	wg.Wait()
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, balance, int64(0), "Balance went negative")
+	assert.Equal(t, int64(initial)-succeeded.Load()*amount, balance)
+	assert.Equal(t, int64(initial/amount), succeeded.Load())
+}
+
+func testHistory(t *testing.T, repo repository.WalletRepository) {
+	walletID := createFundedWallet(t, repo, 0)
+
+	history, err := repo.GetHistory(context.Background(), walletID, 0)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 100, true))
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 40, false))
+	require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, 5, true))
+
+	history, err = repo.GetHistory(context.Background(), walletID, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+
+	// Newest first, amounts are signed
+	assert.Equal(t, model.Deposit, history[0].OperationType)
+	assert.Equal(t, int64(5), history[0].Amount)
+	assert.Equal(t, model.Withdraw, history[1].OperationType)
+	assert.Equal(t, int64(-40), history[1].Amount)
+	assert.Equal(t, model.Deposit, history[2].OperationType)
+	assert.Equal(t, int64(100), history[2].Amount)
+
+	var sum int64
+	for i, e := range history {
+		assert.Equal(t, walletID, e.WalletID)
+		assert.False(t, e.CreatedAt.IsZero())
+		if i > 0 {
+			assert.Greater(t, history[i-1].ID, e.ID)
+		}
+		sum += e.Amount
+	}
+
+	balance, err := repo.GetBalance(context.Background(), walletID)
+	require.NoError(t, err)
+	assert.Equal(t, balance, sum, "History does not add up to the balance")
+
+	limited, err := repo.GetHistory(context.Background(), walletID, 2)
+	require.NoError(t, err)
+	assert.Equal(t, history[:2], limited)
+}
+
+func testBalanceAt(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	history, ok := repo.(repository.BalanceHistory)
+	if !ok {
+		t.Skip("repository does not implement repository.BalanceHistory")
+	}
+
+	walletID := createFundedWallet(t, repo, 0)
+	before, err := history.BalanceAt(ctx, walletID, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, before)
+
+	// snapshotAll snapshots every wallet, other test cases may share the storage
+	snapshotAll := func() {
+		t.Helper()
+		var last string
+		for {
+			next, _, err := history.SnapshotBalances(ctx, last, 2)
+			require.NoError(t, err)
+			if next == "" {
+				return
+			}
+			require.Greater(t, next, last, "Chunks are not in ID order")
+			last = next
+		}
+	}
+
+	amounts := []struct {
+		amount    int64
+		isDeposit bool
+	}{{100, true}, {30, false}, {50, true}, {20, false}, {5, true}}
+	for i, a := range amounts {
+		// The timestamps of the entries tell them apart
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, repo.ProcessTransaction(ctx, walletID, a.amount, a.isDeposit))
+		if i == 1 || i == 3 {
+			snapshotAll()
+		}
+	}
+
+	entries, err := repo.GetHistory(ctx, walletID, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, len(amounts))
+
+	// Oldest first, with the balance after each entry
+	var balance int64
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		got, err := history.BalanceAt(ctx, walletID, e.CreatedAt.Add(-time.Microsecond))
+		require.NoError(t, err)
+		assert.Equal(t, balance, got, "Just before entry %d", e.ID)
+
+		balance += e.Amount
+		got, err = history.BalanceAt(ctx, walletID, e.CreatedAt)
+		require.NoError(t, err)
+		assert.Equal(t, balance, got, "At entry %d", e.ID)
+	}
+	assert.Equal(t, int64(105), balance)
+
+	// Snapshotting again changes nothing
+	snapshotAll()
+	now, err := history.BalanceAt(ctx, walletID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(105), now)
+	first, err := history.BalanceAt(ctx, walletID, entries[len(entries)-1].CreatedAt)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), first)
+
+	_, err = history.BalanceAt(ctx, uuid.NewString(), time.Now())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func testStreamStatement(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	history, ok := repo.(repository.BalanceHistory)
+	if !ok {
+		t.Skip("repository does not implement repository.BalanceHistory")
+	}
+
+	walletID := createFundedWallet(t, repo, 0)
+	for _, amount := range []int64{100, 20, 30, 40} {
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, repo.ProcessTransaction(ctx, walletID, amount, true))
+	}
+	entries, err := repo.GetHistory(ctx, walletID, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// stream returns the opening balance and the amounts of the entries
+	stream := func(walletID string, from, to time.Time) (int64, []int64, error) {
+		var opening int64
+		amounts := []int64{}
+		err := history.StreamStatement(ctx, walletID, from, to,
+			func(balance int64) error {
+				opening = balance
+				return nil
+			},
+			func(e model.LedgerEntry) error {
+				assert.Equal(t, walletID, e.WalletID)
+				amounts = append(amounts, e.Amount)
+				return nil
+			})
+		return opening, amounts, err
+	}
+
+	// The entry at from is in the opening balance, the one at to is in the statement
+	opening, amounts, err := stream(walletID, entries[3].CreatedAt, entries[1].CreatedAt)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), opening)
+	assert.Equal(t, []int64{20, 30}, amounts)
+
+	opening, amounts, err = stream(walletID, entries[3].CreatedAt.Add(-time.Hour), time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, opening)
+	assert.Equal(t, []int64{100, 20, 30, 40}, amounts)
+
+	opening, amounts, err = stream(walletID, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(190), opening)
+	assert.Empty(t, amounts)
+
+	// An error of a callback stops the stream
+	errStop := errors.New("client went away")
+	var streamed int
+	err = history.StreamStatement(ctx, walletID, entries[3].CreatedAt.Add(-time.Hour), time.Now(),
+		func(int64) error { return nil },
+		func(model.LedgerEntry) error {
+			streamed++
+			return errStop
+		})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, streamed)
+
+	_, _, err = stream(uuid.NewString(), time.Now().Add(-time.Hour), time.Now())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func testStreamLedger(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	exporter, ok := repo.(repository.LedgerExporter)
+	if !ok {
+		t.Skip("repository does not implement repository.LedgerExporter")
+	}
+
+	first := createFundedWallet(t, repo, 0)
+	second := createFundedWallet(t, repo, 0)
+	for i, walletID := range []string{first, second, first, second} {
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, repo.ProcessTransaction(ctx, walletID, int64(i+1), true))
+	}
+
+	// stream returns the IDs of the entries of both wallets, other test cases may share the storage
+	stream := func(afterID int64, before time.Time) []int64 {
+		t.Helper()
+		ids := []int64{}
+		last := afterID
+		require.NoError(t, exporter.StreamLedger(ctx, afterID, before, func(e model.LedgerEntry) error {
+			require.Greater(t, e.ID, last, "Entries are not in ID order")
+			last = e.ID
+			if e.WalletID == first || e.WalletID == second {
+				ids = append(ids, e.ID)
+			}
+			return nil
+		}))
+		return ids
+	}
+
+	all := stream(0, time.Now())
+	require.Len(t, all, 4)
+
+	entries, err := repo.GetHistory(ctx, second, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{entries[1].ID, all[2], entries[0].ID}, stream(all[0], time.Now()))
+
+	// Stops before the first entry created after before
+	assert.Equal(t, all[:2], stream(0, entries[1].CreatedAt))
+	assert.Empty(t, stream(all[3], time.Now()))
+
+	errStop := errors.New("export failed")
+	err = exporter.StreamLedger(ctx, all[0]-1, time.Now(), func(model.LedgerEntry) error { return errStop })
+	assert.ErrorIs(t, err, errStop)
+}
+
+func testLeaseExport(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	exporter, ok := repo.(repository.LedgerExporter)
+	if !ok {
+		t.Skip("repository does not implement repository.LedgerExporter")
+	}
+
+	// The lease is shared by every test case using the storage, so it ends with the test
+	first, second := uuid.NewString(), uuid.NewString()
+	t.Cleanup(func() {
+		exporter.ReleaseExport(ctx, first)
+		exporter.ReleaseExport(ctx, second)
+	})
+	now := time.Now()
+
+	leased := func(owner string, at time.Time) bool {
+		t.Helper()
+		ok, err := exporter.LeaseExport(ctx, owner, at, time.Minute)
+		require.NoError(t, err)
+		return ok
+	}
+	require.True(t, leased(first, now))
+	assert.False(t, leased(second, now.Add(30*time.Second)), "The lease is held by the first owner")
+	assert.True(t, leased(first, now.Add(30*time.Second)), "Its owner extends the lease")
+	assert.False(t, leased(second, now.Add(time.Minute)), "The extended lease has not ended")
+
+	// Releasing the lease of another owner is a no-op
+	require.NoError(t, exporter.ReleaseExport(ctx, second))
+	assert.False(t, leased(second, now.Add(time.Minute)))
+
+	assert.True(t, leased(second, now.Add(2*time.Minute)), "An ended lease is taken over")
+	assert.False(t, leased(first, now.Add(2*time.Minute)))
+
+	require.NoError(t, exporter.ReleaseExport(ctx, second))
+	assert.True(t, leased(first, now.Add(2*time.Minute)), "A released lease is free")
+}
+
+func testFreeze(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	walletID := createFundedWallet(t, repo, 100)
+
+	require.NoError(t, repo.SetFrozen(ctx, walletID, true))
+	wallet, err := repo.GetWallet(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, model.Wallet{ID: walletID, Balance: 100, Frozen: true}, wallet)
+
+	assert.ErrorIs(t, repo.ProcessTransaction(ctx, walletID, 10, true), model.ErrWalletFrozen)
+	assert.ErrorIs(t, repo.ProcessTransaction(ctx, walletID, 10, false), model.ErrWalletFrozen)
+
+	require.NoError(t, repo.SetFrozen(ctx, walletID, false))
+	assert.NoError(t, repo.ProcessTransaction(ctx, walletID, 10, false))
+
+	wallet, err = repo.GetWallet(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, model.Wallet{ID: walletID, Balance: 90, Frozen: false}, wallet)
+
+	missingID := uuid.NewString()
+	assert.ErrorIs(t, repo.SetFrozen(ctx, missingID, true), model.ErrWalletNotFound)
+	_, err = repo.GetWallet(ctx, missingID)
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+// requestAdjustment requests an adjustment by "alice" that expires in an hour.
+func requestAdjustment(t *testing.T, repo adminRepository, walletID string, amount int64) model.AdjustmentRequest {
+	t.Helper()
+	a, err := repo.RequestAdjustment(context.Background(), model.AdjustmentRequest{
+		WalletID:      walletID,
+		Amount:        amount,
+		ReasonCode:    model.ReasonFeeRefund,
+		Justification: "fee charged twice",
+		RequestedBy:   "alice",
+		ExpiresAt:     time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func pendingIDs(t *testing.T, repo adminRepository) map[string]model.AdjustmentRequest {
+	t.Helper()
+	pending, err := repo.PendingAdjustments(context.Background())
+	require.NoError(t, err)
+	ids := make(map[string]model.AdjustmentRequest, len(pending))
+	for _, a := range pending {
+		ids[a.ID] = a
+	}
+	return ids
+}
+
+func testAdjust(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	walletID := createFundedWallet(t, repo, 100)
+
+	requested := requestAdjustment(t, repo, walletID, -30)
+	assert.NotEmpty(t, requested.ID)
+	assert.Equal(t, model.AdjustmentPending, requested.Status)
+	assert.Equal(t, "alice", requested.RequestedBy)
+
+	// Nothing is applied before the approval
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), balance)
+
+	pending := pendingIDs(t, repo)
+	if assert.Contains(t, pending, requested.ID) {
+		listed := pending[requested.ID]
+		assert.Equal(t, walletID, listed.WalletID)
+		assert.Equal(t, int64(-30), listed.Amount)
+		assert.Equal(t, model.ReasonFeeRefund, listed.ReasonCode)
+		assert.Equal(t, "fee charged twice", listed.Justification)
+		assert.WithinDuration(t, requested.ExpiresAt, listed.ExpiresAt, time.Millisecond)
+	}
+
+	_, err = repo.ApproveAdjustment(ctx, requested.ID, "alice")
+	assert.ErrorIs(t, err, model.ErrSelfApproval)
+	_, err = repo.ApproveAdjustment(ctx, requested.ID, " Alice ")
+	assert.ErrorIs(t, err, model.ErrSelfApproval)
+
+	approved, err := repo.ApproveAdjustment(ctx, requested.ID, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, model.AdjustmentApproved, approved.Status)
+	assert.Equal(t, "bob", approved.DecidedBy)
+	require.NotNil(t, approved.DecidedAt)
+	assert.NotZero(t, approved.LedgerEntryID)
+	assert.NotContains(t, pendingIDs(t, repo), requested.ID)
+
+	_, err = repo.ApproveAdjustment(ctx, requested.ID, "carol")
+	assert.ErrorIs(t, err, model.ErrAdjustmentNotPending)
+	_, err = repo.RejectAdjustment(ctx, requested.ID, "carol")
+	assert.ErrorIs(t, err, model.ErrAdjustmentNotPending)
+
+	balance, err = repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(70), balance)
+
+	history, err := repo.GetHistory(ctx, walletID, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, approved.LedgerEntryID, history[0].ID)
+	assert.Equal(t, model.Adjustment, history[0].OperationType)
+	assert.Equal(t, int64(-30), history[0].Amount)
+	assert.Equal(t, requested.LedgerReason(), history[0].Reason)
+	assert.Equal(t, model.Deposit, history[1].OperationType)
+	assert.Empty(t, history[1].Reason)
+
+	_, err = repo.ApproveAdjustment(ctx, uuid.NewString(), "bob")
+	assert.ErrorIs(t, err, model.ErrAdjustmentNotFound)
+}
+
+func testAdjustRejected(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	walletID := createFundedWallet(t, repo, 100)
+
+	// The requester may withdraw their own request
+	withdrawn := requestAdjustment(t, repo, walletID, 10)
+	rejected, err := repo.RejectAdjustment(ctx, withdrawn.ID, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, model.AdjustmentRejected, rejected.Status)
+	assert.Equal(t, "alice", rejected.DecidedBy)
+	assert.Zero(t, rejected.LedgerEntryID)
+	assert.NotContains(t, pendingIDs(t, repo), withdrawn.ID)
+
+	_, err = repo.ApproveAdjustment(ctx, withdrawn.ID, "bob")
+	assert.ErrorIs(t, err, model.ErrAdjustmentNotPending)
+
+	// A failed approval leaves the request pending
+	tooMuch := requestAdjustment(t, repo, walletID, -150)
+	_, err = repo.ApproveAdjustment(ctx, tooMuch.ID, "bob")
+	var fundsErr *model.InsufficientFundsError
+	if assert.ErrorAs(t, err, &fundsErr) {
+		assert.Equal(t, int64(100), fundsErr.Available)
+	}
+	assert.Contains(t, pendingIDs(t, repo), tooMuch.ID)
+
+	credit := requestAdjustment(t, repo, walletID, 5)
+	require.NoError(t, repo.SetFrozen(ctx, walletID, true))
+	_, err = repo.ApproveAdjustment(ctx, credit.ID, "bob")
+	assert.ErrorIs(t, err, model.ErrWalletFrozen)
+	assert.Contains(t, pendingIDs(t, repo), credit.ID)
+
+	require.NoError(t, repo.SetFrozen(ctx, walletID, false))
+	_, err = repo.ApproveAdjustment(ctx, credit.ID, "bob")
+	require.NoError(t, err)
+
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(105), balance)
+}
+
+func testAdjustExpired(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	walletID := createFundedWallet(t, repo, 100)
+
+	req := model.AdjustmentRequest{
+		WalletID:      walletID,
+		Amount:        10,
+		ReasonCode:    model.ReasonGoodwill,
+		Justification: "late delivery",
+		RequestedBy:   "alice",
+		ExpiresAt:     time.Now().Add(-time.Second),
+	}
+	expired, err := repo.RequestAdjustment(ctx, req)
+	require.NoError(t, err)
+	assert.NotContains(t, pendingIDs(t, repo), expired.ID)
+
+	_, err = repo.ApproveAdjustment(ctx, expired.ID, "bob")
+	assert.ErrorIs(t, err, model.ErrAdjustmentExpired)
+	// Once found expired, it is no longer pending
+	_, err = repo.RejectAdjustment(ctx, expired.ID, "bob")
+	assert.ErrorIs(t, err, model.ErrAdjustmentNotPending)
+
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), balance)
+}
+
+func testAdjustInvalid(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	walletID := createFundedWallet(t, repo, 100)
+	valid := model.AdjustmentRequest{
+		WalletID:      walletID,
+		Amount:        10,
+		ReasonCode:    model.ReasonOther,
+		Justification: "manual correction",
+		RequestedBy:   "alice",
+		ExpiresAt:     time.Now().Add(time.Hour),
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(a *model.AdjustmentRequest)
+		want   error
+	}{
+		{"zero amount", func(a *model.AdjustmentRequest) { a.Amount = 0 }, model.ErrInvalidAmount},
+		{"unknown reason code", func(a *model.AdjustmentRequest) { a.ReasonCode = "BIRTHDAY" }, model.ErrInvalidReasonCode},
+		{"blank justification", func(a *model.AdjustmentRequest) { a.Justification = " " }, model.ErrReasonRequired},
+		{"unknown wallet", func(a *model.AdjustmentRequest) { a.WalletID = uuid.NewString() }, model.ErrWalletNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := valid
+			tc.modify(&req)
+			_, err := repo.RequestAdjustment(ctx, req)
+			assert.ErrorIs(t, err, tc.want)
+		})
+	}
+
+	req := valid
+	req.RequestedBy = ""
+	_, err := repo.RequestAdjustment(ctx, req)
+	assert.Error(t, err)
+}
+
+func testCheckBalances(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	funded := createFundedWallet(t, repo, 100)
+	empty := createFundedWallet(t, repo, 0)
+
+	// Other test cases may share the storage, so only these wallets are looked at
+	checks := make(map[string]model.BalanceCheck)
+	var last string
+	for {
+		chunk, err := repo.CheckBalances(ctx, last, 2)
+		require.NoError(t, err)
+		if len(chunk) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(chunk), 2)
+		for _, c := range chunk {
+			require.Greater(t, c.WalletID, last, "Chunks are not in ID order")
+			last = c.WalletID
+			checks[c.WalletID] = c
+		}
+	}
+
+	assert.Equal(t, model.BalanceCheck{WalletID: funded, Balance: 100, LedgerBalance: 100}, checks[funded])
+	assert.Equal(t, model.BalanceCheck{WalletID: empty}, checks[empty])
+	assert.Zero(t, checks[funded].Drift())
+
+	all, err := repo.CheckBalances(ctx, "", 0)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(all), 2)
+}
+
+func testDriftReports(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	walletID := createFundedWallet(t, repo, 100)
+
+	// Other test cases may share the storage, so only this wallet's reports are looked at
+	reports := func() []model.DriftReport {
+		t.Helper()
+		all, err := repo.DriftReports(ctx, 0)
+		require.NoError(t, err)
+		var own []model.DriftReport
+		for _, d := range all {
+			if d.WalletID == walletID {
+				own = append(own, d)
+			}
+		}
+		return own
+	}
+
+	drift := model.BalanceCheck{WalletID: walletID, Balance: 1000, LedgerBalance: 100}
+	require.NoError(t, repo.ReportDrift(ctx, drift, false))
+	first := reports()
+	require.Len(t, first, 1)
+	assert.Equal(t, int64(1000), first[0].Balance)
+	assert.Equal(t, int64(100), first[0].LedgerBalance)
+	assert.Equal(t, int64(900), first[0].Drift())
+	assert.False(t, first[0].Frozen)
+	assert.Equal(t, first[0].DetectedAt, first[0].LastSeenAt)
+
+	// The same drift found again, after a transaction, is the same report
+	time.Sleep(time.Millisecond)
+	require.NoError(t, repo.ReportDrift(ctx, drift, true))
+	moved := model.BalanceCheck{WalletID: walletID, Balance: 1010, LedgerBalance: 110}
+	require.NoError(t, repo.ReportDrift(ctx, moved, false))
+	again := reports()
+	require.Len(t, again, 1)
+	assert.Equal(t, first[0].ID, again[0].ID)
+	assert.Equal(t, int64(1010), again[0].Balance)
+	assert.Equal(t, int64(110), again[0].LedgerBalance)
+	assert.Equal(t, first[0].DetectedAt, again[0].DetectedAt)
+	assert.True(t, again[0].LastSeenAt.After(first[0].LastSeenAt))
+	assert.True(t, again[0].Frozen, "Frozen must stick once the wallet was frozen")
+
+	time.Sleep(time.Millisecond)
+	require.NoError(t, repo.ReportDrift(ctx, model.BalanceCheck{WalletID: walletID, Balance: 50, LedgerBalance: 100}, false))
+	latest := reports()
+	require.Len(t, latest, 2)
+	assert.Equal(t, int64(-50), latest[0].Drift(), "Most recently seen first")
+	assert.Equal(t, first[0].ID, latest[1].ID)
+
+	limited, err := repo.DriftReports(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, limited, 1)
+
+	assert.ErrorIs(t, repo.ReportDrift(ctx, model.BalanceCheck{WalletID: uuid.NewString(), Balance: 1}, false), model.ErrWalletNotFound)
+}
+
+func testProcessTransactionOnce(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	once, ok := repo.(repository.OnceProcessor)
+	if !ok {
+		t.Skip("repository does not implement repository.OnceProcessor")
+	}
+
+	walletID := createFundedWallet(t, repo, 10)
+	reference := "test:" + uuid.NewString()
+
+	// A rejected transaction does not use up its reference
+	var insufficient *model.InsufficientFundsError
+	require.ErrorAs(t, once.ProcessTransactionOnce(ctx, walletID, 50, false, reference), &insufficient)
+	require.NoError(t, once.ProcessTransactionOnce(ctx, walletID, 5, false, reference))
+	assert.ErrorIs(t, once.ProcessTransactionOnce(ctx, walletID, 5, false, reference), model.ErrDuplicateReference)
+	assert.ErrorIs(t, once.ProcessTransactionOnce(ctx, walletID, 5, true, reference), model.ErrDuplicateReference)
+	require.NoError(t, once.ProcessTransactionOnce(ctx, walletID, 1, true, reference+":next"))
+
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), balance)
+
+	// Concurrent attempts apply the reference once
+	reference = "test:" + uuid.NewString()
+	var applied atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := once.ProcessTransactionOnce(ctx, walletID, 1, true, reference)
+			if err == nil {
+				applied.Add(1)
+				return
+			}
+			assert.ErrorIs(t, err, model.ErrDuplicateReference)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), applied.Load())
+
+	balance, err = repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), balance)
+
+	assert.ErrorIs(t, once.ProcessTransactionOnce(ctx, uuid.NewString(), 1, true, "test:"+uuid.NewString()), model.ErrWalletNotFound)
+}
+
+func schedules(t *testing.T, repo repository.WalletRepository) repository.Schedules {
+	t.Helper()
+	schedules, ok := repo.(repository.Schedules)
+	if !ok {
+		t.Skip("repository does not implement repository.Schedules")
+	}
+	return schedules
+}
+
+// newSchedule returns an active schedule of the wallet due at at.
+func newSchedule(walletID string, at time.Time) model.Schedule {
+	at = at.UTC().Truncate(time.Microsecond)
+	return model.Schedule{
+		WalletID:      walletID,
+		OperationType: model.Deposit,
+		Amount:        10,
+		Recurrence:    "daily",
+		StartAt:       at,
+		Status:        model.ScheduleActive,
+		NextRunAt:     &at,
+		DueAt:         &at,
+	}
+}
+
+func testSchedules(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	store := schedules(t, repo)
+	walletID := createFundedWallet(t, repo, 0)
+
+	empty, err := store.ListSchedules(ctx, walletID)
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+
+	start := time.Now().Add(time.Hour)
+	first, err := store.CreateSchedule(ctx, newSchedule(walletID, start))
+	require.NoError(t, err)
+	_, err = uuid.Parse(first.ID)
+	assert.NoError(t, err, "Schedule ID is not a valid UUID")
+	assert.False(t, first.CreatedAt.IsZero())
+
+	time.Sleep(2 * time.Millisecond)
+	end := start.Add(72 * time.Hour).UTC().Truncate(time.Microsecond)
+	second := newSchedule(walletID, start)
+	second.OperationType = model.Withdraw
+	second.Recurrence = ""
+	second.EndAt = &end
+	second, err = store.CreateSchedule(ctx, second)
+	require.NoError(t, err)
+
+	got, err := store.GetSchedule(ctx, walletID, second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.Withdraw, got.OperationType)
+	assert.Empty(t, got.Recurrence)
+	require.NotNil(t, got.EndAt)
+	assert.True(t, end.Equal(*got.EndAt))
+	assert.True(t, second.DueAt.Equal(*got.DueAt))
+
+	list, err := store.ListSchedules(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, first.ID, list[0].ID, "Oldest first")
+	assert.Equal(t, second.ID, list[1].ID)
+
+	// Updates based on an older version are rejected
+	paused := got
+	paused.Status = model.SchedulePaused
+	paused.Amount = 25
+	paused, err = store.UpdateSchedule(ctx, paused)
+	require.NoError(t, err)
+	assert.Equal(t, model.SchedulePaused, paused.Status)
+	assert.Equal(t, int64(25), paused.Amount)
+	assert.NotEqual(t, got.Version, paused.Version)
+
+	_, err = store.UpdateSchedule(ctx, got)
+	assert.ErrorIs(t, err, repository.ErrScheduleChanged)
+
+	got, err = store.GetSchedule(ctx, walletID, second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, paused.Version, got.Version)
+	assert.Equal(t, model.SchedulePaused, got.Status)
+
+	otherWallet := createFundedWallet(t, repo, 0)
+	_, err = store.GetSchedule(ctx, otherWallet, second.ID)
+	assert.ErrorIs(t, err, model.ErrScheduleNotFound)
+	_, err = store.GetSchedule(ctx, walletID, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrScheduleNotFound)
+	_, err = store.CreateSchedule(ctx, newSchedule(uuid.NewString(), start))
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+	_, err = store.ListSchedules(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func testClaimDueSchedules(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	store := schedules(t, repo)
+	walletID := createFundedWallet(t, repo, 0)
+
+	now := time.Now().UTC()
+	due, err := store.CreateSchedule(ctx, newSchedule(walletID, now.Add(-time.Minute)))
+	require.NoError(t, err)
+	later, err := store.CreateSchedule(ctx, newSchedule(walletID, now.Add(time.Hour)))
+	require.NoError(t, err)
+	paused := newSchedule(walletID, now.Add(-time.Minute))
+	paused.Status = model.SchedulePaused
+	_, err = store.CreateSchedule(ctx, paused)
+	require.NoError(t, err)
+
+	// claim returns the claimed schedules of the wallet, other test cases may share the storage
+	claim := func(at time.Time) []model.Schedule {
+		t.Helper()
+		all, err := store.ClaimDueSchedules(ctx, at, time.Minute, 0)
+		require.NoError(t, err)
+		var own []model.Schedule
+		for _, s := range all {
+			if s.WalletID == walletID {
+				own = append(own, s)
+			}
+		}
+		return own
+	}
+
+	claimed := claim(now)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, due.ID, claimed[0].ID)
+	assert.NotEqual(t, due.Version, claimed[0].Version, "Claiming changes the version")
+	assert.Empty(t, claim(now.Add(30*time.Second)), "Leased schedules are not claimed again")
+
+	// An update based on the version before the claim is rejected
+	_, err = store.UpdateSchedule(ctx, due)
+	assert.ErrorIs(t, err, repository.ErrScheduleChanged)
+
+	// Once the lease is over the schedule is claimed again, the first claim can no longer finish
+	reclaimed := claim(now.Add(2 * time.Minute))
+	require.Len(t, reclaimed, 1)
+	assert.Equal(t, due.ID, reclaimed[0].ID)
+
+	occurrence := *claimed[0].NextRunAt
+	run := model.ScheduleRun{
+		Occurrence: occurrence,
+		Attempt:    1,
+		Status:     model.RunSucceeded,
+		StartedAt:  now.Truncate(time.Microsecond),
+		FinishedAt: now.Truncate(time.Microsecond),
+	}
+	// Its run is recorded all the same, the transaction it ran was applied
+	_, err = store.FinishScheduleRun(ctx, claimed[0], run)
+	assert.ErrorIs(t, err, repository.ErrScheduleChanged)
+	runs, err := store.ScheduleRuns(ctx, due.ID, 0)
+	require.NoError(t, err)
+	assert.Len(t, runs, 1)
+
+	next := reclaimed[0]
+	nextRun := occurrence.Add(24 * time.Hour)
+	next.NextRunAt = &nextRun
+	next.DueAt = &nextRun
+	finished, err := store.FinishScheduleRun(ctx, next, run)
+	require.NoError(t, err)
+	assert.True(t, nextRun.Equal(*finished.NextRunAt))
+
+	// The lease ended with the run, the schedule is claimed as soon as it is due again
+	assert.Empty(t, claim(now.Add(2*time.Minute)))
+	both := claim(nextRun)
+	require.Len(t, both, 2)
+	assert.Equal(t, later.ID, both[0].ID, "Earliest due first")
+	assert.Equal(t, due.ID, both[1].ID)
+	again := both[1:]
+
+	retry := run
+	retry.Occurrence = nextRun
+	retry.Status = model.RunFailed
+	retry.ErrorCode = model.CodeWalletFrozen
+	_, err = store.FinishScheduleRun(ctx, again[0], retry)
+	require.NoError(t, err)
+
+	runs, err = store.ScheduleRuns(ctx, due.ID, 0)
+	require.NoError(t, err)
+	require.Len(t, runs, 2, "The attempt finished twice is recorded once")
+	assert.Equal(t, model.RunFailed, runs[0].Status, "Newest first")
+	assert.Equal(t, model.CodeWalletFrozen, runs[0].ErrorCode)
+	assert.True(t, nextRun.Equal(runs[0].Occurrence))
+	assert.Equal(t, model.RunSucceeded, runs[1].Status)
+	assert.Empty(t, runs[1].ErrorCode)
+	assert.Equal(t, due.ID, runs[1].ScheduleID)
+	assert.True(t, occurrence.Equal(runs[1].Occurrence))
+
+	limited, err := store.ScheduleRuns(ctx, due.ID, 1)
+	require.NoError(t, err)
+	assert.Len(t, limited, 1)
+
+	none, err := store.ScheduleRuns(ctx, later.ID, 0)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func interestStore(t *testing.T, repo repository.WalletRepository) repository.Interest {
+	t.Helper()
+	store, ok := repo.(repository.Interest)
+	if !ok {
+		t.Skip("repository does not implement repository.Interest")
+	}
+	return store
+}
+
+// createInterestProduct stores a 5% ACT/365 product rounded down, under a unique name.
+func createInterestProduct(t *testing.T, store repository.Interest) model.InterestProduct {
+	t.Helper()
+	p, err := store.CreateInterestProduct(context.Background(), model.InterestProduct{
+		Name:          "savings-" + uuid.NewString(),
+		AnnualRateBps: 500,
+		DayCount:      string(interest.Actual365),
+		Rounding:      string(interest.RoundDown),
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// accrual returns the accrual of the day on the balance under the product.
+func accrual(walletID string, p model.InterestProduct, day time.Time, balance int64) model.InterestAccrual {
+	amount := interest.Accrue(balance, p.AnnualRateBps, interest.DayCount(p.DayCount), day)
+	return model.InterestAccrual{
+		WalletID:      walletID,
+		Day:           day,
+		ProductID:     p.ID,
+		AnnualRateBps: p.AnnualRateBps,
+		DayCount:      p.DayCount,
+		Balance:       balance,
+		Units:         amount.Units,
+		Fraction:      amount.Fraction,
+	}
+}
+
+// posting returns the posting of the month ending with the account accrued as is.
+func posting(account model.InterestAccount, period string) *model.InterestPosting {
+	rounding := interest.Rounding(account.Product.Rounding)
+	amount, _ := interest.Post(interest.Amount{Units: account.AccruedUnits, Fraction: account.AccruedFraction}, rounding)
+	return &model.InterestPosting{
+		WalletID:        account.WalletID,
+		Period:          period,
+		AccruedUnits:    account.AccruedUnits,
+		AccruedFraction: account.AccruedFraction,
+		Rounding:        string(rounding),
+		Amount:          amount,
+	}
+}
+
+func testInterestAccounts(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	store := interestStore(t, repo)
+	walletID := createFundedWallet(t, repo, 0)
+
+	first := createInterestProduct(t, store)
+	_, err := uuid.Parse(first.ID)
+	assert.NoError(t, err, "Product ID is not a valid UUID")
+	assert.False(t, first.CreatedAt.IsZero())
+	time.Sleep(2 * time.Millisecond)
+	second := createInterestProduct(t, store)
+
+	products, err := store.InterestProducts(ctx)
+	require.NoError(t, err)
+	var own []string
+	for _, p := range products {
+		if p.ID == first.ID || p.ID == second.ID {
+			own = append(own, p.ID)
+		}
+	}
+	assert.Equal(t, []string{first.ID, second.ID}, own, "Oldest first")
+
+	_, err = store.GetInterestAccount(ctx, walletID)
+	assert.ErrorIs(t, err, model.ErrInterestNotAssigned)
+
+	account, err := store.AssignInterestProduct(ctx, walletID, first.ID, date(2025, time.March, 10))
+	require.NoError(t, err)
+	assert.Equal(t, walletID, account.WalletID)
+	assert.Equal(t, first.ID, account.Product.ID)
+	assert.Equal(t, first.Name, account.Product.Name)
+	assert.Equal(t, date(2025, time.March, 9), account.AccruedThrough)
+
+	// Switching product keeps the accrued days
+	_, err = store.AssignInterestProduct(ctx, walletID, second.ID, date(2025, time.June, 1))
+	require.NoError(t, err)
+	account, err = store.GetInterestAccount(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, second.ID, account.Product.ID)
+	assert.Equal(t, int64(500), account.Product.AnnualRateBps)
+	assert.Equal(t, string(interest.Actual365), account.Product.DayCount)
+	assert.Equal(t, date(2025, time.March, 9), account.AccruedThrough)
+
+	// due returns the due accounts among the ones of the test, other test cases may share the storage
+	other := createFundedWallet(t, repo, 0)
+	_, err = store.AssignInterestProduct(ctx, other, first.ID, date(2025, time.March, 12))
+	require.NoError(t, err)
+	due := func(through time.Time, limit int) []string {
+		t.Helper()
+		var ids []string
+		afterID := ""
+		for {
+			accounts, err := store.DueInterestAccounts(ctx, afterID, through, limit)
+			require.NoError(t, err)
+			if len(accounts) == 0 {
+				return ids
+			}
+			for _, a := range accounts {
+				if a.WalletID == walletID || a.WalletID == other {
+					ids = append(ids, a.WalletID)
+				}
+			}
+			afterID = accounts[len(accounts)-1].WalletID
+		}
+	}
+	assert.Empty(t, due(date(2025, time.March, 9), 0))
+	assert.Equal(t, []string{walletID}, due(date(2025, time.March, 10), 0))
+	both := []string{walletID, other}
+	if other < walletID {
+		both = []string{other, walletID}
+	}
+	assert.Equal(t, both, due(date(2025, time.March, 12), 1), "Wallet ID order")
+
+	_, err = store.AssignInterestProduct(ctx, walletID, uuid.NewString(), date(2025, time.March, 10))
+	assert.ErrorIs(t, err, model.ErrInterestProductNotFound)
+	_, err = store.AssignInterestProduct(ctx, uuid.NewString(), first.ID, date(2025, time.March, 10))
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+	_, err = store.GetInterestAccount(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+	_, err = store.InterestAccruals(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+	_, err = store.InterestPostings(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func testAccrueInterest(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	store := interestStore(t, repo)
+	walletID := createFundedWallet(t, repo, 1_000_000)
+	product := createInterestProduct(t, store)
+
+	_, err := store.AssignInterestProduct(ctx, walletID, product.ID, date(2025, time.January, 30))
+	require.NoError(t, err)
+
+	// 10,000.00 at 5% earns 1.36 and 360/365 of a cent a day
+	day := accrual(walletID, product, date(2025, time.January, 30), 1_000_000)
+	account, err := store.AccrueInterest(ctx, day, nil)
+	require.NoError(t, err)
+	assert.Equal(t, date(2025, time.January, 30), account.AccruedThrough)
+	assert.Equal(t, day.Units, account.AccruedUnits)
+	assert.Equal(t, day.Fraction, account.AccruedFraction)
+
+	// A day already accrued, or one past the next, is rejected
+	_, err = store.AccrueInterest(ctx, day, nil)
+	assert.ErrorIs(t, err, repository.ErrInterestChanged)
+	_, err = store.AccrueInterest(ctx, accrual(walletID, product, date(2025, time.February, 1), 1_000_000), nil)
+	assert.ErrorIs(t, err, repository.ErrInterestChanged)
+
+	// The last day of the month posts the rounded interest and carries the rest
+	last := accrual(walletID, product, date(2025, time.January, 31), 1_000_000)
+	accrued := interest.Amount{Units: day.Units, Fraction: day.Fraction}.Add(interest.Amount{Units: last.Units, Fraction: last.Fraction})
+	post := posting(model.InterestAccount{WalletID: walletID, Product: product, AccruedUnits: accrued.Units, AccruedFraction: accrued.Fraction}, "2025-01")
+	require.Equal(t, int64(273), post.Amount)
+
+	stale := *post
+	stale.AccruedUnits--
+	_, err = store.AccrueInterest(ctx, last, &stale)
+	assert.ErrorIs(t, err, repository.ErrInterestChanged, "Posting of another accrued amount")
+
+	account, err = store.AccrueInterest(ctx, last, post)
+	require.NoError(t, err)
+	carry := accrued.Sub(post.Amount)
+	assert.Equal(t, carry.Units, account.AccruedUnits)
+	assert.Equal(t, carry.Fraction, account.AccruedFraction)
+
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_000_273), balance)
+
+	history, err := repo.GetHistory(ctx, walletID, 1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, model.Interest, history[0].OperationType)
+	assert.Equal(t, int64(273), history[0].Amount)
+
+	accruals, err := store.InterestAccruals(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, accruals, 2)
+	assert.Equal(t, day, accruals[0])
+	assert.Equal(t, last, accruals[1])
+
+	postings, err := store.InterestPostings(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, postings, 1)
+	assert.Equal(t, "2025-01", postings[0].Period)
+	assert.Equal(t, post.Amount, postings[0].Amount)
+	assert.Equal(t, accrued.Units, postings[0].AccruedUnits)
+	assert.Equal(t, accrued.Fraction, postings[0].AccruedFraction)
+	assert.Equal(t, history[0].ID, postings[0].LedgerEntryID)
+	assert.False(t, postings[0].PostedAt.IsZero())
+
+	// Nothing to post records the posting without a ledger entry
+	empty := createFundedWallet(t, repo, 0)
+	_, err = store.AssignInterestProduct(ctx, empty, product.ID, date(2025, time.February, 28))
+	require.NoError(t, err)
+	nothing := accrual(empty, product, date(2025, time.February, 28), 0)
+	_, err = store.AccrueInterest(ctx, nothing, posting(model.InterestAccount{WalletID: empty, Product: product}, "2025-02"))
+	require.NoError(t, err)
+
+	postings, err = store.InterestPostings(ctx, empty)
+	require.NoError(t, err)
+	require.Len(t, postings, 1)
+	assert.Zero(t, postings[0].Amount)
+	assert.Zero(t, postings[0].LedgerEntryID)
+	entries, err := repo.GetHistory(ctx, empty, 0)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = store.AccrueInterest(ctx, accrual(createFundedWallet(t, repo, 0), product, date(2025, time.March, 1), 0), nil)
+	assert.ErrorIs(t, err, model.ErrInterestNotAssigned)
+}
+
+func testAccrueInterestFrozen(t *testing.T, repo adminRepository) {
+	ctx := context.Background()
+	store := interestStore(t, repo)
+	walletID := createFundedWallet(t, repo, 1_000_000)
+	product := createInterestProduct(t, store)
+
+	_, err := store.AssignInterestProduct(ctx, walletID, product.ID, date(2025, time.April, 30))
+	require.NoError(t, err)
+	require.NoError(t, repo.SetFrozen(ctx, walletID, true))
+
+	// The posting of a frozen wallet fails and rolls the accrual back with it
+	last := accrual(walletID, product, date(2025, time.April, 30), 1_000_000)
+	post := posting(model.InterestAccount{WalletID: walletID, Product: product, AccruedUnits: last.Units, AccruedFraction: last.Fraction}, "2025-04")
+	_, err = store.AccrueInterest(ctx, last, post)
+	assert.ErrorIs(t, err, model.ErrWalletFrozen)
+
+	account, err := store.GetInterestAccount(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, date(2025, time.April, 29), account.AccruedThrough)
+	assert.Zero(t, account.AccruedUnits)
+	accruals, err := store.InterestAccruals(ctx, walletID)
+	require.NoError(t, err)
+	assert.Empty(t, accruals)
+
+	// Accruals without a posting do not touch the wallet
+	_, err = store.AccrueInterest(ctx, last, nil)
+	assert.NoError(t, err)
+}
+
+func overdraftStore(t *testing.T, repo repository.WalletRepository) repository.Overdraft {
+	t.Helper()
+	store, ok := repo.(repository.Overdraft)
+	if !ok {
+		t.Skip("repository does not implement repository.Overdraft")
+	}
+	return store
+}
+
+// dueOverdraft returns the due overdraft of the wallet among every due one, false if it is not due.
+func dueOverdraft(t *testing.T, store repository.Overdraft, walletID string, through time.Time) (model.Overdraft, bool) {
+	t.Helper()
+	due, err := store.DueOverdraftFees(context.Background(), "", through, 0)
+	require.NoError(t, err)
+	for _, o := range due {
+		if o.WalletID == walletID {
+			return o, true
+		}
+	}
+	return model.Overdraft{}, false
+}
+
+func testOverdraft(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	store := overdraftStore(t, repo)
+	walletID := createFundedWallet(t, repo, 50)
+
+	o, err := store.GetOverdraft(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, model.Overdraft{WalletID: walletID, Balance: 50}, o)
+
+	o, err = store.SetOverdraft(ctx, walletID, 100, 0, date(2025, time.March, 1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), o.CreditLimit)
+	assert.Nil(t, o.FeesChargedThrough, "No fee, nothing to charge")
+
+	// The balance may go down to minus the limit and no further
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 120, false))
+	err = repo.ProcessTransaction(ctx, walletID, 31, false)
+	assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+	var fundsErr *model.InsufficientFundsError
+	if assert.ErrorAs(t, err, &fundsErr) {
+		assert.Equal(t, int64(30), fundsErr.Available)
+	}
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 30, false))
+
+	o, err = store.GetOverdraft(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-100), o.Balance)
+	assert.Equal(t, int64(100), o.Used())
+	assert.Zero(t, o.Available())
+
+	// The limit cannot drop below the overdraft in use
+	_, err = store.SetOverdraft(ctx, walletID, 99, 0, date(2025, time.March, 1))
+	assert.ErrorIs(t, err, model.ErrInvalidOverdraft)
+	_, err = store.SetOverdraft(ctx, walletID, -1, 0, date(2025, time.March, 1))
+	assert.ErrorIs(t, err, model.ErrInvalidOverdraft)
+	_, err = store.SetOverdraft(ctx, walletID, 100, -1, date(2025, time.March, 1))
+	assert.ErrorIs(t, err, model.ErrInvalidOverdraft)
+
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 100, true))
+	_, err = store.SetOverdraft(ctx, walletID, 0, 0, date(2025, time.March, 1))
+	require.NoError(t, err)
+	err = repo.ProcessTransaction(ctx, walletID, 1, false)
+	assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+
+	// A credit overflowing the balance is rejected
+	rich := createFundedWallet(t, repo, 1)
+	err = repo.ProcessTransaction(ctx, rich, math.MaxInt64, true)
+	assert.ErrorIs(t, err, model.ErrInvalidAmount)
+
+	_, err = store.GetOverdraft(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+	_, err = store.SetOverdraft(ctx, uuid.NewString(), 100, 0, date(2025, time.March, 1))
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func testOverdraftFees(t *testing.T, repo repository.WalletRepository) {
+	ctx := context.Background()
+	store := overdraftStore(t, repo)
+	walletID := createFundedWallet(t, repo, 0)
+
+	o, err := store.SetOverdraft(ctx, walletID, 100, 30, date(2025, time.March, 1))
+	require.NoError(t, err)
+	require.NotNil(t, o.FeesChargedThrough)
+	assert.Equal(t, date(2025, time.February, 28), *o.FeesChargedThrough)
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 80, false))
+
+	_, due := dueOverdraft(t, store, walletID, date(2025, time.February, 28))
+	assert.False(t, due, "Charged through the day")
+	o, due = dueOverdraft(t, store, walletID, date(2025, time.March, 2))
+	require.True(t, due)
+	assert.Equal(t, int64(-80), o.Balance)
+	assert.Equal(t, int64(30), o.DailyFee)
+
+	// A day past the next is rejected
+	_, err = store.ChargeOverdraftFee(ctx, model.OverdraftCharge{WalletID: walletID, Day: date(2025, time.March, 2), Balance: -80, Amount: 30})
+	assert.ErrorIs(t, err, repository.ErrOverdraftFeeChanged)
+
+	// The fee is capped at the credit left
+	fee, err := store.ChargeOverdraftFee(ctx, model.OverdraftCharge{WalletID: walletID, Day: date(2025, time.March, 1), Balance: -80, Amount: 30})
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), fee.Amount)
+	assert.NotZero(t, fee.LedgerEntryID)
+
+	_, err = store.ChargeOverdraftFee(ctx, model.OverdraftCharge{WalletID: walletID, Day: date(2025, time.March, 1), Balance: -80, Amount: 30})
+	assert.ErrorIs(t, err, repository.ErrOverdraftFeeChanged, "Charged twice")
+
+	// With no credit left the day is charged nothing
+	fee, err = store.ChargeOverdraftFee(ctx, model.OverdraftCharge{WalletID: walletID, Day: date(2025, time.March, 2), Balance: -100, Amount: 30})
+	require.NoError(t, err)
+	assert.Zero(t, fee.Amount)
+	assert.Zero(t, fee.LedgerEntryID)
+
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-100), balance)
+
+	history, err := repo.GetHistory(ctx, walletID, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, model.OverdraftFee, history[0].OperationType)
+	assert.Equal(t, int64(-20), history[0].Amount)
+
+	fees, err := store.OverdraftFees(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, fees, 1)
+	assert.Equal(t, date(2025, time.March, 1), fees[0].Day)
+	assert.Equal(t, int64(-80), fees[0].Balance)
+	assert.Equal(t, int64(20), fees[0].Amount)
+	assert.Equal(t, history[0].ID, fees[0].LedgerEntryID)
+	assert.False(t, fees[0].ChargedAt.IsZero())
+
+	_, due = dueOverdraft(t, store, walletID, date(2025, time.March, 2))
+	assert.False(t, due)
+
+	// Without a fee nothing is due, a new fee is charged from its first day
+	_, err = store.SetOverdraft(ctx, walletID, 100, 0, date(2025, time.March, 3))
+	require.NoError(t, err)
+	_, due = dueOverdraft(t, store, walletID, date(2025, time.March, 10))
+	assert.False(t, due)
+	o, err = store.SetOverdraft(ctx, walletID, 100, 10, date(2025, time.March, 10))
+	require.NoError(t, err)
+	assert.Equal(t, date(2025, time.March, 9), *o.FeesChargedThrough)
+
+	_, err = store.OverdraftFees(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
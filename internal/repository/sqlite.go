@@ -0,0 +1,1265 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"WalletApi/internal/model"
+
+	"github.com/google/uuid"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type SQLiteRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteRepository(db *sql.DB) *SQLiteRepository {
+	return &SQLiteRepository{db: db}
+}
+
+// OpenSQLite opens the database file at path. Every transaction is started
+// with BEGIN IMMEDIATE, so the write lock is taken before the balance is read,
+// which mirrors SELECT ... FOR UPDATE in PostgreSQL.
+func OpenSQLite(path string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Set("_txlock", "immediate")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(ON)")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	return db, nil
+}
+
+func (r *SQLiteRepository) CreateWallet(ctx context.Context) (string, error) {
+	walletID := uuid.NewString()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO wallets (id, balance) VALUES (?, 0)",
+		walletID,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create wallet: %v", err)
+	}
+
+	return walletID, nil
+}
+
+func (r *SQLiteRepository) ProcessTransaction(ctx context.Context, walletID string, amount int64, isDeposit bool) error {
+	return r.processTransaction(ctx, walletID, amount, isDeposit, "")
+}
+
+func (r *SQLiteRepository) ProcessTransactionOnce(ctx context.Context, walletID string, amount int64, isDeposit bool, reference string) error {
+	return r.processTransaction(ctx, walletID, amount, isDeposit, reference)
+}
+
+func (r *SQLiteRepository) processTransaction(ctx context.Context, walletID string, amount int64, isDeposit bool, reference string) error {
+	// Validation of the amount
+	if amount <= 0 {
+		return model.ErrInvalidAmount
+	}
+
+	delta := amount
+	if !isDeposit {
+		delta = -amount
+	}
+
+	// The connection is opened with _txlock=immediate, so this is BEGIN IMMEDIATE
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := applySQLite(ctx, tx, walletID, operationType(isDeposit), delta, "", reference); err != nil {
+		return err
+	}
+
+	// Fixing the transaction
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return nil
+}
+
+// applySQLite changes the balance by delta and records the ledger entry within
+// tx, which holds the write lock, and returns the ID of the entry. A non-empty
+// reference must not have been applied yet.
+func applySQLite(ctx context.Context, tx *sql.Tx, walletID string, operation model.OperationType, delta int64, reason, reference string) (int64, error) {
+	// 1. Getting the current balance
+	var balance, creditLimit int64
+	var frozen bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT balance, credit_limit, frozen FROM wallets WHERE id = ?",
+		walletID,
+	).Scan(&balance, &creditLimit, &frozen)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, model.ErrWalletNotFound
+		}
+		return 0, fmt.Errorf("failed to get balance: %w", err)
+	}
+	if frozen {
+		return 0, model.ErrWalletFrozen
+	}
+	if reference != "" {
+		// References are unique across wallets, the write lock keeps any other
+		// transaction from applying the same one until this one commits
+		var applied bool
+		err := tx.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM ledger_entries WHERE reference = ?)",
+			reference,
+		).Scan(&applied)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check reference: %w", err)
+		}
+		if applied {
+			return 0, model.ErrDuplicateReference
+		}
+	}
+
+	// 2. We check whether there are enough funds to debit, the credit line included
+	if err := checkFunds(balance, creditLimit, delta); err != nil {
+		return 0, err
+	}
+
+	// 3. Calculating the new balance
+	newBalance := balance + delta
+
+	// 4. Updating the balance
+	_, err = tx.ExecContext(ctx,
+		"UPDATE wallets SET balance = ? WHERE id = ?",
+		newBalance,
+		walletID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("balance update failed: %w", err)
+	}
+
+	// 5. Recording the ledger entry
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO ledger_entries (wallet_id, operation_type, amount, reason, reference, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		walletID,
+		operation,
+		delta,
+		nullString(reason),
+		nullString(reference),
+		time.Now().UnixNano(),
+	)
+	if isSQLiteReferenceConflict(err) {
+		return 0, model.ErrDuplicateReference
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ledger entry insert failed: %w", err)
+	}
+
+	return res.LastInsertId()
+}
+
+// isSQLiteReferenceConflict reports whether err violates the unique index on
+// ledger entry references.
+func isSQLiteReferenceConflict(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE &&
+		strings.Contains(sqliteErr.Error(), "ledger_entries.reference")
+}
+
+func (r *SQLiteRepository) GetBalance(ctx context.Context, walletID string) (int64, error) {
+	var balance int64
+	err := r.db.QueryRowContext(ctx,
+		"SELECT balance FROM wallets WHERE id = ?",
+		walletID,
+	).Scan(&balance)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, model.ErrWalletNotFound
+		}
+		return 0, err
+	}
+	return balance, nil
+}
+
+func (r *SQLiteRepository) GetHistory(ctx context.Context, walletID string, limit int) ([]model.LedgerEntry, error) {
+	if _, err := r.GetBalance(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, wallet_id, operation_type, amount, COALESCE(reason, ''), created_at
+		FROM ledger_entries WHERE wallet_id = ? ORDER BY id DESC`
+	args := []interface{}{walletID}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []model.LedgerEntry{}
+	for rows.Next() {
+		var e model.LedgerEntry
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &e.WalletID, &e.OperationType, &e.Amount, &e.Reason, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		e.CreatedAt = time.Unix(0, createdAt).UTC()
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+func (r *SQLiteRepository) BalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error) {
+	var exists bool
+	var balance int64
+	err := r.db.QueryRowContext(ctx, `
+		WITH snapshot AS (
+			SELECT entry_id, balance FROM balance_snapshots
+			WHERE wallet_id = ?1 AND created_at <= ?2
+			ORDER BY created_at DESC, entry_id DESC
+			LIMIT 1
+		)
+		SELECT
+			EXISTS (SELECT 1 FROM wallets WHERE id = ?1),
+			COALESCE((SELECT balance FROM snapshot), 0) + COALESCE((
+				SELECT SUM(amount) FROM ledger_entries
+				WHERE wallet_id = ?1 AND created_at <= ?2 AND id > COALESCE((SELECT entry_id FROM snapshot), 0)
+			), 0)`,
+		walletID,
+		at.UnixNano(),
+	).Scan(&exists, &balance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute balance: %w", err)
+	}
+	if !exists {
+		return 0, model.ErrWalletNotFound
+	}
+	return balance, nil
+}
+
+// StreamStatement reads the opening balance and the entries with two statements
+// outside of a transaction, which would take the write lock. Both split the
+// entries on from, so an entry committed in between is in neither, and the
+// running balance still adds up to the closing one.
+func (r *SQLiteRepository) StreamStatement(ctx context.Context, walletID string, from, to time.Time, opening func(int64) error, entry func(model.LedgerEntry) error) error {
+	balance, err := r.BalanceAt(ctx, walletID, from)
+	if err != nil {
+		return err
+	}
+	if err := opening(balance); err != nil {
+		return err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, wallet_id, operation_type, amount, COALESCE(reason, ''), created_at
+		FROM ledger_entries
+		WHERE wallet_id = ? AND created_at > ? AND created_at <= ?
+		ORDER BY created_at, id`,
+		walletID,
+		from.UnixNano(),
+		to.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get statement entries: %w", err)
+	}
+	return scanSQLiteEntries(rows, entry)
+}
+
+func (r *SQLiteRepository) StreamLedger(ctx context.Context, afterID int64, before time.Time, fn func(model.LedgerEntry) error) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, wallet_id, operation_type, amount, COALESCE(reason, ''), created_at
+		FROM ledger_entries
+		WHERE id > ?
+		ORDER BY id`,
+		afterID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get ledger entries: %w", err)
+	}
+	err = scanSQLiteEntries(rows, stopAfter(before, fn))
+	if errors.Is(err, errStopStream) {
+		return nil
+	}
+	return err
+}
+
+func (r *SQLiteRepository) LeaseExport(ctx context.Context, owner string, now time.Time, lease time.Duration) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO export_lease (id, owner, lease_until) VALUES (1, ?1, ?2)
+		ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, lease_until = excluded.lease_until
+		WHERE export_lease.owner = excluded.owner OR export_lease.lease_until <= ?3`,
+		owner,
+		now.Add(lease).UnixNano(),
+		now.UnixNano(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to lease the export: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *SQLiteRepository) ReleaseExport(ctx context.Context, owner string) error {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM export_lease WHERE owner = ?", owner); err != nil {
+		return fmt.Errorf("failed to release the export lease: %w", err)
+	}
+	return nil
+}
+
+// scanSQLiteEntries calls fn with every ledger entry of rows and closes them.
+func scanSQLiteEntries(rows *sql.Rows, fn func(model.LedgerEntry) error) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var e model.LedgerEntry
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &e.WalletID, &e.OperationType, &e.Amount, &e.Reason, &createdAt); err != nil {
+			return fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		e.CreatedAt = time.Unix(0, createdAt).UTC()
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *SQLiteRepository) SnapshotBalances(ctx context.Context, afterID string, limit int) (string, int, error) {
+	var lastID sql.NullString
+	err := r.db.QueryRowContext(ctx,
+		"SELECT MAX(id) FROM (SELECT id FROM wallets WHERE id > ? ORDER BY id LIMIT ?)",
+		afterID,
+		sqliteLimit(limit),
+	).Scan(&lastID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to select wallets: %w", err)
+	}
+	if !lastID.Valid {
+		return "", 0, nil
+	}
+
+	// Only the entries since the latest snapshot of each wallet are summed
+	res, err := r.db.ExecContext(ctx, `
+		WITH latest AS (
+			SELECT s.wallet_id, s.entry_id, s.balance
+			FROM balance_snapshots s
+			WHERE s.wallet_id > ?1 AND s.wallet_id <= ?2
+				AND s.entry_id = (SELECT MAX(entry_id) FROM balance_snapshots WHERE wallet_id = s.wallet_id)
+		), delta AS (
+			SELECT e.wallet_id, MAX(e.id) AS entry_id, SUM(e.amount) AS amount
+			FROM ledger_entries e
+			LEFT JOIN latest s ON s.wallet_id = e.wallet_id
+			WHERE e.wallet_id > ?1 AND e.wallet_id <= ?2 AND e.id > COALESCE(s.entry_id, 0)
+			GROUP BY e.wallet_id
+		)
+		INSERT OR IGNORE INTO balance_snapshots (wallet_id, entry_id, balance, created_at, taken_at)
+		SELECT d.wallet_id, d.entry_id, COALESCE(s.balance, 0) + d.amount, e.created_at, ?3
+		FROM delta d
+		JOIN ledger_entries e ON e.id = d.entry_id
+		LEFT JOIN latest s ON s.wallet_id = d.wallet_id`,
+		afterID,
+		lastID.String,
+		time.Now().UnixNano(),
+	)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+	taken, err := res.RowsAffected()
+	if err != nil {
+		return "", 0, err
+	}
+	return lastID.String, int(taken), nil
+}
+
+func (r *SQLiteRepository) GetWallet(ctx context.Context, walletID string) (model.Wallet, error) {
+	w := model.Wallet{ID: walletID}
+	err := r.db.QueryRowContext(ctx,
+		"SELECT balance, frozen, credit_limit FROM wallets WHERE id = ?",
+		walletID,
+	).Scan(&w.Balance, &w.Frozen, &w.CreditLimit)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Wallet{}, model.ErrWalletNotFound
+		}
+		return model.Wallet{}, fmt.Errorf("failed to get wallet: %w", err)
+	}
+	return w, nil
+}
+
+func (r *SQLiteRepository) SetFrozen(ctx context.Context, walletID string, frozen bool) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE wallets SET frozen = ? WHERE id = ?",
+		frozen,
+		walletID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update wallet: %w", err)
+	}
+	return checkUpdated(res)
+}
+
+func (r *SQLiteRepository) RequestAdjustment(ctx context.Context, req model.AdjustmentRequest) (model.AdjustmentRequest, error) {
+	a, err := newAdjustment(req, time.Now().UTC())
+	if err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO adjustments (id, wallet_id, amount, reason_code, justification, status, requested_by, requested_at, expires_at)
+		SELECT ?, id, ?, ?, ?, ?, ?, ?, ? FROM wallets WHERE id = ?`,
+		a.ID, a.Amount, a.ReasonCode, a.Justification, a.Status, a.RequestedBy,
+		a.RequestedAt.UnixNano(), a.ExpiresAt.UnixNano(), a.WalletID,
+	)
+	if err != nil {
+		return model.AdjustmentRequest{}, fmt.Errorf("failed to insert adjustment: %w", err)
+	}
+	if err := checkUpdated(res); err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	return a, nil
+}
+
+const sqliteAdjustmentColumns = `id, wallet_id, amount, reason_code, justification, status,
+	requested_by, requested_at, expires_at, decided_by, decided_at, ledger_entry_id`
+
+func scanSQLiteAdjustment(row interface{ Scan(...any) error }) (model.AdjustmentRequest, error) {
+	var a model.AdjustmentRequest
+	var requestedAt, expiresAt int64
+	var decidedBy sql.NullString
+	var decidedAt, entryID sql.NullInt64
+	err := row.Scan(&a.ID, &a.WalletID, &a.Amount, &a.ReasonCode, &a.Justification, &a.Status,
+		&a.RequestedBy, &requestedAt, &expiresAt, &decidedBy, &decidedAt, &entryID)
+	if err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	a.RequestedAt = time.Unix(0, requestedAt).UTC()
+	a.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	a.DecidedBy = decidedBy.String
+	if decidedAt.Valid {
+		t := time.Unix(0, decidedAt.Int64).UTC()
+		a.DecidedAt = &t
+	}
+	a.LedgerEntryID = entryID.Int64
+	return a, nil
+}
+
+func (r *SQLiteRepository) PendingAdjustments(ctx context.Context) ([]model.AdjustmentRequest, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+sqliteAdjustmentColumns+" FROM adjustments WHERE status = ? AND expires_at > ? ORDER BY requested_at, id",
+		model.AdjustmentPending,
+		time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list adjustments: %w", err)
+	}
+	defer rows.Close()
+
+	pending := []model.AdjustmentRequest{}
+	for rows.Next() {
+		a, err := scanSQLiteAdjustment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan adjustment: %w", err)
+		}
+		pending = append(pending, a)
+	}
+	return pending, rows.Err()
+}
+
+func (r *SQLiteRepository) ApproveAdjustment(ctx context.Context, id, approver string) (model.AdjustmentRequest, error) {
+	return r.decideAdjustment(ctx, id, approver, true)
+}
+
+func (r *SQLiteRepository) RejectAdjustment(ctx context.Context, id, operator string) (model.AdjustmentRequest, error) {
+	return r.decideAdjustment(ctx, id, operator, false)
+}
+
+func (r *SQLiteRepository) decideAdjustment(ctx context.Context, id, operator string, approve bool) (model.AdjustmentRequest, error) {
+	// BEGIN IMMEDIATE, concurrent decisions on the same adjustment wait for each other
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.AdjustmentRequest{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	a, err := scanSQLiteAdjustment(tx.QueryRowContext(ctx,
+		"SELECT "+sqliteAdjustmentColumns+" FROM adjustments WHERE id = ?", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.AdjustmentRequest{}, model.ErrAdjustmentNotFound
+		}
+		return model.AdjustmentRequest{}, fmt.Errorf("failed to get adjustment: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if err := decideAdjustment(a, operator, approve, now); err != nil {
+		if errors.Is(err, model.ErrAdjustmentExpired) {
+			a.Status = model.AdjustmentExpired
+			if err := updateSQLiteAdjustment(ctx, tx, a); err != nil {
+				return model.AdjustmentRequest{}, err
+			}
+			if err := tx.Commit(); err != nil {
+				return model.AdjustmentRequest{}, fmt.Errorf("transaction commit failed: %w", err)
+			}
+		}
+		return model.AdjustmentRequest{}, err
+	}
+
+	a.Status = model.AdjustmentRejected
+	if approve {
+		entryID, err := applySQLite(ctx, tx, a.WalletID, model.Adjustment, a.Amount, a.LedgerReason(), "")
+		if err != nil {
+			return model.AdjustmentRequest{}, err
+		}
+		a.Status = model.AdjustmentApproved
+		a.LedgerEntryID = entryID
+	}
+	a.DecidedBy = strings.TrimSpace(operator)
+	a.DecidedAt = &now
+
+	if err := updateSQLiteAdjustment(ctx, tx, a); err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.AdjustmentRequest{}, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return a, nil
+}
+
+func updateSQLiteAdjustment(ctx context.Context, tx *sql.Tx, a model.AdjustmentRequest) error {
+	var entryID sql.NullInt64
+	if a.LedgerEntryID != 0 {
+		entryID = sql.NullInt64{Int64: a.LedgerEntryID, Valid: true}
+	}
+	var decidedAt sql.NullInt64
+	if a.DecidedAt != nil {
+		decidedAt = sql.NullInt64{Int64: a.DecidedAt.UnixNano(), Valid: true}
+	}
+
+	_, err := tx.ExecContext(ctx,
+		"UPDATE adjustments SET status = ?, decided_by = ?, decided_at = ?, ledger_entry_id = ? WHERE id = ?",
+		a.Status, nullString(a.DecidedBy), decidedAt, entryID, a.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update adjustment: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) CheckBalances(ctx context.Context, afterID string, limit int) ([]model.BalanceCheck, error) {
+	// Only the wallets of the chunk are aggregated, each chunk is a short read
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT w.id, w.balance, COALESCE(SUM(e.amount), 0)
+		FROM (SELECT id, balance FROM wallets WHERE id > ? ORDER BY id LIMIT ?) w
+		LEFT JOIN ledger_entries e ON e.wallet_id = w.id
+		GROUP BY w.id, w.balance
+		ORDER BY w.id`,
+		afterID,
+		sqliteLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check balances: %w", err)
+	}
+	return scanBalanceChecks(rows)
+}
+
+func (r *SQLiteRepository) ReportDrift(ctx context.Context, check model.BalanceCheck, frozen bool) error {
+	now := time.Now().UnixNano()
+	// The WHERE clause keeps SQLite from reading ON CONFLICT as a join constraint
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO balance_drifts (wallet_id, balance, ledger_balance, drift, detected_at, last_seen_at, frozen)
+		SELECT id, ?, ?, ?, ?, ?, ? FROM wallets WHERE id = ?
+		ON CONFLICT (wallet_id, drift) DO UPDATE SET
+			balance = excluded.balance,
+			ledger_balance = excluded.ledger_balance,
+			last_seen_at = excluded.last_seen_at,
+			frozen = balance_drifts.frozen OR excluded.frozen`,
+		check.Balance,
+		check.LedgerBalance,
+		check.Drift(),
+		now,
+		now,
+		frozen,
+		check.WalletID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record balance drift: %w", err)
+	}
+	return checkUpdated(res)
+}
+
+func (r *SQLiteRepository) DriftReports(ctx context.Context, limit int) ([]model.DriftReport, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, wallet_id, balance, ledger_balance, detected_at, last_seen_at, frozen
+		FROM balance_drifts ORDER BY last_seen_at DESC, id DESC LIMIT ?`,
+		sqliteLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list balance drifts: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []model.DriftReport{}
+	for rows.Next() {
+		var d model.DriftReport
+		var detectedAt, lastSeenAt int64
+		if err := rows.Scan(&d.ID, &d.WalletID, &d.Balance, &d.LedgerBalance, &detectedAt, &lastSeenAt, &d.Frozen); err != nil {
+			return nil, fmt.Errorf("failed to scan balance drift: %w", err)
+		}
+		d.DetectedAt = time.Unix(0, detectedAt).UTC()
+		d.LastSeenAt = time.Unix(0, lastSeenAt).UTC()
+		reports = append(reports, d)
+	}
+	return reports, rows.Err()
+}
+
+func (r *SQLiteRepository) CreateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error) {
+	s = newSchedule(s, time.Now().UTC())
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO schedules (id, wallet_id, operation_type, amount, recurrence, start_at, end_at, status,
+			next_run_at, due_at, attempts, version, created_at, updated_at)
+		SELECT ?, id, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM wallets WHERE id = ?`,
+		s.ID, s.OperationType, s.Amount, s.Recurrence, s.StartAt.UnixNano(), sqliteTime(s.EndAt), s.Status,
+		sqliteTime(s.NextRunAt), sqliteTime(s.DueAt), s.Attempts, s.Version, s.CreatedAt.UnixNano(), s.UpdatedAt.UnixNano(),
+		s.WalletID,
+	)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("failed to insert schedule: %w", err)
+	}
+	if err := checkUpdated(res); err != nil {
+		return model.Schedule{}, err
+	}
+	return s, nil
+}
+
+const sqliteScheduleColumns = `id, wallet_id, operation_type, amount, recurrence, start_at, end_at, status,
+	next_run_at, due_at, attempts, version, created_at, updated_at`
+
+func scanSQLiteSchedule(row interface{ Scan(...any) error }) (model.Schedule, error) {
+	var s model.Schedule
+	var startAt, createdAt, updatedAt int64
+	var endAt, nextRunAt, dueAt sql.NullInt64
+	err := row.Scan(&s.ID, &s.WalletID, &s.OperationType, &s.Amount, &s.Recurrence, &startAt, &endAt, &s.Status,
+		&nextRunAt, &dueAt, &s.Attempts, &s.Version, &createdAt, &updatedAt)
+	if err != nil {
+		return model.Schedule{}, err
+	}
+	s.StartAt = time.Unix(0, startAt).UTC()
+	s.EndAt = sqliteTimePtr(endAt)
+	s.NextRunAt = sqliteTimePtr(nextRunAt)
+	s.DueAt = sqliteTimePtr(dueAt)
+	s.CreatedAt = time.Unix(0, createdAt).UTC()
+	s.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return s, nil
+}
+
+func scanSQLiteSchedules(rows *sql.Rows) ([]model.Schedule, error) {
+	defer rows.Close()
+
+	schedules := []model.Schedule{}
+	for rows.Next() {
+		s, err := scanSQLiteSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+func (r *SQLiteRepository) GetSchedule(ctx context.Context, walletID, id string) (model.Schedule, error) {
+	s, err := scanSQLiteSchedule(r.db.QueryRowContext(ctx,
+		"SELECT "+sqliteScheduleColumns+" FROM schedules WHERE id = ? AND wallet_id = ?", id, walletID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Schedule{}, model.ErrScheduleNotFound
+		}
+		return model.Schedule{}, fmt.Errorf("failed to get schedule: %w", err)
+	}
+	return s, nil
+}
+
+func (r *SQLiteRepository) ListSchedules(ctx context.Context, walletID string) ([]model.Schedule, error) {
+	if _, err := r.GetBalance(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+sqliteScheduleColumns+" FROM schedules WHERE wallet_id = ? ORDER BY created_at, id", walletID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	return scanSQLiteSchedules(rows)
+}
+
+func (r *SQLiteRepository) UpdateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error) {
+	return updateSQLiteSchedule(ctx, r.db, s, false)
+}
+
+// updateSQLiteSchedule stores the mutable fields of s if its version is the
+// stored one, and ends the lease if endLease is set.
+func updateSQLiteSchedule(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, s model.Schedule, endLease bool) (model.Schedule, error) {
+	stored, err := scanSQLiteSchedule(db.QueryRowContext(ctx, `
+		UPDATE schedules SET amount = ?, end_at = ?, status = ?, next_run_at = ?, due_at = ?, attempts = ?,
+			lease_until = CASE WHEN ? THEN NULL ELSE lease_until END, version = version + 1, updated_at = ?
+		WHERE id = ? AND version = ?
+		RETURNING `+sqliteScheduleColumns,
+		s.Amount, sqliteTime(s.EndAt), s.Status, sqliteTime(s.NextRunAt), sqliteTime(s.DueAt), s.Attempts,
+		endLease, time.Now().UnixNano(), s.ID, s.Version,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Schedule{}, ErrScheduleChanged
+		}
+		return model.Schedule{}, fmt.Errorf("failed to update schedule: %w", err)
+	}
+	return stored, nil
+}
+
+// ClaimDueSchedules leases the schedules with a single statement, which SQLite
+// runs under the write lock.
+func (r *SQLiteRepository) ClaimDueSchedules(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Schedule, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		UPDATE schedules SET lease_until = ?1, version = version + 1
+		WHERE id IN (
+			SELECT id FROM schedules
+			WHERE status = ?2 AND due_at <= ?3 AND (lease_until IS NULL OR lease_until <= ?3)
+			ORDER BY due_at, id
+			LIMIT ?4
+		)
+		RETURNING `+sqliteScheduleColumns,
+		now.Add(lease).UnixNano(),
+		model.ScheduleActive,
+		now.UnixNano(),
+		sqliteLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim schedules: %w", err)
+	}
+	schedules, err := scanSQLiteSchedules(rows)
+	if err != nil {
+		return nil, err
+	}
+	sortDue(schedules)
+	return schedules, nil
+}
+
+func (r *SQLiteRepository) FinishScheduleRun(ctx context.Context, s model.Schedule, run model.ScheduleRun) (model.Schedule, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A schedule changed meanwhile is left as it is, the run is recorded all the same
+	stored, err := updateSQLiteSchedule(ctx, tx, s, true)
+	changed := errors.Is(err, ErrScheduleChanged)
+	if err != nil && !changed {
+		return model.Schedule{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO schedule_runs (schedule_id, occurrence, attempt, status, error_code, started_at, finished_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+		ON CONFLICT (schedule_id, occurrence, attempt) DO UPDATE SET
+			status = excluded.status, error_code = excluded.error_code,
+			started_at = excluded.started_at, finished_at = excluded.finished_at
+		WHERE excluded.status = ?8`,
+		s.ID, run.Occurrence.UnixNano(), run.Attempt, run.Status, nullString(run.ErrorCode),
+		run.StartedAt.UnixNano(), run.FinishedAt.UnixNano(), model.RunSucceeded,
+	)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("failed to insert schedule run: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Schedule{}, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	if changed {
+		return model.Schedule{}, ErrScheduleChanged
+	}
+	return stored, nil
+}
+
+func (r *SQLiteRepository) ScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]model.ScheduleRun, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, schedule_id, occurrence, attempt, status, COALESCE(error_code, ''), started_at, finished_at
+		FROM schedule_runs WHERE schedule_id = ? ORDER BY id DESC LIMIT ?`,
+		scheduleID,
+		sqliteLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedule runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []model.ScheduleRun{}
+	for rows.Next() {
+		var run model.ScheduleRun
+		var occurrence, startedAt, finishedAt int64
+		if err := rows.Scan(&run.ID, &run.ScheduleID, &occurrence, &run.Attempt, &run.Status, &run.ErrorCode, &startedAt, &finishedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule run: %w", err)
+		}
+		run.Occurrence = time.Unix(0, occurrence).UTC()
+		run.StartedAt = time.Unix(0, startedAt).UTC()
+		run.FinishedAt = time.Unix(0, finishedAt).UTC()
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (r *SQLiteRepository) CreateInterestProduct(ctx context.Context, p model.InterestProduct) (model.InterestProduct, error) {
+	p = newInterestProduct(p, time.Now().UTC())
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO interest_products (id, name, annual_rate_bps, day_count, rounding, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		p.ID, p.Name, p.AnnualRateBps, p.DayCount, p.Rounding, p.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return model.InterestProduct{}, fmt.Errorf("failed to insert interest product: %w", err)
+	}
+	return p, nil
+}
+
+const sqliteInterestProductColumns = "id, name, annual_rate_bps, day_count, rounding, created_at"
+
+func (r *SQLiteRepository) InterestProducts(ctx context.Context) ([]model.InterestProduct, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+sqliteInterestProductColumns+" FROM interest_products ORDER BY created_at, id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interest products: %w", err)
+	}
+	defer rows.Close()
+
+	products := []model.InterestProduct{}
+	for rows.Next() {
+		var p model.InterestProduct
+		var createdAt int64
+		if err := rows.Scan(&p.ID, &p.Name, &p.AnnualRateBps, &p.DayCount, &p.Rounding, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan interest product: %w", err)
+		}
+		p.CreatedAt = time.Unix(0, createdAt).UTC()
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+func (r *SQLiteRepository) AssignInterestProduct(ctx context.Context, walletID, productID string, from time.Time) (model.InterestAccount, error) {
+	// BEGIN IMMEDIATE, the checks hold until the account is written
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var walletExists, productExists bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM wallets WHERE id = ?), EXISTS (SELECT 1 FROM interest_products WHERE id = ?)",
+		walletID, productID,
+	).Scan(&walletExists, &productExists)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to check interest product: %w", err)
+	}
+	if !walletExists {
+		return model.InterestAccount{}, model.ErrWalletNotFound
+	}
+	if !productExists {
+		return model.InterestAccount{}, model.ErrInterestProductNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO interest_accounts (wallet_id, product_id, accrued_through, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (wallet_id) DO UPDATE SET product_id = excluded.product_id, updated_at = excluded.updated_at`,
+		walletID, productID, from.UTC().AddDate(0, 0, -1).UnixNano(), time.Now().UnixNano(),
+	)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to assign interest product: %w", err)
+	}
+	account, err := getSQLiteInterestAccount(ctx, tx, walletID)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.InterestAccount{}, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return account, nil
+}
+
+const sqliteInterestAccountQuery = `
+	SELECT a.wallet_id, a.accrued_through, a.accrued_units, a.accrued_fraction, a.updated_at,
+		p.id, p.name, p.annual_rate_bps, p.day_count, p.rounding, p.created_at
+	FROM interest_accounts a JOIN interest_products p ON p.id = a.product_id`
+
+func scanSQLiteInterestAccount(row interface{ Scan(...any) error }) (model.InterestAccount, error) {
+	var a model.InterestAccount
+	var accruedThrough, updatedAt, createdAt int64
+	err := row.Scan(&a.WalletID, &accruedThrough, &a.AccruedUnits, &a.AccruedFraction, &updatedAt,
+		&a.Product.ID, &a.Product.Name, &a.Product.AnnualRateBps, &a.Product.DayCount, &a.Product.Rounding, &createdAt)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	a.AccruedThrough = time.Unix(0, accruedThrough).UTC()
+	a.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	a.Product.CreatedAt = time.Unix(0, createdAt).UTC()
+	return a, nil
+}
+
+func getSQLiteInterestAccount(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, walletID string) (model.InterestAccount, error) {
+	a, err := scanSQLiteInterestAccount(db.QueryRowContext(ctx, sqliteInterestAccountQuery+" WHERE a.wallet_id = ?", walletID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.InterestAccount{}, model.ErrInterestNotAssigned
+		}
+		return model.InterestAccount{}, fmt.Errorf("failed to get interest account: %w", err)
+	}
+	return a, nil
+}
+
+func (r *SQLiteRepository) GetInterestAccount(ctx context.Context, walletID string) (model.InterestAccount, error) {
+	if _, err := r.GetBalance(ctx, walletID); err != nil {
+		return model.InterestAccount{}, err
+	}
+	return getSQLiteInterestAccount(ctx, r.db, walletID)
+}
+
+func (r *SQLiteRepository) DueInterestAccounts(ctx context.Context, afterID string, through time.Time, limit int) ([]model.InterestAccount, error) {
+	rows, err := r.db.QueryContext(ctx,
+		sqliteInterestAccountQuery+" WHERE a.wallet_id > ? AND a.accrued_through < ? ORDER BY a.wallet_id LIMIT ?",
+		afterID, through.UnixNano(), sqliteLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list due interest accounts: %w", err)
+	}
+	defer rows.Close()
+
+	accounts := []model.InterestAccount{}
+	for rows.Next() {
+		a, err := scanSQLiteInterestAccount(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan interest account: %w", err)
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+func (r *SQLiteRepository) AccrueInterest(ctx context.Context, accrual model.InterestAccrual, posting *model.InterestPosting) (model.InterestAccount, error) {
+	// BEGIN IMMEDIATE, concurrent accruals of the wallet wait for each other
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	account, err := getSQLiteInterestAccount(ctx, tx, accrual.WalletID)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+	account, err = accrueInto(account, accrual, posting)
+	if err != nil {
+		return model.InterestAccount{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO interest_accruals (wallet_id, day, product_id, annual_rate_bps, day_count, balance, units, fraction)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		accrual.WalletID, accrual.Day.UnixNano(), accrual.ProductID, accrual.AnnualRateBps, accrual.DayCount,
+		accrual.Balance, accrual.Units, accrual.Fraction,
+	)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to insert interest accrual: %w", err)
+	}
+
+	if posting != nil {
+		var entryID sql.NullInt64
+		if posting.Amount > 0 {
+			id, err := applySQLite(ctx, tx, posting.WalletID, model.Interest, posting.Amount, "", posting.Reference())
+			if err != nil {
+				return model.InterestAccount{}, err
+			}
+			entryID = sql.NullInt64{Int64: id, Valid: true}
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO interest_postings (wallet_id, period, accrued_units, accrued_fraction, rounding, amount, ledger_entry_id, posted_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			posting.WalletID, posting.Period, posting.AccruedUnits, posting.AccruedFraction, posting.Rounding,
+			posting.Amount, entryID, time.Now().UnixNano(),
+		)
+		if err != nil {
+			return model.InterestAccount{}, fmt.Errorf("failed to insert interest posting: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE interest_accounts SET accrued_through = ?, accrued_units = ?, accrued_fraction = ?, updated_at = ?
+		WHERE wallet_id = ?`,
+		account.AccruedThrough.UnixNano(), account.AccruedUnits, account.AccruedFraction, account.UpdatedAt.UnixNano(),
+		account.WalletID,
+	)
+	if err != nil {
+		return model.InterestAccount{}, fmt.Errorf("failed to update interest account: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return model.InterestAccount{}, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return account, nil
+}
+
+func (r *SQLiteRepository) InterestAccruals(ctx context.Context, walletID string) ([]model.InterestAccrual, error) {
+	if _, err := r.GetBalance(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT wallet_id, day, product_id, annual_rate_bps, day_count, balance, units, fraction
+		FROM interest_accruals WHERE wallet_id = ? ORDER BY day`,
+		walletID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interest accruals: %w", err)
+	}
+	defer rows.Close()
+
+	accruals := []model.InterestAccrual{}
+	for rows.Next() {
+		var a model.InterestAccrual
+		var day int64
+		if err := rows.Scan(&a.WalletID, &day, &a.ProductID, &a.AnnualRateBps, &a.DayCount, &a.Balance, &a.Units, &a.Fraction); err != nil {
+			return nil, fmt.Errorf("failed to scan interest accrual: %w", err)
+		}
+		a.Day = time.Unix(0, day).UTC()
+		accruals = append(accruals, a)
+	}
+	return accruals, rows.Err()
+}
+
+func (r *SQLiteRepository) InterestPostings(ctx context.Context, walletID string) ([]model.InterestPosting, error) {
+	if _, err := r.GetBalance(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT wallet_id, period, accrued_units, accrued_fraction, rounding, amount, COALESCE(ledger_entry_id, 0), posted_at
+		FROM interest_postings WHERE wallet_id = ? ORDER BY period`,
+		walletID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interest postings: %w", err)
+	}
+	defer rows.Close()
+
+	postings := []model.InterestPosting{}
+	for rows.Next() {
+		var p model.InterestPosting
+		var postedAt int64
+		if err := rows.Scan(&p.WalletID, &p.Period, &p.AccruedUnits, &p.AccruedFraction, &p.Rounding, &p.Amount, &p.LedgerEntryID, &postedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan interest posting: %w", err)
+		}
+		p.PostedAt = time.Unix(0, postedAt).UTC()
+		postings = append(postings, p)
+	}
+	return postings, rows.Err()
+}
+
+const sqliteOverdraftQuery = "SELECT id, balance, credit_limit, overdraft_fee, overdraft_fees_through FROM wallets"
+
+func scanSQLiteOverdraft(row interface{ Scan(...any) error }) (model.Overdraft, error) {
+	var o model.Overdraft
+	var feesThrough sql.NullInt64
+	if err := row.Scan(&o.WalletID, &o.Balance, &o.CreditLimit, &o.DailyFee, &feesThrough); err != nil {
+		return model.Overdraft{}, err
+	}
+	o.FeesChargedThrough = sqliteTimePtr(feesThrough)
+	return o, nil
+}
+
+func getSQLiteOverdraft(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, walletID string) (model.Overdraft, error) {
+	o, err := scanSQLiteOverdraft(db.QueryRowContext(ctx, sqliteOverdraftQuery+" WHERE id = ?", walletID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Overdraft{}, model.ErrWalletNotFound
+		}
+		return model.Overdraft{}, fmt.Errorf("failed to get overdraft: %w", err)
+	}
+	return o, nil
+}
+
+func (r *SQLiteRepository) GetOverdraft(ctx context.Context, walletID string) (model.Overdraft, error) {
+	return getSQLiteOverdraft(ctx, r.db, walletID)
+}
+
+func (r *SQLiteRepository) SetOverdraft(ctx context.Context, walletID string, creditLimit, dailyFee int64, from time.Time) (model.Overdraft, error) {
+	// BEGIN IMMEDIATE, the balance checked against the limit holds until it is written
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Overdraft{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err := getSQLiteOverdraft(ctx, tx, walletID)
+	if err != nil {
+		return model.Overdraft{}, err
+	}
+	if o, err = setOverdraft(o, creditLimit, dailyFee, from); err != nil {
+		return model.Overdraft{}, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE wallets SET credit_limit = ?, overdraft_fee = ?, overdraft_fees_through = ? WHERE id = ?",
+		o.CreditLimit, o.DailyFee, sqliteTime(o.FeesChargedThrough), walletID,
+	)
+	if err != nil {
+		return model.Overdraft{}, fmt.Errorf("failed to update overdraft: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Overdraft{}, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return o, nil
+}
+
+func (r *SQLiteRepository) DueOverdraftFees(ctx context.Context, afterID string, through time.Time, limit int) ([]model.Overdraft, error) {
+	rows, err := r.db.QueryContext(ctx,
+		sqliteOverdraftQuery+" WHERE id > ? AND overdraft_fee > 0 AND overdraft_fees_through < ? ORDER BY id LIMIT ?",
+		afterID, through.UnixNano(), sqliteLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list due overdraft fees: %w", err)
+	}
+	defer rows.Close()
+
+	due := []model.Overdraft{}
+	for rows.Next() {
+		o, err := scanSQLiteOverdraft(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan overdraft: %w", err)
+		}
+		due = append(due, o)
+	}
+	return due, rows.Err()
+}
+
+func (r *SQLiteRepository) ChargeOverdraftFee(ctx context.Context, fee model.OverdraftCharge) (model.OverdraftCharge, error) {
+	// BEGIN IMMEDIATE, concurrent charges of the wallet wait for each other
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.OverdraftCharge{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err := getSQLiteOverdraft(ctx, tx, fee.WalletID)
+	if err != nil {
+		return model.OverdraftCharge{}, err
+	}
+	if fee, err = chargeFee(o, fee); err != nil {
+		return model.OverdraftCharge{}, err
+	}
+
+	if fee.Amount > 0 {
+		if fee.LedgerEntryID, err = applySQLite(ctx, tx, fee.WalletID, model.OverdraftFee, -fee.Amount, "", fee.Reference()); err != nil {
+			return model.OverdraftCharge{}, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO overdraft_fees (wallet_id, day, balance, amount, ledger_entry_id, charged_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			fee.WalletID, fee.Day.UnixNano(), fee.Balance, fee.Amount, fee.LedgerEntryID, fee.ChargedAt.UnixNano(),
+		)
+		if err != nil {
+			return model.OverdraftCharge{}, fmt.Errorf("failed to insert overdraft fee: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE wallets SET overdraft_fees_through = ? WHERE id = ?",
+		fee.Day.UnixNano(), fee.WalletID,
+	)
+	if err != nil {
+		return model.OverdraftCharge{}, fmt.Errorf("failed to update overdraft: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return model.OverdraftCharge{}, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return fee, nil
+}
+
+func (r *SQLiteRepository) OverdraftFees(ctx context.Context, walletID string) ([]model.OverdraftCharge, error) {
+	if _, err := r.GetBalance(ctx, walletID); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT wallet_id, day, balance, amount, ledger_entry_id, charged_at
+		FROM overdraft_fees WHERE wallet_id = ? ORDER BY day`,
+		walletID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list overdraft fees: %w", err)
+	}
+	defer rows.Close()
+
+	fees := []model.OverdraftCharge{}
+	for rows.Next() {
+		var f model.OverdraftCharge
+		var day, chargedAt int64
+		if err := rows.Scan(&f.WalletID, &day, &f.Balance, &f.Amount, &f.LedgerEntryID, &chargedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan overdraft fee: %w", err)
+		}
+		f.Day = time.Unix(0, day).UTC()
+		f.ChargedAt = time.Unix(0, chargedAt).UTC()
+		fees = append(fees, f)
+	}
+	return fees, rows.Err()
+}
+
+// sqliteTime stores a nil time as NULL.
+func sqliteTime(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func sqliteTimePtr(t sql.NullInt64) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	v := time.Unix(0, t.Int64).UTC()
+	return &v
+}
+
+// sqliteLimit turns a limit of zero or less into no limit, SQLite takes -1 for it.
+func sqliteLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+func (r *SQLiteRepository) RunMigrations(ctx context.Context) error {
+	return applyMigrations(ctx, r.db, sqliteMigrations)
+}
+
+// PendingMigrations returns the versions of the migrations that are not applied yet.
+func (r *SQLiteRepository) PendingMigrations(ctx context.Context) ([]string, error) {
+	return pendingMigrations(ctx, r.db, sqliteMigrations)
+}
+
+// Ping verifies the database connection is alive.
+func (r *SQLiteRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
@@ -2,10 +2,434 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"WalletApi/internal/interest"
+	"WalletApi/internal/model"
+
+	"github.com/google/uuid"
 )
 
+// QueryHook is called before every statement a SQL repository runs. The returned
+// function is called with the statement's error once it completes. Hooks may
+// return a derived context, for example one carrying a tracing span.
+type QueryHook func(ctx context.Context, name string) (context.Context, func(error))
+
 type WalletRepository interface {
 	ProcessTransaction(ctx context.Context, walletID string, amount int64, isDeposit bool) error
 	GetBalance(ctx context.Context, walletID string) (int64, error)
 	CreateWallet(ctx context.Context) (string, error)
+	// GetHistory returns up to limit ledger entries of the wallet, newest first.
+	// A limit of zero or less returns the whole history.
+	GetHistory(ctx context.Context, walletID string, limit int) ([]model.LedgerEntry, error)
+}
+
+// OnceProcessor is implemented by repositories that can apply a transaction at most once.
+type OnceProcessor interface {
+	// ProcessTransactionOnce is ProcessTransaction recording reference with the
+	// ledger entry. A reference already recorded fails with
+	// model.ErrDuplicateReference and nothing is applied.
+	ProcessTransactionOnce(ctx context.Context, walletID string, amount int64, isDeposit bool, reference string) error
+}
+
+// Maintainer is implemented by repositories whose storage can be checked for readiness.
+type Maintainer interface {
+	Ping(ctx context.Context) error
+	RunMigrations(ctx context.Context) error
+	PendingMigrations(ctx context.Context) ([]string, error)
+}
+
+// BalanceHistory is implemented by repositories that can tell past balances from the ledger.
+type BalanceHistory interface {
+	// BalanceAt returns the balance of the wallet made of its ledger entries
+	// created at or before at, zero before its first entry.
+	BalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error)
+	// SnapshotBalances records the ledger balance of up to limit wallets whose ID
+	// sorts after afterID and that have entries since their last snapshot, so
+	// BalanceAt does not replay their whole history. It returns the last wallet ID
+	// of the chunk, empty once no wallet is left, and the number of snapshots taken.
+	SnapshotBalances(ctx context.Context, afterID string, limit int) (string, int, error)
+	// StreamStatement calls opening with the balance of the wallet at from, then
+	// entry with each ledger entry created after from and up to to, oldest first.
+	// Entries are read from a database cursor as entry returns, never all at once.
+	// An error returned by a callback stops the stream and is returned.
+	StreamStatement(ctx context.Context, walletID string, from, to time.Time, opening func(int64) error, entry func(model.LedgerEntry) error) error
+}
+
+// LedgerExporter is implemented by repositories whose ledger can be exported in bulk.
+type LedgerExporter interface {
+	// StreamLedger calls fn with every ledger entry whose ID is above afterID, in
+	// ID order, from a database cursor. It stops before the first entry created
+	// after before: IDs are taken before commit, so younger entries may still be
+	// followed by lower IDs committing later. An error returned by fn stops the
+	// stream and is returned.
+	StreamLedger(ctx context.Context, afterID int64, before time.Time, fn func(model.LedgerEntry) error) error
+	// LeaseExport takes the export lease for owner until now plus lease and
+	// reports whether it did. The lease of another owner is taken only once it
+	// ended, its owner extends it by taking it again.
+	LeaseExport(ctx context.Context, owner string, now time.Time, lease time.Duration) (bool, error)
+	// ReleaseExport ends the export lease if owner holds it.
+	ReleaseExport(ctx context.Context, owner string) error
+}
+
+// errStopStream ends a stream of entries early without an error.
+var errStopStream = errors.New("stop stream")
+
+// stopAfter wraps fn to stop the stream before the first entry created after before.
+func stopAfter(before time.Time, fn func(model.LedgerEntry) error) func(model.LedgerEntry) error {
+	return func(e model.LedgerEntry) error {
+		if e.CreatedAt.After(before) {
+			return errStopStream
+		}
+		return fn(e)
+	}
+}
+
+// ErrScheduleChanged rejects a write of a schedule whose version is not the stored one.
+var ErrScheduleChanged = errors.New("schedule changed concurrently")
+
+// Schedules is implemented by repositories that store scheduled transactions and their runs.
+type Schedules interface {
+	// CreateSchedule stores s and returns it with its ID, version and times set.
+	CreateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error)
+	// GetSchedule returns the schedule of the wallet, model.ErrScheduleNotFound
+	// if the wallet has no such schedule.
+	GetSchedule(ctx context.Context, walletID, id string) (model.Schedule, error)
+	// ListSchedules returns the schedules of the wallet, oldest first.
+	ListSchedules(ctx context.Context, walletID string) ([]model.Schedule, error)
+	// UpdateSchedule stores the amount, end, status, next run, due time and
+	// attempts of s if s.Version is still the stored version, otherwise it fails
+	// with ErrScheduleChanged. It returns s with its new version.
+	UpdateSchedule(ctx context.Context, s model.Schedule) (model.Schedule, error)
+	// ClaimDueSchedules leases up to limit active schedules due at now, earliest
+	// first, until now plus lease. Leased schedules are not claimed again before
+	// their lease ends, so an occurrence is run by one instance at a time.
+	ClaimDueSchedules(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Schedule, error)
+	// FinishScheduleRun records run and stores s like UpdateSchedule, in one
+	// transaction, and ends the lease. The run is recorded even when s fails
+	// with ErrScheduleChanged: its transaction was applied whatever happened to
+	// the schedule meanwhile. An attempt is recorded once, a later run of the
+	// same attempt only replaces it when it succeeded, as the transaction of an
+	// occurrence is applied once.
+	FinishScheduleRun(ctx context.Context, s model.Schedule, run model.ScheduleRun) (model.Schedule, error)
+	// ScheduleRuns returns up to limit runs of the schedule, newest first. A
+	// limit of zero or less returns every run.
+	ScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]model.ScheduleRun, error)
+}
+
+// ErrInterestChanged rejects an accrual of a day that is not the one after the
+// last accrued day, another run accrued it first.
+var ErrInterestChanged = errors.New("interest accrued concurrently")
+
+// Interest is implemented by repositories that accrue interest on wallets.
+type Interest interface {
+	// CreateInterestProduct stores p and returns it with its ID and creation time set.
+	CreateInterestProduct(ctx context.Context, p model.InterestProduct) (model.InterestProduct, error)
+	// InterestProducts returns every product, oldest first.
+	InterestProducts(ctx context.Context) ([]model.InterestProduct, error)
+	// AssignInterestProduct makes the wallet accrue interest with the product,
+	// from the day from on. A wallet already assigned a product switches to the
+	// new one from its next accrued day, from is then ignored.
+	AssignInterestProduct(ctx context.Context, walletID, productID string, from time.Time) (model.InterestAccount, error)
+	// GetInterestAccount returns the interest state of the wallet,
+	// model.ErrInterestNotAssigned if it has no product.
+	GetInterestAccount(ctx context.Context, walletID string) (model.InterestAccount, error)
+	// DueInterestAccounts returns up to limit accounts whose wallet ID sorts
+	// after afterID and that are not accrued through the day through, in wallet
+	// ID order. An empty afterID starts from the first wallet.
+	DueInterestAccounts(ctx context.Context, afterID string, through time.Time, limit int) ([]model.InterestAccount, error)
+	// AccrueInterest records the accrual of the day after the last accrued day of
+	// its wallet, and adds it to the accrued interest. With a posting, which
+	// must be of the month ending that day, the posted amount is credited as an
+	// INTEREST ledger entry and taken off the accrued interest, in the same
+	// transaction. An accrual of another day fails with ErrInterestChanged.
+	AccrueInterest(ctx context.Context, accrual model.InterestAccrual, posting *model.InterestPosting) (model.InterestAccount, error)
+	// InterestAccruals returns the accruals of the wallet, oldest first.
+	InterestAccruals(ctx context.Context, walletID string) ([]model.InterestAccrual, error)
+	// InterestPostings returns the postings of the wallet, oldest first.
+	InterestPostings(ctx context.Context, walletID string) ([]model.InterestPosting, error)
+}
+
+// ErrOverdraftFeeChanged rejects an overdraft fee of a day that is not the one
+// after the last charged day, another run charged it first.
+var ErrOverdraftFeeChanged = errors.New("overdraft fee charged concurrently")
+
+// Overdraft is implemented by repositories whose wallets can have a credit line.
+// Every debit, whatever its operation, may take the balance down to minus the
+// credit limit of the wallet and no further.
+type Overdraft interface {
+	// GetOverdraft returns the balance of the wallet with its credit line, read together.
+	GetOverdraft(ctx context.Context, walletID string) (model.Overdraft, error)
+	// SetOverdraft sets the credit limit and the daily fee of the wallet. A limit
+	// below the overdraft in use fails with model.ErrInvalidOverdraft. Setting a
+	// fee on a wallet that had none charges it from the day from on.
+	SetOverdraft(ctx context.Context, walletID string, creditLimit, dailyFee int64, from time.Time) (model.Overdraft, error)
+	// DueOverdraftFees returns up to limit wallets with a daily fee whose ID sorts
+	// after afterID and whose fee is not charged through the day through, in
+	// wallet ID order. An empty afterID starts from the first wallet.
+	DueOverdraftFees(ctx context.Context, afterID string, through time.Time, limit int) ([]model.Overdraft, error)
+	// ChargeOverdraftFee debits fee.Amount as an OVERDRAFT_FEE ledger entry, or
+	// the credit left if less, for the day after the last charged day of its
+	// wallet and records it, in one transaction. A zero amount only records the
+	// day as charged. A fee of another day fails with ErrOverdraftFeeChanged. It
+	// returns the fee with the amount charged.
+	ChargeOverdraftFee(ctx context.Context, fee model.OverdraftCharge) (model.OverdraftCharge, error)
+	// OverdraftFees returns the fees charged to the wallet, oldest first.
+	OverdraftFees(ctx context.Context, walletID string) ([]model.OverdraftCharge, error)
+}
+
+// Administrator is implemented by repositories that support the operator commands of walletctl.
+type Administrator interface {
+	GetWallet(ctx context.Context, walletID string) (model.Wallet, error)
+	// SetFrozen freezes or unfreezes the wallet, a frozen wallet rejects every transaction
+	SetFrozen(ctx context.Context, walletID string, frozen bool) error
+	// RequestAdjustment stores a pending adjustment of req.WalletID, it fills the
+	// ID, status and request time. Nothing is applied until it is approved.
+	RequestAdjustment(ctx context.Context, req model.AdjustmentRequest) (model.AdjustmentRequest, error)
+	// PendingAdjustments lists the adjustments awaiting a decision that have not expired, oldest first
+	PendingAdjustments(ctx context.Context) ([]model.AdjustmentRequest, error)
+	// ApproveAdjustment applies a pending adjustment with the same checks as
+	// ProcessTransaction, in the transaction that records the approval. The
+	// approver must not be the operator who requested it.
+	ApproveAdjustment(ctx context.Context, id, approver string) (model.AdjustmentRequest, error)
+	// RejectAdjustment discards a pending adjustment, its requester may withdraw it this way
+	RejectAdjustment(ctx context.Context, id, operator string) (model.AdjustmentRequest, error)
+	// CheckBalances compares up to limit wallets whose ID sorts after afterID, in ID
+	// order, with their ledger. An empty afterID starts from the first wallet.
+	CheckBalances(ctx context.Context, afterID string, limit int) ([]model.BalanceCheck, error)
+	// ReportDrift records a drift found by CheckBalances, frozen tells the wallet was
+	// frozen because of it. Reporting the same drift amount of a wallet again
+	// updates the balances and the last seen time of its report.
+	ReportDrift(ctx context.Context, check model.BalanceCheck, frozen bool) error
+	// DriftReports returns up to limit drift reports, the most recently seen first.
+	// A limit of zero or less returns every report.
+	DriftReports(ctx context.Context, limit int) ([]model.DriftReport, error)
+}
+
+// decideAdjustment checks that the pending adjustment a can be decided by operator
+// at now, approve tells an approval from a rejection. An expired adjustment is
+// reported with model.ErrAdjustmentExpired, the caller records it as expired.
+func decideAdjustment(a model.AdjustmentRequest, operator string, approve bool, now time.Time) error {
+	if strings.TrimSpace(operator) == "" {
+		return errors.New("deciding operator is required")
+	}
+	if a.Status != model.AdjustmentPending {
+		return fmt.Errorf("%w: %s", model.ErrAdjustmentNotPending, a.Status)
+	}
+	if !now.Before(a.ExpiresAt) {
+		return model.ErrAdjustmentExpired
+	}
+	if approve && model.SameOperator(a.RequestedBy, operator) {
+		return model.ErrSelfApproval
+	}
+	return nil
+}
+
+// newAdjustment fills the fields of a requested adjustment set by the repository.
+func newAdjustment(req model.AdjustmentRequest, now time.Time) (model.AdjustmentRequest, error) {
+	if err := req.Validate(); err != nil {
+		return model.AdjustmentRequest{}, err
+	}
+	req.ID = uuid.NewString()
+	req.Status = model.AdjustmentPending
+	req.RequestedBy = strings.TrimSpace(req.RequestedBy)
+	req.RequestedAt = now
+	req.ExpiresAt = req.ExpiresAt.UTC()
+	req.DecidedBy = ""
+	req.DecidedAt = nil
+	req.LedgerEntryID = 0
+	return req, nil
+}
+
+// newSchedule fills the fields of a created schedule set by the repository.
+func newSchedule(s model.Schedule, now time.Time) model.Schedule {
+	s.ID = uuid.NewString()
+	s.Version = 1
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	return s
+}
+
+// newInterestProduct fills the fields of a created product set by the repository.
+func newInterestProduct(p model.InterestProduct, now time.Time) model.InterestProduct {
+	p.ID = uuid.NewString()
+	p.CreatedAt = now
+	return p
+}
+
+// accrueInto returns account with the accrual added to its accrued interest and
+// the posting taken off. It checks that the accrual is of the day after the last
+// accrued day, and that the posting is of the month ending that day and of the
+// interest accrued with it.
+func accrueInto(account model.InterestAccount, accrual model.InterestAccrual, posting *model.InterestPosting) (model.InterestAccount, error) {
+	if !accrual.Day.Equal(account.AccruedThrough.AddDate(0, 0, 1)) {
+		return model.InterestAccount{}, ErrInterestChanged
+	}
+
+	accrued := interest.Amount{Units: account.AccruedUnits, Fraction: account.AccruedFraction}.
+		Add(interest.Amount{Units: accrual.Units, Fraction: accrual.Fraction})
+	if posting != nil {
+		if posting.WalletID != accrual.WalletID {
+			return model.InterestAccount{}, fmt.Errorf("posting of wallet %s with an accrual of wallet %s", posting.WalletID, accrual.WalletID)
+		}
+		if accrual.Day.AddDate(0, 0, 1).Day() != 1 || posting.Period != accrual.Day.Format("2006-01") {
+			return model.InterestAccount{}, fmt.Errorf("posting of %s does not end on %s", posting.Period, accrual.Day.Format(time.DateOnly))
+		}
+		if posting.AccruedUnits != accrued.Units || posting.AccruedFraction != accrued.Fraction {
+			return model.InterestAccount{}, ErrInterestChanged
+		}
+		if posting.Amount < 0 {
+			return model.InterestAccount{}, model.ErrInvalidAmount
+		}
+		accrued = accrued.Sub(posting.Amount)
+	}
+
+	account.AccruedThrough = accrual.Day
+	account.AccruedUnits = accrued.Units
+	account.AccruedFraction = accrued.Fraction
+	account.UpdatedAt = time.Now().UTC()
+	return account, nil
+}
+
+// checkFunds checks that delta can be applied to a wallet with balance and
+// creditLimit: a debit must not take the balance below -creditLimit, and a
+// credit must not overflow it.
+func checkFunds(balance, creditLimit, delta int64) error {
+	if delta > 0 {
+		if balance > math.MaxInt64-delta {
+			return fmt.Errorf("%w: the balance would overflow", model.ErrInvalidAmount)
+		}
+		return nil
+	}
+	if available := model.Available(balance, creditLimit); available < -delta {
+		return &model.InsufficientFundsError{Available: available}
+	}
+	return nil
+}
+
+// setOverdraft returns o with the new credit limit and daily fee. A fee set on
+// a wallet that had none is charged from the day from on.
+func setOverdraft(o model.Overdraft, creditLimit, dailyFee int64, from time.Time) (model.Overdraft, error) {
+	switch {
+	case creditLimit < 0:
+		return model.Overdraft{}, fmt.Errorf("%w: credit limit must not be negative", model.ErrInvalidOverdraft)
+	case dailyFee < 0:
+		return model.Overdraft{}, fmt.Errorf("%w: daily fee must not be negative", model.ErrInvalidOverdraft)
+	case o.Balance < -creditLimit:
+		return model.Overdraft{}, fmt.Errorf("%w: credit limit below the overdraft in use of %d", model.ErrInvalidOverdraft, o.Used())
+	}
+	if o.DailyFee == 0 && dailyFee > 0 {
+		through := from.UTC().AddDate(0, 0, -1)
+		o.FeesChargedThrough = &through
+	}
+	o.CreditLimit = creditLimit
+	o.DailyFee = dailyFee
+	return o, nil
+}
+
+// chargeFee checks that fee is of the day after the last charged day of o, and
+// returns it with its amount capped at the credit left.
+func chargeFee(o model.Overdraft, fee model.OverdraftCharge) (model.OverdraftCharge, error) {
+	if o.FeesChargedThrough == nil || !fee.Day.Equal(o.FeesChargedThrough.AddDate(0, 0, 1)) {
+		return model.OverdraftCharge{}, ErrOverdraftFeeChanged
+	}
+	if fee.Amount < 0 {
+		return model.OverdraftCharge{}, model.ErrInvalidAmount
+	}
+	fee.Amount = min(fee.Amount, max(o.Available(), 0))
+	fee.ChargedAt = time.Now().UTC()
+	return fee, nil
+}
+
+// sortDue sorts claimed schedules by due time, the order they are run in.
+func sortDue(schedules []model.Schedule) {
+	sort.Slice(schedules, func(i, j int) bool {
+		if !schedules[i].DueAt.Equal(*schedules[j].DueAt) {
+			return schedules[i].DueAt.Before(*schedules[j].DueAt)
+		}
+		return schedules[i].ID < schedules[j].ID
+	})
+}
+
+// operationType returns the ledger operation recorded for a ProcessTransaction call.
+func operationType(isDeposit bool) model.OperationType {
+	if isDeposit {
+		return model.Deposit
+	}
+	return model.Withdraw
+}
+
+var (
+	_ WalletRepository = (*PostgresRepository)(nil)
+	_ WalletRepository = (*SQLiteRepository)(nil)
+	_ WalletRepository = (*MemoryRepository)(nil)
+
+	_ BalanceHistory = (*PostgresRepository)(nil)
+	_ BalanceHistory = (*SQLiteRepository)(nil)
+	_ BalanceHistory = (*MemoryRepository)(nil)
+
+	_ LedgerExporter = (*PostgresRepository)(nil)
+	_ LedgerExporter = (*SQLiteRepository)(nil)
+	_ LedgerExporter = (*MemoryRepository)(nil)
+
+	_ OnceProcessor = (*PostgresRepository)(nil)
+	_ OnceProcessor = (*SQLiteRepository)(nil)
+	_ OnceProcessor = (*MemoryRepository)(nil)
+
+	_ Schedules = (*PostgresRepository)(nil)
+	_ Schedules = (*SQLiteRepository)(nil)
+	_ Schedules = (*MemoryRepository)(nil)
+
+	_ Interest = (*PostgresRepository)(nil)
+	_ Interest = (*SQLiteRepository)(nil)
+	_ Interest = (*MemoryRepository)(nil)
+
+	_ Overdraft = (*PostgresRepository)(nil)
+	_ Overdraft = (*SQLiteRepository)(nil)
+	_ Overdraft = (*MemoryRepository)(nil)
+
+	_ Maintainer = (*PostgresRepository)(nil)
+	_ Maintainer = (*SQLiteRepository)(nil)
+	_ Maintainer = (*MemoryRepository)(nil)
+
+	_ Administrator = (*PostgresRepository)(nil)
+	_ Administrator = (*SQLiteRepository)(nil)
+	_ Administrator = (*MemoryRepository)(nil)
+)
+
+// nullString stores an empty string as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// checkUpdated returns model.ErrWalletNotFound when the UPDATE of res matched no wallet.
+func checkUpdated(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count updated rows: %w", err)
+	}
+	if n == 0 {
+		return model.ErrWalletNotFound
+	}
+	return nil
+}
+
+func scanBalanceChecks(rows *sql.Rows) ([]model.BalanceCheck, error) {
+	defer rows.Close()
+
+	checks := []model.BalanceCheck{}
+	for rows.Next() {
+		var c model.BalanceCheck
+		if err := rows.Scan(&c.WalletID, &c.Balance, &c.LedgerBalance); err != nil {
+			return nil, fmt.Errorf("failed to scan balance check: %w", err)
+		}
+		checks = append(checks, c)
+	}
+	return checks, rows.Err()
 }
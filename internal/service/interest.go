@@ -0,0 +1,370 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/interest"
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+)
+
+const (
+	// DefaultInterestChunkSize is the number of due accounts read per query
+	DefaultInterestChunkSize = 500
+	// DefaultAccrualLag is how long after midnight UTC a day is accrued, so
+	// transactions committing late are in its closing balance
+	DefaultAccrualLag = 5 * time.Minute
+)
+
+// InterestAccruer manages the interest products and accrues the interest of
+// the wallets assigned one.
+//
+// Interest accrues daily on the closing ledger balance of a UTC day, in exact
+// fractions of a minor unit. The interest accrued over a month is rounded and
+// posted as an INTEREST ledger entry with the accrual of its last day, the
+// rounding remainder is carried to the next month. Each day is recorded with the
+// balance and terms it accrued on, so Audit can replay it from the ledger.
+//
+// Every instance may run the accruer: a day is accrued once, the accrual of a
+// day another instance recorded first is skipped.
+type InterestAccruer struct {
+	repo    repository.Interest
+	history repository.BalanceHistory
+	cache   cache.BalanceCache
+
+	chunkSize int
+	lag       time.Duration
+	now       func() time.Time
+}
+
+// InterestOption configures optional InterestAccruer settings
+type InterestOption func(*InterestAccruer)
+
+// WithInterestChunkSize sets the number of due accounts read per query
+func WithInterestChunkSize(size int) InterestOption {
+	return func(a *InterestAccruer) {
+		a.chunkSize = size
+	}
+}
+
+// WithAccrualLag sets how long after the end of a day it is accrued
+func WithAccrualLag(lag time.Duration) InterestOption {
+	return func(a *InterestAccruer) {
+		a.lag = lag
+	}
+}
+
+// WithInterestCache removes the cached balance of a wallet after each posting.
+// Postings change the balance without going through the WalletService, so its
+// cache must be given here for it to stay coherent. The removal also keeps a
+// shard worker that read the balance before the posting from caching it after.
+func WithInterestCache(c cache.BalanceCache) InterestOption {
+	return func(a *InterestAccruer) {
+		a.cache = c
+	}
+}
+
+// WithInterestClock replaces time.Now, for tests
+func WithInterestClock(now func() time.Time) InterestOption {
+	return func(a *InterestAccruer) {
+		a.now = now
+	}
+}
+
+func NewInterestAccruer(repo repository.Interest, history repository.BalanceHistory, opts ...InterestOption) *InterestAccruer {
+	a := &InterestAccruer{
+		repo:      repo,
+		history:   history,
+		chunkSize: DefaultInterestChunkSize,
+		lag:       DefaultAccrualLag,
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func invalidInterestProduct(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", model.ErrInvalidInterestProduct, fmt.Sprintf(format, args...))
+}
+
+// CreateProduct validates p and stores it. Products cannot be changed, a wallet
+// is moved to another product instead.
+func (a *InterestAccruer) CreateProduct(ctx context.Context, p model.InterestProduct) (model.InterestProduct, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return model.InterestProduct{}, invalidInterestProduct("name is required")
+	}
+	if p.AnnualRateBps <= 0 || p.AnnualRateBps > interest.MaxRateBps {
+		return model.InterestProduct{}, invalidInterestProduct("annual rate must be between 1 and %d basis points", interest.MaxRateBps)
+	}
+	if _, err := interest.ParseDayCount(p.DayCount); err != nil {
+		return model.InterestProduct{}, fmt.Errorf("%w: %v", model.ErrInvalidInterestProduct, err)
+	}
+	if _, err := interest.ParseRounding(p.Rounding); err != nil {
+		return model.InterestProduct{}, fmt.Errorf("%w: %v", model.ErrInvalidInterestProduct, err)
+	}
+
+	products, err := a.repo.InterestProducts(ctx)
+	if err != nil {
+		return model.InterestProduct{}, err
+	}
+	for _, existing := range products {
+		if existing.Name == p.Name {
+			return model.InterestProduct{}, invalidInterestProduct("a product named %q exists", p.Name)
+		}
+	}
+	return a.repo.CreateInterestProduct(ctx, p)
+}
+
+func (a *InterestAccruer) Products(ctx context.Context) ([]model.InterestProduct, error) {
+	return a.repo.InterestProducts(ctx)
+}
+
+// Assign makes the wallet accrue interest with the product from the UTC day of
+// from on, today if from is zero. A wallet that has a product switches to the
+// new one from its next accrued day.
+func (a *InterestAccruer) Assign(ctx context.Context, walletID, productID string, from time.Time) (model.InterestAccount, error) {
+	if from.IsZero() {
+		from = a.now()
+	}
+	return a.repo.AssignInterestProduct(ctx, walletID, productID, utcDay(from))
+}
+
+func (a *InterestAccruer) Account(ctx context.Context, walletID string) (model.InterestAccount, error) {
+	return a.repo.GetInterestAccount(ctx, walletID)
+}
+
+func (a *InterestAccruer) Postings(ctx context.Context, walletID string) ([]model.InterestPosting, error) {
+	return a.repo.InterestPostings(ctx, walletID)
+}
+
+// utcDay returns the midnight UTC starting the day of t.
+func utcDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// closingBalance returns the ledger balance of the wallet at the end of day.
+func (a *InterestAccruer) closingBalance(ctx context.Context, walletID string, day time.Time) (int64, error) {
+	return a.history.BalanceAt(ctx, walletID, day.AddDate(0, 0, 1).Add(-time.Nanosecond))
+}
+
+// InterestReport is the result of an accrual run.
+type InterestReport struct {
+	Accounts int `json:"accounts"`
+	Accruals int `json:"accruals"`
+	Postings int `json:"postings"`
+	// Failed counts the wallets left behind by an error, they are caught up by a later run
+	Failed int `json:"failed"`
+}
+
+// Run accrues every assigned wallet through the last day that ended more than
+// the lag ago, catching up the days missed since its last accrual. On error,
+// the report holds what was accrued until then.
+func (a *InterestAccruer) Run(ctx context.Context) (InterestReport, error) {
+	var report InterestReport
+	err := a.run(ctx, &report)
+	metrics.ObserveInterestRun(report.Accruals, report.Postings, report.Failed, err)
+	return report, err
+}
+
+func (a *InterestAccruer) run(ctx context.Context, report *InterestReport) error {
+	through := utcDay(a.now().Add(-a.lag)).AddDate(0, 0, -1)
+	var last string
+	for {
+		accounts, err := a.repo.DueInterestAccounts(ctx, last, through, a.chunkSize)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			return nil
+		}
+		for _, account := range accounts {
+			report.Accounts++
+			err := a.accrue(ctx, account, through, report)
+			switch {
+			case err == nil:
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case errors.Is(err, repository.ErrInterestChanged):
+				// Another instance is accruing the wallet
+			default:
+				// A frozen wallet stays at the end of the month until it is unfrozen
+				report.Failed++
+				slog.Error("Interest accrual of wallet failed", "wallet_id", account.WalletID, "accrued_through", account.AccruedThrough.Format(time.DateOnly), "error", err)
+			}
+		}
+		last = accounts[len(accounts)-1].WalletID
+	}
+}
+
+// accrue records the accruals of the wallet from its next day through through,
+// with the posting of every month ending on the way.
+func (a *InterestAccruer) accrue(ctx context.Context, account model.InterestAccount, through time.Time, report *InterestReport) error {
+	for day := account.AccruedThrough.AddDate(0, 0, 1); !day.After(through); day = day.AddDate(0, 0, 1) {
+		balance, err := a.closingBalance(ctx, account.WalletID, day)
+		if err != nil {
+			return err
+		}
+		product := account.Product
+		amount := interest.Accrue(balance, product.AnnualRateBps, interest.DayCount(product.DayCount), day)
+		accrual := model.InterestAccrual{
+			WalletID:      account.WalletID,
+			Day:           day,
+			ProductID:     product.ID,
+			AnnualRateBps: product.AnnualRateBps,
+			DayCount:      product.DayCount,
+			Balance:       balance,
+			Units:         amount.Units,
+			Fraction:      amount.Fraction,
+		}
+
+		var posting *model.InterestPosting
+		if lastOfMonth(day) {
+			accrued := interest.Amount{Units: account.AccruedUnits, Fraction: account.AccruedFraction}.Add(amount)
+			posted, _ := interest.Post(accrued, interest.Rounding(product.Rounding))
+			posting = &model.InterestPosting{
+				WalletID:        account.WalletID,
+				Period:          day.Format("2006-01"),
+				AccruedUnits:    accrued.Units,
+				AccruedFraction: accrued.Fraction,
+				Rounding:        product.Rounding,
+				Amount:          posted,
+			}
+		}
+
+		if account, err = a.repo.AccrueInterest(ctx, accrual, posting); err != nil {
+			return err
+		}
+		report.Accruals++
+		if posting != nil {
+			if a.cache != nil {
+				// The posting is committed, so the caller giving up must not skip it
+				a.cache.Delete(context.WithoutCancel(ctx), posting.WalletID)
+			}
+			report.Postings++
+			slog.InfoContext(ctx, "Interest posted",
+				"wallet_id", posting.WalletID, "period", posting.Period, "amount", posting.Amount)
+		}
+	}
+	return nil
+}
+
+func lastOfMonth(day time.Time) bool {
+	return day.AddDate(0, 0, 1).Day() == 1
+}
+
+// InterestMismatch is a recorded figure of a wallet's interest that its replay
+// from the ledger does not give.
+type InterestMismatch struct {
+	// Day is the accrued day, or the posted month
+	Day      string `json:"day"`
+	Field    string `json:"field"`
+	Recorded string `json:"recorded"`
+	Replayed string `json:"replayed"`
+}
+
+// Audit replays the interest of the wallet: every accrual from the closing
+// balance of its day and the terms it recorded, every posting from the accruals
+// of its month, and the accrued interest of the account from both. It returns
+// the figures that differ from the recorded ones, none when the records are
+// consistent with the ledger.
+func (a *InterestAccruer) Audit(ctx context.Context, walletID string) ([]InterestMismatch, error) {
+	account, err := a.repo.GetInterestAccount(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	accruals, err := a.repo.InterestAccruals(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	postings, err := a.repo.InterestPostings(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	byPeriod := make(map[string]model.InterestPosting, len(postings))
+	for _, p := range postings {
+		byPeriod[p.Period] = p
+	}
+
+	mismatches := []InterestMismatch{}
+	mismatch := func(day, field string, recorded, replayed any) {
+		mismatches = append(mismatches, InterestMismatch{
+			Day:      day,
+			Field:    field,
+			Recorded: fmt.Sprint(recorded),
+			Replayed: fmt.Sprint(replayed),
+		})
+	}
+
+	var accrued interest.Amount
+	for _, accrual := range accruals {
+		day := accrual.Day.Format(time.DateOnly)
+		balance, err := a.closingBalance(ctx, walletID, accrual.Day)
+		if err != nil {
+			return nil, err
+		}
+		if balance != accrual.Balance {
+			mismatch(day, "balance", accrual.Balance, balance)
+		}
+		recorded := interest.Amount{Units: accrual.Units, Fraction: accrual.Fraction}
+		replayed := interest.Accrue(balance, accrual.AnnualRateBps, interest.DayCount(accrual.DayCount), accrual.Day)
+		if recorded != replayed {
+			mismatch(day, "accrual", recorded, replayed)
+		}
+		accrued = accrued.Add(recorded)
+
+		if !lastOfMonth(accrual.Day) {
+			continue
+		}
+		period := accrual.Day.Format("2006-01")
+		p, ok := byPeriod[period]
+		if !ok {
+			mismatch(period, "posting", "none", "posting")
+			continue
+		}
+		delete(byPeriod, period)
+		if posted := (interest.Amount{Units: p.AccruedUnits, Fraction: p.AccruedFraction}); posted != accrued {
+			mismatch(period, "posting accrued", posted, accrued)
+		}
+		if amount, _ := interest.Post(accrued, interest.Rounding(p.Rounding)); amount != p.Amount {
+			mismatch(period, "posting amount", p.Amount, amount)
+		}
+		accrued = accrued.Sub(p.Amount)
+	}
+	for _, p := range postings {
+		if _, ok := byPeriod[p.Period]; ok {
+			mismatch(p.Period, "posting", "posting", "none")
+		}
+	}
+
+	if recorded := (interest.Amount{Units: account.AccruedUnits, Fraction: account.AccruedFraction}); recorded != accrued {
+		mismatch(account.AccruedThrough.Format(time.DateOnly), "accrued", recorded, accrued)
+	}
+	return mismatches, nil
+}
+
+// Start accrues the interest every interval in the background until ctx is
+// canceled, see startJob.
+func (a *InterestAccruer) Start(ctx context.Context, interval time.Duration) (wait func()) {
+	return startJob(ctx, interval, "Interest accrual", func(ctx context.Context) error {
+		report, err := a.Run(ctx)
+		if err != nil {
+			return err
+		}
+		if report.Accruals > 0 {
+			slog.Info("Interest accrued",
+				"accounts", report.Accounts, "accruals", report.Accruals, "postings", report.Postings, "failed", report.Failed)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,228 @@
+package service_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/model"
+	"WalletApi/internal/service"
+)
+
+// backdate moves the ledger entries of the wallet created at or after since to at.
+func backdate(t *testing.T, db *sql.DB, walletID string, since, at time.Time) {
+	t.Helper()
+	_, err := db.Exec("UPDATE ledger_entries SET created_at = ? WHERE wallet_id = ? AND created_at >= ?",
+		at.UnixNano(), walletID, since.UnixNano())
+	require.NoError(t, err)
+}
+
+func TestInterestAccruer_Run(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+	now := time.Date(2025, time.February, 2, 0, 4, 0, 0, time.UTC)
+	accruer := service.NewInterestAccruer(repo, repo, service.WithInterestChunkSize(1),
+		service.WithInterestClock(func() time.Time { return now }))
+
+	product, err := accruer.CreateProduct(ctx, model.InterestProduct{
+		Name:          "Savings",
+		AnnualRateBps: 500,
+		DayCount:      "ACT/365",
+		Rounding:      "HALF_EVEN",
+	})
+	require.NoError(t, err)
+
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 1_000_000, true))
+	backdate(t, db, walletID, time.Time{}, time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC))
+	_, err = accruer.Assign(ctx, walletID, product.ID, time.Date(2025, time.January, 30, 18, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	// The posting of a frozen wallet fails, the other wallets are accrued
+	frozenID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, frozenID, 1_000_000, true))
+	backdate(t, db, frozenID, time.Time{}, time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC))
+	_, err = accruer.Assign(ctx, frozenID, product.ID, time.Date(2025, time.January, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.NoError(t, repo.SetFrozen(ctx, frozenID, true))
+
+	// February 1 ended less than the lag ago, January 30 and 31 are accrued
+	report, err := accruer.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, service.InterestReport{Accounts: 2, Accruals: 2, Postings: 1, Failed: 1}, report)
+
+	// Two days of 136.99 rounded half to even
+	balance, err := repo.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_000_274), balance)
+
+	postings, err := accruer.Postings(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, postings, 1)
+	assert.Equal(t, "2025-01", postings[0].Period)
+	assert.Equal(t, int64(274), postings[0].Amount)
+
+	account, err := accruer.Account(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, time.January, 31, 0, 0, 0, 0, time.UTC), account.AccruedThrough)
+	assert.Equal(t, int64(-1), account.AccruedUnits, "A rounded up posting carries less than zero")
+
+	frozen, err := accruer.Account(ctx, frozenID)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, time.January, 30, 0, 0, 0, 0, time.UTC), frozen.AccruedThrough)
+
+	report, err = accruer.Run(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, report.Accruals, "Nothing is accrued twice")
+
+	// The interest posted after the month ended earns interest the next day
+	backdate(t, db, walletID, time.Date(2025, time.January, 16, 0, 0, 0, 0, time.UTC), time.Date(2025, time.February, 1, 0, 5, 0, 0, time.UTC))
+	require.NoError(t, repo.SetFrozen(ctx, frozenID, false))
+	now = now.Add(24 * time.Hour)
+	report, err = accruer.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, service.InterestReport{Accounts: 2, Accruals: 3, Postings: 1}, report)
+
+	accruals, err := repo.InterestAccruals(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, accruals, 3)
+	assert.Equal(t, int64(1_000_274), accruals[2].Balance)
+
+	mismatches, err := accruer.Audit(ctx, walletID)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// A tampered accrual no longer replays
+	_, err = db.Exec("UPDATE interest_accruals SET units = units + 1 WHERE wallet_id = ? AND day = ?",
+		walletID, time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	require.NoError(t, err)
+	mismatches, err = accruer.Audit(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 2)
+	assert.Equal(t, "2025-02-01", mismatches[0].Day)
+	assert.Equal(t, "accrual", mismatches[0].Field)
+	assert.Equal(t, "accrued", mismatches[1].Field)
+
+	_, err = accruer.Audit(ctx, frozenID)
+	require.NoError(t, err)
+}
+
+func TestInterestAccruer_Run_Cache(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+	balanceCache := cache.NewLRU(100, time.Hour)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(balanceCache))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+	now := time.Date(2025, time.February, 1, 1, 0, 0, 0, time.UTC)
+	accruer := service.NewInterestAccruer(repo, repo, service.WithInterestCache(balanceCache),
+		service.WithInterestClock(func() time.Time { return now }))
+
+	product, err := accruer.CreateProduct(ctx, model.InterestProduct{
+		Name:          "Savings",
+		AnnualRateBps: 500,
+		DayCount:      "ACT/365",
+		Rounding:      "HALF_EVEN",
+	})
+	require.NoError(t, err)
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 1_000_000, true))
+	backdate(t, db, walletID, time.Time{}, time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC))
+	_, err = accruer.Assign(ctx, walletID, product.ID, time.Date(2025, time.January, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	_, err = walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheHit, info.CacheStatus)
+	assert.Equal(t, int64(1_000_000), info.Balance)
+
+	report, err := accruer.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Postings)
+
+	// The posting removed the cached balance, the next read sees it
+	info, err = walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus)
+	assert.Equal(t, int64(1_000_137), info.Balance)
+}
+
+func TestInterestAccruer_Run_CacheRefreshRacingPosting(t *testing.T) {
+	ctx := context.Background()
+	sqliteRepo, db := newSQLiteRepository(t)
+	repo := newPausingRepository(sqliteRepo)
+	balanceCache := cache.NewLRU(100, time.Hour)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(balanceCache))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+	now := time.Date(2025, time.February, 1, 1, 0, 0, 0, time.UTC)
+	accruer := service.NewInterestAccruer(sqliteRepo, sqliteRepo, service.WithInterestCache(balanceCache),
+		service.WithInterestClock(func() time.Time { return now }))
+
+	product, err := accruer.CreateProduct(ctx, model.InterestProduct{
+		Name:          "Savings",
+		AnnualRateBps: 500,
+		DayCount:      "ACT/365",
+		Rounding:      "HALF_EVEN",
+	})
+	require.NoError(t, err)
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 1_000_000, true))
+	backdate(t, db, walletID, time.Time{}, time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC))
+	_, err = accruer.Assign(ctx, walletID, product.ID, time.Date(2025, time.January, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	// The interest is posted after the shard worker read the balance to cache
+	depositAround(t, walletService, repo, walletID, 10, func() {
+		report, err := accruer.Run(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Postings)
+	})
+
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus, "The balance read before the posting was cached")
+	assert.Equal(t, int64(1_000_147), info.Balance)
+}
+
+func TestInterestAccruer_CreateProduct(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := newSQLiteRepository(t)
+	accruer := service.NewInterestAccruer(repo, repo)
+
+	_, err := accruer.CreateProduct(ctx, model.InterestProduct{Name: "Savings", AnnualRateBps: 250, DayCount: "30/360", Rounding: "DOWN"})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		product model.InterestProduct
+	}{
+		{"missing name", model.InterestProduct{Name: " ", AnnualRateBps: 250, DayCount: "30/360", Rounding: "DOWN"}},
+		{"taken name", model.InterestProduct{Name: "Savings", AnnualRateBps: 300, DayCount: "30/360", Rounding: "DOWN"}},
+		{"zero rate", model.InterestProduct{Name: "Zero", DayCount: "30/360", Rounding: "DOWN"}},
+		{"rate above 100%", model.InterestProduct{Name: "High", AnnualRateBps: 10_001, DayCount: "30/360", Rounding: "DOWN"}},
+		{"unknown day count", model.InterestProduct{Name: "Other", AnnualRateBps: 250, DayCount: "ACT/364", Rounding: "DOWN"}},
+		{"unknown rounding", model.InterestProduct{Name: "Other", AnnualRateBps: 250, DayCount: "ACT/360", Rounding: "NEAREST"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := accruer.CreateProduct(ctx, tc.product)
+			assert.ErrorIs(t, err, model.ErrInvalidInterestProduct)
+		})
+	}
+
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = accruer.Assign(ctx, walletID, "9b0c1c38-53f6-4a53-9d7b-0e1cfd0d1e19", time.Time{})
+	assert.ErrorIs(t, err, model.ErrInterestProductNotFound)
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// startJob calls run every interval in the background until ctx is canceled.
+// The first run starts after one interval, not at startup. A failed run is
+// logged as the failure of name unless ctx was canceled, and the next one
+// still runs. The returned wait blocks until the run in progress has returned
+// after ctx is canceled.
+func startJob(ctx context.Context, interval time.Duration, name string, run func(ctx context.Context) error) (wait func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// A tick may be picked over the cancellation, which then starts no run
+				if ctx.Err() != nil {
+					return
+				}
+				if err := run(ctx); err != nil && ctx.Err() == nil {
+					slog.Error(name+" failed", "error", err)
+				}
+			}
+		}
+	}()
+	return func() { <-done }
+}
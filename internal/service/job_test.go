@@ -0,0 +1,34 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs atomic.Int32
+	var stopped atomic.Bool
+	wait := startJob(ctx, time.Millisecond, "Test job", func(ctx context.Context) error {
+		if runs.Add(1) < 3 {
+			return errors.New("failed")
+		}
+		// The run in progress when ctx is canceled
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		stopped.Store(true)
+		return ctx.Err()
+	})
+
+	assert.Eventually(t, func() bool { return runs.Load() == 3 }, time.Second, time.Millisecond, "A failed run does not stop the job")
+
+	cancel()
+	wait()
+	assert.True(t, stopped.Load(), "wait returns once the run in progress has returned")
+	assert.Equal(t, int32(3), runs.Load())
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+)
+
+const (
+	// DefaultOverdraftChunkSize is the number of wallets with a fee due read per query
+	DefaultOverdraftChunkSize = 500
+	// DefaultOverdraftFeeLag is how long after midnight UTC a day is charged, so
+	// transactions committing late are in its closing balance
+	DefaultOverdraftFeeLag = 5 * time.Minute
+)
+
+// OverdraftFeeCharger manages the credit lines of wallets and charges their
+// daily overdraft fee.
+//
+// A wallet whose closing ledger balance of a UTC day is below zero is charged
+// its daily fee for that day as an OVERDRAFT_FEE ledger entry. The fee never
+// takes the balance below the credit limit: with less credit left, only what
+// is left is charged.
+//
+// Every instance may run the charger: a day is charged once, the charge of a
+// day another instance recorded first is skipped.
+type OverdraftFeeCharger struct {
+	repo    repository.Overdraft
+	history repository.BalanceHistory
+	cache   cache.BalanceCache
+
+	chunkSize int
+	lag       time.Duration
+	now       func() time.Time
+}
+
+// OverdraftOption configures optional OverdraftFeeCharger settings
+type OverdraftOption func(*OverdraftFeeCharger)
+
+// WithOverdraftChunkSize sets the number of wallets with a fee due read per query
+func WithOverdraftChunkSize(size int) OverdraftOption {
+	return func(c *OverdraftFeeCharger) {
+		c.chunkSize = size
+	}
+}
+
+// WithOverdraftFeeLag sets how long after the end of a day it is charged
+func WithOverdraftFeeLag(lag time.Duration) OverdraftOption {
+	return func(c *OverdraftFeeCharger) {
+		c.lag = lag
+	}
+}
+
+// WithOverdraftCache removes the cached balance and credit limit of a wallet
+// after each fee charged and each change of its credit line. Neither goes
+// through the WalletService, so its cache must be given here for it to stay coherent.
+// The removal also keeps a shard worker that read the balance before the change
+// from caching it after.
+func WithOverdraftCache(balanceCache cache.BalanceCache) OverdraftOption {
+	return func(c *OverdraftFeeCharger) {
+		c.cache = balanceCache
+	}
+}
+
+// WithOverdraftClock replaces time.Now, for tests
+func WithOverdraftClock(now func() time.Time) OverdraftOption {
+	return func(c *OverdraftFeeCharger) {
+		c.now = now
+	}
+}
+
+func NewOverdraftFeeCharger(repo repository.Overdraft, history repository.BalanceHistory, opts ...OverdraftOption) *OverdraftFeeCharger {
+	c := &OverdraftFeeCharger{
+		repo:      repo,
+		history:   history,
+		chunkSize: DefaultOverdraftChunkSize,
+		lag:       DefaultOverdraftFeeLag,
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Set sets the credit limit and the daily fee of the wallet. A fee set on a
+// wallet that had none is charged from today on. The limit cannot be lowered
+// below the overdraft in use.
+func (c *OverdraftFeeCharger) Set(ctx context.Context, walletID string, creditLimit, dailyFee int64) (model.Overdraft, error) {
+	o, err := c.repo.SetOverdraft(ctx, walletID, creditLimit, dailyFee, utcDay(c.now()))
+	if err == nil {
+		c.invalidate(ctx, walletID)
+	}
+	return o, err
+}
+
+// invalidate removes the cached balance of the wallet after a committed change.
+func (c *OverdraftFeeCharger) invalidate(ctx context.Context, walletID string) {
+	if c.cache != nil {
+		// The change is committed, so the caller giving up must not skip it
+		c.cache.Delete(context.WithoutCancel(ctx), walletID)
+	}
+}
+
+func (c *OverdraftFeeCharger) Get(ctx context.Context, walletID string) (model.Overdraft, error) {
+	return c.repo.GetOverdraft(ctx, walletID)
+}
+
+func (c *OverdraftFeeCharger) Fees(ctx context.Context, walletID string) ([]model.OverdraftCharge, error) {
+	return c.repo.OverdraftFees(ctx, walletID)
+}
+
+// OverdraftReport is the result of an overdraft fee run.
+type OverdraftReport struct {
+	Wallets int `json:"wallets"`
+	// Days counts the days charged, including the ones that did not end overdrawn
+	Days    int `json:"days"`
+	Charged int `json:"charged"`
+	// Failed counts the wallets left behind by an error, they are caught up by a later run
+	Failed int `json:"failed"`
+}
+
+// Run charges every wallet with a fee through the last day that ended more than
+// the lag ago, catching up the days missed since its last charge. On error, the
+// report holds what was charged until then.
+func (c *OverdraftFeeCharger) Run(ctx context.Context) (OverdraftReport, error) {
+	var report OverdraftReport
+	err := c.run(ctx, &report)
+	metrics.ObserveOverdraftFeeRun(report.Charged, report.Failed, err)
+	return report, err
+}
+
+func (c *OverdraftFeeCharger) run(ctx context.Context, report *OverdraftReport) error {
+	through := utcDay(c.now().Add(-c.lag)).AddDate(0, 0, -1)
+	var last string
+	for {
+		due, err := c.repo.DueOverdraftFees(ctx, last, through, c.chunkSize)
+		if err != nil {
+			return err
+		}
+		if len(due) == 0 {
+			return nil
+		}
+		for _, o := range due {
+			report.Wallets++
+			err := c.charge(ctx, o, through, report)
+			switch {
+			case err == nil:
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case errors.Is(err, repository.ErrOverdraftFeeChanged):
+				// Another instance is charging the wallet
+			default:
+				// A frozen wallet stays at the day it could not be charged until it is unfrozen
+				report.Failed++
+				slog.Error("Overdraft fee of wallet failed", "wallet_id", o.WalletID, "charged_through", o.FeesChargedThrough.Format(time.DateOnly), "error", err)
+			}
+		}
+		last = due[len(due)-1].WalletID
+	}
+}
+
+// charge charges the days of the wallet from its next day through through.
+func (c *OverdraftFeeCharger) charge(ctx context.Context, o model.Overdraft, through time.Time, report *OverdraftReport) error {
+	for day := o.FeesChargedThrough.AddDate(0, 0, 1); !day.After(through); day = day.AddDate(0, 0, 1) {
+		balance, err := c.history.BalanceAt(ctx, o.WalletID, day.AddDate(0, 0, 1).Add(-time.Nanosecond))
+		if err != nil {
+			return err
+		}
+		fee := model.OverdraftCharge{WalletID: o.WalletID, Day: day, Balance: balance}
+		if balance < 0 {
+			fee.Amount = o.DailyFee
+		}
+
+		if fee, err = c.repo.ChargeOverdraftFee(ctx, fee); err != nil {
+			return err
+		}
+		report.Days++
+		if fee.Amount > 0 {
+			c.invalidate(ctx, fee.WalletID)
+			report.Charged++
+			slog.InfoContext(ctx, "Overdraft fee charged",
+				"wallet_id", fee.WalletID, "day", fee.Day.Format(time.DateOnly), "balance", fee.Balance, "amount", fee.Amount)
+		}
+	}
+	return nil
+}
+
+// Start charges the overdraft fees every interval in the background until ctx
+// is canceled, see startJob.
+func (c *OverdraftFeeCharger) Start(ctx context.Context, interval time.Duration) (wait func()) {
+	return startJob(ctx, interval, "Overdraft fee run", func(ctx context.Context) error {
+		report, err := c.Run(ctx)
+		if err != nil {
+			return err
+		}
+		if report.Charged > 0 {
+			slog.Info("Overdraft fees charged",
+				"wallets", report.Wallets, "days", report.Days, "charged", report.Charged, "failed", report.Failed)
+		}
+		return nil
+	})
+}
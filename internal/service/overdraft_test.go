@@ -0,0 +1,180 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/model"
+	"WalletApi/internal/service"
+)
+
+func TestOverdraftFeeCharger_Run(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+	now := time.Date(2025, time.February, 28, 10, 0, 0, 0, time.UTC)
+	charger := service.NewOverdraftFeeCharger(repo, repo, service.WithOverdraftChunkSize(1),
+		service.WithOverdraftClock(func() time.Time { return now }))
+
+	// Overdrawn at the end of February 28, back above zero on March 1
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = charger.Set(ctx, walletID, 500, 25)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 100, true))
+	backdate(t, db, walletID, time.Time{}, time.Date(2025, time.February, 27, 12, 0, 0, 0, time.UTC))
+	since := time.Now()
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 300, false))
+	backdate(t, db, walletID, since, time.Date(2025, time.February, 28, 15, 0, 0, 0, time.UTC))
+	since = time.Now()
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 250, true))
+	backdate(t, db, walletID, since, time.Date(2025, time.March, 1, 10, 0, 0, 0, time.UTC))
+
+	// The fee of a frozen wallet fails, the other wallets are charged
+	frozenID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = charger.Set(ctx, frozenID, 100, 10)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, frozenID, 50, false))
+	backdate(t, db, frozenID, time.Time{}, time.Date(2025, time.February, 28, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, repo.SetFrozen(ctx, frozenID, true))
+
+	// March 2 ended less than the lag ago, February 28 and March 1 are charged
+	now = time.Date(2025, time.March, 3, 0, 4, 0, 0, time.UTC)
+	report, err := charger.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, service.OverdraftReport{Wallets: 2, Days: 2, Charged: 1, Failed: 1}, report)
+
+	o, err := charger.Get(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(25), o.Balance)
+	assert.Equal(t, time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC), *o.FeesChargedThrough)
+
+	fees, err := charger.Fees(ctx, walletID)
+	require.NoError(t, err)
+	require.Len(t, fees, 1)
+	assert.Equal(t, time.Date(2025, time.February, 28, 0, 0, 0, 0, time.UTC), fees[0].Day)
+	assert.Equal(t, int64(-200), fees[0].Balance)
+	assert.Equal(t, int64(25), fees[0].Amount)
+
+	report, err = charger.Run(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, report.Days, "Nothing is charged twice")
+
+	// The frozen wallet is caught up once unfrozen
+	require.NoError(t, repo.SetFrozen(ctx, frozenID, false))
+	report, err = charger.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, service.OverdraftReport{Wallets: 1, Days: 2, Charged: 2}, report)
+
+	balance, err := repo.GetBalance(ctx, frozenID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-70), balance)
+
+	_, err = charger.Set(ctx, frozenID, 60, 10)
+	assert.ErrorIs(t, err, model.ErrInvalidOverdraft)
+}
+
+func TestOverdraftFeeCharger_Run_Cache(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+	balanceCache := cache.NewLRU(100, time.Hour)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(balanceCache))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+	now := time.Date(2025, time.February, 28, 10, 0, 0, 0, time.UTC)
+	charger := service.NewOverdraftFeeCharger(repo, repo, service.WithOverdraftCache(balanceCache),
+		service.WithOverdraftClock(func() time.Time { return now }))
+
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+
+	// A new credit line is read instead of the cached one
+	_, err = charger.Set(ctx, walletID, 500, 25)
+	require.NoError(t, err)
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus)
+	assert.Equal(t, int64(500), info.CreditLimit)
+
+	err = walletService.ProcessTransaction(ctx, model.Transaction{WalletID: walletID, OperationType: model.Withdraw, Amount: 100})
+	require.NoError(t, err)
+	backdate(t, db, walletID, time.Time{}, time.Date(2025, time.February, 28, 12, 0, 0, 0, time.UTC))
+	info, err = walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheHit, info.CacheStatus)
+	assert.Equal(t, int64(-100), info.Balance)
+
+	// The fee removed the cached balance, the next read sees it
+	now = time.Date(2025, time.March, 1, 1, 0, 0, 0, time.UTC)
+	report, err := charger.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Charged)
+
+	info, err = walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus)
+	assert.Equal(t, int64(-125), info.Balance)
+}
+
+func TestOverdraftFeeCharger_Run_CacheRefreshRacingFee(t *testing.T) {
+	ctx := context.Background()
+	sqliteRepo, db := newSQLiteRepository(t)
+	repo := newPausingRepository(sqliteRepo)
+	balanceCache := cache.NewLRU(100, time.Hour)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(balanceCache))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+	now := time.Date(2025, time.February, 28, 10, 0, 0, 0, time.UTC)
+	charger := service.NewOverdraftFeeCharger(sqliteRepo, sqliteRepo, service.WithOverdraftCache(balanceCache),
+		service.WithOverdraftClock(func() time.Time { return now }))
+
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = charger.Set(ctx, walletID, 500, 25)
+	require.NoError(t, err)
+	require.NoError(t, repo.ProcessTransaction(ctx, walletID, 100, false))
+	backdate(t, db, walletID, time.Time{}, time.Date(2025, time.February, 28, 12, 0, 0, 0, time.UTC))
+
+	// The fee is charged after the shard worker read the balance to cache
+	now = time.Date(2025, time.March, 1, 1, 0, 0, 0, time.UTC)
+	depositAround(t, walletService, repo, walletID, 10, func() {
+		report, err := charger.Run(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Charged)
+	})
+
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus, "The balance read before the fee was cached")
+	assert.Equal(t, int64(-115), info.Balance)
+}
+
+func TestWalletService_GetBalanceInfo_CreditLimit(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := newSQLiteRepository(t)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(cache.NewLRU(100, time.Minute)))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = repo.SetOverdraft(ctx, walletID, 100, 0, time.Now())
+	require.NoError(t, err)
+
+	err = walletService.ProcessTransaction(ctx, model.Transaction{WalletID: walletID, OperationType: model.Withdraw, Amount: 60})
+	require.NoError(t, err)
+
+	// Written through to the cache with the limit
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheHit, info.CacheStatus)
+	assert.Equal(t, int64(-60), info.Balance)
+	assert.Equal(t, int64(100), info.CreditLimit)
+
+	err = walletService.ProcessTransaction(ctx, model.Transaction{WalletID: walletID, OperationType: model.Withdraw, Amount: 41})
+	assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+}
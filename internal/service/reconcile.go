@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+)
+
+// DefaultReconcileChunkSize is the number of wallets compared per query unless WithChunkSize is given
+const DefaultReconcileChunkSize = 500
+
+// Reconciler compares the balance of every wallet with the sum of its ledger
+// entries. It reads a chunk of wallets per query, so no run holds locks on the
+// wallets table for long, and records every drift it finds with the repository.
+type Reconciler struct {
+	repo      repository.Administrator
+	cache     cache.BalanceCache
+	chunkSize int
+	freeze    bool
+}
+
+// ReconcilerOption configures optional Reconciler features
+type ReconcilerOption func(*Reconciler)
+
+// WithChunkSize sets the number of wallets compared per query
+func WithChunkSize(size int) ReconcilerOption {
+	return func(r *Reconciler) {
+		r.chunkSize = size
+	}
+}
+
+// WithFreeze makes the reconciler freeze the wallets that drifted, so they reject
+// every transaction until an operator looked into them and unfroze them.
+func WithFreeze(freeze bool) ReconcilerOption {
+	return func(r *Reconciler) {
+		r.freeze = freeze
+	}
+}
+
+// WithReconcileCache removes the cached balance of every drifted wallet. A
+// drift means the balance was changed behind the WalletService, and a frozen
+// wallet must not be served from before its freeze, so its cache must be given
+// here for it to stay coherent.
+func WithReconcileCache(c cache.BalanceCache) ReconcilerOption {
+	return func(r *Reconciler) {
+		r.cache = c
+	}
+}
+
+func NewReconciler(repo repository.Administrator, opts ...ReconcilerOption) *Reconciler {
+	r := &Reconciler{
+		repo:      repo,
+		chunkSize: DefaultReconcileChunkSize,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// ReconcileReport is the result of a reconciliation run.
+type ReconcileReport struct {
+	Checked int                  `json:"checked"`
+	Drifts  []model.BalanceCheck `json:"drifts"`
+	// Frozen tells the drifted wallets were frozen
+	Frozen bool `json:"frozen"`
+}
+
+// Run goes once through every wallet. On error, the report holds what was
+// checked until then.
+func (r *Reconciler) Run(ctx context.Context) (ReconcileReport, error) {
+	start := time.Now()
+	report := ReconcileReport{Drifts: []model.BalanceCheck{}, Frozen: r.freeze}
+	err := r.run(ctx, &report)
+	metrics.ObserveReconciliation(report.Checked, len(report.Drifts), time.Since(start), err)
+	return report, err
+}
+
+func (r *Reconciler) run(ctx context.Context, report *ReconcileReport) error {
+	var last string
+	for {
+		checks, err := r.repo.CheckBalances(ctx, last, r.chunkSize)
+		if err != nil {
+			return err
+		}
+		for _, check := range checks {
+			if check.Drift() != 0 {
+				if err := r.report(ctx, check); err != nil {
+					return err
+				}
+				report.Drifts = append(report.Drifts, check)
+			}
+		}
+		report.Checked += len(checks)
+		if len(checks) < r.chunkSize {
+			return nil
+		}
+		last = checks[len(checks)-1].WalletID
+	}
+}
+
+func (r *Reconciler) report(ctx context.Context, check model.BalanceCheck) error {
+	slog.WarnContext(ctx, "Balance drifted from the ledger",
+		"wallet_id", check.WalletID,
+		"balance", check.Balance,
+		"ledger_balance", check.LedgerBalance,
+		"drift", check.Drift(),
+		"freeze", r.freeze,
+	)
+	if r.freeze {
+		if err := r.repo.SetFrozen(ctx, check.WalletID, true); err != nil {
+			return fmt.Errorf("failed to freeze wallet %s: %w", check.WalletID, err)
+		}
+	}
+	if r.cache != nil {
+		r.cache.Delete(ctx, check.WalletID)
+	}
+	return r.repo.ReportDrift(ctx, check, r.freeze)
+}
+
+// Start runs the reconciliation every interval in the background until ctx is
+// canceled, see startJob.
+func (r *Reconciler) Start(ctx context.Context, interval time.Duration) (wait func()) {
+	return startJob(ctx, interval, "Balance reconciliation", func(ctx context.Context) error {
+		report, err := r.Run(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("Balance reconciliation completed", "checked", report.Checked, "drifted", len(report.Drifts))
+		return nil
+	})
+}
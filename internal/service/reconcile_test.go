@@ -0,0 +1,164 @@
+package service_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/cache"
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/repository/repotest"
+	"WalletApi/internal/service"
+)
+
+// newSQLiteRepository returns a migrated SQLite repository and its database,
+// through which the tests change balances behind the ledger's back.
+func newSQLiteRepository(t *testing.T) (*repository.SQLiteRepository, *sql.DB) {
+	t.Helper()
+	db, err := repository.OpenSQLite(filepath.Join(t.TempDir(), "wallet.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	repo := repository.NewSQLiteRepository(db)
+	require.NoError(t, repo.RunMigrations(context.Background()))
+	return repo, db
+}
+
+func newLegacySQLiteRepository(t *testing.T, balances ...int64) (*repository.SQLiteRepository, *sql.DB, []string) {
+	t.Helper()
+	db, err := repository.OpenSQLite(filepath.Join(t.TempDir(), "wallet.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	walletIDs := repotest.SeedLegacySQLite(t, db, balances...)
+	repo := repository.NewSQLiteRepository(db)
+	require.NoError(t, repo.RunMigrations(context.Background()))
+	return repo, db, walletIDs
+}
+
+func setBalance(t *testing.T, db *sql.DB, walletID string, balance int64) {
+	t.Helper()
+	_, err := db.Exec("UPDATE wallets SET balance = ? WHERE id = ?", balance, walletID)
+	require.NoError(t, err)
+}
+
+func TestReconciler_ReportsDrift(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+
+	walletIDs := make([]string, 5)
+	for i := range walletIDs {
+		var err error
+		walletIDs[i], err = repo.CreateWallet(ctx)
+		require.NoError(t, err)
+		require.NoError(t, repo.ProcessTransaction(ctx, walletIDs[i], 100, true))
+	}
+
+	reconciler := service.NewReconciler(repo, service.WithChunkSize(2))
+	report, err := reconciler.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.Empty(t, report.Drifts)
+
+	// A balance changed by hand leaves no ledger entry
+	setBalance(t, db, walletIDs[3], 1000)
+
+	report, err = reconciler.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.Equal(t, []model.BalanceCheck{{WalletID: walletIDs[3], Balance: 1000, LedgerBalance: 100}}, report.Drifts)
+	assert.False(t, report.Frozen)
+
+	// Not frozen unless asked to
+	require.NoError(t, repo.ProcessTransaction(ctx, walletIDs[3], 1, true))
+	_, err = reconciler.Run(ctx)
+	require.NoError(t, err)
+
+	drifts, err := repo.DriftReports(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, drifts, 1, "The same drift found by every run is one report")
+	assert.Equal(t, walletIDs[3], drifts[0].WalletID)
+	assert.Equal(t, int64(900), drifts[0].Drift())
+	assert.False(t, drifts[0].Frozen)
+}
+
+func TestReconciler_Freeze(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+
+	drifted, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	clean, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	setBalance(t, db, drifted, 50)
+
+	report, err := service.NewReconciler(repo, service.WithFreeze(true)).Run(ctx)
+	require.NoError(t, err)
+	assert.Len(t, report.Drifts, 1)
+	assert.True(t, report.Frozen)
+
+	assert.ErrorIs(t, repo.ProcessTransaction(ctx, drifted, 10, false), model.ErrWalletFrozen)
+	assert.NoError(t, repo.ProcessTransaction(ctx, clean, 10, true))
+
+	drifts, err := repo.DriftReports(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, drifts, 1)
+	assert.Equal(t, drifted, drifts[0].WalletID)
+	assert.True(t, drifts[0].Frozen)
+}
+
+func TestReconciler_Cache(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+	balanceCache := cache.NewLRU(100, time.Hour)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(balanceCache))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+
+	drifted, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	clean, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	for _, walletID := range []string{drifted, clean} {
+		_, err := walletService.GetBalanceInfo(ctx, walletID)
+		require.NoError(t, err)
+	}
+	setBalance(t, db, drifted, 50)
+
+	_, err = service.NewReconciler(repo, service.WithFreeze(true), service.WithReconcileCache(balanceCache)).Run(ctx)
+	require.NoError(t, err)
+
+	// The drifted wallet is read again, the other one is still cached
+	info, err := walletService.GetBalanceInfo(ctx, drifted)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus)
+	assert.Equal(t, int64(50), info.Balance)
+
+	info, err = walletService.GetBalanceInfo(ctx, clean)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheHit, info.CacheStatus)
+}
+
+func TestReconciler_Start(t *testing.T) {
+	repo, db := newSQLiteRepository(t)
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	setBalance(t, db, walletID, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := service.NewReconciler(repo).Start(ctx, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		drifts, err := repo.DriftReports(context.Background(), 0)
+		return err == nil && len(drifts) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Stopped for good once wait returns, the database can be closed
+	cancel()
+	wait()
+}
@@ -0,0 +1,406 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"WalletApi/internal/metrics"
+	"WalletApi/internal/model"
+	"WalletApi/internal/recurrence"
+	"WalletApi/internal/repository"
+)
+
+const (
+	DefaultScheduleBatchSize    = 100
+	DefaultScheduleLease        = time.Minute
+	DefaultScheduleRetries      = 3
+	DefaultScheduleRetryBackoff = time.Hour
+)
+
+// Scheduler stores scheduled transactions and runs their due occurrences
+// through the wallet service.
+//
+// Every instance may run the scheduler. An instance leases the schedules it
+// runs, and a transaction carries the reference of its occurrence, so an
+// occurrence is applied once even when a lease ends before its run is recorded
+// and another instance runs it again.
+type Scheduler struct {
+	repo    repository.Schedules
+	wallets WalletService
+
+	batchSize    int
+	lease        time.Duration
+	retries      int
+	retryBackoff time.Duration
+	now          func() time.Time
+}
+
+// SchedulerOption configures optional Scheduler settings
+type SchedulerOption func(*Scheduler)
+
+// WithBatchSize sets the number of due schedules claimed at a time
+func WithBatchSize(size int) SchedulerOption {
+	return func(s *Scheduler) {
+		s.batchSize = size
+	}
+}
+
+// WithLease sets how long a claimed schedule is kept from other instances. It
+// must exceed the time a batch takes to run.
+func WithLease(lease time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.lease = lease
+	}
+}
+
+// WithRetries retries an occurrence rejected for insufficient funds up to
+// retries times, backoff apart, before it is recorded as failed and skipped.
+func WithRetries(retries int, backoff time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.retries = retries
+		s.retryBackoff = backoff
+	}
+}
+
+// WithClock replaces time.Now, for tests
+func WithClock(now func() time.Time) SchedulerOption {
+	return func(s *Scheduler) {
+		s.now = now
+	}
+}
+
+func NewScheduler(repo repository.Schedules, wallets WalletService, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		repo:         repo,
+		wallets:      wallets,
+		batchSize:    DefaultScheduleBatchSize,
+		lease:        DefaultScheduleLease,
+		retries:      DefaultScheduleRetries,
+		retryBackoff: DefaultScheduleRetryBackoff,
+		now:          time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ScheduleRequest describes a schedule to create. A zero StartAt means now.
+type ScheduleRequest struct {
+	WalletID      string
+	OperationType model.OperationType
+	Amount        int64
+	Recurrence    string
+	StartAt       time.Time
+	EndAt         *time.Time
+}
+
+func invalidSchedule(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", model.ErrInvalidSchedule, fmt.Sprintf(format, args...))
+}
+
+// Create validates req and stores the schedule, which is active and first due
+// at its first occurrence.
+func (s *Scheduler) Create(ctx context.Context, req ScheduleRequest) (model.Schedule, error) {
+	if req.OperationType != model.Deposit && req.OperationType != model.Withdraw {
+		return model.Schedule{}, invalidSchedule("operationType must be DEPOSIT or WITHDRAW")
+	}
+	if req.Amount <= 0 {
+		return model.Schedule{}, invalidSchedule("amount must be positive")
+	}
+	rule, err := recurrence.Parse(req.Recurrence)
+	if err != nil {
+		return model.Schedule{}, fmt.Errorf("%w: %v", model.ErrInvalidSchedule, err)
+	}
+
+	now := s.now().UTC()
+	start := now
+	if !req.StartAt.IsZero() {
+		start = req.StartAt.UTC()
+		// A little slack keeps a start of "now" sent by a client from being rejected
+		if start.Before(now.Add(-time.Minute)) {
+			return model.Schedule{}, invalidSchedule("startAt must not be in the past")
+		}
+	}
+	var end *time.Time
+	if req.EndAt != nil {
+		e := req.EndAt.UTC()
+		if e.Before(start) {
+			return model.Schedule{}, invalidSchedule("endAt must not be before startAt")
+		}
+		end = &e
+	}
+
+	sched := model.Schedule{
+		WalletID:      req.WalletID,
+		OperationType: req.OperationType,
+		Amount:        req.Amount,
+		Recurrence:    rule.String(),
+		StartAt:       start,
+		EndAt:         end,
+		Status:        model.ScheduleActive,
+	}
+	// A cron rule starts at its first matching minute from startAt on
+	first, ok := rule.Next(start, start.Add(-time.Nanosecond))
+	if !ok || afterEnd(sched, first) {
+		return model.Schedule{}, invalidSchedule("the schedule has no occurrence before endAt")
+	}
+	sched.NextRunAt = &first
+	sched.DueAt = &first
+	return s.repo.CreateSchedule(ctx, sched)
+}
+
+func (s *Scheduler) Get(ctx context.Context, walletID, id string) (model.Schedule, error) {
+	return s.repo.GetSchedule(ctx, walletID, id)
+}
+
+func (s *Scheduler) List(ctx context.Context, walletID string) ([]model.Schedule, error) {
+	return s.repo.ListSchedules(ctx, walletID)
+}
+
+// Runs returns up to limit runs of the schedule, newest first.
+func (s *Scheduler) Runs(ctx context.Context, walletID, id string, limit int) ([]model.ScheduleRun, error) {
+	if _, err := s.repo.GetSchedule(ctx, walletID, id); err != nil {
+		return nil, err
+	}
+	return s.repo.ScheduleRuns(ctx, id, limit)
+}
+
+// ScheduleUpdate changes the fields that are set.
+type ScheduleUpdate struct {
+	Amount *int64
+	// Status pauses or resumes the schedule, it is ScheduleActive or SchedulePaused
+	Status *model.ScheduleStatus
+}
+
+// Update changes the amount of the schedule, or pauses or resumes it. A resumed
+// schedule skips the occurrences missed while it was paused.
+func (s *Scheduler) Update(ctx context.Context, walletID, id string, u ScheduleUpdate) (model.Schedule, error) {
+	if u.Amount != nil && *u.Amount <= 0 {
+		return model.Schedule{}, invalidSchedule("amount must be positive")
+	}
+	if u.Status != nil && *u.Status != model.ScheduleActive && *u.Status != model.SchedulePaused {
+		return model.Schedule{}, invalidSchedule("status must be ACTIVE or PAUSED")
+	}
+
+	return s.modify(ctx, walletID, id, func(sched *model.Schedule) {
+		if u.Amount != nil {
+			sched.Amount = *u.Amount
+		}
+		if u.Status != nil && *u.Status != sched.Status {
+			sched.Status = *u.Status
+			if sched.Status == model.ScheduleActive {
+				s.resume(sched)
+			}
+		}
+	})
+}
+
+// Cancel closes the schedule, its runs are kept.
+func (s *Scheduler) Cancel(ctx context.Context, walletID, id string) (model.Schedule, error) {
+	return s.modify(ctx, walletID, id, func(sched *model.Schedule) {
+		sched.Status = model.ScheduleCancelled
+		sched.NextRunAt = nil
+		sched.DueAt = nil
+	})
+}
+
+// modify applies fn to the stored schedule and stores it, again if the
+// scheduler claimed or finished it meanwhile. A run in progress still records
+// its outcome, see advanceChanged.
+func (s *Scheduler) modify(ctx context.Context, walletID, id string, fn func(*model.Schedule)) (model.Schedule, error) {
+	for {
+		sched, err := s.repo.GetSchedule(ctx, walletID, id)
+		if err != nil {
+			return model.Schedule{}, err
+		}
+		if sched.Status.Closed() {
+			return model.Schedule{}, model.ErrScheduleClosed
+		}
+		fn(&sched)
+		updated, err := s.repo.UpdateSchedule(ctx, sched)
+		if errors.Is(err, repository.ErrScheduleChanged) {
+			continue
+		}
+		return updated, err
+	}
+}
+
+// resume moves a repeating schedule to its first occurrence from now on, a
+// single occurrence missed while paused runs right away.
+func (s *Scheduler) resume(sched *model.Schedule) {
+	rule, err := recurrence.Parse(sched.Recurrence)
+	if err != nil || !rule.Repeats() || sched.NextRunAt == nil {
+		return
+	}
+	now := s.now().UTC()
+	if !sched.NextRunAt.Before(now) {
+		return
+	}
+	next, ok := rule.Next(sched.StartAt, now.Add(-time.Nanosecond))
+	s.moveTo(sched, next, ok)
+}
+
+// moveTo makes next the occurrence to run, or completes the schedule if there
+// is none (ok is false) or it is past the end.
+func (s *Scheduler) moveTo(sched *model.Schedule, next time.Time, ok bool) {
+	sched.Attempts = 0
+	if !ok || afterEnd(*sched, next) {
+		sched.Status = model.ScheduleCompleted
+		sched.NextRunAt = nil
+		sched.DueAt = nil
+		return
+	}
+	sched.NextRunAt = &next
+	sched.DueAt = &next
+}
+
+func afterEnd(sched model.Schedule, t time.Time) bool {
+	return sched.EndAt != nil && t.After(*sched.EndAt)
+}
+
+// Run claims the due schedules a batch at a time and runs their occurrence,
+// until none is due. It returns the number of attempts recorded. Occurrences
+// missed while the service was down are caught up one after the other, a
+// schedule whose run failed is left to its lease.
+func (s *Scheduler) Run(ctx context.Context) (int, error) {
+	var total int
+	for {
+		claimed, err := s.repo.ClaimDueSchedules(ctx, s.now().UTC(), s.lease, s.batchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(claimed) == 0 {
+			return total, nil
+		}
+		for _, sched := range claimed {
+			status, err := s.runOnce(ctx, sched)
+			metrics.ObserveScheduledRun(status, err)
+			if err != nil {
+				if ctx.Err() != nil {
+					return total, ctx.Err()
+				}
+				// The lease keeps the schedule until it ends, then it is run again
+				slog.Error("Scheduled transaction failed", "schedule_id", sched.ID, "wallet_id", sched.WalletID, "error", err)
+				continue
+			}
+			total++
+		}
+	}
+}
+
+// runOnce runs the occurrence of a claimed schedule and records the outcome.
+// Business rejections are recorded, other errors are returned and leave the
+// occurrence to be run again.
+func (s *Scheduler) runOnce(ctx context.Context, sched model.Schedule) (model.RunStatus, error) {
+	rule, err := recurrence.Parse(sched.Recurrence)
+	if err != nil {
+		return "", err
+	}
+	occurrence := *sched.NextRunAt
+	run := model.ScheduleRun{
+		Occurrence: occurrence,
+		Attempt:    sched.Attempts + 1,
+		StartedAt:  s.now().UTC(),
+	}
+
+	err = s.wallets.ProcessTransaction(ctx, model.Transaction{
+		WalletID:      sched.WalletID,
+		OperationType: sched.OperationType,
+		Amount:        sched.Amount,
+		Reference:     sched.Reference(occurrence),
+	})
+	run.FinishedAt = s.now().UTC()
+
+	// advance moves a schedule on from the occurrence after the run
+	var advance func(*model.Schedule)
+	skip := func(sched *model.Schedule) {
+		next, ok := rule.Next(sched.StartAt, occurrence)
+		s.moveTo(sched, next, ok)
+	}
+	switch {
+	// Applied by an earlier attempt whose outcome was not recorded
+	case err == nil, errors.Is(err, model.ErrDuplicateReference):
+		run.Status = model.RunSucceeded
+		advance = skip
+	case errors.Is(err, model.ErrInsufficientFunds) && run.Attempt <= s.retries:
+		run.Status = model.RunRetrying
+		run.ErrorCode = model.ErrorCode(err)
+		due := run.FinishedAt.Add(s.retryBackoff)
+		advance = func(sched *model.Schedule) {
+			sched.Attempts = run.Attempt
+			sched.DueAt = &due
+		}
+	case rejected(err):
+		run.Status = model.RunFailed
+		run.ErrorCode = model.ErrorCode(err)
+		advance = skip
+	default:
+		return "", err
+	}
+
+	finished := sched
+	advance(&finished)
+	_, err = s.repo.FinishScheduleRun(ctx, finished, run)
+	if errors.Is(err, repository.ErrScheduleChanged) {
+		// Updated or cancelled while it ran, the run is recorded all the same
+		err = s.advanceChanged(ctx, sched, occurrence, advance)
+	}
+	if err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "Scheduled transaction run",
+		"schedule_id", sched.ID,
+		"wallet_id", sched.WalletID,
+		"occurrence", occurrence,
+		"attempt", run.Attempt,
+		"status", run.Status,
+		"error_code", run.ErrorCode,
+	)
+	return run.Status, nil
+}
+
+// advanceChanged applies advance to the schedule changed while its occurrence
+// ran, unless the change closed it or moved it past the occurrence. A paused
+// schedule is advanced too, so it does not run the occurrence again once
+// resumed. Its lease is left to end, UpdateSchedule keeps it.
+func (s *Scheduler) advanceChanged(ctx context.Context, sched model.Schedule, occurrence time.Time, advance func(*model.Schedule)) error {
+	for {
+		current, err := s.repo.GetSchedule(ctx, sched.WalletID, sched.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status.Closed() || current.NextRunAt == nil || !current.NextRunAt.Equal(occurrence) {
+			return nil
+		}
+		advance(&current)
+		_, err = s.repo.UpdateSchedule(ctx, current)
+		if !errors.Is(err, repository.ErrScheduleChanged) {
+			return err
+		}
+	}
+}
+
+// rejected reports whether the wallet rejected the transaction, which running
+// it again would not change.
+func rejected(err error) bool {
+	return model.ErrorCode(err) != "" && !errors.Is(err, model.ErrShuttingDown)
+}
+
+// Start runs the due schedules every interval in the background until ctx is
+// canceled, see startJob.
+func (s *Scheduler) Start(ctx context.Context, interval time.Duration) (wait func()) {
+	return startJob(ctx, interval, "Scheduled transactions", func(ctx context.Context) error {
+		runs, err := s.Run(ctx)
+		if err != nil {
+			return err
+		}
+		if runs > 0 {
+			slog.Info("Scheduled transactions run", "runs", runs)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,406 @@
+package service_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
+	"WalletApi/internal/service"
+)
+
+// clock is a settable time for the scheduler.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+type schedulerFixture struct {
+	repo      *repository.SQLiteRepository
+	wallets   service.WalletService
+	clock     *clock
+	scheduler *service.Scheduler
+	walletID  string
+}
+
+func newSchedulerFixture(t *testing.T, balance int64, opts ...service.SchedulerOption) *schedulerFixture {
+	t.Helper()
+	repo, _ := newSQLiteRepository(t)
+	wallets := service.NewWalletService(repo, 2)
+	t.Cleanup(func() { wallets.Shutdown(context.Background()) })
+
+	walletID, err := repo.CreateWallet(context.Background())
+	require.NoError(t, err)
+	if balance > 0 {
+		require.NoError(t, repo.ProcessTransaction(context.Background(), walletID, balance, true))
+	}
+
+	c := &clock{now: time.Date(2030, time.January, 15, 9, 0, 0, 0, time.UTC)}
+	opts = append([]service.SchedulerOption{service.WithClock(c.Now)}, opts...)
+	return &schedulerFixture{
+		repo:      repo,
+		wallets:   wallets,
+		clock:     c,
+		scheduler: service.NewScheduler(repo, wallets, opts...),
+		walletID:  walletID,
+	}
+}
+
+func (f *schedulerFixture) run(t *testing.T, at time.Time) int {
+	t.Helper()
+	f.clock.Set(at)
+	runs, err := f.scheduler.Run(context.Background())
+	require.NoError(t, err)
+	return runs
+}
+
+func (f *schedulerFixture) balance(t *testing.T) int64 {
+	t.Helper()
+	balance, err := f.repo.GetBalance(context.Background(), f.walletID)
+	require.NoError(t, err)
+	return balance
+}
+
+func (f *schedulerFixture) runs(t *testing.T, id string) []model.ScheduleRun {
+	t.Helper()
+	runs, err := f.scheduler.Runs(context.Background(), f.walletID, id, 0)
+	require.NoError(t, err)
+	return runs
+}
+
+func TestScheduler_Create(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+	now := f.clock.Now()
+	end := now.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		req  service.ScheduleRequest
+	}{
+		{"operation", service.ScheduleRequest{OperationType: "TRANSFER", Amount: 1}},
+		{"amount", service.ScheduleRequest{OperationType: model.Deposit}},
+		{"recurrence", service.ScheduleRequest{OperationType: model.Deposit, Amount: 1, Recurrence: "hourly"}},
+		{"past start", service.ScheduleRequest{OperationType: model.Deposit, Amount: 1, StartAt: now.Add(-time.Hour)}},
+		{"end before start", service.ScheduleRequest{OperationType: model.Deposit, Amount: 1, StartAt: now.Add(2 * time.Hour), EndAt: &end}},
+		{"no occurrence before end", service.ScheduleRequest{OperationType: model.Deposit, Amount: 1, Recurrence: "0 12 * * *", EndAt: &end}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.WalletID = f.walletID
+			_, err := f.scheduler.Create(ctx, tt.req)
+			assert.ErrorIs(t, err, model.ErrInvalidSchedule)
+		})
+	}
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{
+		WalletID:      f.walletID,
+		OperationType: model.Deposit,
+		Amount:        5,
+		Recurrence:    "0 12 * * 1-5",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, model.ScheduleActive, s.Status)
+	assert.Equal(t, now, s.StartAt, "A missing start is now")
+	require.NotNil(t, s.NextRunAt)
+	assert.Equal(t, time.Date(2030, time.January, 15, 12, 0, 0, 0, time.UTC), *s.NextRunAt, "Cron rules start at their first match")
+	assert.Equal(t, s.NextRunAt, s.DueAt)
+
+	_, err = f.scheduler.Create(ctx, service.ScheduleRequest{WalletID: "00000000-0000-0000-0000-000000000000", OperationType: model.Deposit, Amount: 1})
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
+
+func TestScheduler_RunsOccurrences(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+	start := f.clock.Now().Add(time.Hour)
+	end := start.Add(48 * time.Hour)
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{
+		WalletID:      f.walletID,
+		OperationType: model.Deposit,
+		Amount:        10,
+		Recurrence:    "daily",
+		StartAt:       start,
+		EndAt:         &end,
+	})
+	require.NoError(t, err)
+
+	assert.Zero(t, f.run(t, start.Add(-time.Minute)), "Not due yet")
+	assert.Equal(t, 1, f.run(t, start))
+	assert.Zero(t, f.run(t, start.Add(time.Minute)), "The next occurrence is tomorrow")
+	assert.Equal(t, int64(10), f.balance(t))
+
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	require.NotNil(t, s.NextRunAt)
+	assert.Equal(t, start.Add(24*time.Hour), *s.NextRunAt)
+
+	// Both occurrences missed while the service was down are caught up, the end is the last one
+	assert.Equal(t, 2, f.run(t, start.Add(72*time.Hour)))
+	assert.Equal(t, int64(30), f.balance(t))
+
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ScheduleCompleted, s.Status)
+	assert.Nil(t, s.NextRunAt)
+	assert.Nil(t, s.DueAt)
+
+	runs := f.runs(t, s.ID)
+	require.Len(t, runs, 3)
+	for i, run := range runs {
+		assert.Equal(t, model.RunSucceeded, run.Status)
+		assert.Equal(t, 1, run.Attempt)
+		assert.Equal(t, start.Add(time.Duration(2-i)*24*time.Hour), run.Occurrence, "Newest first")
+	}
+
+	_, err = f.scheduler.Cancel(ctx, f.walletID, s.ID)
+	assert.ErrorIs(t, err, model.ErrScheduleClosed)
+}
+
+func TestScheduler_RetriesInsufficientFunds(t *testing.T) {
+	f := newSchedulerFixture(t, 5, service.WithRetries(1, time.Hour))
+	ctx := context.Background()
+	start := f.clock.Now()
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{
+		WalletID:      f.walletID,
+		OperationType: model.Withdraw,
+		Amount:        10,
+		Recurrence:    "weekly",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, f.run(t, start))
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, s.Attempts)
+	assert.Equal(t, start, *s.NextRunAt, "The occurrence is retried")
+	assert.Equal(t, start.Add(time.Hour), *s.DueAt)
+
+	assert.Zero(t, f.run(t, start.Add(30*time.Minute)))
+	assert.Equal(t, 1, f.run(t, start.Add(time.Hour)))
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Zero(t, s.Attempts)
+	assert.Equal(t, start.Add(7*24*time.Hour), *s.NextRunAt, "Out of retries, the occurrence is skipped")
+
+	// Funded in time, the next occurrence goes through
+	require.NoError(t, f.repo.ProcessTransaction(ctx, f.walletID, 10, true))
+	assert.Equal(t, 1, f.run(t, start.Add(7*24*time.Hour)))
+	assert.Equal(t, int64(5), f.balance(t))
+
+	runs := f.runs(t, s.ID)
+	require.Len(t, runs, 3)
+	assert.Equal(t, model.RunSucceeded, runs[0].Status)
+	assert.Equal(t, model.RunFailed, runs[1].Status)
+	assert.Equal(t, model.CodeInsufficientFunds, runs[1].ErrorCode)
+	assert.Equal(t, 2, runs[1].Attempt)
+	assert.Equal(t, model.RunRetrying, runs[2].Status)
+	assert.Equal(t, start, runs[2].Occurrence)
+	assert.Equal(t, 1, runs[2].Attempt)
+}
+
+func TestScheduler_FrozenWalletFails(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{WalletID: f.walletID, OperationType: model.Deposit, Amount: 1})
+	require.NoError(t, err)
+	require.NoError(t, f.repo.SetFrozen(ctx, f.walletID, true))
+
+	assert.Equal(t, 1, f.run(t, f.clock.Now()))
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ScheduleCompleted, s.Status, "Only insufficient funds are retried")
+
+	runs := f.runs(t, s.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, model.RunFailed, runs[0].Status)
+	assert.Equal(t, model.CodeWalletFrozen, runs[0].ErrorCode)
+}
+
+func TestScheduler_OccurrenceAppliedOnce(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+	now := f.clock.Now()
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{WalletID: f.walletID, OperationType: model.Deposit, Amount: 7, Recurrence: "daily"})
+	require.NoError(t, err)
+
+	// An instance claimed the schedule and applied the occurrence, then died before recording it
+	claimed, err := f.repo.ClaimDueSchedules(ctx, now, time.Minute, 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.NoError(t, f.repo.ProcessTransactionOnce(ctx, f.walletID, 7, true, s.Reference(now)))
+
+	assert.Zero(t, f.run(t, now.Add(30*time.Second)), "The lease keeps the schedule from other instances")
+	assert.Equal(t, 1, f.run(t, now.Add(2*time.Minute)))
+	assert.Equal(t, int64(7), f.balance(t))
+
+	runs := f.runs(t, s.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, model.RunSucceeded, runs[0].Status)
+
+	// Instances running at the same time apply the next occurrence once
+	next := now.Add(24 * time.Hour)
+	f.clock.Set(next)
+	other := service.NewScheduler(f.repo, f.wallets, service.WithClock(f.clock.Now))
+	var wg sync.WaitGroup
+	for _, scheduler := range []*service.Scheduler{f.scheduler, other, f.scheduler, other} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := scheduler.Run(ctx)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(14), f.balance(t))
+	assert.Len(t, f.runs(t, s.ID), 2)
+}
+
+func TestScheduler_PauseResume(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+	start := f.clock.Now()
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{WalletID: f.walletID, OperationType: model.Deposit, Amount: 3, Recurrence: "daily"})
+	require.NoError(t, err)
+
+	paused := model.SchedulePaused
+	amount := int64(4)
+	s, err = f.scheduler.Update(ctx, f.walletID, s.ID, service.ScheduleUpdate{Status: &paused, Amount: &amount})
+	require.NoError(t, err)
+	assert.Equal(t, model.SchedulePaused, s.Status)
+	assert.Equal(t, int64(4), s.Amount)
+	assert.Zero(t, f.run(t, start.Add(50*time.Hour)), "Paused schedules do not run")
+
+	// Resumed, the missed occurrences are skipped
+	active := model.ScheduleActive
+	s, err = f.scheduler.Update(ctx, f.walletID, s.ID, service.ScheduleUpdate{Status: &active})
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(72*time.Hour), *s.NextRunAt)
+	assert.Zero(t, f.run(t, start.Add(50*time.Hour)))
+	assert.Equal(t, 1, f.run(t, start.Add(72*time.Hour)))
+	assert.Equal(t, int64(4), f.balance(t))
+
+	invalid := model.ScheduleCompleted
+	_, err = f.scheduler.Update(ctx, f.walletID, s.ID, service.ScheduleUpdate{Status: &invalid})
+	assert.ErrorIs(t, err, model.ErrInvalidSchedule)
+
+	s, err = f.scheduler.Cancel(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ScheduleCancelled, s.Status)
+	assert.Nil(t, s.NextRunAt)
+	assert.Zero(t, f.run(t, start.Add(96*time.Hour)))
+	assert.Len(t, f.runs(t, s.ID), 1, "Cancelling keeps the history")
+
+	_, err = f.scheduler.Update(ctx, f.walletID, s.ID, service.ScheduleUpdate{Amount: &amount})
+	assert.ErrorIs(t, err, model.ErrScheduleClosed)
+	_, err = f.scheduler.Get(ctx, f.walletID, "00000000-0000-0000-0000-000000000000")
+	assert.ErrorIs(t, err, model.ErrScheduleNotFound)
+}
+
+// blockingWallets holds each transaction of the scheduler until it is released.
+type blockingWallets struct {
+	service.WalletService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWallets) ProcessTransaction(ctx context.Context, t model.Transaction) error {
+	w.started <- struct{}{}
+	<-w.release
+	return w.WalletService.ProcessTransaction(ctx, t)
+}
+
+// runBlocked runs the due schedules and calls change while the transaction
+// of the first one is in flight.
+func (f *schedulerFixture) runBlocked(t *testing.T, at time.Time, change func()) {
+	t.Helper()
+	f.clock.Set(at)
+	wallets := &blockingWallets{WalletService: f.wallets, started: make(chan struct{}), release: make(chan struct{})}
+	scheduler := service.NewScheduler(f.repo, wallets, service.WithClock(f.clock.Now))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := scheduler.Run(context.Background())
+		done <- err
+	}()
+	<-wallets.started
+	change()
+	close(wallets.release)
+	require.NoError(t, <-done)
+}
+
+func TestScheduler_CancelDuringRun(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+	start := f.clock.Now()
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{WalletID: f.walletID, OperationType: model.Deposit, Amount: 7, Recurrence: "daily"})
+	require.NoError(t, err)
+
+	f.runBlocked(t, start, func() {
+		cancelled, err := f.scheduler.Cancel(ctx, f.walletID, s.ID)
+		require.NoError(t, err)
+		assert.Equal(t, model.ScheduleCancelled, cancelled.Status)
+	})
+
+	// The deposit in flight was applied, its run is in the history
+	assert.Equal(t, int64(7), f.balance(t))
+	runs := f.runs(t, s.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, model.RunSucceeded, runs[0].Status)
+	assert.Equal(t, start, runs[0].Occurrence)
+
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ScheduleCancelled, s.Status, "The run does not reopen the schedule")
+	assert.Nil(t, s.NextRunAt)
+}
+
+func TestScheduler_UpdateDuringRun(t *testing.T) {
+	f := newSchedulerFixture(t, 0)
+	ctx := context.Background()
+	start := f.clock.Now()
+
+	s, err := f.scheduler.Create(ctx, service.ScheduleRequest{WalletID: f.walletID, OperationType: model.Deposit, Amount: 7, Recurrence: "daily"})
+	require.NoError(t, err)
+
+	amount := int64(9)
+	f.runBlocked(t, start, func() {
+		_, err := f.scheduler.Update(ctx, f.walletID, s.ID, service.ScheduleUpdate{Amount: &amount})
+		require.NoError(t, err)
+	})
+	assert.Len(t, f.runs(t, s.ID), 1)
+
+	// The update is kept and the schedule moved on to its next occurrence
+	s, err = f.scheduler.Get(ctx, f.walletID, s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), s.Amount)
+	require.NotNil(t, s.NextRunAt)
+	assert.Equal(t, start.Add(24*time.Hour), *s.NextRunAt)
+
+	assert.Equal(t, 1, f.run(t, start.Add(24*time.Hour+2*service.DefaultScheduleLease)))
+	assert.Equal(t, int64(16), f.balance(t))
+	assert.Len(t, f.runs(t, s.ID), 2)
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"WalletApi/internal/repository"
+)
+
+// Snapshotter records the ledger balance of every wallet, a chunk of wallets at
+// a time, so point-in-time balances only replay the entries since the latest snapshot.
+type Snapshotter struct {
+	repo      repository.BalanceHistory
+	chunkSize int
+}
+
+func NewSnapshotter(repo repository.BalanceHistory, chunkSize int) *Snapshotter {
+	return &Snapshotter{repo: repo, chunkSize: chunkSize}
+}
+
+// Run goes once through every wallet and returns the number of snapshots taken.
+// Wallets without entries since their latest snapshot are skipped.
+func (s *Snapshotter) Run(ctx context.Context) (int, error) {
+	var last string
+	var total int
+	for {
+		next, taken, err := s.repo.SnapshotBalances(ctx, last, s.chunkSize)
+		if err != nil {
+			return total, err
+		}
+		if next == "" {
+			return total, nil
+		}
+		total += taken
+		last = next
+	}
+}
+
+// Start takes the snapshots every interval in the background until ctx is
+// canceled, see startJob.
+func (s *Snapshotter) Start(ctx context.Context, interval time.Duration) (wait func()) {
+	return startJob(ctx, interval, "Balance snapshots", func(ctx context.Context) error {
+		taken, err := s.Run(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("Balance snapshots taken", "taken", taken)
+		return nil
+	})
+}
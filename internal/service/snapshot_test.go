@@ -0,0 +1,46 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/service"
+)
+
+func TestSnapshotter_Run(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newSQLiteRepository(t)
+
+	walletIDs := make([]string, 5)
+	for i := range walletIDs {
+		var err error
+		walletIDs[i], err = repo.CreateWallet(ctx)
+		require.NoError(t, err)
+	}
+	// Wallets without entries have nothing to snapshot
+	for _, walletID := range walletIDs[:3] {
+		require.NoError(t, repo.ProcessTransaction(ctx, walletID, 100, true))
+	}
+
+	snapshotter := service.NewSnapshotter(repo, 2)
+	taken, err := snapshotter.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, taken)
+
+	require.NoError(t, repo.ProcessTransaction(ctx, walletIDs[0], 20, false))
+	taken, err = snapshotter.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, taken, "Only the wallets with new entries get a snapshot")
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM balance_snapshots").Scan(&count))
+	assert.Equal(t, 4, count)
+
+	balance, err := repo.BalanceAt(ctx, walletIDs[0], time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(80), balance)
+}
@@ -2,11 +2,23 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"WalletApi/internal/cache"
+	"WalletApi/internal/metrics"
 	"WalletApi/internal/model"
 	"WalletApi/internal/repository"
+	"WalletApi/internal/statement"
+	"WalletApi/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // WalletService interface for working with wallets
@@ -14,33 +26,109 @@ type WalletService interface {
 	CreateWallet(ctx context.Context) (string, error)
 	ProcessTransaction(ctx context.Context, t model.Transaction) error
 	GetBalance(ctx context.Context, walletID string) (int64, error)
-	Shutdown()
+	GetBalanceInfo(ctx context.Context, walletID string) (BalanceInfo, error)
+	// GetBalanceAt returns the balance of the wallet as of at, computed from its ledger
+	GetBalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error)
+	// WriteStatement streams the statement of the wallet for the entries created
+	// after from and up to to, with the running balance after each of them
+	WriteStatement(ctx context.Context, walletID string, from, to time.Time, w statement.Writer) error
+	// QueueDepths returns the number of transactions waiting in each shard queue
+	QueueDepths() []int
+	// QueueCapacity returns how many transactions each shard queue can hold
+	QueueCapacity() int
+	// Shutdown stops accepting transactions and drains the shard queues, see walletService.Shutdown
+	Shutdown(ctx context.Context) error
+}
+
+// CacheStatus tells how the balance cache took part in a read.
+type CacheStatus string
+
+const (
+	CacheDisabled CacheStatus = ""
+	CacheHit      CacheStatus = "hit"
+	CacheMiss     CacheStatus = "miss"
+	CacheBypass   CacheStatus = "bypass" // strong reads never use the cache
+)
+
+// BalanceInfo is a wallet balance with details about its freshness
+type BalanceInfo struct {
+	Balance int64
+	// CreditLimit is how far below zero the balance may go, see model.Overdraft
+	CreditLimit int64
+	CacheStatus CacheStatus
+	Age         time.Duration // time since the balance was cached, zero unless it is a hit
 }
 
 type walletService struct {
-	repo    repository.WalletRepository
-	queues  []chan transactionRequest
-	workers int
-	wg      sync.WaitGroup
+	repo      repository.WalletRepository
+	cache     cache.BalanceCache
+	queues    []chan transactionRequest
+	queueSize int
+	workers   int
+	wg        sync.WaitGroup
+
+	// mu guards closed, so no transaction is sent to a queue Shutdown has closed
+	mu     sync.RWMutex
+	closed bool
+	// closing is closed when Shutdown starts, releasing the senders waiting
+	// for room in a full queue so Shutdown can take mu
+	closing     chan struct{}
+	closingOnce sync.Once
+	dropping    atomic.Bool // set when the drain deadline passed, workers answer without processing
+	dropped     atomic.Int64
+}
+
+// Option configures optional WalletService features
+type Option func(*walletService)
+
+// WithCache puts the cache in front of balance reads. The shard workers keep it
+// up to date after every committed transaction, and the background jobs that
+// change wallets outside of them remove the entries they change when given the
+// same cache (WithInterestCache, WithOverdraftCache, WithReconcileCache); the
+// cache's versions keep a balance read before such a removal from being stored
+// after it. It is coherent as long as no other process writes the wallets this instance serves:
+// changes made by walletctl or another instance are only seen once the entry
+// expires, so leave the cache off where they must be seen at once.
+func WithCache(c cache.BalanceCache) Option {
+	return func(s *walletService) {
+		s.cache = c
+	}
 }
 
 type transactionRequest struct {
-	ctx    context.Context
-	t      model.Transaction
-	result chan error
+	ctx      context.Context
+	t        model.Transaction
+	result   chan error
+	queuedAt time.Time
+	// waitSpan covers the time spent in the shard queue, the worker ends it
+	waitSpan trace.Span
 }
 
-// New WalletService creates a new implementation of WalletService
-func NewWalletService(repo repository.WalletRepository, workers int) WalletService {
-	queues := make([]chan transactionRequest, workers)
-	for i := range queues {
-		queues[i] = make(chan transactionRequest, 10000)
+// DefaultQueueSize is the capacity of each shard queue unless WithQueueSize is given
+const DefaultQueueSize = 10000
+
+// WithQueueSize sets the capacity of each shard queue
+func WithQueueSize(size int) Option {
+	return func(s *walletService) {
+		s.queueSize = size
 	}
+}
 
+// New WalletService creates a new implementation of WalletService
+func NewWalletService(repo repository.WalletRepository, workers int, opts ...Option) WalletService {
 	s := &walletService{
-		repo:    repo,
-		queues:  queues,
-		workers: workers,
+		repo:      repo,
+		workers:   workers,
+		queueSize: DefaultQueueSize,
+		closing:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.queues = make([]chan transactionRequest, workers)
+	for i := range s.queues {
+		s.queues[i] = make(chan transactionRequest, s.queueSize)
 	}
 
 	for i := 0; i < workers; i++ {
@@ -65,42 +153,252 @@ func (s *walletService) ProcessTransaction(ctx context.Context, t model.Transact
 	shard := s.getShard(t.WalletID)
 	resultChan := make(chan error, 1)
 
-	s.queues[shard] <- transactionRequest{
-		ctx:    ctx,
-		t:      t,
-		result: resultChan,
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return model.ErrShuttingDown
 	}
 
+	// The request span stays the parent of the worker's spans, the wait span is its sibling
+	_, waitSpan := tracing.Tracer().Start(ctx, "shard.queue_wait",
+		trace.WithAttributes(attribute.Int("wallet.shard", shard)))
+
+	req := transactionRequest{
+		ctx:      ctx,
+		t:        t,
+		result:   resultChan,
+		queuedAt: time.Now(),
+		waitSpan: waitSpan,
+	}
+	select {
+	case s.queues[shard] <- req:
+	case <-s.closing:
+		// The queue is full and Shutdown waits for mu, the transaction was never accepted
+		s.mu.RUnlock()
+		waitSpan.End()
+		return model.ErrShuttingDown
+	}
+	s.mu.RUnlock()
+
+	// Every accepted transaction gets an answer, the workers drain the queues before exiting
 	return <-resultChan
 }
 
+// WithStrongConsistency makes reads with the returned context bypass read replicas.
+func WithStrongConsistency(ctx context.Context) context.Context {
+	return repository.WithStrongConsistency(ctx)
+}
+
 func (s *walletService) GetBalance(ctx context.Context, walletID string) (int64, error) {
-	return s.repo.GetBalance(ctx, walletID)
+	info, err := s.GetBalanceInfo(ctx, walletID)
+	return info.Balance, err
+}
+
+var errNoBalanceHistory = errors.New("the storage does not keep the balance history")
+
+func (s *walletService) GetBalanceAt(ctx context.Context, walletID string, at time.Time) (int64, error) {
+	history, ok := s.repo.(repository.BalanceHistory)
+	if !ok {
+		return 0, errNoBalanceHistory
+	}
+	return history.BalanceAt(ctx, walletID, at)
+}
+
+func (s *walletService) WriteStatement(ctx context.Context, walletID string, from, to time.Time, w statement.Writer) error {
+	history, ok := s.repo.(repository.BalanceHistory)
+	if !ok {
+		return errNoBalanceHistory
+	}
+
+	var balance int64
+	err := history.StreamStatement(ctx, walletID, from, to,
+		func(opening int64) error {
+			balance = opening
+			return w.Begin(statement.Header{WalletID: walletID, From: from, To: to, Opening: opening})
+		},
+		func(e model.LedgerEntry) error {
+			balance += e.Amount
+			return w.Entry(e, balance)
+		})
+	if err != nil {
+		return err
+	}
+	return w.End(balance)
+}
+
+func (s *walletService) GetBalanceInfo(ctx context.Context, walletID string) (BalanceInfo, error) {
+	if s.cache == nil {
+		return s.readBalance(ctx, walletID)
+	}
+
+	if repository.IsStrongConsistency(ctx) {
+		version := s.cache.Version(ctx, walletID)
+		info, err := s.readBalance(ctx, walletID)
+		if err != nil {
+			return BalanceInfo{}, err
+		}
+		s.cache.SetIfAbsent(ctx, walletID, version, info.Balance, info.CreditLimit)
+		info.CacheStatus = CacheBypass
+		return info, nil
+	}
+
+	if entry, ok := s.cache.Get(ctx, walletID); ok {
+		return BalanceInfo{
+			Balance:     entry.Balance,
+			CreditLimit: entry.CreditLimit,
+			CacheStatus: CacheHit,
+			Age:         time.Since(entry.StoredAt),
+		}, nil
+	}
+
+	// A replica may lag behind, the cache is only filled from the primary
+	version := s.cache.Version(ctx, walletID)
+	info, err := s.readBalance(repository.WithStrongConsistency(ctx), walletID)
+	if err != nil {
+		return BalanceInfo{}, err
+	}
+	s.cache.SetIfAbsent(ctx, walletID, version, info.Balance, info.CreditLimit)
+	info.CacheStatus = CacheMiss
+	return info, nil
+}
+
+// readBalance reads the balance of the wallet from the repository, with its
+// credit limit when the repository supports overdrafts.
+func (s *walletService) readBalance(ctx context.Context, walletID string) (BalanceInfo, error) {
+	if overdraft, ok := s.repo.(repository.Overdraft); ok {
+		o, err := overdraft.GetOverdraft(ctx, walletID)
+		return BalanceInfo{Balance: o.Balance, CreditLimit: o.CreditLimit}, err
+	}
+	balance, err := s.repo.GetBalance(ctx, walletID)
+	return BalanceInfo{Balance: balance}, err
 }
 
 func (s *walletService) processTransactions(shardIndex int) {
 	defer s.wg.Done()
 	for req := range s.queues[shardIndex] {
-		var err error
-		switch req.t.OperationType {
-		case model.Deposit:
-			err = s.repo.ProcessTransaction(req.ctx, req.t.WalletID, req.t.Amount, true)
-		case model.Withdraw:
-			err = s.repo.ProcessTransaction(req.ctx, req.t.WalletID, req.t.Amount, false)
-		default:
-			err = model.ErrInvalidOperation
+		req.waitSpan.End()
+		metrics.ObserveQueueWait(shardIndex, time.Since(req.queuedAt))
+
+		if s.dropping.Load() {
+			s.dropped.Add(1)
+			metrics.ObserveTransaction(req.t.OperationType, model.ErrShuttingDown)
+			req.result <- model.ErrShuttingDown
+			continue
 		}
-		req.result <- err
+		req.result <- s.process(req, shardIndex)
+	}
+}
+
+func (s *walletService) process(req transactionRequest, shardIndex int) error {
+	ctx, span := tracing.Tracer().Start(req.ctx, "shard.process", trace.WithAttributes(
+		attribute.Int("wallet.shard", shardIndex),
+		attribute.String("wallet.operation", string(req.t.OperationType)),
+	))
+	defer span.End()
+
+	var err error
+	switch req.t.OperationType {
+	case model.Deposit:
+		err = s.apply(ctx, req.t, true)
+	case model.Withdraw:
+		err = s.apply(ctx, req.t, false)
+	default:
+		err = model.ErrInvalidOperation
+	}
+	if err == nil && s.cache != nil {
+		s.refreshCache(ctx, req.t.WalletID)
+	}
+	metrics.ObserveTransaction(req.t.OperationType, err)
+
+	if err != nil {
+		span.SetAttributes(attribute.String("wallet.outcome", metrics.Outcome(err)))
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+var errNoReferences = errors.New("the storage cannot apply a transaction at most once")
+
+// apply applies t with the repository, at most once when it has a reference.
+func (s *walletService) apply(ctx context.Context, t model.Transaction, isDeposit bool) error {
+	if t.Reference == "" {
+		return s.repo.ProcessTransaction(ctx, t.WalletID, t.Amount, isDeposit)
+	}
+	once, ok := s.repo.(repository.OnceProcessor)
+	if !ok {
+		return errNoReferences
+	}
+	return once.ProcessTransactionOnce(ctx, t.WalletID, t.Amount, isDeposit, t.Reference)
+}
+
+// refreshCache writes the committed balance through to the cache. It runs on the
+// wallet's shard worker, so no other transaction of this wallet can interleave,
+// but the background jobs change balances outside of the workers: one committing
+// after the balance is read deletes the wallet from the cache, and the versioned
+// Set then drops the balance read before it instead of storing it.
+func (s *walletService) refreshCache(ctx context.Context, walletID string) {
+	// The transaction is committed, so the caller giving up must not skip the update
+	ctx = repository.WithStrongConsistency(context.WithoutCancel(ctx))
+
+	version := s.cache.Version(ctx, walletID)
+	info, err := s.readBalance(ctx, walletID)
+	if err != nil {
+		s.cache.Delete(ctx, walletID)
+		return
 	}
+	s.cache.Set(ctx, walletID, version, info.Balance, info.CreditLimit)
+}
+
+func (s *walletService) QueueDepths() []int {
+	depths := make([]int, len(s.queues))
+	for i, q := range s.queues {
+		depths[i] = len(q)
+	}
+	return depths
+}
+
+func (s *walletService) QueueCapacity() int {
+	return s.queueSize
 }
 
 func (s *walletService) CreateWallet(ctx context.Context) (string, error) {
 	return s.repo.CreateWallet(ctx)
 }
 
-func (s *walletService) Shutdown() {
-	for i := range s.queues {
-		close(s.queues[i])
+// Shutdown stops accepting transactions, new ones fail with model.ErrShuttingDown,
+// and waits for the workers to process the queued ones. When ctx ends first, the
+// transactions still queued are answered with model.ErrShuttingDown without being
+// processed and the returned error reports how many were dropped. In both cases it
+// returns once every worker has stopped, so the repository can be closed afterwards.
+func (s *walletService) Shutdown(ctx context.Context) error {
+	s.closingOnce.Do(func() { close(s.closing) })
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for i := range s.queues {
+			close(s.queues[i])
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// A worker finishes the transaction it is processing, the rest of its queue is dropped
+	s.dropping.Store(true)
+	<-done
+
+	if dropped := s.dropped.Load(); dropped > 0 {
+		return fmt.Errorf("dropped %d queued transactions: %w", dropped, ctx.Err())
 	}
-	s.wg.Wait()
+	return nil
 }
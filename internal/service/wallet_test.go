@@ -1,18 +1,29 @@
 package service_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
+	"WalletApi/internal/cache"
 	"WalletApi/internal/model"
+	"WalletApi/internal/repository"
 	"WalletApi/internal/service"
+	"WalletApi/internal/statement"
 )
 
 // MockWalletRepository implements repository.WalletRepository
@@ -35,13 +46,19 @@ func (m *MockWalletRepository) GetBalance(ctx context.Context, walletID string)
 	return args.Get(0).(int64), args.Error(1)
 }
 
+func (m *MockWalletRepository) GetHistory(ctx context.Context, walletID string, limit int) ([]model.LedgerEntry, error) {
+	args := m.Called(ctx, walletID, limit)
+	history, _ := args.Get(0).([]model.LedgerEntry)
+	return history, args.Error(1)
+}
+
 func TestWalletService_CreateWallet(t *testing.T) {
 	testUUID := uuid.NewString()
 	mockRepo := new(MockWalletRepository)
 	mockRepo.On("CreateWallet", mock.Anything).Return(testUUID, nil)
 
 	walletService := service.NewWalletService(mockRepo, 1)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	walletID, err := walletService.CreateWallet(context.Background())
 
@@ -57,7 +74,7 @@ func TestWalletService_GetBalance(t *testing.T) {
 	mockRepo.On("GetBalance", mock.Anything, testUUID).Return(int64(100), nil)
 
 	walletService := service.NewWalletService(mockRepo, 1)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	balance, err := walletService.GetBalance(context.Background(), testUUID)
 
@@ -71,7 +88,7 @@ func TestWalletService_ProcessTransaction_Success(t *testing.T) {
 	mockRepo.On("ProcessTransaction", mock.Anything, testUUID, int64(100), true).Return(nil)
 
 	walletService := service.NewWalletService(mockRepo, 1)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	transaction := model.Transaction{
 		WalletID:      testUUID,
@@ -85,7 +102,7 @@ func TestWalletService_ProcessTransaction_Success(t *testing.T) {
 
 func TestWalletService_ProcessTransaction_ValidationError(t *testing.T) {
 	walletService := service.NewWalletService(nil, 1)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	testCases := []struct {
 		name        string
@@ -129,7 +146,7 @@ func TestWalletService_Sharding(t *testing.T) {
 	mockRepo.On("ProcessTransaction", mock.Anything, uuid2, mock.Anything, true).Return(nil).Once()
 
 	walletService := service.NewWalletService(mockRepo, 2)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	transactions := []model.Transaction{
 		{WalletID: uuid1, OperationType: model.Deposit, Amount: 100},
@@ -167,7 +184,7 @@ func TestWalletService_Shutdown(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		walletService.Shutdown()
+		walletService.Shutdown(context.Background())
 		close(done)
 	}()
 
@@ -178,6 +195,188 @@ func TestWalletService_Shutdown(t *testing.T) {
 	}
 }
 
+func TestWalletService_ShutdownUnderLoad(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	walletService := service.NewWalletService(repo, 4)
+
+	ctx := context.Background()
+	walletID, err := walletService.CreateWallet(ctx)
+	assert.NoError(t, err)
+
+	// Deposits race with the shutdown, each one is either applied or refused
+	var wg sync.WaitGroup
+	var accepted atomic.Int64
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := walletService.ProcessTransaction(ctx, model.Transaction{
+				WalletID:      walletID,
+				OperationType: model.Deposit,
+				Amount:        1,
+			})
+			if err == nil {
+				accepted.Add(1)
+			} else {
+				assert.ErrorIs(t, err, model.ErrShuttingDown)
+			}
+		}()
+	}
+
+	assert.NoError(t, walletService.Shutdown(ctx))
+	wg.Wait()
+
+	balance, err := repo.GetBalance(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, accepted.Load(), balance, "Every accepted deposit must be applied")
+
+	err = walletService.ProcessTransaction(ctx, model.Transaction{
+		WalletID:      walletID,
+		OperationType: model.Deposit,
+		Amount:        1,
+	})
+	assert.ErrorIs(t, err, model.ErrShuttingDown)
+}
+
+func TestWalletService_ShutdownDeadline(t *testing.T) {
+	testUUID := uuid.NewString()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	mockRepo := new(MockWalletRepository)
+	mockRepo.On("ProcessTransaction", mock.Anything, testUUID, int64(100), true).
+		Run(func(args mock.Arguments) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+		}).
+		Return(nil)
+
+	walletService := service.NewWalletService(mockRepo, 1)
+
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- walletService.ProcessTransaction(context.Background(), model.Transaction{
+				WalletID:      testUUID,
+				OperationType: model.Deposit,
+				Amount:        100,
+			})
+		}()
+	}
+	<-started
+	assert.Eventually(t, func() bool {
+		return walletService.QueueDepths()[0] == 2
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() {
+		// Lets Shutdown notice the deadline before the worker moves on to the queued transactions
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+
+	err := walletService.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "dropped 2 queued transactions")
+
+	// The transaction in progress completes, the queued ones are refused
+	var processed, dropped int
+	for i := 0; i < 3; i++ {
+		switch err := <-results; {
+		case err == nil:
+			processed++
+		case errors.Is(err, model.ErrShuttingDown):
+			dropped++
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	assert.Equal(t, 1, processed)
+	assert.Equal(t, 2, dropped)
+	mockRepo.AssertNumberOfCalls(t, "ProcessTransaction", 1)
+}
+
+func TestWalletService_ShutdownFullQueue(t *testing.T) {
+	testUUID := uuid.NewString()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	mockRepo := new(MockWalletRepository)
+	mockRepo.On("ProcessTransaction", mock.Anything, testUUID, int64(100), true).
+		Run(func(args mock.Arguments) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+		}).
+		Return(nil)
+
+	walletService := service.NewWalletService(mockRepo, 1, service.WithQueueSize(1))
+
+	results := make(chan error, 3)
+	deposit := func() {
+		results <- walletService.ProcessTransaction(context.Background(), model.Transaction{
+			WalletID:      testUUID,
+			OperationType: model.Deposit,
+			Amount:        100,
+		})
+	}
+	// One in progress, one queued and one waiting for room in the full queue
+	go deposit()
+	<-started
+	go deposit()
+	assert.Eventually(t, func() bool {
+		return walletService.QueueDepths()[0] == 1
+	}, time.Second, time.Millisecond)
+	go deposit()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- walletService.Shutdown(ctx)
+	}()
+
+	// The waiting sender is refused while the worker is still busy, it does not hold up Shutdown
+	select {
+	case err := <-results:
+		assert.ErrorIs(t, err, model.ErrShuttingDown)
+	case <-time.After(time.Second):
+		t.Fatal("The sender waiting for a full queue was not released")
+	}
+
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	err := <-shutdown
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "dropped 1 queued transactions")
+
+	// The transaction in progress completes, the queued one is refused
+	var processed, dropped int
+	for i := 0; i < 2; i++ {
+		switch err := <-results; {
+		case err == nil:
+			processed++
+		case errors.Is(err, model.ErrShuttingDown):
+			dropped++
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	assert.Equal(t, 1, processed)
+	assert.Equal(t, 1, dropped)
+	mockRepo.AssertNumberOfCalls(t, "ProcessTransaction", 1)
+}
+
 func TestWalletService_WorkerProcessing(t *testing.T) {
 	testUUID := uuid.NewString()
 	processed := make(chan struct{})
@@ -190,7 +389,7 @@ func TestWalletService_WorkerProcessing(t *testing.T) {
 		Return(nil)
 
 	walletService := service.NewWalletService(mockRepo, 1)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	err := walletService.ProcessTransaction(context.Background(), model.Transaction{
 		WalletID:      testUUID,
@@ -214,7 +413,7 @@ func TestWalletService_RepositoryError(t *testing.T) {
 	mockRepo.On("ProcessTransaction", mock.Anything, testUUID, int64(100), true).Return(expectedErr)
 
 	walletService := service.NewWalletService(mockRepo, 1)
-	defer walletService.Shutdown()
+	defer walletService.Shutdown(context.Background())
 
 	err := walletService.ProcessTransaction(context.Background(), model.Transaction{
 		WalletID:      testUUID,
@@ -223,3 +422,260 @@ func TestWalletService_RepositoryError(t *testing.T) {
 	})
 	assert.ErrorIs(t, err, expectedErr)
 }
+
+func TestWalletService_MemoryRepository_EndToEnd(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	walletService := service.NewWalletService(repo, 4)
+	defer walletService.Shutdown(context.Background())
+
+	ctx := context.Background()
+	walletIDs := make([]string, 8)
+	for i := range walletIDs {
+		walletID, err := walletService.CreateWallet(ctx)
+		assert.NoError(t, err)
+		assert.NoError(t, walletService.ProcessTransaction(ctx, model.Transaction{
+			WalletID:      walletID,
+			OperationType: model.Deposit,
+			Amount:        100,
+		}))
+		walletIDs[i] = walletID
+	}
+
+	// Every wallet receives more withdrawals than it can cover
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := make(map[string]int)
+	for _, walletID := range walletIDs {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(walletID string) {
+				defer wg.Done()
+				err := walletService.ProcessTransaction(ctx, model.Transaction{
+					WalletID:      walletID,
+					OperationType: model.Withdraw,
+					Amount:        10,
+				})
+				if err == nil {
+					mu.Lock()
+					succeeded[walletID]++
+					mu.Unlock()
+					return
+				}
+				assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+			}(walletID)
+		}
+	}
+	wg.Wait()
+
+	for _, walletID := range walletIDs {
+		balance, err := walletService.GetBalance(ctx, walletID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), balance)
+		assert.Equal(t, 10, succeeded[walletID])
+	}
+}
+
+func TestWalletService_CacheWriteThrough(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	walletService := service.NewWalletService(repo, 2, service.WithCache(cache.NewLRU(100, time.Minute)))
+	defer walletService.Shutdown(context.Background())
+
+	ctx := context.Background()
+	walletID, err := walletService.CreateWallet(ctx)
+	assert.NoError(t, err)
+
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus)
+
+	info, err = walletService.GetBalanceInfo(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, service.CacheHit, info.CacheStatus)
+	assert.Equal(t, int64(0), info.Balance)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, walletService.ProcessTransaction(ctx, model.Transaction{
+			WalletID:      walletID,
+			OperationType: model.Deposit,
+			Amount:        10,
+		}))
+
+		// The committed balance is visible from the cache right away
+		info, err = walletService.GetBalanceInfo(ctx, walletID)
+		assert.NoError(t, err)
+		assert.Equal(t, service.CacheHit, info.CacheStatus)
+		assert.Equal(t, int64(10*(i+1)), info.Balance)
+	}
+
+	info, err = walletService.GetBalanceInfo(service.WithStrongConsistency(ctx), walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, service.CacheBypass, info.CacheStatus)
+	assert.Equal(t, int64(100), info.Balance)
+}
+
+func TestWalletService_CacheNotUpdatedOnFailure(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	walletService := service.NewWalletService(repo, 1, service.WithCache(cache.NewLRU(100, time.Minute)))
+	defer walletService.Shutdown(context.Background())
+
+	ctx := context.Background()
+	walletID, err := walletService.CreateWallet(ctx)
+	assert.NoError(t, err)
+
+	_, err = walletService.GetBalanceInfo(ctx, walletID)
+	assert.NoError(t, err)
+
+	err = walletService.ProcessTransaction(ctx, model.Transaction{
+		WalletID:      walletID,
+		OperationType: model.Withdraw,
+		Amount:        10,
+	})
+	assert.ErrorIs(t, err, model.ErrInsufficientFunds)
+
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, service.CacheHit, info.CacheStatus)
+	assert.Equal(t, int64(0), info.Balance)
+}
+
+// pausingRepository holds the balance of the next GetOverdraft armed, once
+// read, until it is released: other writes can commit between the read and its use.
+type pausingRepository struct {
+	*repository.SQLiteRepository
+	armed   atomic.Bool
+	read    chan struct{}
+	release chan struct{}
+}
+
+func newPausingRepository(repo *repository.SQLiteRepository) *pausingRepository {
+	return &pausingRepository{SQLiteRepository: repo, read: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (r *pausingRepository) GetOverdraft(ctx context.Context, walletID string) (model.Overdraft, error) {
+	o, err := r.SQLiteRepository.GetOverdraft(ctx, walletID)
+	if r.armed.CompareAndSwap(true, false) {
+		r.read <- struct{}{}
+		<-r.release
+	}
+	return o, err
+}
+
+// depositAround deposits amount on the wallet and runs write while the shard
+// worker holds the balance it read to refresh the cache.
+func depositAround(t *testing.T, walletService service.WalletService, repo *pausingRepository, walletID string, amount int64, write func()) {
+	t.Helper()
+	repo.armed.Store(true)
+	done := make(chan error, 1)
+	go func() {
+		done <- walletService.ProcessTransaction(context.Background(), model.Transaction{
+			WalletID:      walletID,
+			OperationType: model.Deposit,
+			Amount:        amount,
+		})
+	}()
+
+	<-repo.read
+	write()
+	close(repo.release)
+	require.NoError(t, <-done)
+}
+
+func TestWalletService_CacheRefreshRacingJob(t *testing.T) {
+	ctx := context.Background()
+	sqliteRepo, db := newSQLiteRepository(t)
+	repo := newPausingRepository(sqliteRepo)
+	balanceCache := cache.NewLRU(100, time.Hour)
+	walletService := service.NewWalletService(repo, 1, service.WithCache(balanceCache))
+	t.Cleanup(func() { walletService.Shutdown(context.Background()) })
+
+	walletID, err := repo.CreateWallet(ctx)
+	require.NoError(t, err)
+	_, err = walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+
+	// The reconciler fixes the balance after the worker read it, and deletes the cached one
+	depositAround(t, walletService, repo, walletID, 10, func() {
+		setBalance(t, db, walletID, 50)
+		_, err := service.NewReconciler(sqliteRepo, service.WithReconcileCache(balanceCache)).Run(ctx)
+		require.NoError(t, err)
+	})
+
+	// The balance the worker read before is not stored after the deletion
+	info, err := walletService.GetBalanceInfo(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, service.CacheMiss, info.CacheStatus)
+	assert.Equal(t, int64(50), info.Balance)
+}
+
+func TestWalletService_TraceContextReachesWorker(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prevProvider)
+
+	testUUID := uuid.NewString()
+	mockRepo := new(MockWalletRepository)
+	mockRepo.On("ProcessTransaction", mock.MatchedBy(func(ctx context.Context) bool {
+		return trace.SpanContextFromContext(ctx).IsValid()
+	}), testUUID, int64(100), true).Return(nil)
+
+	walletService := service.NewWalletService(mockRepo, 1)
+	defer walletService.Shutdown(context.Background())
+
+	ctx, requestSpan := otel.Tracer("test").Start(context.Background(), "request")
+	err := walletService.ProcessTransaction(ctx, model.Transaction{
+		WalletID:      testUUID,
+		OperationType: model.Deposit,
+		Amount:        100,
+	})
+	requestSpan.End()
+	assert.NoError(t, err)
+	mockRepo.AssertExpectations(t)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"shard.queue_wait", "shard.process"} {
+		span, ok := spans[name]
+		if assert.True(t, ok, "Span %s was not recorded", name) {
+			assert.Equal(t, requestSpan.SpanContext().TraceID(), span.SpanContext().TraceID())
+			assert.Equal(t, requestSpan.SpanContext().SpanID(), span.Parent().SpanID())
+		}
+	}
+}
+
+func TestWalletService_WriteStatement(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	walletService := service.NewWalletService(repo, 1)
+	defer walletService.Shutdown(context.Background())
+
+	ctx := context.Background()
+	walletID, err := walletService.CreateWallet(ctx)
+	assert.NoError(t, err)
+	for _, tx := range []model.Transaction{
+		{WalletID: walletID, OperationType: model.Deposit, Amount: 100},
+		{WalletID: walletID, OperationType: model.Withdraw, Amount: 30},
+		{WalletID: walletID, OperationType: model.Deposit, Amount: 5},
+	} {
+		time.Sleep(time.Millisecond)
+		assert.NoError(t, walletService.ProcessTransaction(ctx, tx))
+	}
+	history, err := repo.GetHistory(ctx, walletID, 0)
+	assert.NoError(t, err)
+
+	// The first deposit is in the opening balance
+	var buf bytes.Buffer
+	from, to := history[2].CreatedAt, time.Now()
+	assert.NoError(t, walletService.WriteStatement(ctx, walletID, from, to, statement.NewWriter(statement.CSV, &buf)))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 5)
+	assert.Regexp(t, `^opening,`+walletID+`,,[^,]+,,,100,$`, lines[1])
+	assert.Regexp(t, `^entry,`+walletID+`,\d+,[^,]+,WITHDRAW,-30,70,$`, lines[2])
+	assert.Regexp(t, `^entry,`+walletID+`,\d+,[^,]+,DEPOSIT,5,75,$`, lines[3])
+	assert.Regexp(t, `^closing,`+walletID+`,,[^,]+,,,75,$`, lines[4])
+
+	err = walletService.WriteStatement(ctx, uuid.NewString(), from, to, statement.NewWriter(statement.CSV, &buf))
+	assert.ErrorIs(t, err, model.ErrWalletNotFound)
+}
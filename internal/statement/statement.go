@@ -0,0 +1,224 @@
+// Package statement writes wallet statements: the opening balance, every
+// ledger entry with the running balance after it and the closing balance.
+// The layouts are a contract with finance tooling, columns and fields are only
+// ever added at the end.
+package statement
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"WalletApi/internal/model"
+)
+
+type Format string
+
+const (
+	CSV       Format = "csv"
+	JSONLines Format = "jsonl"
+	Text      Format = "txt"
+)
+
+var ErrUnknownFormat = errors.New("unknown statement format")
+
+// ParseFormat returns the format named s, csv, jsonl or txt.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case CSV, JSONLines, Text:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownFormat, s)
+}
+
+// ContentType is the media type statements of the format are served with.
+func (f Format) ContentType() string {
+	switch f {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case JSONLines:
+		return "application/jsonl"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// Record types, the first column or the record field of every line
+const (
+	RecordOpening = "opening"
+	RecordEntry   = "entry"
+	RecordClosing = "closing"
+)
+
+// Header opens a statement. It covers the entries created after From and up to
+// To, Opening is the balance at From.
+type Header struct {
+	WalletID string
+	From     time.Time
+	To       time.Time
+	Opening  int64
+}
+
+// Writer writes one statement: Begin, then Entry for every ledger entry oldest
+// first with the balance after it, then End. Lines are buffered, End flushes
+// them; a statement without its closing line is incomplete.
+type Writer interface {
+	Begin(h Header) error
+	Entry(e model.LedgerEntry, balance int64) error
+	End(closing int64) error
+}
+
+// NewWriter returns a writer of statements in format f to w.
+func NewWriter(f Format, w io.Writer) Writer {
+	switch f {
+	case CSV:
+		return &csvWriter{w: csv.NewWriter(w)}
+	case JSONLines:
+		bw := bufio.NewWriter(w)
+		return &jsonWriter{w: bw, enc: json.NewEncoder(bw)}
+	default:
+		return &textWriter{w: bufio.NewWriter(w)}
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// csvWriter writes a header row then one row per record:
+//
+//	record,wallet_id,entry_id,time,operation_type,amount,balance,reason
+type csvWriter struct {
+	w      *csv.Writer
+	header Header
+}
+
+func (c *csvWriter) Begin(h Header) error {
+	c.header = h
+	if err := c.w.Write([]string{"record", "wallet_id", "entry_id", "time", "operation_type", "amount", "balance", "reason"}); err != nil {
+		return err
+	}
+	return c.w.Write([]string{RecordOpening, h.WalletID, "", formatTime(h.From), "", "", strconv.FormatInt(h.Opening, 10), ""})
+}
+
+func (c *csvWriter) Entry(e model.LedgerEntry, balance int64) error {
+	return c.w.Write([]string{
+		RecordEntry,
+		e.WalletID,
+		strconv.FormatInt(e.ID, 10),
+		formatTime(e.CreatedAt),
+		string(e.OperationType),
+		strconv.FormatInt(e.Amount, 10),
+		strconv.FormatInt(balance, 10),
+		e.Reason,
+	})
+}
+
+func (c *csvWriter) End(closing int64) error {
+	if err := c.w.Write([]string{RecordClosing, c.header.WalletID, "", formatTime(c.header.To), "", "", strconv.FormatInt(closing, 10), ""}); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonRecord struct {
+	Record        string              `json:"record"`
+	WalletID      string              `json:"walletId"`
+	ID            int64               `json:"id,omitempty"`
+	At            string              `json:"at,omitempty"`
+	CreatedAt     string              `json:"createdAt,omitempty"`
+	OperationType model.OperationType `json:"operationType,omitempty"`
+	Amount        *int64              `json:"amount,omitempty"`
+	Balance       int64               `json:"balance"`
+	Reason        string              `json:"reason,omitempty"`
+	// Entries is the number of entries of the statement, on the closing record
+	Entries *int `json:"entries,omitempty"`
+}
+
+// jsonWriter writes one JSON object per line, the record field tells its type.
+type jsonWriter struct {
+	w       *bufio.Writer
+	enc     *json.Encoder
+	header  Header
+	entries int
+}
+
+func (j *jsonWriter) Begin(h Header) error {
+	j.header = h
+	return j.enc.Encode(jsonRecord{Record: RecordOpening, WalletID: h.WalletID, At: formatTime(h.From), Balance: h.Opening})
+}
+
+func (j *jsonWriter) Entry(e model.LedgerEntry, balance int64) error {
+	j.entries++
+	return j.enc.Encode(jsonRecord{
+		Record:        RecordEntry,
+		WalletID:      e.WalletID,
+		ID:            e.ID,
+		CreatedAt:     formatTime(e.CreatedAt),
+		OperationType: e.OperationType,
+		Amount:        &e.Amount,
+		Balance:       balance,
+		Reason:        e.Reason,
+	})
+}
+
+func (j *jsonWriter) End(closing int64) error {
+	err := j.enc.Encode(jsonRecord{Record: RecordClosing, WalletID: j.header.WalletID, At: formatTime(j.header.To), Balance: closing, Entries: &j.entries})
+	if err != nil {
+		return err
+	}
+	return j.w.Flush()
+}
+
+// textWriter writes fixed-width columns for people, one line per record.
+type textWriter struct {
+	w       *bufio.Writer
+	header  Header
+	entries int
+}
+
+const textLine = "%-30s  %10s  %-15s  %20s  %20s  %s"
+
+func (t *textWriter) line(format string, args ...any) error {
+	_, err := fmt.Fprintln(t.w, strings.TrimRight(fmt.Sprintf(format, args...), " "))
+	return err
+}
+
+func (t *textWriter) Begin(h Header) error {
+	t.header = h
+	if err := t.line("Statement of wallet %s", h.WalletID); err != nil {
+		return err
+	}
+	if err := t.line("From %s to %s\n", formatTime(h.From), formatTime(h.To)); err != nil {
+		return err
+	}
+	if err := t.line(textLine, "TIME", "ENTRY", "OPERATION", "AMOUNT", "BALANCE", "REASON"); err != nil {
+		return err
+	}
+	return t.line(textLine, formatTime(h.From), "", "OPENING BALANCE", "", strconv.FormatInt(h.Opening, 10), "")
+}
+
+func (t *textWriter) Entry(e model.LedgerEntry, balance int64) error {
+	t.entries++
+	// A reason spanning lines would break the columns
+	reason := strings.Join(strings.Fields(e.Reason), " ")
+	return t.line(textLine, formatTime(e.CreatedAt), strconv.FormatInt(e.ID, 10), e.OperationType,
+		strconv.FormatInt(e.Amount, 10), strconv.FormatInt(balance, 10), reason)
+}
+
+func (t *textWriter) End(closing int64) error {
+	if err := t.line(textLine, formatTime(t.header.To), "", "CLOSING BALANCE", "", strconv.FormatInt(closing, 10), ""); err != nil {
+		return err
+	}
+	if err := t.line("\n%d entries", t.entries); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
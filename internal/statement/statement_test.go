@@ -0,0 +1,78 @@
+package statement_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"WalletApi/internal/model"
+	"WalletApi/internal/statement"
+)
+
+const walletID = "0b7e5a36-2f4c-4f3e-9a55-6d1f3f6a3c11"
+
+func write(t *testing.T, f statement.Format) string {
+	t.Helper()
+	from := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	entries := []model.LedgerEntry{
+		{ID: 7, WalletID: walletID, OperationType: model.Deposit, Amount: 500, CreatedAt: from.Add(90 * time.Minute)},
+		{ID: 9, WalletID: walletID, OperationType: model.Adjustment, Amount: -25, Reason: "FEE_REFUND: \"double\", fee\nreversal", CreatedAt: from.Add(36*time.Hour + time.Millisecond)},
+	}
+
+	var buf bytes.Buffer
+	w := statement.NewWriter(f, &buf)
+	require.NoError(t, w.Begin(statement.Header{WalletID: walletID, From: from, To: from.AddDate(0, 1, 0), Opening: 1000}))
+	balance := int64(1000)
+	for _, e := range entries {
+		balance += e.Amount
+		require.NoError(t, w.Entry(e, balance))
+	}
+	require.NoError(t, w.End(balance))
+	return buf.String()
+}
+
+func TestWriter_CSV(t *testing.T) {
+	assert.Equal(t, `record,wallet_id,entry_id,time,operation_type,amount,balance,reason
+opening,`+walletID+`,,2025-01-01T00:00:00Z,,,1000,
+entry,`+walletID+`,7,2025-01-01T01:30:00Z,DEPOSIT,500,1500,
+entry,`+walletID+`,9,2025-01-02T12:00:00.001Z,ADJUSTMENT,-25,1475,"FEE_REFUND: ""double"", fee
+reversal"
+closing,`+walletID+`,,2025-02-01T00:00:00Z,,,1475,
+`, write(t, statement.CSV))
+}
+
+func TestWriter_JSONLines(t *testing.T) {
+	assert.Equal(t, `{"record":"opening","walletId":"`+walletID+`","at":"2025-01-01T00:00:00Z","balance":1000}
+{"record":"entry","walletId":"`+walletID+`","id":7,"createdAt":"2025-01-01T01:30:00Z","operationType":"DEPOSIT","amount":500,"balance":1500}
+{"record":"entry","walletId":"`+walletID+`","id":9,"createdAt":"2025-01-02T12:00:00.001Z","operationType":"ADJUSTMENT","amount":-25,"balance":1475,"reason":"FEE_REFUND: \"double\", fee\nreversal"}
+{"record":"closing","walletId":"`+walletID+`","at":"2025-02-01T00:00:00Z","balance":1475,"entries":2}
+`, write(t, statement.JSONLines))
+}
+
+func TestWriter_Text(t *testing.T) {
+	assert.Equal(t, `Statement of wallet `+walletID+`
+From 2025-01-01T00:00:00Z to 2025-02-01T00:00:00Z
+
+TIME                                 ENTRY  OPERATION                      AMOUNT               BALANCE  REASON
+2025-01-01T00:00:00Z                        OPENING BALANCE                                        1000
+2025-01-01T01:30:00Z                     7  DEPOSIT                           500                  1500
+2025-01-02T12:00:00.001Z                 9  ADJUSTMENT                        -25                  1475  FEE_REFUND: "double", fee reversal
+2025-02-01T00:00:00Z                        CLOSING BALANCE                                        1475
+
+2 entries
+`, write(t, statement.Text))
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"csv", "jsonl", "txt"} {
+		f, err := statement.ParseFormat(name)
+		require.NoError(t, err)
+		assert.Equal(t, statement.Format(name), f)
+	}
+
+	_, err := statement.ParseFormat("pdf")
+	assert.ErrorIs(t, err, statement.ErrUnknownFormat)
+}
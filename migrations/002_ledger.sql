@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    operation_type TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_wallet_id_idx ON ledger_entries (wallet_id, id);
+
+-- Wallets funded before the ledger existed are opened with their balance, so
+-- the entries of every wallet sum to its balance
+INSERT INTO ledger_entries (wallet_id, operation_type, amount)
+SELECT w.id, 'OPENING', w.balance
+FROM wallets w
+WHERE w.balance <> 0
+  AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.wallet_id = w.id);
@@ -0,0 +1,4 @@
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS frozen BOOLEAN NOT NULL DEFAULT false;
+
+-- Set on ADJUSTMENT entries, which are posted by operators
+ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS reason TEXT;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS adjustments (
+    id UUID PRIMARY KEY,
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    amount BIGINT NOT NULL CHECK (amount <> 0),
+    reason_code TEXT NOT NULL,
+    justification TEXT NOT NULL,
+    status TEXT NOT NULL,
+    requested_by TEXT NOT NULL,
+    requested_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    decided_by TEXT,
+    decided_at TIMESTAMPTZ,
+    ledger_entry_id BIGINT REFERENCES ledger_entries (id),
+    -- Maker-checker, also enforced by the repository
+    CHECK (status <> 'APPROVED' OR lower(decided_by) <> lower(requested_by))
+);
+
+CREATE INDEX IF NOT EXISTS adjustments_pending_idx ON adjustments (requested_at) WHERE status = 'PENDING';
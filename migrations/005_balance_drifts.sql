@@ -0,0 +1,15 @@
+-- Drifts found by the balance reconciliation, one row per drift amount of a wallet.
+-- balance and ledger_balance are the values it was last seen with.
+CREATE TABLE IF NOT EXISTS balance_drifts (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    balance BIGINT NOT NULL,
+    ledger_balance BIGINT NOT NULL,
+    drift BIGINT NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    frozen BOOLEAN NOT NULL DEFAULT false,
+    UNIQUE (wallet_id, drift)
+);
+
+CREATE INDEX IF NOT EXISTS balance_drifts_last_seen_idx ON balance_drifts (last_seen_at);
@@ -0,0 +1,12 @@
+-- Ledger balance of a wallet up to and including entry_id, whose created_at is copied
+-- here. A balance at a point in time starts from the latest snapshot before it.
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    entry_id BIGINT NOT NULL REFERENCES ledger_entries (id),
+    balance BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    taken_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (wallet_id, entry_id)
+);
+
+CREATE INDEX IF NOT EXISTS balance_snapshots_created_at_idx ON balance_snapshots (wallet_id, created_at);
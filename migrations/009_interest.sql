@@ -0,0 +1,51 @@
+-- Interest products never change once created, wallets are assigned another one instead
+CREATE TABLE IF NOT EXISTS interest_products (
+    id UUID PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    annual_rate_bps BIGINT NOT NULL CHECK (annual_rate_bps > 0),
+    day_count TEXT NOT NULL,
+    rounding TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- The product a wallet accrues interest with. accrued_through is the last day
+-- accrued; accrued_units plus accrued_fraction over the denominator of the
+-- interest package is the interest not posted yet.
+CREATE TABLE IF NOT EXISTS interest_accounts (
+    wallet_id UUID PRIMARY KEY REFERENCES wallets (id),
+    product_id UUID NOT NULL REFERENCES interest_products (id),
+    accrued_through DATE NOT NULL,
+    accrued_units BIGINT NOT NULL DEFAULT 0,
+    accrued_fraction BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS interest_accounts_accrued_through_idx ON interest_accounts (accrued_through);
+
+-- One row per wallet and day accrued, with the terms and the end of day balance
+-- it was computed from, so an audit can replay it from the ledger
+CREATE TABLE IF NOT EXISTS interest_accruals (
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    day DATE NOT NULL,
+    product_id UUID NOT NULL REFERENCES interest_products (id),
+    annual_rate_bps BIGINT NOT NULL,
+    day_count TEXT NOT NULL,
+    balance BIGINT NOT NULL,
+    units BIGINT NOT NULL,
+    fraction BIGINT NOT NULL,
+    PRIMARY KEY (wallet_id, day)
+);
+
+-- One row per wallet and month posted, ledger_entry_id is NULL when the accrued
+-- interest rounded to nothing
+CREATE TABLE IF NOT EXISTS interest_postings (
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    period TEXT NOT NULL,
+    accrued_units BIGINT NOT NULL,
+    accrued_fraction BIGINT NOT NULL,
+    rounding TEXT NOT NULL,
+    amount BIGINT NOT NULL CHECK (amount >= 0),
+    ledger_entry_id BIGINT REFERENCES ledger_entries (id),
+    posted_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (wallet_id, period)
+);
@@ -0,0 +1,17 @@
+-- The balance of a wallet may go down to -credit_limit. overdraft_fee is charged
+-- for every UTC day the wallet ends overdrawn, overdraft_fees_through is the last
+-- day charged, NULL until a fee is set.
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS credit_limit BIGINT NOT NULL DEFAULT 0 CHECK (credit_limit >= 0);
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS overdraft_fee BIGINT NOT NULL DEFAULT 0 CHECK (overdraft_fee >= 0);
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS overdraft_fees_through DATE;
+
+-- One row per wallet and day charged, with the closing balance it was charged on
+CREATE TABLE IF NOT EXISTS overdraft_fees (
+    wallet_id UUID NOT NULL REFERENCES wallets (id),
+    day DATE NOT NULL,
+    balance BIGINT NOT NULL,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    ledger_entry_id BIGINT NOT NULL REFERENCES ledger_entries (id),
+    charged_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (wallet_id, day)
+);
@@ -0,0 +1,6 @@
+-- The lease of the ledger export, one row held by the run in progress until lease_until
+CREATE TABLE IF NOT EXISTS export_lease (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    owner TEXT NOT NULL,
+    lease_until TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL schema files so the binary can apply them
+// regardless of its working directory.
+package migrations
+
+import "embed"
+
+// FS holds the PostgreSQL migrations at its root and the SQLite ones under sqlite/.
+//
+//go:embed *.sql sqlite/*.sql
+var FS embed.FS
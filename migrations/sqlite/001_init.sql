@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS wallets (
+    id TEXT PRIMARY KEY,
+    balance INTEGER NOT NULL DEFAULT 0
+);
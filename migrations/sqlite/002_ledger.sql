@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    operation_type TEXT NOT NULL,
+    amount INTEGER NOT NULL,
+    -- Unix time in nanoseconds, UTC
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_wallet_id_idx ON ledger_entries (wallet_id, id);
+
+-- Wallets funded before the ledger existed are opened with their balance, so
+-- the entries of every wallet sum to its balance
+INSERT INTO ledger_entries (wallet_id, operation_type, amount, created_at)
+SELECT w.id, 'OPENING', w.balance, CAST(strftime('%s', 'now') AS INTEGER) * 1000000000
+FROM wallets w
+WHERE w.balance <> 0
+  AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.wallet_id = w.id);
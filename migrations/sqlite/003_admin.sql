@@ -0,0 +1,4 @@
+ALTER TABLE wallets ADD COLUMN frozen INTEGER NOT NULL DEFAULT 0;
+
+-- Set on ADJUSTMENT entries, which are posted by operators
+ALTER TABLE ledger_entries ADD COLUMN reason TEXT;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS adjustments (
+    id TEXT PRIMARY KEY,
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    amount INTEGER NOT NULL CHECK (amount <> 0),
+    reason_code TEXT NOT NULL,
+    justification TEXT NOT NULL,
+    status TEXT NOT NULL,
+    requested_by TEXT NOT NULL,
+    -- Unix times in nanoseconds, UTC
+    requested_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    decided_by TEXT,
+    decided_at INTEGER,
+    ledger_entry_id INTEGER REFERENCES ledger_entries (id),
+    -- Maker-checker, also enforced by the repository
+    CHECK (status <> 'APPROVED' OR lower(decided_by) <> lower(requested_by))
+);
+
+CREATE INDEX IF NOT EXISTS adjustments_pending_idx ON adjustments (requested_at) WHERE status = 'PENDING';
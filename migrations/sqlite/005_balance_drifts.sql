@@ -0,0 +1,16 @@
+-- Drifts found by the balance reconciliation, one row per drift amount of a wallet.
+-- balance and ledger_balance are the values it was last seen with.
+CREATE TABLE IF NOT EXISTS balance_drifts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    balance INTEGER NOT NULL,
+    ledger_balance INTEGER NOT NULL,
+    drift INTEGER NOT NULL,
+    -- Unix times in nanoseconds, UTC
+    detected_at INTEGER NOT NULL,
+    last_seen_at INTEGER NOT NULL,
+    frozen INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (wallet_id, drift)
+);
+
+CREATE INDEX IF NOT EXISTS balance_drifts_last_seen_idx ON balance_drifts (last_seen_at);
@@ -0,0 +1,13 @@
+-- Ledger balance of a wallet up to and including entry_id, whose created_at is copied
+-- here. A balance at a point in time starts from the latest snapshot before it.
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    entry_id INTEGER NOT NULL REFERENCES ledger_entries (id),
+    balance INTEGER NOT NULL,
+    -- Unix times in nanoseconds, UTC
+    created_at INTEGER NOT NULL,
+    taken_at INTEGER NOT NULL,
+    PRIMARY KEY (wallet_id, entry_id)
+);
+
+CREATE INDEX IF NOT EXISTS balance_snapshots_created_at_idx ON balance_snapshots (wallet_id, created_at);
@@ -0,0 +1,3 @@
+-- Statements read the entries of a wallet by time. Per wallet, ID order is time
+-- order, so the index also returns them in ID order.
+CREATE INDEX IF NOT EXISTS ledger_entries_created_at_idx ON ledger_entries (wallet_id, created_at, id);
@@ -0,0 +1,44 @@
+-- Set on entries that must be applied at most once, such as the occurrences of
+-- schedules. NULLs do not collide, so only referenced entries are unique.
+ALTER TABLE ledger_entries ADD COLUMN reference TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entries_reference_idx ON ledger_entries (reference);
+
+-- Deposits and withdrawals run at start_at, then on every occurrence of
+-- recurrence until end_at. next_run_at is the occurrence to run next, attempted
+-- at due_at. An instance running it holds it until lease_until; version changes
+-- on every write, so a run only records its outcome if nothing changed meanwhile.
+CREATE TABLE IF NOT EXISTS schedules (
+    id TEXT PRIMARY KEY,
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    operation_type TEXT NOT NULL,
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    recurrence TEXT NOT NULL DEFAULT '',
+    -- Unix times in nanoseconds, UTC
+    start_at INTEGER NOT NULL,
+    end_at INTEGER,
+    status TEXT NOT NULL,
+    next_run_at INTEGER,
+    due_at INTEGER,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    lease_until INTEGER,
+    version INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS schedules_wallet_id_idx ON schedules (wallet_id, created_at);
+CREATE INDEX IF NOT EXISTS schedules_due_idx ON schedules (due_at) WHERE status = 'ACTIVE';
+
+-- One row per attempt of an occurrence
+CREATE TABLE IF NOT EXISTS schedule_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    schedule_id TEXT NOT NULL REFERENCES schedules (id),
+    occurrence INTEGER NOT NULL,
+    attempt INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    error_code TEXT,
+    -- Unix times in nanoseconds, UTC
+    started_at INTEGER NOT NULL,
+    finished_at INTEGER NOT NULL,
+    UNIQUE (schedule_id, occurrence, attempt)
+);
@@ -0,0 +1,53 @@
+-- Interest products never change once created, wallets are assigned another one instead
+CREATE TABLE IF NOT EXISTS interest_products (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    annual_rate_bps INTEGER NOT NULL CHECK (annual_rate_bps > 0),
+    day_count TEXT NOT NULL,
+    rounding TEXT NOT NULL,
+    -- Unix time in nanoseconds, UTC
+    created_at INTEGER NOT NULL
+);
+
+-- The product a wallet accrues interest with. accrued_through is the last day
+-- accrued; accrued_units plus accrued_fraction over the denominator of the
+-- interest package is the interest not posted yet.
+CREATE TABLE IF NOT EXISTS interest_accounts (
+    wallet_id TEXT PRIMARY KEY REFERENCES wallets (id),
+    product_id TEXT NOT NULL REFERENCES interest_products (id),
+    -- Days are Unix times in nanoseconds of their midnight, UTC
+    accrued_through INTEGER NOT NULL,
+    accrued_units INTEGER NOT NULL DEFAULT 0,
+    accrued_fraction INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS interest_accounts_accrued_through_idx ON interest_accounts (accrued_through);
+
+-- One row per wallet and day accrued, with the terms and the end of day balance
+-- it was computed from, so an audit can replay it from the ledger
+CREATE TABLE IF NOT EXISTS interest_accruals (
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    day INTEGER NOT NULL,
+    product_id TEXT NOT NULL REFERENCES interest_products (id),
+    annual_rate_bps INTEGER NOT NULL,
+    day_count TEXT NOT NULL,
+    balance INTEGER NOT NULL,
+    units INTEGER NOT NULL,
+    fraction INTEGER NOT NULL,
+    PRIMARY KEY (wallet_id, day)
+);
+
+-- One row per wallet and month posted, ledger_entry_id is NULL when the accrued
+-- interest rounded to nothing
+CREATE TABLE IF NOT EXISTS interest_postings (
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    period TEXT NOT NULL,
+    accrued_units INTEGER NOT NULL,
+    accrued_fraction INTEGER NOT NULL,
+    rounding TEXT NOT NULL,
+    amount INTEGER NOT NULL CHECK (amount >= 0),
+    ledger_entry_id INTEGER REFERENCES ledger_entries (id),
+    posted_at INTEGER NOT NULL,
+    PRIMARY KEY (wallet_id, period)
+);
@@ -0,0 +1,18 @@
+-- The balance of a wallet may go down to -credit_limit. overdraft_fee is charged
+-- for every UTC day the wallet ends overdrawn, overdraft_fees_through is the last
+-- day charged, NULL until a fee is set.
+ALTER TABLE wallets ADD COLUMN credit_limit INTEGER NOT NULL DEFAULT 0 CHECK (credit_limit >= 0);
+ALTER TABLE wallets ADD COLUMN overdraft_fee INTEGER NOT NULL DEFAULT 0 CHECK (overdraft_fee >= 0);
+-- Unix time in nanoseconds of the day's midnight, UTC
+ALTER TABLE wallets ADD COLUMN overdraft_fees_through INTEGER;
+
+-- One row per wallet and day charged, with the closing balance it was charged on
+CREATE TABLE IF NOT EXISTS overdraft_fees (
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    day INTEGER NOT NULL,
+    balance INTEGER NOT NULL,
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    ledger_entry_id INTEGER NOT NULL REFERENCES ledger_entries (id),
+    charged_at INTEGER NOT NULL,
+    PRIMARY KEY (wallet_id, day)
+);
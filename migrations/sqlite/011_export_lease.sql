@@ -0,0 +1,7 @@
+-- The lease of the ledger export, one row held by the run in progress until lease_until
+CREATE TABLE IF NOT EXISTS export_lease (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    owner TEXT NOT NULL,
+    -- Unix time in nanoseconds
+    lease_until INTEGER NOT NULL
+);